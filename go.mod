@@ -6,6 +6,8 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.24
 	github.com/pod32g/simple-logger v0.3.0
 	github.com/prometheus/client_golang v1.22.0
+	golang.org/x/crypto v0.35.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
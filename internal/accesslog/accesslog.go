@@ -0,0 +1,443 @@
+// Package accesslog records one entry per request or tunnel handled by the
+// HTTP listeners, in the format and sink chosen by config.AccessLog.
+package accesslog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pod32g/proxy/internal/config"
+	log "github.com/pod32g/simple-logger"
+)
+
+// Error classes recorded by SetError and the handlers of the proxy.
+const (
+	ErrorCanceled    = "canceled"
+	ErrorTimeout     = "timeout"
+	ErrorDNS         = "dns"
+	ErrorRefused     = "refused"
+	ErrorTLS         = "tls"
+	ErrorUpstream    = "upstream"
+	ErrorUnavailable = "unavailable"
+	ErrorAuth        = "auth"
+	ErrorForbidden   = "forbidden"
+	ErrorACL         = "acl"
+	ErrorRateLimited = "rate_limited"
+)
+
+// Record is an access log entry. Upstream is the address of the connection
+// the request was sent on, to an origin, backend or parent proxy, and Cache
+// the X-Cache result of cacheable requests.
+type Record struct {
+	Time      time.Time
+	Listener  string
+	Client    string
+	User      string
+	Method    string
+	URL       string
+	Host      string
+	Proto     string
+	Status    int
+	BytesIn   int64
+	BytesOut  int64
+	Upstream  string
+	Duration  time.Duration
+	Cache     string
+	Error     string
+	Referer   string
+	UserAgent string
+}
+
+// entry is the record of a request in flight, annotated by the handlers it
+// passes through.
+type entry struct {
+	in, out atomic.Int64
+	mu      sync.Mutex
+	rec     Record
+}
+
+type entryKey struct{}
+
+func fromContext(ctx context.Context) *entry {
+	e, _ := ctx.Value(entryKey{}).(*entry)
+	return e
+}
+
+// SetUpstream records addr as the upstream of the request of ctx.
+func SetUpstream(ctx context.Context, addr string) {
+	if e := fromContext(ctx); e != nil {
+		e.mu.Lock()
+		e.rec.Upstream = addr
+		e.mu.Unlock()
+	}
+}
+
+// SetUser records user as the authenticated user of the request of ctx.
+func SetUser(ctx context.Context, user string) {
+	if e := fromContext(ctx); e != nil {
+		e.mu.Lock()
+		e.rec.User = user
+		e.mu.Unlock()
+	}
+}
+
+// SetErrorClass records class as the error of the request of ctx unless one
+// was recorded already.
+func SetErrorClass(ctx context.Context, class string) {
+	if e := fromContext(ctx); e != nil {
+		e.mu.Lock()
+		if e.rec.Error == "" {
+			e.rec.Error = class
+		}
+		e.mu.Unlock()
+	}
+}
+
+// SetError records the class of err, as returned by Classify, as the error
+// of the request of ctx.
+func SetError(ctx context.Context, err error) {
+	SetErrorClass(ctx, Classify(err))
+}
+
+// Classify returns the error class of an error connecting to or exchanging
+// with an upstream server.
+func Classify(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var unknownAuth x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorRefused
+	case errors.As(err, &certErr), errors.As(err, &unknownAuth), errors.As(err, &hostErr), errors.As(err, &recordErr):
+		return ErrorTLS
+	}
+	return ErrorUpstream
+}
+
+// Trace returns ctx with a client trace recording the remote address of the
+// connection used to send the request of ctx upstream as its upstream.
+func Trace(ctx context.Context) context.Context {
+	e := fromContext(ctx)
+	if e == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			SetUpstream(ctx, info.Conn.RemoteAddr().String())
+		},
+	})
+}
+
+// Logger writes access log records as configured by its settings function,
+// which is consulted for every request so that changes apply at once.
+type Logger struct {
+	// Logger reports failures to open or write the sink.
+	Logger *log.Logger
+	// Client returns the address and user of the client of a request. By
+	// default they are the peer address and no user; the user is recorded
+	// with SetUser once authenticated.
+	Client func(*http.Request) (addr, user string)
+
+	settings func() config.AccessLog
+	stdout   io.Writer
+
+	mu      sync.Mutex
+	applied config.AccessLog
+	sink    sink
+	// failed are the settings whose sink failed to open, tried again from
+	// retryAt on.
+	failed  config.AccessLog
+	retryAt time.Time
+}
+
+// reopenDelay is how long records are dropped after the sink failed to open
+// before opening it is tried again.
+const reopenDelay = 5 * time.Second
+
+// New creates an access logger following the settings returned by settings.
+func New(settings func() config.AccessLog) *Logger {
+	return &Logger{settings: settings, stdout: os.Stdout}
+}
+
+// Log writes rec, opening the sink first if the settings changed since the
+// last record. Records are dropped while the access log is disabled or its
+// sink cannot be opened, which is tried again every reopenDelay.
+func (l *Logger) Log(rec Record) {
+	s := l.settings()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !s.Enabled {
+		l.closeLocked()
+		return
+	}
+	if s != l.applied {
+		if s == l.failed && time.Now().Before(l.retryAt) {
+			return
+		}
+		l.closeLocked()
+		sk, err := openSink(s, l.stdout)
+		if err != nil {
+			l.failed, l.retryAt = s, time.Now().Add(reopenDelay)
+			l.logError("Failed to open access log", err)
+			return
+		}
+		l.applied, l.sink = s, sk
+	}
+	if err := l.sink.Write(format(s, rec)); err != nil {
+		l.logError("Failed to write access log", err)
+	}
+}
+
+// Close closes the sink. The next record opens it again.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closeLocked()
+}
+
+func (l *Logger) closeLocked() error {
+	l.applied = config.AccessLog{}
+	if l.sink == nil {
+		return nil
+	}
+	err := l.sink.Close()
+	l.sink = nil
+	return err
+}
+
+func (l *Logger) logError(args ...interface{}) {
+	if l.Logger != nil {
+		l.Logger.Error(args...)
+	}
+}
+
+func (l *Logger) enabled() bool {
+	return l.settings().Enabled
+}
+
+func (l *Logger) client(r *http.Request) (string, string) {
+	if l.Client != nil {
+		return l.Client(r)
+	}
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return addr, ""
+}
+
+// finish logs e once its request or tunnel is over.
+func (l *Logger) finish(e *entry, hijacked bool) {
+	e.mu.Lock()
+	rec := e.rec
+	e.mu.Unlock()
+	rec.BytesIn, rec.BytesOut = e.in.Load(), e.out.Load()
+	rec.Duration = time.Since(rec.Time)
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+		if hijacked && rec.Method != http.MethodConnect {
+			rec.Status = http.StatusSwitchingProtocols
+		}
+	}
+	l.Log(rec)
+}
+
+// Middleware logs to l the requests received on the named listener.
+// Requests already logged by an outer Middleware are passed through, so a
+// listener can be wrapped both outside its authentication, to log rejected
+// requests, and inside TLS interception, to log the requests decrypted from
+// intercepted tunnels. Hijacked connections such as CONNECT tunnels are
+// logged when closed, with the bytes relayed in both directions.
+func Middleware(next http.Handler, l *Logger, listener string) http.Handler {
+	if next == nil || l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fromContext(r.Context()) != nil || !l.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		e := &entry{rec: Record{
+			Time:      time.Now(),
+			Listener:  listener,
+			Method:    r.Method,
+			URL:       requestURL(r),
+			Host:      r.Host,
+			Proto:     r.Proto,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		}}
+		if r.Method != http.MethodConnect && r.URL.Host != "" {
+			e.rec.Host = r.URL.Host
+		}
+		e.rec.Client, e.rec.User = l.client(r)
+		r = r.WithContext(context.WithValue(r.Context(), entryKey{}, e))
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &countingBody{ReadCloser: r.Body, n: &e.in}
+		}
+		rw := &responseWriter{ResponseWriter: w, l: l, e: e}
+		next.ServeHTTP(rw, r)
+		if rw.hijacked {
+			return
+		}
+		if r.Context().Err() != nil {
+			SetErrorClass(r.Context(), ErrorCanceled)
+		}
+		l.finish(e, false)
+	})
+}
+
+// requestURL returns the URL of r as received, without credentials.
+func requestURL(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		return r.Host
+	}
+	if r.URL.IsAbs() {
+		u := *r.URL
+		u.User = nil
+		return u.String()
+	}
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+// responseWriter records the status, cache result and size of a response.
+type responseWriter struct {
+	http.ResponseWriter
+	l           *Logger
+	e           *entry
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader && (code >= http.StatusOK || code == http.StatusSwitchingProtocols) {
+		w.wroteHeader = true
+		w.e.mu.Lock()
+		w.e.rec.Status = code
+		w.e.rec.Cache = w.Header().Get("X-Cache")
+		w.e.mu.Unlock()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.e.out.Add(int64(n))
+	return n, err
+}
+
+// Flush allows streaming responses to be flushed.
+func (w *responseWriter) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack hands over a connection counting the bytes relayed over it, and
+// logging the request when it is closed.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support Hijacker")
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	cc := &countingConn{Conn: c, l: w.l, e: w.e}
+	if brw != nil {
+		// Bytes already buffered were read from c before it was wrapped.
+		// Reset the buffers on top of cc, buffering those bytes again, so
+		// that later reads and writes through brw are counted.
+		n := brw.Reader.Buffered()
+		buffered, _ := brw.Reader.Peek(n)
+		buffered = append([]byte(nil), buffered...)
+		w.e.in.Add(int64(n))
+		brw.Reader.Reset(io.MultiReader(bytes.NewReader(buffered), cc))
+		brw.Reader.Peek(n)
+		brw.Writer.Reset(cc)
+	}
+	return cc, brw, nil
+}
+
+// countingConn counts the bytes of a hijacked connection and logs its
+// request once closed.
+type countingConn struct {
+	net.Conn
+	l    *Logger
+	e    *entry
+	once sync.Once
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.e.in.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.e.out.Add(int64(n))
+	return n, err
+}
+
+// CloseWrite shuts down the write side of the underlying connection, for
+// tunnels closed one direction at a time.
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *countingConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.l.finish(c.e, true) })
+	return err
+}
@@ -0,0 +1,267 @@
+package accesslog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pod32g/proxy/internal/config"
+)
+
+// syncBuffer is a strings.Builder safe for concurrent use.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func newLogger(settings *config.AccessLog) (*Logger, *syncBuffer) {
+	l := New(func() config.AccessLog { return *settings })
+	buf := &syncBuffer{}
+	l.stdout = buf
+	return l, buf
+}
+
+func TestFormats(t *testing.T) {
+	rec := Record{
+		Time:      time.Date(2024, 3, 5, 14, 7, 9, 0, time.UTC),
+		Listener:  "edge",
+		Client:    "192.0.2.7",
+		User:      "alice",
+		Method:    "GET",
+		URL:       `http://example.com/a"b`,
+		Host:      "example.com",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		BytesIn:   10,
+		BytesOut:  1234,
+		Upstream:  "93.184.216.34:80",
+		Duration:  1500 * time.Microsecond,
+		Cache:     "MISS",
+		UserAgent: "curl/8\n",
+	}
+	for _, tc := range []struct {
+		format, template, want string
+	}{
+		{config.LogFormatCommon, "", `192.0.2.7 - alice [05/Mar/2024:14:07:09 +0000] "GET http://example.com/a\"b HTTP/1.1" 200 1234`},
+		{config.LogFormatCombined, "", `192.0.2.7 - alice [05/Mar/2024:14:07:09 +0000] "GET http://example.com/a\"b HTTP/1.1" 200 1234 "-" "curl/8\x0a"`},
+		{config.LogFormatTemplate, "{listener} {upstream} {duration_ms}ms {cache} {error}", "edge 93.184.216.34:80 1.500ms MISS -"},
+	} {
+		got := string(format(config.AccessLog{Format: tc.format, Template: tc.template}, rec))
+		if got != tc.want+"\n" {
+			t.Errorf("%s:\n got %q\nwant %q", tc.format, got, tc.want+"\n")
+		}
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(format(config.AccessLog{Format: config.LogFormatJSON}, rec), &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range config.AccessLogFields {
+		if _, ok := m[f]; !ok {
+			t.Errorf("JSON record lacks %s", f)
+		}
+	}
+	if m["bytes_out"] != 1234.0 || m["duration_ms"] != 1.5 || m["user_agent"] != "curl/8\n" {
+		t.Errorf("unexpected JSON record: %v", m)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	settings := config.AccessLog{Enabled: true, Format: config.LogFormatJSON}
+	l, buf := newLogger(&settings)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		SetUser(r.Context(), "bob")
+		SetUpstream(r.Context(), "198.51.100.1:80")
+		w.Header().Set("X-Cache", "HIT")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "hello")
+	})
+	// Nested middlewares log each request once, as the outermost one.
+	h := Middleware(Middleware(inner, l, "inner"), l, "edge")
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/p?q=1", strings.NewReader("body"))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	var rec struct {
+		Listener, Client, User, Method, URL, Host, Upstream, Cache string
+		Status                                                     int
+		BytesIn                                                    int64 `json:"bytes_in"`
+		BytesOut                                                   int64 `json:"bytes_out"`
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one record, got %q", buf.String())
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Listener != "edge" || rec.Client != "192.0.2.1" || rec.User != "bob" || rec.Method != "POST" ||
+		rec.URL != "http://example.com/p?q=1" || rec.Host != "example.com" || rec.Status != 201 ||
+		rec.BytesIn != 4 || rec.BytesOut != 5 || rec.Upstream != "198.51.100.1:80" || rec.Cache != "HIT" {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+
+	settings.Enabled = false
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Fatalf("disabled access log wrote records: %q", buf.String())
+	}
+}
+
+func TestMiddlewareErrorClass(t *testing.T) {
+	settings := config.AccessLog{Enabled: true, Format: config.LogFormatTemplate, Template: "{status} {error}"}
+	l, buf := newLogger(&settings)
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetError(r.Context(), &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED})
+		SetErrorClass(r.Context(), ErrorTimeout)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+	}), l, "edge")
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := buf.String(); got != "502 refused\n" {
+		t.Fatalf("unexpected record %q", got)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{context.Canceled, ErrorCanceled},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), ErrorTimeout},
+		{&net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}, ErrorDNS},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, ErrorRefused},
+		{errors.New("EOF"), ErrorUpstream},
+	} {
+		if got := Classify(tc.err); got != tc.want {
+			t.Errorf("Classify(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestHijackedTunnel(t *testing.T) {
+	settings := config.AccessLog{Enabled: true, Format: config.LogFormatTemplate, Template: "{method} {url} {status} {bytes_in} {bytes_out}"}
+	l, buf := newLogger(&settings)
+	srv := httptest.NewServer(Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		line, _ := brw.ReadString('\n')
+		io.WriteString(conn, strings.ToUpper(line))
+	}), l, "edge"))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The tunnel data is sent along with the request, so part of it is
+	// buffered by the server before the hijack.
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\nping\n")
+	br := bufio.NewReader(conn)
+	if _, err := http.ReadResponse(br, nil); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := br.ReadString('\n'); line != "PING\n" {
+		t.Fatalf("unexpected tunnel data %q", line)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for buf.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := fmt.Sprintf("CONNECT example.com:443 200 5 %d\n", len("HTTP/1.1 200 Connection Established\r\n\r\n")+5)
+	if got := buf.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	s, err := openFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 5; i++ {
+		if err := s.Write([]byte(fmt.Sprintf("line %d\n", i))); err != nil {
+			t.Fatal(err)
+		}
+		// Backups are named after the time of the rotation.
+		time.Sleep(2 * time.Millisecond)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "line 4\n" {
+		t.Fatalf("unexpected current file %q", b)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %v", backups)
+	}
+	if b, _ := os.ReadFile(backups[1]); string(b) != "line 3\n" {
+		t.Fatalf("unexpected latest backup %q", b)
+	}
+}
+
+func TestLoggerSinkSwitch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	settings := config.AccessLog{Enabled: true, Format: config.LogFormatTemplate, Template: "{url}"}
+	l, buf := newLogger(&settings)
+	defer l.Close()
+	l.Log(Record{URL: "/one"})
+	settings.Sink, settings.File = config.LogSinkFile, path
+	l.Log(Record{URL: "/two"})
+	if buf.String() != "/one\n" {
+		t.Fatalf("unexpected stdout %q", buf.String())
+	}
+	if b, _ := os.ReadFile(path); string(b) != "/two\n" {
+		t.Fatalf("unexpected file %q", b)
+	}
+}
+
+func TestLoggerReopensFailedSink(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	path := filepath.Join(dir, "access.log")
+	settings := config.AccessLog{Enabled: true, Format: config.LogFormatTemplate, Template: "{url}", Sink: config.LogSinkFile, File: path}
+	l, _ := newLogger(&settings)
+	defer l.Close()
+	l.Log(Record{URL: "/lost"})
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	l.Log(Record{URL: "/throttled"})
+	l.mu.Lock()
+	l.retryAt = time.Now()
+	l.mu.Unlock()
+	l.Log(Record{URL: "/kept"})
+	if b, _ := os.ReadFile(path); string(b) != "/kept\n" {
+		t.Fatalf("sink not reopened after failing: %q", b)
+	}
+}
@@ -0,0 +1,166 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pod32g/proxy/internal/config"
+)
+
+// clfTime is the time layout of the Common and Combined Log Formats.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+var placeholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// format renders rec as a line in the format of a.
+func format(a config.AccessLog, rec Record) []byte {
+	var line string
+	switch a.Format {
+	case config.LogFormatCommon:
+		line = common(rec)
+	case config.LogFormatJSON:
+		b, _ := json.Marshal(jsonRecord{
+			Time:      rec.Time.Format(time.RFC3339Nano),
+			Listener:  rec.Listener,
+			Client:    rec.Client,
+			User:      rec.User,
+			Method:    rec.Method,
+			URL:       rec.URL,
+			Host:      rec.Host,
+			Proto:     rec.Proto,
+			Status:    rec.Status,
+			BytesIn:   rec.BytesIn,
+			BytesOut:  rec.BytesOut,
+			Upstream:  rec.Upstream,
+			Duration:  durationMS(rec.Duration),
+			Cache:     rec.Cache,
+			Error:     rec.Error,
+			Referer:   rec.Referer,
+			UserAgent: rec.UserAgent,
+		})
+		line = string(b)
+	case config.LogFormatTemplate:
+		line = placeholder.ReplaceAllStringFunc(a.Template, func(m string) string {
+			return escape(field(rec, m[1:len(m)-1]))
+		})
+	default:
+		line = common(rec) + ` "` + escape(rec.Referer) + `" "` + escape(rec.UserAgent) + `"`
+	}
+	return []byte(line + "\n")
+}
+
+// jsonRecord is a record in the JSON format, with the fields named as in
+// config.AccessLogFields.
+type jsonRecord struct {
+	Time      string  `json:"time"`
+	Listener  string  `json:"listener"`
+	Client    string  `json:"client"`
+	User      string  `json:"user"`
+	Method    string  `json:"method"`
+	URL       string  `json:"url"`
+	Host      string  `json:"host"`
+	Proto     string  `json:"proto"`
+	Status    int     `json:"status"`
+	BytesIn   int64   `json:"bytes_in"`
+	BytesOut  int64   `json:"bytes_out"`
+	Upstream  string  `json:"upstream"`
+	Duration  float64 `json:"duration_ms"`
+	Cache     string  `json:"cache"`
+	Error     string  `json:"error"`
+	Referer   string  `json:"referer"`
+	UserAgent string  `json:"user_agent"`
+}
+
+// common renders rec in the Common Log Format.
+func common(rec Record) string {
+	var b strings.Builder
+	b.WriteString(escape(rec.Client))
+	b.WriteString(" - ")
+	b.WriteString(escape(rec.User))
+	b.WriteString(" [")
+	b.WriteString(rec.Time.Format(clfTime))
+	b.WriteString(`] "`)
+	b.WriteString(escape(rec.Method + " " + rec.URL + " " + rec.Proto))
+	b.WriteString(`" `)
+	b.WriteString(strconv.Itoa(rec.Status))
+	b.WriteString(" ")
+	b.WriteString(escape(field(rec, "bytes_out")))
+	return b.String()
+}
+
+// field returns the named field of rec as text, or "" if it is empty.
+func field(rec Record, name string) string {
+	switch name {
+	case "time":
+		return rec.Time.Format(time.RFC3339)
+	case "listener":
+		return rec.Listener
+	case "client":
+		return rec.Client
+	case "user":
+		return rec.User
+	case "method":
+		return rec.Method
+	case "url":
+		return rec.URL
+	case "host":
+		return rec.Host
+	case "proto":
+		return rec.Proto
+	case "status":
+		return strconv.Itoa(rec.Status)
+	case "bytes_in":
+		if rec.BytesIn > 0 {
+			return strconv.FormatInt(rec.BytesIn, 10)
+		}
+	case "bytes_out":
+		if rec.BytesOut > 0 {
+			return strconv.FormatInt(rec.BytesOut, 10)
+		}
+	case "upstream":
+		return rec.Upstream
+	case "duration_ms":
+		return strconv.FormatFloat(durationMS(rec.Duration), 'f', 3, 64)
+	case "cache":
+		return rec.Cache
+	case "error":
+		return rec.Error
+	case "referer":
+		return rec.Referer
+	case "user_agent":
+		return rec.UserAgent
+	}
+	return ""
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// escape returns s for a text log line: "-" when empty, and with quotes,
+// backslashes and control characters escaped so that values cannot break
+// the line or its quoting.
+func escape(s string) string {
+	if s == "" {
+		return "-"
+	}
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			b.WriteString(`\x`)
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,178 @@
+package accesslog
+
+import (
+	"io"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pod32g/proxy/internal/config"
+)
+
+// syslogTag identifies access log messages in syslog.
+const syslogTag = "proxy-access"
+
+// sink is the destination of access log lines.
+type sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+func openSink(a config.AccessLog, stdout io.Writer) (sink, error) {
+	switch a.Sink {
+	case config.LogSinkFile:
+		return openFile(a.File, a.MaxSize<<20, a.MaxAge.Std(), a.MaxBackups)
+	case config.LogSinkSyslog:
+		return openSyslog(a.Syslog)
+	}
+	return writerSink{stdout}, nil
+}
+
+// writerSink writes lines to a writer it does not own, such as stdout.
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) Write(line []byte) error {
+	_, err := s.w.Write(line)
+	return err
+}
+
+func (s writerSink) Close() error { return nil }
+
+// syslogSink sends lines to the local syslog daemon.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// openSyslog connects to the syslog daemon listening on the Unix socket at
+// path, or on the system socket when path is empty.
+func openSyslog(path string) (sink, error) {
+	const priority = syslog.LOG_INFO | syslog.LOG_DAEMON
+	if path == "" {
+		w, err := syslog.New(priority, syslogTag)
+		if err != nil {
+			return nil, err
+		}
+		return syslogSink{w}, nil
+	}
+	w, err := syslog.Dial("unixgram", path, priority, syslogTag)
+	if err != nil {
+		w, err = syslog.Dial("unix", path, priority, syslogTag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{w}, nil
+}
+
+func (s syslogSink) Write(line []byte) error {
+	return s.w.Info(strings.TrimSuffix(string(line), "\n"))
+}
+
+func (s syslogSink) Close() error {
+	return s.w.Close()
+}
+
+// fileSink appends lines to a file, rotated once it would exceed maxSize
+// bytes or is older than maxAge; zero disables either limit. Rotated files
+// are renamed with the time of the rotation appended, and the oldest are
+// removed beyond maxBackups unless it is zero.
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// backupTime is the layout of the suffix of rotated files, which sorts in
+// time order.
+const backupTime = "20060102T150405.000"
+
+func openFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*fileSink, error) {
+	s := &fileSink{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size, s.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (s *fileSink) Write(line []byte) error {
+	now := time.Now()
+	if s.size > 0 && ((s.maxSize > 0 && s.size+int64(len(line)) > s.maxSize) ||
+		(s.maxAge > 0 && now.Sub(s.opened) >= s.maxAge)) {
+		if err := s.rotate(now); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) rotate(now time.Time) error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(s.path, s.path+"."+now.Format(backupTime)); err != nil {
+		return err
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	return s.prune()
+}
+
+// prune removes the oldest rotated files beyond maxBackups.
+func (s *fileSink) prune() error {
+	if s.maxBackups <= 0 {
+		return nil
+	}
+	dir, base := filepath.Split(s.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, e := range entries {
+		if suffix, ok := strings.CutPrefix(e.Name(), base+"."); ok && len(suffix) == len(backupTime) {
+			backups = append(backups, e.Name())
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > s.maxBackups {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	return s.f.Close()
+}
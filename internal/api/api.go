@@ -1,24 +1,155 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/pod32g/proxy/internal/cache"
 	"github.com/pod32g/proxy/internal/config"
+	"github.com/pod32g/proxy/internal/proxy"
 	"github.com/pod32g/proxy/internal/server"
 	log "github.com/pod32g/simple-logger"
 )
 
+// Option configures optional features of the API handler.
+type Option func(*handler)
+
+// WithBalancer exposes the live state of the reverse proxy pool.
+func WithBalancer(b *proxy.Balancer) Option {
+	return func(h *handler) { h.balancer = b }
+}
+
+// WithCache exposes occupancy and purging of the shared HTTP cache.
+func WithCache(c *cache.Store) Option {
+	return func(h *handler) { h.cache = c }
+}
+
+// WithACL exposes the rule hit counters of the access control list.
+func WithACL(a *proxy.ACL) Option {
+	return func(h *handler) { h.acl = a }
+}
+
+// WithTunnels exposes the live CONNECT tunnels of the forward proxy and
+// allows terminating them.
+func WithTunnels(f *proxy.Forward) Option {
+	return func(h *handler) { h.forward = f }
+}
+
 // New returns a handler exposing REST APIs for runtime configuration.
-func New(cfg *config.Config, store *config.Store, logger *log.Logger, stats *server.DomainStats) http.Handler {
+func New(cfg *config.Config, store *config.Store, logger *log.Logger, stats *server.DomainStats, opts ...Option) http.Handler {
 	h := &handler{cfg: cfg, store: store, logger: logger, stats: stats}
+	for _, opt := range opts {
+		opt(h)
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/headers", h.headers)
+	mux.HandleFunc("/trusted-proxies", h.trustedProxies)
+	mux.HandleFunc("/forwarding", h.forwarding)
+	mux.HandleFunc("/access-log", h.accessLog)
+	mux.HandleFunc("/tunnels", h.tunnels)
+	mux.HandleFunc("/tunnels/timeouts", h.tunnelTimeouts)
 	mux.HandleFunc("/loglevel", h.logLevel)
 	mux.HandleFunc("/auth", h.auth)
+	mux.HandleFunc("/users", h.users)
+	mux.HandleFunc("/tokens", h.tokens)
 	mux.HandleFunc("/identity", h.identity)
 	mux.HandleFunc("/stats", h.statsHandler)
-	return mux
+	mux.HandleFunc("/mitm", h.mitm)
+	mux.HandleFunc("/parents", h.parents)
+	mux.HandleFunc("/upstreams", h.upstreams)
+	mux.HandleFunc("/upstreams/policy", h.upstreamPolicy)
+	mux.HandleFunc("/upstreams/health", h.healthCheck)
+	mux.HandleFunc("/routes", h.routes)
+	mux.HandleFunc("/ratelimits", h.rateLimits)
+	mux.HandleFunc("/acl", h.aclRules)
+	mux.HandleFunc("/acl/policy", h.aclPolicy)
+	mux.HandleFunc("/cache", h.cacheUsage)
+	mux.HandleFunc("/cache/purge", h.cachePurge)
+	mux.HandleFunc("/config/history", h.configHistory)
+	mux.HandleFunc("/config/diff", h.configDiff)
+	mux.HandleFunc("/config/rollback", h.configRollback)
+	mux.HandleFunc("/config/export", h.configExport)
+	mux.HandleFunc("/config/import", h.configImport)
+	return h.withTokens(mux)
+}
+
+// writeScopes maps API paths to the token scope required to change them.
+// Paths not listed require config.ScopeWrite, among them /auth and /users,
+// since managing users grants every scope.
+var writeScopes = map[string]string{
+	"/headers":          config.ScopeWriteHeaders,
+	"/trusted-proxies":  config.ScopeWriteHeaders,
+	"/forwarding":       config.ScopeWriteHeaders,
+	"/access-log":       config.ScopeWriteSettings,
+	"/tunnels":          config.ScopeWriteSettings,
+	"/tunnels/timeouts": config.ScopeWriteSettings,
+	"/loglevel":         config.ScopeWriteSettings,
+	"/identity":         config.ScopeWriteSettings,
+	"/stats":            config.ScopeWriteSettings,
+	"/mitm":             config.ScopeWriteSettings,
+	"/tokens":           config.ScopeWriteAuth,
+	"/parents":          config.ScopeWriteUpstreams,
+	"/upstreams":        config.ScopeWriteUpstreams,
+	"/upstreams/policy": config.ScopeWriteUpstreams,
+	"/upstreams/health": config.ScopeWriteUpstreams,
+	"/routes":           config.ScopeWriteUpstreams,
+	"/ratelimits":       config.ScopeWriteACL,
+	"/acl":              config.ScopeWriteACL,
+	"/acl/policy":       config.ScopeWriteACL,
+	"/cache/purge":      config.ScopeWriteCache,
+	"/config/rollback":  config.ScopeWriteConfig,
+	"/config/import":    config.ScopeWriteConfig,
+}
+
+// requiredScope returns the token scope needed for r.
+func requiredScope(r *http.Request) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return config.ScopeRead
+	}
+	if scope, ok := writeScopes[r.URL.Path]; ok {
+		return scope
+	}
+	return config.ScopeWrite
+}
+
+type tokenKey struct{}
+
+// withTokens authenticates requests carrying an API token in an
+// "Authorization: Bearer" header and rejects those outside its scopes.
+// Other requests are left to the server.Router.
+func (h *handler) withTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tok, ok := h.cfg.AuthenticateToken(strings.TrimSpace(auth[len("Bearer "):]))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer realm=\"proxy\"")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !tok.Allows(requiredScope(r)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.store.TouchToken(tok.Name, tok.LastUsed)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, tok)))
+	})
+}
+
+// tokenAllows reports whether the API token r was made with, if any, grants
+// scope. Requests made without a token were authorized by the router.
+func tokenAllows(r *http.Request, scope string) bool {
+	tok, ok := r.Context().Value(tokenKey{}).(config.Token)
+	return !ok || tok.Allows(scope)
 }
 
 type handler struct {
@@ -26,6 +157,11 @@ type handler struct {
 	store  *config.Store
 	logger *log.Logger
 	stats  *server.DomainStats
+
+	balancer *proxy.Balancer
+	cache    *cache.Store
+	acl      *proxy.ACL
+	forward  *proxy.Forward
 }
 
 type headerReq struct {
@@ -34,6 +170,10 @@ type headerReq struct {
 	Client string `json:"client"`
 }
 
+type trustedProxiesReq struct {
+	Proxies []string `json:"proxies"`
+}
+
 type logLevelReq struct {
 	Level string `json:"level"`
 }
@@ -44,10 +184,80 @@ type authReq struct {
 	Password string `json:"password"`
 }
 
+type userReq struct {
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+	Password string `json:"password,omitempty"`
+}
+
+type tokenReq struct {
+	Name      string          `json:"name"`
+	Scopes    []string        `json:"scopes"`
+	ExpiresIn config.Duration `json:"expires_in"`
+}
+
+// tokenResp describes a token without its hash. Token is only set in the
+// response creating it.
+type tokenResp struct {
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	Token    string   `json:"token,omitempty"`
+	Created  string   `json:"created"`
+	Expires  string   `json:"expires,omitempty"`
+	LastUsed string   `json:"last_used,omitempty"`
+}
+
+func newTokenResp(t config.Token) tokenResp {
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	return tokenResp{Name: t.Name, Scopes: t.Scopes, Created: format(t.Created), Expires: format(t.Expires), LastUsed: format(t.LastUsed)}
+}
+
 type statsReq struct {
 	Enabled bool `json:"enabled"`
 }
 
+type mitmReq struct {
+	Enabled bool     `json:"enabled"`
+	Bypass  []string `json:"bypass"`
+}
+
+type upstreamReq struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+type policyReq struct {
+	Policy  string `json:"policy"`
+	HashKey string `json:"hash_key"`
+}
+
+type aclPolicyReq struct {
+	Default  string `json:"default"`
+	DenyPage string `json:"deny_page"`
+}
+
+type purgeReq struct {
+	URL  string `json:"url"`
+	Host string `json:"host"`
+}
+
+type nameReq struct {
+	Name string `json:"name"`
+}
+
+// maxImportSize limits the size of imported configuration documents.
+const maxImportSize = 10 << 20
+
+type rollbackReq struct {
+	Version int  `json:"version"`
+	Users   bool `json:"users"`
+}
+
 type identityReq struct {
 	Name string `json:"name"`
 	ID   string `json:"id"`
@@ -58,6 +268,19 @@ func writeJSON(w http.ResponseWriter, v interface{}) {
 	json.NewEncoder(w).Encode(v)
 }
 
+// actor names who made a change in the configuration history: the API
+// token as "token:NAME", the authenticated user, or "api" for anonymous
+// requests.
+func actor(r *http.Request) string {
+	if tok, ok := r.Context().Value(tokenKey{}).(config.Token); ok {
+		return "token:" + tok.Name
+	}
+	if user := proxy.RequestUser(r); user != "" {
+		return user
+	}
+	return "api"
+}
+
 func (h *handler) headers(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
@@ -68,6 +291,14 @@ func (h *handler) headers(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPost:
 		var req headerReq
 		json.NewDecoder(r.Body).Decode(&req)
+		if req.Client != "" {
+			sel, err := config.ParseSelector(req.Client)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Client = sel.String()
+		}
 		if req.Name != "" {
 			if req.Client == "" {
 				h.cfg.SetHeader(req.Name, req.Value)
@@ -78,7 +309,7 @@ func (h *handler) headers(w http.ResponseWriter, r *http.Request) {
 				h.logger.Info("Set header", req.Name, req.Value)
 			}
 			if h.store != nil {
-				h.store.Save(h.cfg)
+				h.store.SaveAs(h.cfg, actor(r))
 			}
 		}
 		w.WriteHeader(http.StatusNoContent)
@@ -95,7 +326,7 @@ func (h *handler) headers(w http.ResponseWriter, r *http.Request) {
 				h.logger.Info("Deleted header", req.Name)
 			}
 			if h.store != nil {
-				h.store.Save(h.cfg)
+				h.store.SaveAs(h.cfg, actor(r))
 			}
 		}
 		w.WriteHeader(http.StatusNoContent)
@@ -104,6 +335,33 @@ func (h *handler) headers(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *handler) trustedProxies(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		proxies := h.cfg.GetTrustedProxies()
+		if proxies == nil {
+			proxies = []string{}
+		}
+		writeJSON(w, trustedProxiesReq{Proxies: proxies})
+	case http.MethodPost:
+		var req trustedProxiesReq
+		json.NewDecoder(r.Body).Decode(&req)
+		if err := h.cfg.SetTrustedProxies(req.Proxies); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.logger != nil {
+			h.logger.Info("Set trusted proxies", len(req.Proxies))
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
 func (h *handler) logLevel(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
@@ -118,7 +376,7 @@ func (h *handler) logLevel(w http.ResponseWriter, r *http.Request) {
 			h.logger.Info("Set log level", req.Level)
 		}
 		if h.store != nil {
-			h.store.Save(h.cfg)
+			h.store.SaveAs(h.cfg, actor(r))
 		}
 		w.WriteHeader(http.StatusNoContent)
 	default:
@@ -129,17 +387,127 @@ func (h *handler) logLevel(w http.ResponseWriter, r *http.Request) {
 func (h *handler) auth(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		enabled, user, _ := h.cfg.GetAuth()
-		writeJSON(w, map[string]interface{}{"enabled": enabled, "username": user})
+		writeJSON(w, map[string]interface{}{"enabled": h.cfg.AuthEnabledState(), "users": len(h.cfg.GetUsers())})
 	case http.MethodPost:
 		var req authReq
 		json.NewDecoder(r.Body).Decode(&req)
-		h.cfg.SetAuth(req.Enabled, req.Username, req.Password)
+		if err := h.cfg.SetAuth(req.Enabled, req.Username, req.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if h.logger != nil {
 			h.logger.Info("updated auth settings")
 		}
 		if h.store != nil {
-			h.store.Save(h.cfg)
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *handler) users(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		users := h.cfg.GetUsers()
+		out := make([]userReq, 0, len(users))
+		for _, u := range users {
+			out = append(out, userReq{Name: u.Name, Role: u.Role})
+		}
+		writeJSON(w, out)
+	case http.MethodPost:
+		var req userReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.cfg.SetUser(req.Name, req.Role, req.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.logger != nil {
+			h.logger.Info("Set user", req.Name, req.Role)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		var req nameReq
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Name != "" {
+			if err := h.cfg.DeleteUser(req.Name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if h.logger != nil {
+				h.logger.Info("Deleted user", req.Name)
+			}
+			if h.store != nil {
+				h.store.SaveAs(h.cfg, actor(r))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *handler) tokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tokens := h.cfg.GetTokens()
+		out := make([]tokenResp, 0, len(tokens))
+		for _, t := range tokens {
+			out = append(out, newTokenResp(t))
+		}
+		writeJSON(w, out)
+	case http.MethodPost:
+		var req tokenReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Tokens cannot mint tokens with more scopes than their own.
+		for _, scope := range req.Scopes {
+			if !tokenAllows(r, scope) {
+				http.Error(w, "Forbidden: scope "+scope+" is not granted to the token", http.StatusForbidden)
+				return
+			}
+		}
+		secret, err := h.cfg.CreateToken(req.Name, req.Scopes, time.Duration(req.ExpiresIn))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.logger != nil {
+			h.logger.Info("Created API token", req.Name, req.Scopes)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		resp := tokenResp{Name: req.Name}
+		for _, t := range h.cfg.GetTokens() {
+			if t.Name == req.Name {
+				resp = newTokenResp(t)
+			}
+		}
+		resp.Token = secret
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(resp)
+	case http.MethodDelete:
+		var req nameReq
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Name != "" {
+			h.cfg.DeleteToken(req.Name)
+			if h.logger != nil {
+				h.logger.Info("Revoked API token", req.Name)
+			}
+			if h.store != nil {
+				h.store.SaveAs(h.cfg, actor(r))
+			}
 		}
 		w.WriteHeader(http.StatusNoContent)
 	default:
@@ -160,7 +528,7 @@ func (h *handler) identity(w http.ResponseWriter, r *http.Request) {
 			h.logger.Info("updated identity")
 		}
 		if h.store != nil {
-			h.store.Save(h.cfg)
+			h.store.SaveAs(h.cfg, actor(r))
 		}
 		w.WriteHeader(http.StatusNoContent)
 	default:
@@ -184,10 +552,594 @@ func (h *handler) statsHandler(w http.ResponseWriter, r *http.Request) {
 			h.logger.Info("Set stats enabled", req.Enabled)
 		}
 		if h.store != nil {
-			h.store.Save(h.cfg)
+			h.store.SaveAs(h.cfg, actor(r))
 		}
 		w.WriteHeader(http.StatusNoContent)
 	default:
 		http.NotFound(w, r)
 	}
 }
+
+func (h *handler) mitm(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		enabled, bypass := h.cfg.GetMITM()
+		if bypass == nil {
+			bypass = []string{}
+		}
+		writeJSON(w, map[string]interface{}{"enabled": enabled, "bypass": bypass})
+	case http.MethodPost:
+		var req mitmReq
+		json.NewDecoder(r.Body).Decode(&req)
+		h.cfg.SetMITM(req.Enabled, req.Bypass)
+		if h.logger != nil {
+			h.logger.Info("Set TLS interception", req.Enabled)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *handler) parents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		p := h.cfg.GetParents()
+		if host := r.URL.Query().Get("host"); host != "" {
+			writeJSON(w, map[string]string{"host": host, "route": p.Route(host)})
+			return
+		}
+		p = p.Redacted()
+		if p.Rules == nil {
+			p.Rules = []config.ParentRule{}
+		}
+		writeJSON(w, p)
+	case http.MethodPost:
+		var req config.ParentProxies
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := req.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.cfg.SetParents(req)
+		if h.logger != nil {
+			h.logger.Info("Updated parent proxies")
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *handler) upstreams(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		p := h.cfg.GetPool()
+		data := map[string]interface{}{"policy": p.Policy, "hash_key": p.HashKey}
+		if h.balancer != nil {
+			data["targets"] = h.balancer.Status()
+		} else {
+			targets := p.Targets
+			if targets == nil {
+				targets = []config.Upstream{}
+			}
+			data["targets"] = targets
+		}
+		writeJSON(w, data)
+	case http.MethodPost:
+		var req upstreamReq
+		json.NewDecoder(r.Body).Decode(&req)
+		if err := h.cfg.SetUpstream(config.Upstream{URL: req.URL, Weight: req.Weight}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.logger != nil {
+			h.logger.Info("Set upstream", req.URL, req.Weight)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		var req upstreamReq
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.URL != "" {
+			h.cfg.DeleteUpstream(req.URL)
+			if h.logger != nil {
+				h.logger.Info("Deleted upstream", req.URL)
+			}
+			if h.store != nil {
+				h.store.SaveAs(h.cfg, actor(r))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *handler) upstreamPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	var req policyReq
+	json.NewDecoder(r.Body).Decode(&req)
+	if err := (config.UpstreamPool{Policy: req.Policy, HashKey: req.HashKey}).Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.cfg.SetBalancing(req.Policy, req.HashKey)
+	if h.logger != nil {
+		h.logger.Info("Set balancing policy", req.Policy)
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) forwarding(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, h.cfg.GetForwarding())
+	case http.MethodPost:
+		req := h.cfg.GetForwarding()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.cfg.SetForwarding(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.logger != nil {
+			h.logger.Info("Updated forwarding headers", req.Via, req.XForwardedFor, req.Forwarded)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type tunnelReq struct {
+	ID uint64 `json:"id"`
+}
+
+func (h *handler) tunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.NotFound(w, r)
+		return
+	}
+	if h.forward == nil {
+		http.Error(w, "forward proxy disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, h.forward.Tunnels())
+		return
+	}
+	var req tunnelReq
+	json.NewDecoder(r.Body).Decode(&req)
+	if !h.forward.CloseTunnel(req.ID) {
+		http.Error(w, "no such tunnel", http.StatusNotFound)
+		return
+	}
+	if h.logger != nil {
+		h.logger.Info("Terminated tunnel", req.ID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) tunnelTimeouts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, h.cfg.GetTunnelTimeouts())
+	case http.MethodPost:
+		req := h.cfg.GetTunnelTimeouts()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.cfg.SetTunnelTimeouts(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.logger != nil {
+			h.logger.Info("Updated tunnel timeouts", req.Idle.Std(), req.MaxLifetime.Std(), req.Dial.Std())
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *handler) accessLog(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, h.cfg.GetAccessLog())
+	case http.MethodPost:
+		req := h.cfg.GetAccessLog()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.cfg.SetAccessLog(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.logger != nil {
+			h.logger.Info("Updated access log", req.Enabled, req.Format, req.Sink)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *handler) healthCheck(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, h.cfg.GetHealthCheck())
+	case http.MethodPost:
+		req := h.cfg.GetHealthCheck()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := req.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.cfg.SetHealthCheck(req)
+		if h.logger != nil {
+			h.logger.Info("Updated health checks", req.Enabled)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *handler) routes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, h.cfg.GetRoutes())
+	case http.MethodPost:
+		var req config.Route
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.cfg.SetRoute(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.logger != nil {
+			h.logger.Info("Set route", req.Name, req.Target)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		var req nameReq
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Name != "" {
+			h.cfg.DeleteRoute(req.Name)
+			if h.logger != nil {
+				h.logger.Info("Deleted route", req.Name)
+			}
+			if h.store != nil {
+				h.store.SaveAs(h.cfg, actor(r))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *handler) cacheUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	if h.cache == nil {
+		http.Error(w, "cache disabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, h.cache.Usage())
+}
+
+func (h *handler) cachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if h.cache == nil {
+		http.Error(w, "cache disabled", http.StatusNotFound)
+		return
+	}
+	var req purgeReq
+	json.NewDecoder(r.Body).Decode(&req)
+	if (req.URL == "") == (req.Host == "") {
+		http.Error(w, "exactly one of url or host is required", http.StatusBadRequest)
+		return
+	}
+	var n int
+	if req.URL != "" {
+		n = h.cache.Purge(req.URL)
+	} else {
+		n = h.cache.PurgeHost(req.Host)
+	}
+	if h.logger != nil {
+		h.logger.Info("Purged cache", req.URL+req.Host, n)
+	}
+	writeJSON(w, map[string]int{"purged": n})
+}
+
+func (h *handler) rateLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, h.cfg.GetRateLimits())
+	case http.MethodPost:
+		var req config.RateLimit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.cfg.SetRateLimit(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.logger != nil {
+			h.logger.Info("Set rate limit", req.Name, req.Key, req.Rate, req.Concurrent)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		var req nameReq
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Name != "" {
+			h.cfg.DeleteRateLimit(req.Name)
+			if h.logger != nil {
+				h.logger.Info("Deleted rate limit", req.Name)
+			}
+			if h.store != nil {
+				h.store.SaveAs(h.cfg, actor(r))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *handler) aclRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a := h.cfg.GetACL()
+		hits := map[string]uint64{}
+		if h.acl != nil {
+			hits = h.acl.Hits()
+		}
+		writeJSON(w, map[string]interface{}{"default": a.Default, "deny_page": a.DenyPage, "rules": a.Rules, "hits": hits})
+	case http.MethodPost:
+		var req config.ACLRule
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.cfg.SetACLRule(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.logger != nil {
+			h.logger.Info("Set ACL rule", req.Name, req.Action)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		var req nameReq
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Name != "" {
+			h.cfg.DeleteACLRule(req.Name)
+			if h.logger != nil {
+				h.logger.Info("Deleted ACL rule", req.Name)
+			}
+			if h.store != nil {
+				h.store.SaveAs(h.cfg, actor(r))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *handler) aclPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	var req aclPolicyReq
+	json.NewDecoder(r.Body).Decode(&req)
+	if err := h.cfg.SetACLPolicy(req.Default, req.DenyPage); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.logger != nil {
+		h.logger.Info("Set ACL policy", req.Default)
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) configHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	revs, err := h.store.History(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if revs == nil {
+		revs = []config.Revision{}
+	}
+	writeJSON(w, revs)
+}
+
+func (h *handler) configDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	to, err := strconv.Atoi(q.Get("to"))
+	if q.Get("to") == "" {
+		revs, herr := h.store.History(1)
+		if herr != nil || len(revs) == 0 {
+			http.Error(w, config.ErrNoRevision.Error(), http.StatusNotFound)
+			return
+		}
+		to, err = revs[0].Version, nil
+	}
+	if err != nil {
+		http.Error(w, "invalid to version", http.StatusBadRequest)
+		return
+	}
+	from := to - 1
+	if q.Get("from") != "" {
+		if from, err = strconv.Atoi(q.Get("from")); err != nil {
+			http.Error(w, "invalid from version", http.StatusBadRequest)
+			return
+		}
+	}
+	newer, err := h.store.Snapshot(h.cfg, to)
+	if err != nil {
+		writeRevisionError(w, err)
+		return
+	}
+	var older config.Snapshot
+	if from > 0 {
+		if older, err = h.store.Snapshot(h.cfg, from); err != nil {
+			writeRevisionError(w, err)
+			return
+		}
+	}
+	changes := config.Diff(older, newer)
+	if changes == nil {
+		changes = []config.Change{}
+	}
+	writeJSON(w, map[string]interface{}{"from": from, "to": to, "changes": changes})
+}
+
+func (h *handler) configRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	var req rollbackReq
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.Users && !tokenAllows(r, config.ScopeWrite) {
+		http.Error(w, "Forbidden: restoring users requires the write scope", http.StatusForbidden)
+		return
+	}
+	if err := h.store.Rollback(h.cfg, req.Version, actor(r), req.Users); err != nil {
+		writeRevisionError(w, err)
+		return
+	}
+	if h.logger != nil {
+		h.logger.SetLevel(h.cfg.GetLogLevel())
+		h.logger.Info("Rolled back configuration to version", req.Version)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) configExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	doc, err := h.cfg.Export()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, doc)
+}
+
+func (h *handler) configImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	users, _ := strconv.ParseBool(r.URL.Query().Get("users"))
+	if users && !tokenAllows(r, config.ScopeWrite) {
+		http.Error(w, "Forbidden: importing users requires the write scope", http.StatusForbidden)
+		return
+	}
+	res, err := h.cfg.Import(data, dryRun, users)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !dryRun {
+		if h.logger != nil {
+			h.logger.SetLevel(h.cfg.GetLogLevel())
+			h.logger.Info("Imported configuration", len(res.Changes))
+		}
+		if h.store != nil {
+			h.store.SaveWithComment(h.cfg, actor(r), "import")
+		}
+	}
+	if res.Changes == nil {
+		res.Changes = []config.Change{}
+	}
+	writeJSON(w, res)
+}
+
+func writeRevisionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, config.ErrNoRevision) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
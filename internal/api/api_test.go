@@ -5,9 +5,13 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pod32g/proxy/internal/config"
+	"github.com/pod32g/proxy/internal/proxy"
 	"github.com/pod32g/proxy/internal/server"
 )
 
@@ -44,6 +48,87 @@ func TestHeadersEndpoint(t *testing.T) {
 	if len(cfg.GetHeaders()) != 0 {
 		t.Fatalf("header not deleted")
 	}
+
+	doReq(t, h, "POST", "/headers", map[string]string{"name": "B", "value": "2", "client": "10.0.0.7:5123"})
+	if v := cfg.GetAllClientHeaders()["10.0.0.7"]["B"]; v != "2" {
+		t.Fatalf("client header not set under canonical selector: %v", cfg.GetAllClientHeaders())
+	}
+	if rec := doReq(t, h, "POST", "/headers", map[string]string{"name": "B", "value": "2", "client": "laptop"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid selector, got %d", rec.Code)
+	}
+}
+
+func TestTrustedProxiesEndpoint(t *testing.T) {
+	cfg, h := newAPI()
+	if rec := doReq(t, h, "POST", "/trusted-proxies", map[string][]string{"proxies": {"10.0.0.0/8"}}); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if rec := doReq(t, h, "POST", "/trusted-proxies", map[string][]string{"proxies": {"lb.local"}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if p := cfg.GetTrustedProxies(); len(p) != 1 || p[0] != "10.0.0.0/8" {
+		t.Fatalf("unexpected trusted proxies: %v", p)
+	}
+}
+
+func TestForwardingEndpoint(t *testing.T) {
+	cfg, h := newAPI()
+	if rec := doReq(t, h, "POST", "/forwarding", map[string]interface{}{"via": true, "trust": "none"}); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if rec := doReq(t, h, "POST", "/forwarding", map[string]string{"anonymize": "mask"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if f := cfg.GetForwarding(); !f.Via || f.Trust != config.TrustNone || f.Anonymize != "" {
+		t.Fatalf("unexpected forwarding: %+v", f)
+	}
+	var got config.Forwarding
+	json.Unmarshal(doReq(t, h, "GET", "/forwarding", nil).Body.Bytes(), &got)
+	if !got.Via || got.Trust != config.TrustNone {
+		t.Fatalf("unexpected response: %+v", got)
+	}
+}
+
+func TestAccessLogEndpoint(t *testing.T) {
+	cfg, h := newAPI()
+	if rec := doReq(t, h, "POST", "/access-log", map[string]interface{}{"enabled": true, "format": "json", "sink": "file", "file": "access.log", "max_age": "12h"}); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if rec := doReq(t, h, "POST", "/access-log", map[string]string{"format": "template", "template": "{nope}"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if a := cfg.GetAccessLog(); !a.Enabled || a.Format != config.LogFormatJSON || a.File != "access.log" || a.MaxAge.Std() != 12*time.Hour {
+		t.Fatalf("unexpected access log: %+v", a)
+	}
+	var got config.AccessLog
+	json.Unmarshal(doReq(t, h, "GET", "/access-log", nil).Body.Bytes(), &got)
+	if got.Sink != config.LogSinkFile {
+		t.Fatalf("unexpected response: %+v", got)
+	}
+}
+
+func TestTunnelEndpoints(t *testing.T) {
+	cfg, h := newAPI()
+	if rec := doReq(t, h, "POST", "/tunnels/timeouts", map[string]string{"idle": "2m", "dial": "5s"}); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if rec := doReq(t, h, "POST", "/tunnels/timeouts", map[string]string{"max_lifetime": "-1s"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if tt := cfg.GetTunnelTimeouts(); tt.Idle.Std() != 2*time.Minute || tt.Dial.Std() != 5*time.Second || tt.MaxLifetime != 0 {
+		t.Fatalf("unexpected tunnel timeouts: %+v", tt)
+	}
+	if rec := doReq(t, h, "GET", "/tunnels", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("tunnels listed without a forward proxy: %d", rec.Code)
+	}
+
+	h = New(cfg, nil, nil, server.NewDomainStats(), WithTunnels(proxy.NewForward(nil, nil)))
+	if rec := doReq(t, h, "GET", "/tunnels", nil); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Fatalf("unexpected tunnels %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := doReq(t, h, "DELETE", "/tunnels", map[string]int{"id": 1}); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown tunnel, got %d", rec.Code)
+	}
 }
 
 func TestLogLevelEndpoint(t *testing.T) {
@@ -61,8 +146,7 @@ func TestLogLevelEndpoint(t *testing.T) {
 func TestAuthEndpoint(t *testing.T) {
 	cfg, h := newAPI()
 	doReq(t, h, "POST", "/auth", map[string]interface{}{"enabled": true, "username": "u", "password": "p"})
-	e, u, _ := cfg.GetAuth()
-	if !e || u != "u" {
+	if _, ok := cfg.Authenticate("u", "p"); !ok || !cfg.AuthRequired() {
 		t.Fatalf("auth")
 	}
 	rec := doReq(t, h, "GET", "/auth", nil)
@@ -71,6 +155,93 @@ func TestAuthEndpoint(t *testing.T) {
 	}
 }
 
+func TestUsersEndpoint(t *testing.T) {
+	cfg, h := newAPI()
+	if rec := doReq(t, h, "POST", "/users", map[string]string{"name": "ann", "role": "viewer", "password": "pw"}); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if rec := doReq(t, h, "POST", "/users", map[string]string{"name": "bob", "role": "root", "password": "pw"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if role, ok := cfg.Authenticate("ann", "pw"); !ok || role != config.RoleViewer {
+		t.Fatalf("user not added: %s %v", role, ok)
+	}
+	rec := doReq(t, h, "GET", "/users", nil)
+	if rec.Code != 200 || strings.Contains(rec.Body.String(), "password") || !strings.Contains(rec.Body.String(), `"ann"`) {
+		t.Fatalf("unexpected users: %s", rec.Body.String())
+	}
+	doReq(t, h, "DELETE", "/users", map[string]string{"name": "ann"})
+	if len(cfg.GetUsers()) != 0 {
+		t.Fatalf("user not deleted")
+	}
+}
+
+func TestTokensEndpoint(t *testing.T) {
+	cfg, h := newAPI()
+	rec := doReq(t, h, "POST", "/tokens", map[string]interface{}{"name": "ci", "scopes": []string{"read", "write:headers"}, "expires_in": "24h"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		Token   string `json:"token"`
+		Expires string `json:"expires"`
+	}
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.Token == "" || created.Expires == "" {
+		t.Fatalf("unexpected token response: %+v", created)
+	}
+	if rec := doReq(t, h, "POST", "/tokens", map[string]interface{}{"name": "bad", "scopes": []string{"root"}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+
+	withToken := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(body)
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := withToken("GET", "/headers", created.Token, nil); rec.Code != http.StatusOK {
+		t.Fatalf("read with token: %d", rec.Code)
+	}
+	if rec := withToken("POST", "/headers", created.Token, map[string]string{"name": "X-A", "value": "1"}); rec.Code != http.StatusNoContent || cfg.GetHeaders()["X-A"] != "1" {
+		t.Fatalf("scoped write with token: %d", rec.Code)
+	}
+	if rec := withToken("POST", "/users", created.Token, map[string]string{"name": "eve", "role": "admin", "password": "pw"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 outside the token scopes, got %d", rec.Code)
+	}
+	// Tokens that manage tokens cannot escalate their scopes.
+	admin, err := cfg.CreateToken("tokens", []string{config.ScopeWriteAuth}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := withToken("POST", "/tokens", admin, map[string]interface{}{"name": "root", "scopes": []string{"write"}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 minting a wider token, got %d", rec.Code)
+	}
+	if rec := withToken("POST", "/tokens", admin, map[string]interface{}{"name": "peer", "scopes": []string{"write:auth"}}); rec.Code != http.StatusCreated {
+		t.Fatalf("minting a token within the scopes: %d", rec.Code)
+	}
+	for _, path := range []string{"/users", "/auth"} {
+		body := map[string]interface{}{"name": "eve", "role": "admin", "password": "pw", "enabled": true, "username": "eve"}
+		if rec := withToken("POST", path, admin, body); rec.Code != http.StatusForbidden {
+			t.Fatalf("expected 403 for %s with write:auth, got %d", path, rec.Code)
+		}
+	}
+	if rec := withToken("GET", "/headers", "pxt_wrong", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an unknown token, got %d", rec.Code)
+	}
+	rec = doReq(t, h, "GET", "/tokens", nil)
+	if strings.Contains(rec.Body.String(), created.Token) || !strings.Contains(rec.Body.String(), `"last_used"`) {
+		t.Fatalf("unexpected token list: %s", rec.Body.String())
+	}
+	doReq(t, h, "DELETE", "/tokens", map[string]string{"name": "ci"})
+	if rec := withToken("GET", "/headers", created.Token, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked token accepted: %d", rec.Code)
+	}
+}
+
 func TestIdentityEndpoint(t *testing.T) {
 	cfg, h := newAPI()
 	doReq(t, h, "POST", "/identity", map[string]string{"name": "n", "id": "i"})
@@ -95,3 +266,224 @@ func TestStatsEndpoint(t *testing.T) {
 		t.Fatalf("get stats")
 	}
 }
+
+func TestMITMEndpoint(t *testing.T) {
+	cfg, h := newAPI()
+	doReq(t, h, "POST", "/mitm", map[string]interface{}{"enabled": true, "bypass": []string{"*.example.com"}})
+	enabled, bypass := cfg.GetMITM()
+	if !enabled || len(bypass) != 1 || bypass[0] != "*.example.com" {
+		t.Fatalf("mitm not set: %v %v", enabled, bypass)
+	}
+	rec := doReq(t, h, "GET", "/mitm", nil)
+	if rec.Code != 200 {
+		t.Fatalf("get mitm")
+	}
+}
+
+func TestParentsEndpoint(t *testing.T) {
+	cfg, h := newAPI()
+	body := map[string]interface{}{
+		"http":    "http://proxy.corp:3128",
+		"default": "direct",
+		"rules":   []map[string]string{{"pattern": "*.example.com", "via": "http"}},
+	}
+	if rec := doReq(t, h, "POST", "/parents", body); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if u := cfg.ParentFor("www.example.com"); u == nil || u.Host != "proxy.corp:3128" {
+		t.Fatalf("rule not applied: %v", u)
+	}
+	rec := doReq(t, h, "GET", "/parents?host=www.example.com", nil)
+	var route map[string]string
+	json.NewDecoder(rec.Body).Decode(&route)
+	if route["route"] != "http" {
+		t.Fatalf("unexpected route %v", route)
+	}
+	if rec := doReq(t, h, "POST", "/parents", map[string]string{"default": "bogus"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestUpstreamsEndpoint(t *testing.T) {
+	cfg, h := newAPI()
+	if rec := doReq(t, h, "POST", "/upstreams", map[string]interface{}{"url": "http://10.0.0.1:9000", "weight": 2}); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if rec := doReq(t, h, "POST", "/upstreams", map[string]interface{}{"url": "ftp://x"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	doReq(t, h, "POST", "/upstreams/policy", map[string]string{"policy": "least_requests"})
+	p := cfg.GetPool()
+	if len(p.Targets) != 1 || p.Policy != "least_requests" {
+		t.Fatalf("pool not updated: %+v", p)
+	}
+	if rec := doReq(t, h, "GET", "/upstreams", nil); rec.Code != 200 {
+		t.Fatalf("get upstreams")
+	}
+	doReq(t, h, "DELETE", "/upstreams", map[string]string{"url": "http://10.0.0.1:9000"})
+	if len(cfg.GetPool().Targets) != 0 {
+		t.Fatalf("upstream not deleted")
+	}
+}
+
+func TestHealthCheckEndpoint(t *testing.T) {
+	cfg, h := newAPI()
+	if rec := doReq(t, h, "POST", "/upstreams/health", map[string]interface{}{"enabled": true, "path": "/healthz", "interval": "3s"}); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	hc := cfg.GetHealthCheck()
+	if !hc.Enabled || hc.Path != "/healthz" || hc.Interval.Std() != 3*time.Second {
+		t.Fatalf("health check not updated: %+v", hc)
+	}
+	if rec := doReq(t, h, "POST", "/upstreams/health", map[string]interface{}{"expected_status": 42}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestRoutesEndpoint(t *testing.T) {
+	cfg, h := newAPI()
+	route := map[string]interface{}{"name": "billing", "path_prefix": "/billing/", "strip_prefix": true, "target": "http://10.0.0.2:8000"}
+	if rec := doReq(t, h, "POST", "/routes", route); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if rec := doReq(t, h, "POST", "/routes", map[string]interface{}{"name": "x", "target": "nope"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	rec := doReq(t, h, "GET", "/routes", nil)
+	var routes []config.Route
+	json.NewDecoder(rec.Body).Decode(&routes)
+	if len(routes) != 1 || !routes[0].StripPrefix {
+		t.Fatalf("unexpected routes: %+v", routes)
+	}
+	doReq(t, h, "DELETE", "/routes", map[string]string{"name": "billing"})
+	if len(cfg.GetRoutes()) != 0 {
+		t.Fatalf("route not deleted")
+	}
+}
+
+func TestRateLimitsEndpoint(t *testing.T) {
+	cfg, h := newAPI()
+	if rec := doReq(t, h, "POST", "/ratelimits", map[string]interface{}{"name": "agents", "key": "ip", "rate": 5, "concurrent": 10}); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if rec := doReq(t, h, "POST", "/ratelimits", map[string]interface{}{"name": "bad", "key": "country", "rate": 1}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if l := cfg.GetRateLimits(); len(l) != 1 || l[0].Concurrent != 10 {
+		t.Fatalf("unexpected limits: %+v", l)
+	}
+	doReq(t, h, "DELETE", "/ratelimits", map[string]string{"name": "agents"})
+	if len(cfg.GetRateLimits()) != 0 {
+		t.Fatalf("limit not deleted")
+	}
+}
+
+func TestACLEndpoint(t *testing.T) {
+	cfg, h := newAPI()
+	rule := map[string]interface{}{"name": "ads", "action": "deny", "hosts": []string{".ads.example"}, "ports": []int{80, 443}}
+	if rec := doReq(t, h, "POST", "/acl", rule); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if rec := doReq(t, h, "POST", "/acl", map[string]string{"name": "bad", "action": "drop"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if rec := doReq(t, h, "POST", "/acl/policy", map[string]string{"default": "deny", "deny_page": "blocked"}); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if a := cfg.GetACL(); len(a.Rules) != 1 || len(a.Rules[0].Ports) != 2 || a.Default != "deny" || a.DenyPage != "blocked" {
+		t.Fatalf("unexpected acl: %+v", a)
+	}
+	rec := doReq(t, h, "GET", "/acl", nil)
+	var resp struct {
+		Rules []config.ACLRule `json:"rules"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Rules) != 1 || resp.Rules[0].Name != "ads" {
+		t.Fatalf("unexpected response: %s", rec.Body.String())
+	}
+	doReq(t, h, "DELETE", "/acl", map[string]string{"name": "ads"})
+	if len(cfg.GetACL().Rules) != 0 {
+		t.Fatalf("rule not deleted")
+	}
+}
+
+func TestConfigHistoryEndpoints(t *testing.T) {
+	store, err := config.NewStore(filepath.Join(t.TempDir(), "config.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	cfg := &config.Config{}
+	h := New(cfg, store, nil, server.NewDomainStats())
+	doReq(t, h, "POST", "/headers", map[string]string{"name": "A", "value": "1"})
+	req := httptest.NewRequest("POST", "/headers", strings.NewReader(`{"name":"A","value":"2"}`))
+	req = req.WithContext(proxy.WithUser(req.Context(), "alice"))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	rec := doReq(t, h, "GET", "/config/history", nil)
+	var revs []config.Revision
+	json.NewDecoder(rec.Body).Decode(&revs)
+	if len(revs) != 2 || revs[0].Actor != "alice" || revs[1].Actor != "api" {
+		t.Fatalf("unexpected history: %+v", revs)
+	}
+
+	rec = doReq(t, h, "GET", "/config/diff", nil)
+	var diff struct {
+		From, To int
+		Changes  []config.Change
+	}
+	json.NewDecoder(rec.Body).Decode(&diff)
+	if diff.From != 1 || diff.To != 2 || len(diff.Changes) != 1 || diff.Changes[0].New != "2" {
+		t.Fatalf("unexpected diff: %+v", diff)
+	}
+	if rec := doReq(t, h, "GET", "/config/diff?from=1&to=7", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown version, got %d", rec.Code)
+	}
+
+	if rec := doReq(t, h, "POST", "/config/rollback", map[string]int{"version": 1}); rec.Code != http.StatusNoContent {
+		t.Fatalf("rollback failed: %d %s", rec.Code, rec.Body)
+	}
+	if cfg.GetHeaders()["A"] != "1" {
+		t.Fatalf("rollback not applied: %v", cfg.GetHeaders())
+	}
+}
+
+func TestConfigExportImportEndpoints(t *testing.T) {
+	cfg, h := newAPI()
+	cfg.SetHeader("X-Env", "staging")
+	rec := doReq(t, h, "GET", "/config/export", nil)
+	var doc map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&doc); err != nil || doc["format"] != float64(config.ExportFormat) {
+		t.Fatalf("unexpected export: %v %v", doc, err)
+	}
+
+	other, h2 := newAPI()
+	rec = doReq(t, h2, "POST", "/config/import?dry_run=true", doc)
+	var res config.ImportResult
+	json.NewDecoder(rec.Body).Decode(&res)
+	if rec.Code != 200 || !res.DryRun || len(res.Changes) == 0 || len(other.GetHeaders()) != 0 {
+		t.Fatalf("unexpected dry run: %d %+v", rec.Code, res)
+	}
+	if rec := doReq(t, h2, "POST", "/config/import", doc); rec.Code != 200 || other.GetHeaders()["X-Env"] != "staging" {
+		t.Fatalf("import not applied: %d %s", rec.Code, rec.Body)
+	}
+	if rec := doReq(t, h2, "POST", "/config/import", map[string]interface{}{"format": 1, "log_level": "loud"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid document, got %d", rec.Code)
+	}
+
+	// Importing users takes the write scope.
+	secret, err := other.CreateToken("deploy", []string{config.ScopeWriteConfig}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]int{"/config/import?users=true": http.StatusForbidden, "/config/import": http.StatusOK} {
+		body, _ := json.Marshal(doc)
+		req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		rec := httptest.NewRecorder()
+		h2.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("%s with a write:config token: %d, want %d", path, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// heuristicCap bounds the heuristic freshness lifetime derived from
+// Last-Modified.
+const heuristicCap = 24 * time.Hour
+
+// heuristicStatus lists the status codes that are cacheable by default
+// (RFC 9110, section 15.1).
+var heuristicStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// understoodStatus lists the status codes the cache stores at all.
+var understoodStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 302: true, 307: true,
+	308: true, 404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// directives holds parsed Cache-Control directives keyed by lower case name.
+type directives map[string]string
+
+func parseDirectives(h http.Header) directives {
+	d := make(directives)
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, val, _ := strings.Cut(part, "=")
+			d[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(val), `"`)
+		}
+	}
+	return d
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns the delta-seconds value of the named directive.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	v, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// storable reports whether a response to req with the given status and
+// headers may be stored by a shared cache (RFC 9111, section 3). Responses
+// setting cookies are never stored.
+func storable(req *http.Request, status int, h http.Header) bool {
+	if req.Method != http.MethodGet || !understoodStatus[status] {
+		return false
+	}
+	reqCC, respCC := parseDirectives(req.Header), parseDirectives(h)
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if h.Get("Set-Cookie") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	for _, v := range h.Values("Vary") {
+		if strings.TrimSpace(v) == "*" {
+			return false
+		}
+	}
+	if req.Header.Get("Authorization") != "" &&
+		!respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+	_, maxAge := respCC.seconds("max-age")
+	_, sMaxAge := respCC.seconds("s-maxage")
+	return maxAge || sMaxAge || h.Get("Expires") != "" || respCC.has("public") || heuristicStatus[status]
+}
+
+// lifetime returns the freshness lifetime of m (RFC 9111, section 4.2.1).
+func (m *Meta) lifetime() time.Duration {
+	cc := parseDirectives(m.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date := m.date()
+	if v := m.Header.Get("Expires"); v != "" {
+		exp, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return exp.Sub(date)
+	}
+	if !heuristicStatus[m.Status] {
+		return 0
+	}
+	if lm, err := http.ParseTime(m.Header.Get("Last-Modified")); err == nil && lm.Before(date) {
+		if d := date.Sub(lm) / 10; d < heuristicCap {
+			return d
+		}
+		return heuristicCap
+	}
+	return 0
+}
+
+// date returns the Date header of m, falling back to the response time.
+func (m *Meta) date() time.Time {
+	if d, err := http.ParseTime(m.Header.Get("Date")); err == nil {
+		return d
+	}
+	return m.ResponseTime
+}
+
+// age returns the current age of m (RFC 9111, section 4.2.3).
+func (m *Meta) age(now time.Time) time.Duration {
+	apparent := m.ResponseTime.Sub(m.date())
+	if apparent < 0 {
+		apparent = 0
+	}
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(m.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	corrected := ageValue + m.ResponseTime.Sub(m.RequestTime)
+	if apparent > corrected {
+		corrected = apparent
+	}
+	return corrected + now.Sub(m.ResponseTime)
+}
+
+// validators reports whether m can be revalidated with a conditional request.
+func (m *Meta) validators() bool {
+	return m.Header.Get("ETag") != "" || m.Header.Get("Last-Modified") != ""
+}
+
+// hopHeaders are removed before a response is stored.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func storedHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, f := range h.Values("Connection") {
+		for _, name := range strings.Split(f, ",") {
+			out.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		out.Del(name)
+	}
+	return out
+}
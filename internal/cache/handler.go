@@ -0,0 +1,466 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/pod32g/simple-logger"
+)
+
+// Results reported for every GET or HEAD request seen by the cache.
+const (
+	ResultHit         = "hit"
+	ResultMiss        = "miss"
+	ResultRevalidated = "revalidated"
+	ResultStale       = "stale"
+	ResultBypass      = "bypass"
+)
+
+// Handler serves cacheable requests from a Store and passes everything else
+// to the next handler. Stored responses are revalidated with ETag and
+// Last-Modified, served stale within stale-while-revalidate while being
+// refreshed in the background, and invalidated by unsafe requests.
+type Handler struct {
+	// Headers, when set, returns the headers the next handler adds to a
+	// request for its client. Responses may depend on them although the
+	// client did not send them, so they take part in the cache key like
+	// the headers named by Vary, and responses are only shared between
+	// clients getting the same ones.
+	Headers func(*http.Request) map[string]string
+
+	next    http.Handler
+	store   *Store
+	logger  *log.Logger
+	observe func(string)
+
+	inflight sync.Map
+}
+
+// New wraps next with the cache backed by store. The observe function, which
+// may be nil, receives one of the Result constants for each GET or HEAD
+// request.
+func New(next http.Handler, store *Store, logger *log.Logger, observe func(result string)) *Handler {
+	return &Handler{next: next, store: store, logger: logger, observe: observe}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		sw := &statusWriter{ResponseWriter: w}
+		h.next.ServeHTTP(sw, r)
+		if sw.status < 400 {
+			h.invalidate(r, w.Header())
+		}
+		return
+	default:
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	reqCC := parseDirectives(r.Header)
+	if reqCC.has("no-store") || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+		h.report(ResultBypass, r)
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	rawURL := requestURL(r)
+	m, ok := h.store.Get(h.key(rawURL, h.store.Vary(rawURL), r))
+	if !ok {
+		if reqCC.has("only-if-cached") {
+			http.Error(w, "Not cached", http.StatusGatewayTimeout)
+			return
+		}
+		h.fetch(w, r, rawURL, nil)
+		return
+	}
+
+	now := time.Now()
+	age, lifetime := m.age(now), m.lifetime()
+	respCC := parseDirectives(m.Header)
+	noCache := respCC.has("no-cache") || reqCC.has("no-cache") ||
+		(len(reqCC) == 0 && r.Header.Get("Pragma") == "no-cache")
+	fresh := age < lifetime
+	if d, ok := reqCC.seconds("max-age"); ok && age > d {
+		fresh = false
+	}
+	if d, ok := reqCC.seconds("min-fresh"); ok && lifetime-age < d {
+		fresh = false
+	}
+	if fresh && !noCache {
+		h.serve(w, r, m, ResultHit)
+		return
+	}
+	// s-maxage implies proxy-revalidate for shared caches.
+	if !fresh && !noCache && !respCC.has("must-revalidate") && !respCC.has("proxy-revalidate") && !respCC.has("s-maxage") {
+		staleness := age - lifetime
+		if v, ok := reqCC["max-stale"]; ok {
+			if d, ok := reqCC.seconds("max-stale"); v == "" || (ok && staleness <= d) {
+				h.serve(w, r, m, ResultStale)
+				return
+			}
+		}
+		if d, ok := respCC.seconds("stale-while-revalidate"); ok && staleness <= d {
+			h.serve(w, r, m, ResultStale)
+			h.revalidateAsync(r, rawURL, m)
+			return
+		}
+	}
+	if reqCC.has("only-if-cached") {
+		http.Error(w, "Not cached", http.StatusGatewayTimeout)
+		return
+	}
+	h.fetch(w, r, rawURL, m)
+}
+
+// fetch forwards r upstream and answers the client, serving the stored
+// response when a revalidation of stored reports it unchanged.
+func (h *Handler) fetch(w http.ResponseWriter, r *http.Request, rawURL string, stored *Meta) {
+	if h.forward(w, r, rawURL, stored) {
+		h.store.update(stored)
+		h.serve(w, r, stored, ResultRevalidated)
+		return
+	}
+	h.report(ResultMiss, r)
+}
+
+// forward sends r to the next handler, storing the response when allowed.
+// When stored has validators the request is made conditional; a 304 answer
+// is not written to w and forward reports true.
+func (h *Handler) forward(w http.ResponseWriter, r *http.Request, rawURL string, stored *Meta) bool {
+	out := r
+	if stored != nil && stored.validators() {
+		out = r.Clone(r.Context())
+		for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+			out.Header.Del(name)
+		}
+		if etag := stored.Header.Get("ETag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		}
+		if lm := stored.Header.Get("Last-Modified"); lm != "" {
+			out.Header.Set("If-Modified-Since", lm)
+		}
+	} else {
+		stored = nil
+	}
+	cw := &captureWriter{ResponseWriter: w, store: h.store, req: out, url: rawURL, stored: stored, requestTime: time.Now()}
+	cw.key = func(names []string) string { return h.key(rawURL, names, out) }
+	defer func() {
+		if p := recover(); p != nil {
+			cw.abort()
+			panic(p)
+		}
+	}()
+	h.next.ServeHTTP(cw, out)
+	cw.finish()
+	return cw.notModified
+}
+
+// revalidateAsync refreshes m in the background unless a refresh of the same
+// entry is already running.
+func (h *Handler) revalidateAsync(r *http.Request, rawURL string, m *Meta) {
+	if _, busy := h.inflight.LoadOrStore(m.Key, true); busy {
+		return
+	}
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	req.Method = http.MethodGet
+	go func() {
+		defer h.inflight.Delete(m.Key)
+		defer func() {
+			if p := recover(); p != nil && p != http.ErrAbortHandler && h.logger != nil {
+				h.logger.Error("Cache revalidation failed: %v", p)
+			}
+		}()
+		if h.forward(&discardWriter{header: make(http.Header)}, req, rawURL, m) {
+			h.store.update(m)
+		}
+	}()
+}
+
+// serve writes the stored response m to w.
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request, m *Meta, result string) {
+	f, err := h.store.Body(m)
+	if err != nil {
+		h.fetch(w, r, m.URL, nil)
+		return
+	}
+	defer f.Close()
+	hdr := w.Header()
+	for k := range hdr {
+		delete(hdr, k)
+	}
+	for k, v := range m.Header {
+		hdr[k] = append([]string(nil), v...)
+	}
+	hdr.Set("Age", strconv.Itoa(int(m.age(time.Now())/time.Second)))
+	hdr.Set("X-Cache", strings.ToUpper(result))
+	h.report(result, r)
+	if etag := m.Header.Get("ETag"); etag != "" && etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if hdr.Get("Content-Length") == "" && m.Status != http.StatusNoContent {
+		hdr.Set("Content-Length", strconv.FormatInt(m.Size, 10))
+	}
+	w.WriteHeader(m.Status)
+	if r.Method != http.MethodHead {
+		io.Copy(w, f)
+	}
+}
+
+// key returns the key of the response to r for rawURL, whose stored
+// responses vary on the named request headers, including those added by
+// Headers.
+func (h *Handler) key(rawURL string, names []string, r *http.Request) string {
+	if h.Headers == nil {
+		return varyKey(rawURL, names, r.Header)
+	}
+	added := h.Headers(r)
+	if len(added) == 0 {
+		return varyKey(rawURL, names, r.Header)
+	}
+	header := r.Header.Clone()
+	extra := make([]string, 0, len(added))
+	for name, value := range added {
+		header.Set(name, value)
+		extra = append(extra, http.CanonicalHeaderKey(name))
+	}
+	slices.Sort(extra)
+	return varyKey(rawURL, append(slices.Clone(names), extra...), header)
+}
+
+// invalidate removes responses for the target of an unsafe request and the
+// same-host URLs in its Location and Content-Location headers.
+func (h *Handler) invalidate(r *http.Request, respHeader http.Header) {
+	rawURL := requestURL(r)
+	h.store.Purge(rawURL)
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	for _, name := range []string{"Location", "Content-Location"} {
+		v := respHeader.Get(name)
+		if v == "" {
+			continue
+		}
+		if u, err := base.Parse(v); err == nil && u.Host == base.Host {
+			h.store.Purge(u.String())
+		}
+	}
+}
+
+func (h *Handler) report(result string, r *http.Request) {
+	if h.logger != nil {
+		h.logger.Debug("Cache", result, r.Method, sanitizedURL(r))
+	}
+	if h.observe != nil {
+		h.observe(result)
+	}
+}
+
+// requestURL returns the absolute URL of r, which is the primary cache key.
+func requestURL(r *http.Request) string {
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	u.User = nil
+	u.Fragment = ""
+	return u.String()
+}
+
+func sanitizedURL(r *http.Request) string {
+	u := requestURL(r)
+	if i := strings.IndexByte(u, '?'); i >= 0 {
+		return u[:i]
+	}
+	return u
+}
+
+func etagMatch(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	weak := func(s string) string { return strings.TrimPrefix(strings.TrimSpace(s), "W/") }
+	for _, candidate := range strings.Split(header, ",") {
+		if c := strings.TrimSpace(candidate); c == "*" || weak(c) == weak(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// captureWriter forwards a response to the client while copying a storable
+// body into the cache. A 304 answer to a revalidation is held back so the
+// stored response can be served instead.
+type captureWriter struct {
+	http.ResponseWriter
+	store       *Store
+	req         *http.Request
+	url         string
+	key         func(names []string) string
+	stored      *Meta
+	requestTime time.Time
+
+	wroteHeader bool
+	notModified bool
+	meta        *Meta
+	tmp         *os.File
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	now := time.Now()
+	if c.stored != nil && status == http.StatusNotModified {
+		c.notModified = true
+		// Headers of the 304 response update the stored ones (RFC 9111, section 4.3.4).
+		hdr := c.stored.Header.Clone()
+		for k, v := range storedHeader(c.Header()) {
+			hdr[k] = v
+		}
+		c.stored.Header = hdr
+		c.stored.RequestTime = c.requestTime
+		c.stored.ResponseTime = now
+		return
+	}
+	if storable(c.req, status, c.Header()) {
+		names := varyNames(c.Header())
+		c.meta = &Meta{
+			Key:          c.key(names),
+			URL:          c.url,
+			Vary:         names,
+			Status:       status,
+			Header:       storedHeader(c.Header()),
+			RequestTime:  c.requestTime,
+			ResponseTime: now,
+		}
+		if f, err := c.store.tempFile(); err == nil {
+			c.tmp = f
+		}
+	}
+	c.Header().Set("X-Cache", "MISS")
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.notModified {
+		return len(b), nil
+	}
+	if c.tmp != nil {
+		if c.meta.Size+int64(len(b)) > c.store.MaxObjectSize {
+			c.abort()
+		} else if n, err := c.tmp.Write(b); err != nil {
+			c.abort()
+		} else {
+			c.meta.Size += int64(n)
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *captureWriter) Flush() {
+	if c.notModified {
+		return
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (c *captureWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// finish commits the captured body if it is complete.
+func (c *captureWriter) finish() {
+	if c.tmp == nil {
+		return
+	}
+	if cl := c.meta.Header.Get("Content-Length"); cl != "" && cl != strconv.FormatInt(c.meta.Size, 10) {
+		c.abort()
+		return
+	}
+	name := c.tmp.Name()
+	c.tmp.Close()
+	c.tmp = nil
+	c.store.commit(c.meta, name)
+}
+
+func (c *captureWriter) abort() {
+	if c.tmp == nil {
+		return
+	}
+	c.tmp.Close()
+	os.Remove(c.tmp.Name())
+	c.tmp = nil
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type origin struct {
+	calls   atomic.Int32
+	handler http.HandlerFunc
+}
+
+func (o *origin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.calls.Add(1)
+	o.handler(w, r)
+}
+
+func newTestCache(t *testing.T, next http.Handler) (*Handler, *[]string) {
+	s, err := Open(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []string
+	return New(next, s, nil, func(r string) { results = append(results, r) }), &results
+}
+
+func get(h http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCacheHitAndNoStore(t *testing.T) {
+	o := &origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		io.WriteString(w, "body")
+	}}
+	h, results := newTestCache(t, o)
+	for i := 0; i < 3; i++ {
+		if rec := get(h, "http://example.com/a", nil); rec.Body.String() != "body" {
+			t.Fatalf("unexpected body %q", rec.Body.String())
+		}
+	}
+	if o.calls.Load() != 1 {
+		t.Fatalf("expected 1 origin call, got %d", o.calls.Load())
+	}
+	if rec := get(h, "http://example.com/a", nil); rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Age") == "" {
+		t.Fatalf("missing cache headers: %v", rec.Header())
+	}
+	get(h, "http://example.com/private", nil)
+	get(h, "http://example.com/private", nil)
+	if o.calls.Load() != 3 {
+		t.Fatalf("no-store response was cached")
+	}
+	if (*results)[0] != ResultMiss || (*results)[1] != ResultHit {
+		t.Fatalf("unexpected results: %v", *results)
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	o := &origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "versioned")
+	}}
+	h, results := newTestCache(t, o)
+	get(h, "http://example.com/v", nil)
+	rec := get(h, "http://example.com/v", nil)
+	if rec.Code != 200 || rec.Body.String() != "versioned" || rec.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Fatalf("unexpected revalidated response: %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	if (*results)[1] != ResultRevalidated {
+		t.Fatalf("unexpected results: %v", *results)
+	}
+	rec = get(h, "http://example.com/v", http.Header{"If-None-Match": {`"v1"`}})
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching client validator, got %d", rec.Code)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	o := &origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, r.Header.Get("Accept-Language"))
+	}}
+	h, _ := newTestCache(t, o)
+	en := http.Header{"Accept-Language": {"en"}}
+	fr := http.Header{"Accept-Language": {"fr"}}
+	get(h, "http://example.com/", en)
+	if rec := get(h, "http://example.com/", fr); rec.Body.String() != "fr" {
+		t.Fatalf("served wrong variant: %q", rec.Body.String())
+	}
+	if rec := get(h, "http://example.com/", en); rec.Body.String() != "en" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("variant not cached: %q", rec.Body.String())
+	}
+	if o.calls.Load() != 2 {
+		t.Fatalf("expected 2 origin calls, got %d", o.calls.Load())
+	}
+}
+
+func TestCacheInjectedHeaders(t *testing.T) {
+	tenants := map[string]string{"10.0.0.1:1000": "a", "10.0.0.2:1000": "b", "10.0.0.3:1000": "a"}
+	headers := func(r *http.Request) map[string]string {
+		return map[string]string{"X-Tenant": tenants[r.RemoteAddr]}
+	}
+	o := &origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, r.Header.Get("X-Tenant"))
+	}}
+	// The next handler adds the headers of the client, like the proxy does.
+	h, _ := newTestCache(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range headers(r) {
+			r.Header.Set(k, v)
+		}
+		o.ServeHTTP(w, r)
+	}))
+	h.Headers = headers
+	do := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/tenant", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	do("10.0.0.1:1000")
+	if rec := do("10.0.0.2:1000"); rec.Body.String() != "b" {
+		t.Fatalf("served the response of another client: %q", rec.Body.String())
+	}
+	if rec := do("10.0.0.3:1000"); rec.Body.String() != "a" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("response not shared between clients with the same headers: %q %v", rec.Body.String(), rec.Header())
+	}
+	if o.calls.Load() != 2 {
+		t.Fatalf("expected 2 origin calls, got %d", o.calls.Load())
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var version atomic.Int32
+	version.Store(1)
+	o := &origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		w.Header().Set("Date", time.Now().Add(-time.Second).UTC().Format(http.TimeFormat))
+		if version.Load() == 1 {
+			io.WriteString(w, "old")
+		} else {
+			io.WriteString(w, "new")
+		}
+	}}
+	h, _ := newTestCache(t, o)
+	get(h, "http://example.com/swr", nil)
+	version.Store(2)
+	if rec := get(h, "http://example.com/swr", nil); rec.Body.String() != "old" || rec.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("expected stale response, got %q %v", rec.Body.String(), rec.Header())
+	}
+	waitCalls := func(n int32) {
+		deadline := time.Now().Add(2 * time.Second)
+		for o.calls.Load() < n && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		for time.Now().Before(deadline) {
+			if _, busy := h.inflight.Load("http://example.com/swr"); !busy {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitCalls(2)
+	if rec := get(h, "http://example.com/swr", nil); rec.Body.String() != "new" {
+		t.Fatalf("background revalidation did not refresh the entry: %q", rec.Body.String())
+	}
+	waitCalls(3)
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	o := &origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "x")
+	}}
+	h, _ := newTestCache(t, o)
+	get(h, "http://example.com/item", nil)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://example.com/item", nil))
+	get(h, "http://example.com/item", nil)
+	if o.calls.Load() != 3 {
+		t.Fatalf("POST did not invalidate the cached entry")
+	}
+}
@@ -0,0 +1,288 @@
+// Package cache implements a shared HTTP cache following RFC 9111 on top of
+// a size bounded on-disk store with least recently used eviction.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pod32g/proxy/internal/config"
+)
+
+// Meta describes a stored response. It is persisted next to the body so the
+// cache survives restarts.
+type Meta struct {
+	// Key identifies the response, including the values of the request
+	// headers named by Vary.
+	Key string `json:"key"`
+	// URL is the request URL the response was stored for.
+	URL          string      `json:"url"`
+	Vary         []string    `json:"vary,omitempty"`
+	Status       int         `json:"status"`
+	Header       http.Header `json:"header"`
+	Size         int64       `json:"size"`
+	RequestTime  time.Time   `json:"request_time"`
+	ResponseTime time.Time   `json:"response_time"`
+}
+
+// Usage reports the occupancy of a Store.
+type Usage struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	MaxSize int64 `json:"max_size"`
+}
+
+// Store keeps response bodies and metadata in a directory and evicts the
+// least recently used entries once MaxSize bytes are exceeded.
+type Store struct {
+	dir     string
+	maxSize int64
+	// MaxObjectSize is the largest body that is stored. It defaults to an
+	// eighth of the store size.
+	MaxObjectSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	vary    map[string][]string
+}
+
+// Open opens or creates the store in dir, loading previously stored entries.
+func Open(dir string, maxSize int64) (*Store, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("cache size must be positive")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:           dir,
+		maxSize:       maxSize,
+		MaxObjectSize: maxSize / 8,
+		lru:           list.New(),
+		entries:       make(map[string]*list.Element),
+		vary:          make(map[string][]string),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load() error {
+	tmp, _ := filepath.Glob(filepath.Join(s.dir, "tmp-*"))
+	for _, f := range tmp {
+		os.Remove(f)
+	}
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.meta"))
+	if err != nil {
+		return err
+	}
+	var metas []*Meta
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		m := new(Meta)
+		if json.Unmarshal(b, m) != nil || m.Key == "" {
+			os.Remove(f)
+			continue
+		}
+		if _, err := os.Stat(s.bodyPath(m.Key)); err != nil {
+			os.Remove(f)
+			continue
+		}
+		metas = append(metas, m)
+	}
+	// Without access times the most recently stored entries are kept.
+	sort.Slice(metas, func(i, j int) bool { return metas[i].ResponseTime.After(metas[j].ResponseTime) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range metas {
+		s.entries[m.Key] = s.lru.PushBack(m)
+		s.size += m.Size
+		s.vary[m.URL] = m.Vary
+	}
+	s.evictLocked()
+	return nil
+}
+
+func (s *Store) fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Store) bodyPath(key string) string {
+	return filepath.Join(s.dir, s.fileName(key)+".body")
+}
+
+func (s *Store) metaPath(key string) string {
+	return filepath.Join(s.dir, s.fileName(key)+".meta")
+}
+
+// Vary returns the request header names the stored responses for rawURL
+// vary on.
+func (s *Store) Vary(rawURL string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.vary[rawURL]
+}
+
+// Get returns the metadata stored under key and marks it as recently used.
+func (s *Store) Get(key string) (*Meta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	m := *el.Value.(*Meta)
+	m.Header = m.Header.Clone()
+	return &m, true
+}
+
+// Body opens the stored body of m.
+func (s *Store) Body(m *Meta) (*os.File, error) {
+	return os.Open(s.bodyPath(m.Key))
+}
+
+// tempFile creates a file that receives a body before it is committed.
+func (s *Store) tempFile() (*os.File, error) {
+	return os.CreateTemp(s.dir, "tmp-*")
+}
+
+// commit moves the body written to tmpPath into the store under m.Key,
+// replacing any previous entry, and evicts entries as needed.
+func (s *Store) commit(m *Meta, tmpPath string) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(tmpPath, s.bodyPath(m.Key)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.WriteFile(s.metaPath(m.Key), b, 0600); err != nil {
+		os.Remove(s.bodyPath(m.Key))
+		return err
+	}
+	if el, ok := s.entries[m.Key]; ok {
+		s.size -= el.Value.(*Meta).Size
+		s.lru.Remove(el)
+	}
+	s.entries[m.Key] = s.lru.PushFront(m)
+	s.size += m.Size
+	s.vary[m.URL] = m.Vary
+	s.evictLocked()
+	return nil
+}
+
+// update replaces the stored headers and timings of the entry under m.Key,
+// as done after a successful revalidation.
+func (s *Store) update(m *Meta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[m.Key]
+	if !ok {
+		return nil
+	}
+	stored := el.Value.(*Meta)
+	stored.Header = m.Header.Clone()
+	stored.RequestTime = m.RequestTime
+	stored.ResponseTime = m.ResponseTime
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.metaPath(m.Key), b, 0600)
+}
+
+func (s *Store) evictLocked() {
+	for s.size > s.maxSize {
+		el := s.lru.Back()
+		if el == nil {
+			return
+		}
+		s.removeLocked(el)
+	}
+}
+
+func (s *Store) removeLocked(el *list.Element) {
+	m := el.Value.(*Meta)
+	s.lru.Remove(el)
+	delete(s.entries, m.Key)
+	s.size -= m.Size
+	os.Remove(s.metaPath(m.Key))
+	os.Remove(s.bodyPath(m.Key))
+}
+
+// Purge removes every stored response for rawURL and returns how many were
+// removed.
+func (s *Store) Purge(rawURL string) int {
+	return s.purge(func(m *Meta) bool { return m.URL == rawURL })
+}
+
+// PurgeHost removes every stored response whose host matches pattern, as
+// accepted by config.MatchHost, and returns how many were removed.
+func (s *Store) PurgeHost(pattern string) int {
+	return s.purge(func(m *Meta) bool {
+		u, err := url.Parse(m.URL)
+		return err == nil && config.MatchHost(pattern, u.Host)
+	})
+}
+
+func (s *Store) purge(match func(*Meta) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for el := s.lru.Front(); el != nil; {
+		next := el.Next()
+		if m := el.Value.(*Meta); match(m) {
+			delete(s.vary, m.URL)
+			s.removeLocked(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// Usage returns the number of entries and bytes stored.
+func (s *Store) Usage() Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Usage{Entries: len(s.entries), Size: s.size, MaxSize: s.maxSize}
+}
+
+// varyKey builds the key for rawURL from the values of the named request headers.
+func varyKey(rawURL string, names []string, h http.Header) string {
+	if len(names) == 0 {
+		return rawURL
+	}
+	var b strings.Builder
+	b.WriteString(rawURL)
+	for _, name := range names {
+		b.WriteString("\n")
+		b.WriteString(name)
+		b.WriteString(":")
+		b.WriteString(strings.Join(h.Values(name), ","))
+	}
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func put(t *testing.T, s *Store, rawURL, body string) {
+	t.Helper()
+	f, err := s.tempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(body)
+	f.Close()
+	m := &Meta{Key: rawURL, URL: rawURL, Status: 200, Header: http.Header{}, Size: int64(len(body)), ResponseTime: time.Now()}
+	if err := s.commit(m, f.Name()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreEvictionAndReload(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxObjectSize = 10
+	put(t, s, "http://a/1", "aaaa")
+	put(t, s, "http://a/2", "bbbb")
+	s.Get("http://a/1")
+	put(t, s, "http://b/3", "cccc")
+	if _, ok := s.Get("http://a/2"); ok {
+		t.Fatalf("least recently used entry not evicted")
+	}
+	if u := s.Usage(); u.Entries != 2 || u.Size != 8 {
+		t.Fatalf("unexpected usage: %+v", u)
+	}
+
+	reopened, err := Open(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := reopened.Get("http://a/1")
+	if !ok {
+		t.Fatalf("entry lost after reopening")
+	}
+	f, err := reopened.Body(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if n := reopened.PurgeHost("b"); n != 1 {
+		t.Fatalf("expected 1 purged entry, got %d", n)
+	}
+	if n := reopened.Purge("http://a/1"); n != 1 {
+		t.Fatalf("expected 1 purged entry, got %d", n)
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 0 {
+		t.Fatalf("purged files left behind: %d", len(files))
+	}
+}
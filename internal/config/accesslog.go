@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Access log formats.
+const (
+	LogFormatCommon   = "common"
+	LogFormatCombined = "combined"
+	LogFormatJSON     = "json"
+	LogFormatTemplate = "template"
+)
+
+// Access log sinks.
+const (
+	LogSinkStdout = "stdout"
+	LogSinkFile   = "file"
+	LogSinkSyslog = "syslog"
+)
+
+// AccessLogFields lists the fields of an access log record, as named in JSON
+// records and template placeholders.
+var AccessLogFields = []string{
+	"time", "listener", "client", "user", "method", "url", "host", "proto",
+	"status", "bytes_in", "bytes_out", "upstream", "duration_ms", "cache",
+	"error", "referer", "user_agent",
+}
+
+// AccessLog configures the access log, which records every request and
+// tunnel handled by the HTTP listeners.
+//
+// Format is the Common or Combined Log Format (the default), JSON lines or
+// Template, in which each {field} placeholder is replaced by a field of
+// AccessLogFields. Sink is standard output (the default), File, rotated once
+// it reaches MaxSize megabytes or is older than MaxAge and keeping
+// MaxBackups rotated files (all of them when zero), or the local syslog
+// daemon listening on the Unix socket Syslog, by default the system one.
+type AccessLog struct {
+	Enabled    bool     `json:"enabled"`
+	Format     string   `json:"format"`
+	Template   string   `json:"template,omitempty"`
+	Sink       string   `json:"sink"`
+	File       string   `json:"file,omitempty"`
+	MaxSize    int64    `json:"max_size_mb,omitempty"`
+	MaxAge     Duration `json:"max_age,omitempty"`
+	MaxBackups int      `json:"max_backups,omitempty"`
+	Syslog     string   `json:"syslog,omitempty"`
+}
+
+var placeholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// Validate checks the format and sink of the access log.
+func (a AccessLog) Validate() error {
+	switch a.Format {
+	case "", LogFormatCommon, LogFormatCombined, LogFormatJSON:
+	case LogFormatTemplate:
+		if a.Template == "" {
+			return fmt.Errorf("access log: empty template")
+		}
+		for _, m := range placeholder.FindAllStringSubmatch(a.Template, -1) {
+			if !knownField(m[1]) {
+				return fmt.Errorf("access log: unknown template field %q", m[1])
+			}
+		}
+	default:
+		return fmt.Errorf("access log: unknown format %q", a.Format)
+	}
+	switch a.Sink {
+	case "", LogSinkStdout, LogSinkSyslog:
+	case LogSinkFile:
+		if a.File == "" {
+			return fmt.Errorf("access log: file sink requires a file")
+		}
+	default:
+		return fmt.Errorf("access log: unknown sink %q", a.Sink)
+	}
+	if a.MaxSize < 0 || a.MaxAge < 0 || a.MaxBackups < 0 {
+		return fmt.Errorf("access log: negative rotation limit")
+	}
+	return nil
+}
+
+func knownField(name string) bool {
+	for _, f := range AccessLogFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAccessLog replaces the access log settings.
+func (c *Config) SetAccessLog(a AccessLog) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.AccessLog = a
+	return nil
+}
+
+// GetAccessLog returns the access log settings.
+func (c *Config) GetAccessLog() AccessLog {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.AccessLog
+}
@@ -0,0 +1,205 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// ACL actions.
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// ACLDefaultRule is the name under which decisions taken by the default
+// action are counted.
+const ACLDefaultRule = "default"
+
+// ACLRule allows or denies forward proxy requests. Empty match fields match
+// everything and a request must match every non-empty field.
+//
+// Hosts lists destination host patterns as accepted by MatchHost: an exact
+// host, ".example.com" for a domain and its subdomains or "*.example.com"
+// for subdomains only. HostRegex must match the whole host, without its
+// port. Ports lists destination ports, Clients client IPs or CIDR ranges,
+// Users the authenticated users and Methods the request methods, CONNECT
+// included.
+type ACLRule struct {
+	Name      string   `json:"name"`
+	Action    string   `json:"action"`
+	Hosts     []string `json:"hosts,omitempty"`
+	HostRegex string   `json:"host_regex,omitempty"`
+	Ports     []int    `json:"ports,omitempty"`
+	Clients   []string `json:"clients,omitempty"`
+	Users     []string `json:"users,omitempty"`
+	Methods   []string `json:"methods,omitempty"`
+}
+
+// Validate checks the rule's action and match fields.
+func (r ACLRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("acl rule name is required")
+	}
+	if r.Name == ACLDefaultRule {
+		return fmt.Errorf("acl rule name %q is reserved", ACLDefaultRule)
+	}
+	if r.Action != ACLAllow && r.Action != ACLDeny {
+		return fmt.Errorf("acl rule %s: invalid action %q", r.Name, r.Action)
+	}
+	for _, h := range r.Hosts {
+		if strings.TrimSpace(h) == "" {
+			return fmt.Errorf("acl rule %s: empty host pattern", r.Name)
+		}
+	}
+	if r.HostRegex != "" {
+		if _, err := regexp.Compile(r.HostRegex); err != nil {
+			return fmt.Errorf("acl rule %s: %v", r.Name, err)
+		}
+	}
+	for _, p := range r.Ports {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("acl rule %s: invalid port %d", r.Name, p)
+		}
+	}
+	for _, c := range r.Clients {
+		if _, err := ParseClientNet(c); err != nil {
+			return fmt.Errorf("acl rule %s: %v", r.Name, err)
+		}
+	}
+	for _, m := range r.Methods {
+		if m == "" || strings.ToUpper(m) != m {
+			return fmt.Errorf("acl rule %s: invalid method %q", r.Name, m)
+		}
+	}
+	return nil
+}
+
+func (r ACLRule) clone() ACLRule {
+	r.Hosts = append([]string(nil), r.Hosts...)
+	r.Ports = append([]int(nil), r.Ports...)
+	r.Clients = append([]string(nil), r.Clients...)
+	r.Users = append([]string(nil), r.Users...)
+	r.Methods = append([]string(nil), r.Methods...)
+	return r
+}
+
+// ParseClientNet parses a client IP or CIDR range. A plain IP is returned as
+// a single address network.
+func ParseClientNet(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client address %q", s)
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// AccessControl is the access control list of the forward proxy. Rules are
+// evaluated in order and the first match decides; Default applies otherwise
+// and allows requests when empty. DenyPage is the HTML body of 403 responses
+// to denied requests, in which {host}, {rule} and {client} are replaced.
+type AccessControl struct {
+	Default  string    `json:"default"`
+	DenyPage string    `json:"deny_page,omitempty"`
+	Rules    []ACLRule `json:"rules"`
+}
+
+// Validate checks the default action and every rule.
+func (a AccessControl) Validate() error {
+	if a.Default != "" && a.Default != ACLAllow && a.Default != ACLDeny {
+		return fmt.Errorf("invalid default action %q", a.Default)
+	}
+	names := make(map[string]bool, len(a.Rules))
+	for _, r := range a.Rules {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate acl rule %s", r.Name)
+		}
+		names[r.Name] = true
+	}
+	return nil
+}
+
+func (a AccessControl) clone() AccessControl {
+	rules := make([]ACLRule, 0, len(a.Rules))
+	for _, r := range a.Rules {
+		rules = append(rules, r.clone())
+	}
+	a.Rules = rules
+	return a
+}
+
+// SetACL replaces the access control list.
+func (c *Config) SetACL(a AccessControl) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	defer c.accessChanged()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ACL = a.clone()
+	return nil
+}
+
+// GetACL returns a copy of the access control list.
+func (c *Config) GetACL() AccessControl {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ACL.clone()
+}
+
+// SetACLPolicy sets the default action and the deny page.
+func (c *Config) SetACLPolicy(def, denyPage string) error {
+	if err := (AccessControl{Default: def}).Validate(); err != nil {
+		return err
+	}
+	defer c.accessChanged()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ACL.Default = def
+	c.ACL.DenyPage = denyPage
+	return nil
+}
+
+// SetACLRule adds a rule at the end of the list or replaces the rule with
+// the same name in place.
+func (c *Config) SetACLRule(r ACLRule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	defer c.accessChanged()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, existing := range c.ACL.Rules {
+		if existing.Name == r.Name {
+			c.ACL.Rules[i] = r.clone()
+			return nil
+		}
+	}
+	c.ACL.Rules = append(c.ACL.Rules, r.clone())
+	return nil
+}
+
+// DeleteACLRule removes the named rule.
+func (c *Config) DeleteACLRule(name string) {
+	defer c.accessChanged()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.ACL.Rules[:0]
+	for _, r := range c.ACL.Rules {
+		if r.Name != name {
+			out = append(out, r)
+		}
+	}
+	c.ACL.Rules = out
+}
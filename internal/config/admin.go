@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AdminListener is an optional address serving only the admin UI, API and
+// metrics, apart from the proxied traffic.
+//
+// Addr is a TCP address or "unix:" followed by the path of a Unix socket.
+// TLS is enabled when both CertFile and KeyFile are set, and ClientCAFile
+// additionally requires client certificates signed by one of its CAs. The
+// users with the viewer or admin role authenticate on it whenever users
+// exist, whether or not authentication is enabled for the proxy, unless
+// NoAuth is set. Separate stops the proxy listeners from serving the admin
+// paths, so that they reach the backends or origins like any other path.
+type AdminListener struct {
+	Addr         string
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	NoAuth       bool
+	Separate     bool
+}
+
+// UnixSocket returns the socket path of a Unix socket address.
+func (a AdminListener) UnixSocket() (string, bool) {
+	return strings.CutPrefix(a.Addr, "unix:")
+}
+
+// Validate checks the TLS settings of the admin listener.
+func (a AdminListener) Validate() error {
+	if a.Addr == "" {
+		if a.CertFile != "" || a.KeyFile != "" || a.ClientCAFile != "" {
+			return fmt.Errorf("admin listener: TLS settings require an address")
+		}
+		return nil
+	}
+	if path, ok := a.UnixSocket(); ok && path == "" {
+		return fmt.Errorf("admin listener: empty socket path")
+	}
+	if (a.CertFile == "") != (a.KeyFile == "") {
+		return fmt.Errorf("admin listener: both cert and key are required for TLS")
+	}
+	if a.ClientCAFile != "" && a.CertFile == "" {
+		return fmt.Errorf("admin listener: client certificates require TLS")
+	}
+	return nil
+}
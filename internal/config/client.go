@@ -0,0 +1,242 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Kinds of client selectors, from the lowest to the highest precedence.
+const (
+	SelectCIDR   = "cidr"
+	SelectIP     = "ip"
+	SelectHeader = "header"
+	SelectUser   = "user"
+)
+
+// Selector identifies the clients per-client headers apply to. It is written
+// as an IP address ("192.0.2.7"), a CIDR range ("10.0.0.0/8"), an
+// authenticated user ("user:alice") or a request header value
+// ("header:X-Client-Id=kiosk"). An IP written with a port is accepted and
+// the port ignored.
+type Selector struct {
+	Kind   string
+	Value  string
+	Header string
+	Net    *net.IPNet
+}
+
+// ParseSelector parses a client selector.
+func ParseSelector(s string) (Selector, error) {
+	s = strings.TrimSpace(s)
+	if user, ok := strings.CutPrefix(s, "user:"); ok {
+		if user == "" {
+			return Selector{}, fmt.Errorf("empty user in selector %q", s)
+		}
+		return Selector{Kind: SelectUser, Value: user}, nil
+	}
+	if rest, ok := strings.CutPrefix(s, "header:"); ok {
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return Selector{}, fmt.Errorf("header selector %q must be header:Name=value", s)
+		}
+		return Selector{Kind: SelectHeader, Header: http.CanonicalHeaderKey(strings.TrimSpace(name)), Value: value}, nil
+	}
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return Selector{}, fmt.Errorf("invalid client selector %q", s)
+		}
+		return Selector{Kind: SelectCIDR, Net: n}, nil
+	}
+	host := s
+	if h, _, err := net.SplitHostPort(s); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return Selector{}, fmt.Errorf("invalid client selector %q", s)
+	}
+	return Selector{Kind: SelectIP, Value: ip.String()}, nil
+}
+
+// String returns the canonical form of the selector.
+func (s Selector) String() string {
+	switch s.Kind {
+	case SelectUser:
+		return "user:" + s.Value
+	case SelectHeader:
+		return "header:" + s.Header + "=" + s.Value
+	case SelectCIDR:
+		return s.Net.String()
+	default:
+		return s.Value
+	}
+}
+
+// rank orders selectors by precedence. Narrower CIDR ranges rank above wider
+// ones.
+func (s Selector) rank() int {
+	switch s.Kind {
+	case SelectUser:
+		return 300
+	case SelectHeader:
+		return 200
+	case SelectIP:
+		return 129
+	default:
+		ones, _ := s.Net.Mask.Size()
+		return ones
+	}
+}
+
+// Match reports whether the selector applies to the client.
+func (s Selector) Match(c ClientInfo) bool {
+	switch s.Kind {
+	case SelectUser:
+		return c.User != "" && c.User == s.Value
+	case SelectHeader:
+		if c.Header == nil {
+			return false
+		}
+		for _, v := range c.Header.Values(s.Header) {
+			if strings.TrimSpace(v) == s.Value {
+				return true
+			}
+		}
+		return false
+	case SelectCIDR:
+		return c.IP != nil && s.Net.Contains(c.IP)
+	default:
+		return c.IP != nil && c.IP.String() == s.Value
+	}
+}
+
+// ClientInfo describes the client of a request for selector matching. IP is
+// the client address, taken from X-Forwarded-For when the request came
+// through a trusted proxy. Header is only set for requests from trusted
+// proxies, so header selectors cannot be spoofed by other clients.
+type ClientInfo struct {
+	IP     net.IP
+	User   string
+	Header http.Header
+}
+
+// SetTrustedProxies replaces the addresses or CIDR ranges of the proxies
+// whose X-Forwarded-For and selector headers are trusted.
+func (c *Config) SetTrustedProxies(proxies []string) error {
+	for _, p := range proxies {
+		if _, err := ParseClientNet(p); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.TrustedProxies = append([]string(nil), proxies...)
+	return nil
+}
+
+// GetTrustedProxies returns a copy of the trusted proxy list.
+func (c *Config) GetTrustedProxies() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.TrustedProxies...)
+}
+
+// IdentifyClient describes the client of a request received from remoteAddr
+// with the given authenticated user and headers. When the peer is a trusted
+// proxy the client address is the last X-Forwarded-For entry that is not
+// itself a trusted proxy.
+func (c *Config) IdentifyClient(remoteAddr, user string, header http.Header) ClientInfo {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	info := ClientInfo{IP: net.ParseIP(host), User: user}
+	var trusted []*net.IPNet
+	for _, p := range c.GetTrustedProxies() {
+		if n, err := ParseClientNet(p); err == nil {
+			trusted = append(trusted, n)
+		}
+	}
+	isTrusted := func(ip net.IP) bool {
+		for _, n := range trusted {
+			if ip != nil && n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if !isTrusted(info.IP) {
+		return info
+	}
+	info.Header = header
+	var hops []string
+	for _, v := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
+		}
+		info.IP = ip
+		if !isTrusted(ip) {
+			break
+		}
+	}
+	return info
+}
+
+// HeadersForClient returns the global headers merged with the headers of
+// every selector matching the client, and the selector with the highest
+// precedence among them, or "" if none matched. Headers of higher precedence
+// selectors override lower ones: user, then header, then IP, then CIDR ranges
+// from the narrowest to the widest.
+func (c *Config) HeadersForClient(client ClientInfo) (map[string]string, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	type match struct {
+		sel  Selector
+		key  string
+		hdrs map[string]string
+	}
+	var matches []match
+	for key, hdrs := range c.ClientHeaders {
+		sel, err := ParseSelector(key)
+		if err != nil || !sel.Match(client) {
+			continue
+		}
+		matches = append(matches, match{sel, key, hdrs})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if ri, rj := matches[i].sel.rank(), matches[j].sel.rank(); ri != rj {
+			return ri < rj
+		}
+		return matches[i].key < matches[j].key
+	})
+	out := make(map[string]string, len(c.Headers)+2)
+	for k, v := range c.Headers {
+		out[k] = v
+	}
+	selected := ""
+	for _, m := range matches {
+		for k, v := range m.hdrs {
+			out[k] = v
+		}
+		selected = m.sel.String()
+	}
+	if c.ProxyName != "" {
+		out["X-Proxy-Name"] = c.ProxyName
+	}
+	if c.ProxyID != "" {
+		out["X-Proxy-Id"] = c.ProxyID
+	}
+	return out, selected
+}
@@ -17,7 +17,22 @@ type Config struct {
 	HTTPSAddr string
 	CertFile  string
 	KeyFile   string
+	// SOCKSAddr is the listen address of the optional SOCKS5 listener.
+	SOCKSAddr string
+	// Listeners replaces HTTPAddr, HTTPSAddr and SOCKSAddr when not empty.
+	Listeners []Listener
+	// Timeouts are the timeouts of the HTTP listeners that do not set their
+	// own, including the admin listener.
+	Timeouts ServerTimeouts
+	// Admin optionally serves the UI, API and metrics on their own address.
+	Admin AdminListener
+	// CacheDir enables the shared HTTP cache stored in this directory.
+	CacheDir string
+	// CacheSize is the maximum size of the cache in bytes.
+	CacheSize int64
 
+	// Username and Password are the credentials given with flags, turned
+	// into an admin user by BootstrapAdmin.
 	Username     string
 	Password     string
 	AuthEnabled  bool
@@ -29,10 +44,70 @@ type Config struct {
 
 	LogLevel log.LogLevel
 
-	Headers       map[string]string
+	Headers map[string]string
+	// ClientHeaders maps client selectors (see ParseSelector) to headers
+	// added to the requests of matching clients.
 	ClientHeaders map[string]map[string]string
+	// TrustedProxies lists the addresses or CIDR ranges of proxies whose
+	// X-Forwarded-For and selector headers identify clients.
+	TrustedProxies []string
+	// Forwarding configures the Via and X-Forwarded-For headers added in
+	// forward mode.
+	Forwarding Forwarding
+	// AccessLog configures the access log of the HTTP listeners.
+	AccessLog AccessLog
+	// Tunnels bounds the lifetime of CONNECT tunnels in forward mode.
+	Tunnels TunnelTimeouts
+
+	// MITMEnabled turns on TLS interception of CONNECT tunnels in forward mode.
+	MITMEnabled bool
+	MITMCACert  string
+	MITMCAKey   string
+	// MITMBypass lists host patterns whose tunnels are never intercepted.
+	MITMBypass []string
+
+	// Parents configures chaining through upstream proxies in forward mode.
+	Parents ParentProxies
+	// Pool holds the load balanced targets used in reverse mode.
+	Pool UpstreamPool
+	// Health configures health checking of the Pool targets.
+	Health HealthCheck
+	// Routes send matching reverse proxy requests to dedicated targets
+	// before the Pool is consulted.
+	Routes []Route
+	// RateLimits are applied to every proxied request.
+	RateLimits []RateLimit
+	// ACL allows or denies forward proxy requests.
+	ACL AccessControl
+	// Users authenticate clients of the proxy, the UI and the API.
+	Users []User
+	// Tokens authenticate automation against the API.
+	Tokens []Token
 
 	mu sync.RWMutex
+	// accessHooks are called by accessChanged.
+	accessHooks []func()
+}
+
+// OnAccessChange registers fn to be called after the users, whether
+// authentication is enabled or the access control list may have changed,
+// such as to close the connections of revoked users. fn is called without
+// the lock held, before the change returns.
+func (c *Config) OnAccessChange(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.accessHooks = append(c.accessHooks, fn)
+}
+
+// accessChanged calls the functions registered with OnAccessChange. c.mu
+// must not be held.
+func (c *Config) accessChanged() {
+	c.mu.RLock()
+	hooks := c.accessHooks
+	c.mu.RUnlock()
+	for _, fn := range hooks {
+		fn()
+	}
 }
 
 // SetHeader adds or updates a header in the config in a thread-safe manner.
@@ -70,7 +145,9 @@ func (c *Config) DeleteClientHeader(client, name string) {
 	}
 }
 
-// GetHeadersForClient returns headers combining global and client-specific ones.
+// GetHeadersForClient returns headers combining global ones and those set
+// for the client selector client. It does not resolve overlapping selectors;
+// use HeadersForClient to match a request's client.
 func (c *Config) GetHeadersForClient(client string) map[string]string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -175,19 +252,6 @@ func LevelString(level log.LogLevel) string {
 	}
 }
 
-// SetAuth updates the authentication settings. Empty username or password are ignored.
-func (c *Config) SetAuth(enabled bool, username, password string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.AuthEnabled = enabled
-	if username != "" {
-		c.Username = username
-	}
-	if password != "" {
-		c.Password = password
-	}
-}
-
 // SetStatsEnabled enables or disables statistics collection.
 func (c *Config) SetStatsEnabled(enabled bool) {
 	c.mu.Lock()
@@ -221,9 +285,36 @@ func (c *Config) StatsEnabledState() bool {
 	return c.StatsEnabled
 }
 
-// GetAuth returns the current authentication settings.
-func (c *Config) GetAuth() (bool, string, string) {
+// SetMITM updates the TLS interception settings.
+func (c *Config) SetMITM(enabled bool, bypass []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MITMEnabled = enabled
+	c.MITMBypass = append([]string(nil), bypass...)
+}
+
+// GetMITM returns whether TLS interception is enabled and the bypass list.
+func (c *Config) GetMITM() (bool, []string) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.AuthEnabled, c.Username, c.Password
+	return c.MITMEnabled, append([]string(nil), c.MITMBypass...)
+}
+
+// MITMEnabledState returns whether TLS interception is enabled.
+func (c *Config) MITMEnabledState() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.MITMEnabled
+}
+
+// MITMBypassed reports whether tunnels to host must not be intercepted.
+func (c *Config) MITMBypassed(host string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, p := range c.MITMBypass {
+		if MatchHost(p, host) {
+			return true
+		}
+	}
+	return false
 }
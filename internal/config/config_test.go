@@ -1,9 +1,16 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	log "github.com/pod32g/simple-logger"
+	"net"
+	"net/http"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestHeaderManagement(t *testing.T) {
@@ -49,9 +56,11 @@ func TestLogLevelParseAndString(t *testing.T) {
 
 func TestAuthIdentityStats(t *testing.T) {
 	cfg := &Config{}
-	cfg.SetAuth(true, "user", "pass")
-	if e, u, p := cfg.GetAuth(); !e || u != "user" || p != "pass" {
-		t.Fatalf("unexpected auth: %v %s %s", e, u, p)
+	if err := cfg.SetAuth(true, "user", "pass"); err != nil || !cfg.AuthRequired() {
+		t.Fatalf("unexpected auth: %v", err)
+	}
+	if role, ok := cfg.Authenticate("user", "pass"); !ok || role != RoleAdmin {
+		t.Fatalf("unexpected authentication: %s %v", role, ok)
 	}
 	cfg.SetIdentity("name", "id")
 	n, id := cfg.GetIdentity()
@@ -63,3 +72,543 @@ func TestAuthIdentityStats(t *testing.T) {
 		t.Fatalf("stats not enabled")
 	}
 }
+
+func TestUsers(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.SetUser("ann", "root", "pw"); err == nil {
+		t.Fatalf("expected error for unknown role")
+	}
+	if err := cfg.SetUser("ann", RoleViewer, ""); err == nil {
+		t.Fatalf("expected error for a new user without password")
+	}
+	cfg.SetUser("ann", RoleAdmin, "pw")
+	cfg.SetUser("bob", RoleProxyUser, "pw2")
+	if u := cfg.GetUsers(); len(u) != 2 || u[0].PasswordHash == "pw" {
+		t.Fatalf("unexpected users: %+v", u)
+	}
+	if _, ok := cfg.Authenticate("bob", "pw"); ok {
+		t.Fatalf("wrong password accepted")
+	}
+	if role, ok := cfg.Authenticate("bob", "pw2"); !ok || role != RoleProxyUser {
+		t.Fatalf("unexpected role %s %v", role, ok)
+	}
+	if err := cfg.SetUser("ann", RoleViewer, ""); err == nil {
+		t.Fatalf("expected error demoting the last admin")
+	}
+	cfg.SetAuth(true, "", "")
+	if err := cfg.DeleteUser("ann"); err == nil {
+		t.Fatalf("expected error deleting the last admin")
+	}
+	cfg.DeleteUser("bob")
+	if len(cfg.GetUsers()) != 1 {
+		t.Fatalf("user not deleted")
+	}
+	if !RoleAllows(RoleAdmin, RoleViewer) || RoleAllows(RoleViewer, RoleAdmin) || RoleAllows("", RoleProxyUser) {
+		t.Fatalf("unexpected role hierarchy")
+	}
+
+	legacy := &Config{Username: "old", Password: "secret"}
+	if err := legacy.BootstrapAdmin(); err != nil || legacy.Password != "" {
+		t.Fatalf("bootstrap failed: %v", err)
+	}
+	if role, ok := legacy.Authenticate("old", "secret"); !ok || role != RoleAdmin {
+		t.Fatalf("bootstrap admin not created")
+	}
+}
+
+func TestVerifiedCache(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyPassword(string(hash), "pw") || verifyPassword(string(hash), "nope") {
+		t.Fatal("password not verified")
+	}
+	key := verifiedKey(string(hash), "pw")
+	if key == sha256.Sum256([]byte(string(hash)+"\x00pw")) {
+		t.Fatal("cache keyed by a plain hash of the password")
+	}
+	for i := 0; i < maxVerified-1; i++ {
+		rememberVerified(sha256.Sum256([]byte{byte(i), byte(i >> 8)}))
+	}
+	// Using the pair keeps it over the older entries.
+	verifyPassword(string(hash), "pw")
+	rememberVerified(sha256.Sum256([]byte("newest")))
+	verified.Lock()
+	defer verified.Unlock()
+	if _, ok := verified.m[key]; !ok || len(verified.m) != maxVerified || verified.lru.Len() != maxVerified {
+		t.Fatalf("recently used pair evicted or cache cleared: %d entries", len(verified.m))
+	}
+}
+
+func TestOnAccessChange(t *testing.T) {
+	cfg := &Config{}
+	var calls int
+	var bobAuthenticates bool
+	cfg.OnAccessChange(func() {
+		calls++
+		// The hook sees the change and may read the configuration.
+		_, bobAuthenticates = cfg.Authenticate("bob", "pw")
+	})
+	cfg.SetUser("ann", RoleAdmin, "pw")
+	cfg.SetUser("bob", RoleProxyUser, "pw")
+	if calls != 2 || !bobAuthenticates {
+		t.Fatalf("hook not called for new users: %d %v", calls, bobAuthenticates)
+	}
+	cfg.DeleteUser("bob")
+	if calls != 3 || bobAuthenticates {
+		t.Fatalf("hook not called for a deleted user: %d %v", calls, bobAuthenticates)
+	}
+	cfg.SetAuth(true, "", "")
+	cfg.SetACLRule(ACLRule{Name: "deny", Action: ACLDeny, Hosts: []string{"example.com"}})
+	cfg.DeleteACLRule("deny")
+	cfg.Restore(cfg.Snapshot(), true)
+	if calls != 7 {
+		t.Fatalf("expected 7 calls, got %d", calls)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	cfg := &Config{}
+	if _, err := cfg.CreateToken("ci", []string{"delete:all"}, 0); err == nil {
+		t.Fatalf("expected error for unknown scope")
+	}
+	secret, err := cfg.CreateToken("ci", []string{ScopeRead, ScopeWriteHeaders}, 0)
+	if err != nil || !strings.HasPrefix(secret, tokenPrefix) {
+		t.Fatalf("unexpected token %q: %v", secret, err)
+	}
+	if tok := cfg.GetTokens()[0]; tok.Hash == secret || strings.Contains(tok.Hash, secret) {
+		t.Fatalf("token secret stored")
+	}
+	tok, ok := cfg.AuthenticateToken(secret)
+	if !ok || tok.Name != "ci" || tok.LastUsed.IsZero() {
+		t.Fatalf("token not authenticated: %+v", tok)
+	}
+	if !tok.Allows(ScopeWriteHeaders) || tok.Allows(ScopeWriteAuth) {
+		t.Fatalf("unexpected scopes: %+v", tok.Scopes)
+	}
+	if !(Token{Scopes: []string{ScopeWrite}}).Allows(ScopeWriteAuth) || (Token{Scopes: []string{ScopeWrite}}).Allows(ScopeRead) {
+		t.Fatalf("write scope should grant every write scope only")
+	}
+	if _, ok := cfg.AuthenticateToken(secret + "x"); ok {
+		t.Fatalf("wrong token accepted")
+	}
+
+	expired, _ := cfg.CreateToken("old", []string{ScopeRead}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, ok := cfg.AuthenticateToken(expired); ok {
+		t.Fatalf("expired token accepted")
+	}
+	rotated, _ := cfg.CreateToken("ci", []string{ScopeRead}, 0)
+	if _, ok := cfg.AuthenticateToken(secret); ok {
+		t.Fatalf("replaced token still accepted")
+	}
+	cfg.DeleteToken("ci")
+	if _, ok := cfg.AuthenticateToken(rotated); ok || len(cfg.GetTokens()) != 1 {
+		t.Fatalf("revoked token still accepted")
+	}
+}
+
+func TestMITMBypass(t *testing.T) {
+	cfg := &Config{}
+	cfg.SetMITM(true, []string{"*.bank.example", "pinned.example.org"})
+	if !cfg.MITMEnabledState() {
+		t.Fatalf("interception not enabled")
+	}
+	cases := map[string]bool{
+		"www.bank.example":       true,
+		"bank.example":           false,
+		"pinned.example.org:443": true,
+		"other.example.org":      false,
+	}
+	for host, want := range cases {
+		if got := cfg.MITMBypassed(host); got != want {
+			t.Fatalf("MITMBypassed(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestParentFor(t *testing.T) {
+	cfg := &Config{}
+	p := ParentProxies{
+		HTTP:    "http://u:p@proxy.corp:3128",
+		SOCKS:   "socks5://socks.corp:1080",
+		Default: ViaHTTP,
+		Rules: []ParentRule{
+			{Pattern: ".internal", Via: ViaDirect},
+			{Pattern: "*.db.example", Via: ViaSOCKS},
+		},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.SetParents(p)
+	if u := cfg.ParentFor("app.internal:443"); u != nil {
+		t.Fatalf("expected direct route, got %v", u)
+	}
+	if u := cfg.ParentFor("pg.db.example:5432"); u == nil || u.Scheme != "socks5" {
+		t.Fatalf("expected socks route, got %v", u)
+	}
+	if u := cfg.ParentFor("example.com"); u == nil || u.Host != "proxy.corp:3128" {
+		t.Fatalf("expected http route, got %v", u)
+	}
+	if r := cfg.GetParents().Redacted(); strings.Contains(r.HTTP, ":p@") {
+		t.Fatalf("password not redacted: %s", r.HTTP)
+	}
+	if err := (ParentProxies{Default: "ftp"}).Validate(); err == nil {
+		t.Fatalf("expected invalid route error")
+	}
+}
+
+func TestUpstreamPool(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.SetUpstream(Upstream{URL: "not a url"}); err == nil {
+		t.Fatalf("expected error for invalid URL")
+	}
+	cfg.SetUpstream(Upstream{URL: "http://a:80", Weight: 1})
+	cfg.SetUpstream(Upstream{URL: "http://b:80", Weight: 1})
+	cfg.SetUpstream(Upstream{URL: "http://a:80", Weight: 5})
+	p := cfg.GetPool()
+	if len(p.Targets) != 2 || p.Targets[0].Weight != 5 {
+		t.Fatalf("unexpected pool: %+v", p)
+	}
+	cfg.DeleteUpstream("http://a:80")
+	if p := cfg.GetPool(); len(p.Targets) != 1 || p.Targets[0].URL != "http://b:80" {
+		t.Fatalf("upstream not deleted: %+v", p)
+	}
+	if err := (UpstreamPool{Policy: "random"}).Validate(); err == nil {
+		t.Fatalf("expected invalid policy error")
+	}
+}
+
+func TestHealthCheckSettings(t *testing.T) {
+	cfg := &Config{}
+	if hc := cfg.GetHealthCheck(); hc.Path != "/" || hc.Interval.Std() != 10*time.Second {
+		t.Fatalf("defaults not applied: %+v", hc)
+	}
+	var hc HealthCheck
+	if err := json.Unmarshal([]byte(`{"interval":"5s","timeout":1.5}`), &hc); err != nil {
+		t.Fatal(err)
+	}
+	if hc.Interval.Std() != 5*time.Second || hc.Timeout.Std() != 1500*time.Millisecond {
+		t.Fatalf("durations not decoded: %+v", hc)
+	}
+	if err := (HealthCheck{Path: "healthz"}).Validate(); err == nil {
+		t.Fatalf("expected error for relative path")
+	}
+}
+
+func TestRoutesOrdering(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.SetRoute(Route{Name: "bad", Target: "http://a", PathRegex: "("}); err == nil {
+		t.Fatalf("expected error for invalid regex")
+	}
+	cfg.SetRoute(Route{Name: "first", Target: "http://a"})
+	cfg.SetRoute(Route{Name: "second", Target: "http://b"})
+	cfg.SetRoute(Route{Name: "urgent", Priority: 5, Target: "http://c"})
+	cfg.SetRoute(Route{Name: "first", Target: "http://d"})
+	routes := cfg.GetRoutes()
+	if len(routes) != 3 || routes[0].Name != "urgent" || routes[1].Name != "first" || routes[1].Target != "http://d" {
+		t.Fatalf("unexpected routes: %+v", routes)
+	}
+	cfg.DeleteRoute("urgent")
+	if len(cfg.GetRoutes()) != 2 {
+		t.Fatalf("route not deleted")
+	}
+}
+
+func TestListeners(t *testing.T) {
+	cfg := &Config{Mode: ModeForward, HTTPAddr: ":8080", SOCKSAddr: ":1080"}
+	ls := cfg.GetListeners()
+	if len(ls) != 2 || ls[0].Mode != ModeForward || ls[1].Mode != ModeSOCKS {
+		t.Fatalf("unexpected legacy listeners: %+v", ls)
+	}
+	if err := ValidateListeners(ls); err != nil {
+		t.Fatal(err)
+	}
+	dup := []Listener{{Name: "a", Addr: ":1", Mode: ModeForward}, {Name: "a", Addr: ":2", Mode: ModeReverse}}
+	if err := ValidateListeners(dup); err == nil {
+		t.Fatalf("expected duplicate name error")
+	}
+	if err := (Listener{Name: "a", Addr: ":1", Mode: ModeForward, Targets: []string{"http://x"}}).Validate(); err == nil {
+		t.Fatalf("expected error for targets on forward listener")
+	}
+
+	for _, a := range []AdminListener{
+		{Addr: "unix:"},
+		{Addr: ":9091", CertFile: "c.pem"},
+		{Addr: ":9091", ClientCAFile: "ca.pem"},
+		{CertFile: "c.pem", KeyFile: "k.pem"},
+	} {
+		if err := a.Validate(); err == nil {
+			t.Fatalf("expected error for admin listener %+v", a)
+		}
+	}
+	admin := AdminListener{Addr: "unix:/run/proxy.sock", CertFile: "c.pem", KeyFile: "k.pem", ClientCAFile: "ca.pem"}
+	if path, ok := admin.UnixSocket(); admin.Validate() != nil || !ok || path != "/run/proxy.sock" {
+		t.Fatalf("unexpected admin listener socket %q", path)
+	}
+
+	cfg.SetPool(UpstreamPool{Targets: []Upstream{{URL: "http://shared"}}, Policy: BalanceLeastRequests})
+	own := cfg.ListenerPool(Listener{Targets: []string{"http://own"}})
+	if len(own.Targets) != 1 || own.Targets[0].URL != "http://own" || own.Policy != BalanceLeastRequests {
+		t.Fatalf("unexpected listener pool: %+v", own)
+	}
+	cfg.SetRoute(Route{Name: "a", Target: "http://a"})
+	cfg.SetRoute(Route{Name: "b", Target: "http://b"})
+	if r := cfg.RoutesFor([]string{"b"}); len(r) != 1 || r[0].Name != "b" {
+		t.Fatalf("unexpected routes: %+v", r)
+	}
+	if r := cfg.RoutesFor(nil); len(r) != 2 {
+		t.Fatalf("expected all routes, got %+v", r)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.SetRateLimit(RateLimit{Name: "a", Key: "country", Rate: 1}); err == nil {
+		t.Fatalf("expected error for unknown key")
+	}
+	if err := cfg.SetRateLimit(RateLimit{Name: "a", Key: LimitByIP}); err == nil {
+		t.Fatalf("expected error for limit without rate or concurrency")
+	}
+	cfg.SetRateLimit(RateLimit{Name: "a", Key: LimitByIP, Rate: 1})
+	cfg.SetRateLimit(RateLimit{Name: "b", Key: LimitByHost, Concurrent: 4})
+	cfg.SetRateLimit(RateLimit{Name: "a", Key: LimitByUser, Rate: 2})
+	limits := cfg.GetRateLimits()
+	if len(limits) != 2 || limits[0].Key != LimitByUser {
+		t.Fatalf("unexpected limits: %+v", limits)
+	}
+	cfg.DeleteRateLimit("a")
+	if len(cfg.GetRateLimits()) != 1 {
+		t.Fatalf("limit not deleted")
+	}
+}
+
+func TestACLRules(t *testing.T) {
+	cfg := &Config{}
+	bad := []ACLRule{
+		{Name: "a", Action: "block"},
+		{Name: "a", Action: ACLDeny, Clients: []string{"10.0.0.0/33"}},
+		{Name: "a", Action: ACLDeny, HostRegex: "("},
+		{Name: "a", Action: ACLDeny, Ports: []int{70000}},
+		{Name: ACLDefaultRule, Action: ACLDeny},
+	}
+	for _, r := range bad {
+		if err := cfg.SetACLRule(r); err == nil {
+			t.Fatalf("expected error for %+v", r)
+		}
+	}
+	cfg.SetACLRule(ACLRule{Name: "a", Action: ACLDeny, Clients: []string{"10.0.0.1"}})
+	cfg.SetACLRule(ACLRule{Name: "b", Action: ACLAllow})
+	cfg.SetACLRule(ACLRule{Name: "a", Action: ACLAllow})
+	if err := cfg.SetACLPolicy("maybe", ""); err == nil {
+		t.Fatalf("expected error for invalid default")
+	}
+	cfg.SetACLPolicy(ACLDeny, "<p>no</p>")
+	a := cfg.GetACL()
+	if len(a.Rules) != 2 || a.Rules[0].Action != ACLAllow || a.Default != ACLDeny {
+		t.Fatalf("unexpected acl: %+v", a)
+	}
+	cfg.DeleteACLRule("a")
+	if a := cfg.GetACL(); len(a.Rules) != 1 || a.Rules[0].Name != "b" {
+		t.Fatalf("rule not deleted: %+v", a)
+	}
+}
+
+func TestClientSelectors(t *testing.T) {
+	cfg := &Config{}
+	cfg.SetHeader("X-Global", "1")
+	cfg.SetClientHeader("10.0.0.0/8", "X-Tier", "wide")
+	cfg.SetClientHeader("10.1.0.0/16", "X-Tier", "narrow")
+	cfg.SetClientHeader("10.1.2.3", "X-Tier", "ip")
+	cfg.SetClientHeader("header:X-Client-Id=kiosk", "X-Tier", "header")
+	cfg.SetClientHeader("user:alice", "X-Tier", "user")
+
+	cases := []struct {
+		info     ClientInfo
+		tier     string
+		selector string
+	}{
+		{ClientInfo{IP: net.ParseIP("10.9.9.9")}, "wide", "10.0.0.0/8"},
+		{ClientInfo{IP: net.ParseIP("10.1.9.9")}, "narrow", "10.1.0.0/16"},
+		{ClientInfo{IP: net.ParseIP("10.1.2.3")}, "ip", "10.1.2.3"},
+		{ClientInfo{IP: net.ParseIP("10.1.2.3"), Header: http.Header{"X-Client-Id": {"kiosk"}}}, "header", "header:X-Client-Id=kiosk"},
+		{ClientInfo{IP: net.ParseIP("10.1.2.3"), User: "alice", Header: http.Header{"X-Client-Id": {"kiosk"}}}, "user", "user:alice"},
+		{ClientInfo{IP: net.ParseIP("192.0.2.1")}, "", ""},
+	}
+	for _, c := range cases {
+		hdrs, sel := cfg.HeadersForClient(c.info)
+		if hdrs["X-Tier"] != c.tier || sel != c.selector || hdrs["X-Global"] != "1" {
+			t.Fatalf("%+v: got %v %q, want %s %s", c.info, hdrs, sel, c.tier, c.selector)
+		}
+	}
+
+	if s, err := ParseSelector("10.0.0.5:51234"); err != nil || s.String() != "10.0.0.5" {
+		t.Fatalf("port not stripped: %v %v", s, err)
+	}
+	if s, _ := ParseSelector("header:x-client-id=kiosk"); s.String() != "header:X-Client-Id=kiosk" {
+		t.Fatalf("header name not canonical: %s", s)
+	}
+	if _, err := ParseSelector("client1"); err == nil {
+		t.Fatalf("expected error for invalid selector")
+	}
+}
+
+func TestIdentifyClient(t *testing.T) {
+	cfg := &Config{}
+	h := http.Header{"X-Forwarded-For": {"203.0.113.9, 10.0.0.2"}}
+	if info := cfg.IdentifyClient("10.0.0.1:4000", "", h); info.IP.String() != "10.0.0.1" || info.Header != nil {
+		t.Fatalf("untrusted peer: %+v", info)
+	}
+	if err := cfg.SetTrustedProxies([]string{"10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if info := cfg.IdentifyClient("10.0.0.1:4000", "bob", h); info.IP.String() != "203.0.113.9" || info.Header == nil || info.User != "bob" {
+		t.Fatalf("trusted peer: %+v", info)
+	}
+	if err := cfg.SetTrustedProxies([]string{"proxy.local"}); err == nil {
+		t.Fatalf("expected error for invalid trusted proxy")
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.SetForwarding(Forwarding{Trust: "some"}); err == nil {
+		t.Fatal("expected error for unknown trust")
+	}
+	if err := cfg.SetForwarding(Forwarding{Anonymize: "mask"}); err == nil {
+		t.Fatal("expected error for unknown anonymization")
+	}
+	if err := cfg.SetForwarding(Forwarding{Via: true, Trust: TrustTrusted}); err != nil {
+		t.Fatal(err)
+	}
+	if f := cfg.GetForwarding(); !f.Via || f.Trust != TrustTrusted {
+		t.Fatalf("forwarding not set: %+v", f)
+	}
+	for _, tc := range []struct {
+		mode, ip, want string
+	}{
+		{"", "192.0.2.33", "192.0.2.33"},
+		{AnonymizeTruncate, "192.0.2.33", "192.0.2.0"},
+		{AnonymizeTruncate, "2001:db8:1:2::1", "2001:db8:1::"},
+		{AnonymizeHide, "192.0.2.33", "unknown"},
+		{"", "", "unknown"},
+	} {
+		if got := (Forwarding{Anonymize: tc.mode}).ClientAddr(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("ClientAddr(%q, %s) = %q, want %q", tc.mode, tc.ip, got, tc.want)
+		}
+	}
+	cfg.SetTrustedProxies([]string{"10.0.0.0/8"})
+	if !cfg.TrustedProxy(net.ParseIP("10.1.2.3")) || cfg.TrustedProxy(net.ParseIP("192.0.2.1")) || cfg.TrustedProxy(nil) {
+		t.Fatal("unexpected trusted proxy match")
+	}
+}
+
+func TestAccessLogSettings(t *testing.T) {
+	cfg := &Config{}
+	for _, a := range []AccessLog{
+		{Format: "xml"},
+		{Format: LogFormatTemplate},
+		{Format: LogFormatTemplate, Template: "{client} {size}"},
+		{Sink: "kafka"},
+		{Sink: LogSinkFile},
+		{MaxBackups: -1},
+	} {
+		if err := cfg.SetAccessLog(a); err == nil {
+			t.Errorf("expected error for %+v", a)
+		}
+	}
+	a := AccessLog{Enabled: true, Format: LogFormatTemplate, Template: "{client} {status} {duration_ms}", Sink: LogSinkFile, File: "access.log"}
+	if err := cfg.SetAccessLog(a); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.GetAccessLog(); got != a {
+		t.Fatalf("access log not set: %+v", got)
+	}
+}
+
+func TestTunnelTimeouts(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.SetTunnelTimeouts(TunnelTimeouts{Idle: Duration(-time.Second)}); err == nil {
+		t.Fatal("expected error for a negative idle timeout")
+	}
+	tt := TunnelTimeouts{Idle: Duration(time.Minute), MaxLifetime: Duration(time.Hour)}
+	if err := cfg.SetTunnelTimeouts(tt); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.GetTunnelTimeouts(); got != tt {
+		t.Fatalf("tunnel timeouts not set: %+v", got)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	staging := &Config{SecretKey: "k"}
+	staging.SetHeader("X-Env", "staging")
+	staging.SetAuth(true, "admin", "s3cret")
+	staging.SetParents(ParentProxies{HTTP: "http://u:pw@proxy:3128"})
+	staging.SetRoute(Route{Name: "billing", PathPrefix: "/billing/", Target: "http://b:1"})
+	doc, err := staging.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Secrets != SecretsEncrypted || strings.HasPrefix(doc.Users[0].PasswordHash, "$2") || strings.HasPrefix(doc.Parents.HTTP, "http") {
+		t.Fatalf("secrets not encrypted: %+v", doc)
+	}
+	data, _ := json.Marshal(doc)
+
+	prod := &Config{SecretKey: "k"}
+	prod.SetHeader("X-Env", "prod")
+	res, err := prod.Import(data, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.DryRun || len(res.Changes) == 0 || prod.GetHeaders()["X-Env"] != "prod" {
+		t.Fatalf("dry run applied or reported nothing: %+v", res)
+	}
+	// Users are only imported when asked for.
+	res, err = prod.Import(data, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := prod.Authenticate("admin", "s3cret"); ok || prod.AuthEnabledState() || len(res.Warnings) != 1 || prod.GetHeaders()["X-Env"] != "staging" {
+		t.Fatalf("users imported without being asked for: %+v", res)
+	}
+	if _, err := prod.Import(data, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := prod.Authenticate("admin", "s3cret"); !ok || prod.GetParents().HTTP != "http://u:pw@proxy:3128" || len(prod.GetRoutes()) != 1 {
+		t.Fatalf("import not applied: %+v", prod.Snapshot())
+	}
+
+	if _, err := (&Config{SecretKey: "other"}).Import(data, true, true); err == nil {
+		t.Fatalf("expected error for a different secret key")
+	}
+
+	// Without a secret key secrets are omitted and kept on import.
+	plain := &Config{}
+	plain.SetAuth(true, "admin", "s3cret")
+	plain.SetParents(ParentProxies{HTTP: "http://u:pw@proxy:3128"})
+	doc, _ = plain.Export()
+	if doc.Secrets != SecretsOmitted || doc.Users[0].PasswordHash != "" || doc.Parents.HTTP != "http://u@proxy:3128" {
+		t.Fatalf("secrets not omitted: %+v", doc)
+	}
+	data, _ = json.Marshal(doc)
+	if res, err := plain.Import(data, false, true); err != nil || len(res.Changes) != 0 {
+		t.Fatalf("round trip changed settings: %+v %v", res, err)
+	}
+	if _, ok := plain.Authenticate("admin", "s3cret"); !ok || plain.GetParents().HTTP != "http://u:pw@proxy:3128" {
+		t.Fatalf("omitted secrets not kept")
+	}
+
+	for _, bad := range []string{
+		`{"format": 2}`,
+		`{"format": 1, "bogus": true}`,
+		`{"format": 1, "routes": [{"name": "a"}]}`,
+		`{"format": 1, "client_headers": {"laptop": {"A": "1"}}}`,
+	} {
+		if _, err := plain.Import([]byte(bad), true, true); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+}
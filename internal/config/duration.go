@@ -0,0 +1,60 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration that is encoded in JSON as a string such as
+// "1m30s". Plain numbers are accepted when decoding and taken as seconds.
+type Duration time.Duration
+
+// Std returns d as a time.Duration.
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	return d.set(v, string(b))
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, accepting the same values as
+// UnmarshalJSON.
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	var v interface{}
+	if err := n.Decode(&v); err != nil {
+		return err
+	}
+	return d.set(v, n.Value)
+}
+
+func (d *Duration) set(v interface{}, raw string) error {
+	switch val := v.(type) {
+	case int:
+		*d = Duration(time.Duration(val) * time.Second)
+	case float64:
+		*d = Duration(val * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", raw)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ExportFormat is the version of the export document format.
+const ExportFormat = 1
+
+// How the secrets of an export document are protected.
+const (
+	SecretsEncrypted = "encrypted"
+	SecretsOmitted   = "omitted"
+)
+
+// Export is the document returned by the configuration export and accepted
+// by the import. The password hashes of the users and the parent proxy URLs
+// are encrypted under the secret key when one is configured; otherwise the
+// hashes and the passwords in the parent URLs are left out.
+type Export struct {
+	Format    int        `json:"format"`
+	Exported  time.Time  `json:"exported"`
+	Secrets   string     `json:"secrets"`
+	Listeners []Listener `json:"listeners,omitempty"`
+	Snapshot
+}
+
+// Export returns the runtime configuration as an export document.
+func (c *Config) Export() (Export, error) {
+	e := Export{
+		Format:    ExportFormat,
+		Exported:  time.Now().UTC(),
+		Secrets:   SecretsOmitted,
+		Listeners: c.GetListeners(),
+		Snapshot:  c.Snapshot(),
+	}
+	if c.SecretKey == "" {
+		for i := range e.Users {
+			e.Users[i].PasswordHash = ""
+		}
+		e.Parents.HTTP = stripURLPassword(e.Parents.HTTP)
+		e.Parents.SOCKS = stripURLPassword(e.Parents.SOCKS)
+		return e, nil
+	}
+	e.Secrets = SecretsEncrypted
+	for _, s := range e.secrets() {
+		if *s == "" {
+			continue
+		}
+		enc, err := encrypt(c.SecretKey, *s)
+		if err != nil {
+			return Export{}, err
+		}
+		*s = enc
+	}
+	return e, nil
+}
+
+// secrets returns pointers to the settings of s holding secrets.
+func (s *Snapshot) secrets() []*string {
+	out := []*string{&s.Parents.HTTP, &s.Parents.SOCKS}
+	for i := range s.Users {
+		out = append(out, &s.Users[i].PasswordHash)
+	}
+	return out
+}
+
+// stripURLPassword removes the password from a URL with credentials.
+func stripURLPassword(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); !ok {
+		return raw
+	}
+	u.User = url.User(u.User.Username())
+	return u.String()
+}
+
+// keepURLPassword returns imported with the password of current when
+// imported has none and otherwise names the same user and host.
+func keepURLPassword(imported, current string) string {
+	iu, err := url.Parse(imported)
+	if err != nil || iu.User == nil {
+		return imported
+	}
+	if _, ok := iu.User.Password(); ok {
+		return imported
+	}
+	cu, err := url.Parse(current)
+	if err != nil || cu.User == nil || cu.Host != iu.Host || cu.User.Username() != iu.User.Username() {
+		return imported
+	}
+	iu.User = cu.User
+	return iu.String()
+}
+
+// ImportResult describes the outcome of an import.
+type ImportResult struct {
+	DryRun   bool     `json:"dry_run"`
+	Changes  []Change `json:"changes"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Import validates the export document data and, unless dryRun is set,
+// replaces the persisted settings with it in a single update. Omitted
+// secrets keep their current values. The users and the authentication switch
+// are only imported when users is set, and are otherwise reported as a
+// warning when they differ. Listeners cannot change at runtime, so differing
+// listeners are reported as a warning and ignored.
+func (c *Config) Import(data []byte, dryRun, users bool) (ImportResult, error) {
+	var e Export
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&e); err != nil {
+		return ImportResult{}, fmt.Errorf("invalid export document: %v", err)
+	}
+	if e.Format != ExportFormat {
+		return ImportResult{}, fmt.Errorf("unsupported export format %d", e.Format)
+	}
+	current := c.Snapshot()
+	snap := e.Snapshot.clone()
+	switch e.Secrets {
+	case SecretsEncrypted:
+		if c.SecretKey == "" {
+			return ImportResult{}, errors.New("the document has encrypted secrets but no secret key is configured")
+		}
+		for _, s := range snap.secrets() {
+			if *s == "" {
+				continue
+			}
+			dec, err := decrypt(c.SecretKey, *s)
+			if err != nil {
+				return ImportResult{}, errors.New("cannot decrypt the secrets of the document: the secret keys differ")
+			}
+			*s = dec
+		}
+	case SecretsOmitted, "":
+		hashes := make(map[string]string, len(current.Users))
+		for _, u := range current.Users {
+			hashes[u.Name] = u.PasswordHash
+		}
+		for i, u := range snap.Users {
+			if u.PasswordHash == "" {
+				snap.Users[i].PasswordHash = hashes[u.Name]
+			}
+		}
+		snap.Parents.HTTP = keepURLPassword(snap.Parents.HTTP, current.Parents.HTTP)
+		snap.Parents.SOCKS = keepURLPassword(snap.Parents.SOCKS, current.Parents.SOCKS)
+	default:
+		return ImportResult{}, fmt.Errorf("unknown secrets mode %q", e.Secrets)
+	}
+	canonical := make(map[string]map[string]string, len(snap.ClientHeaders))
+	for client, hdrs := range snap.ClientHeaders {
+		if sel, err := ParseSelector(client); err == nil {
+			client = sel.String()
+		}
+		canonical[client] = hdrs
+	}
+	snap.ClientHeaders = canonical
+	if err := snap.Validate(); err != nil {
+		return ImportResult{}, err
+	}
+	snap.LogLevel = LevelString(ParseLogLevel(snap.LogLevel))
+	snap.Health = snap.Health.WithDefaults()
+
+	var warnings []string
+	if !users {
+		if snap.AuthEnabled != current.AuthEnabled || !slices.Equal(snap.Users, current.Users) {
+			warnings = append(warnings, "users and authentication differ from the running ones and were not applied; import them explicitly to replace them")
+		}
+		snap.AuthEnabled, snap.Users = current.AuthEnabled, current.Users
+	}
+	res := ImportResult{DryRun: dryRun, Changes: Diff(current, snap), Warnings: warnings}
+	if e.Listeners != nil && !reflect.DeepEqual(e.Listeners, c.GetListeners()) {
+		res.Warnings = append(res.Warnings, "listeners differ from the running ones and were not applied; they take effect after a restart")
+	}
+	if !dryRun {
+		c.Restore(snap, users)
+	}
+	return res, nil
+}
+
+// Validate checks every section of the snapshot and reports all problems
+// found, joined with errors.Join.
+func (s Snapshot) Validate() error {
+	var errs []error
+	for name := range s.Headers {
+		if strings.TrimSpace(name) == "" {
+			errs = append(errs, errors.New("empty header name"))
+		}
+	}
+	for client := range s.ClientHeaders {
+		if _, err := ParseSelector(client); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, p := range s.TrustedProxies {
+		if _, err := ParseClientNet(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := s.Forwarding.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.AccessLog.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.Tunnels.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	switch strings.ToUpper(s.LogLevel) {
+	case "", "DEBUG", "INFO", "WARN", "ERROR", "FATAL":
+	default:
+		errs = append(errs, fmt.Errorf("unknown log level %q", s.LogLevel))
+	}
+	names := make(map[string]bool)
+	admin := false
+	for _, u := range s.Users {
+		if err := u.Validate(); err != nil {
+			errs = append(errs, err)
+		} else if names[u.Name] {
+			errs = append(errs, fmt.Errorf("duplicate user %s", u.Name))
+		}
+		names[u.Name] = true
+		admin = admin || u.Role == RoleAdmin
+	}
+	if s.AuthEnabled && len(s.Users) > 0 && !admin {
+		errs = append(errs, errors.New("enabling authentication requires an admin user"))
+	}
+	if err := s.Parents.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.Pool.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.Health.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	names = make(map[string]bool)
+	for _, r := range s.Routes {
+		if err := r.Validate(); err != nil {
+			errs = append(errs, err)
+		} else if names[r.Name] {
+			errs = append(errs, fmt.Errorf("duplicate route %s", r.Name))
+		}
+		names[r.Name] = true
+	}
+	names = make(map[string]bool)
+	for _, l := range s.RateLimits {
+		if err := l.Validate(); err != nil {
+			errs = append(errs, err)
+		} else if names[l.Name] {
+			errs = append(errs, fmt.Errorf("duplicate rate limit %s", l.Name))
+		}
+		names[l.Name] = true
+	}
+	if err := s.ACL.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
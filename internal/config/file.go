@@ -0,0 +1,293 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is the declarative configuration file given with -config, written in
+// YAML or JSON. Sections present in the file replace the corresponding
+// settings entirely; absent sections leave them untouched.
+type File struct {
+	Listeners      []Listener                   `yaml:"listeners"`
+	Headers        map[string]string            `yaml:"headers"`
+	ClientHeaders  map[string]map[string]string `yaml:"client_headers"`
+	TrustedProxies []string                     `yaml:"trusted_proxies"`
+	Auth           *FileAuth                    `yaml:"auth"`
+	Identity       *FileIdentity                `yaml:"identity"`
+	Stats          *bool                        `yaml:"stats"`
+	LogLevel       string                       `yaml:"log_level"`
+}
+
+// FileAuth is the auth section of the configuration file.
+type FileAuth struct {
+	Enabled  bool   `json:"enabled" yaml:"enabled"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
+
+// FileIdentity is the identity section of the configuration file.
+type FileIdentity struct {
+	Name string `json:"name" yaml:"name"`
+	ID   string `json:"id" yaml:"id"`
+}
+
+// FileError is a configuration file error at a given line.
+type FileError struct {
+	Path string
+	Line int
+	Msg  string
+}
+
+func (e *FileError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+}
+
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// LoadFile reads and validates the configuration file at path. Every problem
+// found is reported as a *FileError, joined with errors.Join.
+func LoadFile(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, yamlError(path, err)
+	}
+	f := &File{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, yamlError(path, err)
+	}
+	if err := f.validate(path, &root); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// yamlError converts the errors of the YAML decoder to FileErrors.
+func yamlError(path string, err error) error {
+	var msgs []string
+	var te *yaml.TypeError
+	if errors.As(err, &te) {
+		msgs = te.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+	var errs []error
+	for _, m := range msgs {
+		fe := &FileError{Path: path, Msg: m}
+		if sub := yamlLine.FindStringSubmatch(m); sub != nil {
+			fe.Line, _ = strconv.Atoi(sub[1])
+			fe.Msg = sub[2]
+		}
+		errs = append(errs, fe)
+	}
+	return errors.Join(errs...)
+}
+
+func (f *File) validate(path string, root *yaml.Node) error {
+	var errs []error
+	fail := func(line int, format string, args ...interface{}) {
+		errs = append(errs, &FileError{Path: path, Line: line, Msg: fmt.Sprintf(format, args...)})
+	}
+	names := make(map[string]bool)
+	addrs := make(map[string]bool)
+	for i, l := range f.Listeners {
+		line := nodeLine(root, "listeners", i)
+		if err := l.Validate(); err != nil {
+			fail(line, "%v", err)
+			continue
+		}
+		if names[l.Name] {
+			fail(line, "duplicate listener name %s", l.Name)
+		}
+		if addrs[l.Addr] {
+			fail(line, "duplicate listener address %s", l.Addr)
+		}
+		names[l.Name], addrs[l.Addr] = true, true
+	}
+	for name := range f.Headers {
+		if strings.TrimSpace(name) == "" {
+			fail(nodeLine(root, "headers"), "empty header name")
+		}
+	}
+	for client := range f.ClientHeaders {
+		if _, err := ParseSelector(client); err != nil {
+			fail(nodeLine(root, "client_headers", client), "%v", err)
+		}
+	}
+	for i, p := range f.TrustedProxies {
+		if _, err := ParseClientNet(p); err != nil {
+			fail(nodeLine(root, "trusted_proxies", i), "%v", err)
+		}
+	}
+	if f.Auth != nil && (f.Auth.Username == "") != (f.Auth.Password == "") {
+		fail(nodeLine(root, "auth"), "auth username and password must be given together")
+	}
+	if f.LogLevel != "" {
+		switch strings.ToUpper(f.LogLevel) {
+		case "DEBUG", "INFO", "WARN", "ERROR", "FATAL":
+		default:
+			fail(nodeLine(root, "log_level"), "unknown log level %q", f.LogLevel)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// nodeLine returns the line of the node reached from root by following
+// mapping keys (strings) and sequence indexes (ints), or of the deepest node
+// found on the way.
+func nodeLine(root *yaml.Node, path ...interface{}) int {
+	n := root
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	line := n.Line
+	for _, p := range path {
+		var next *yaml.Node
+		switch k := p.(type) {
+		case string:
+			if n.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(n.Content); i += 2 {
+					if n.Content[i].Value == k {
+						line = n.Content[i].Line
+						next = n.Content[i+1]
+						break
+					}
+				}
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && k < len(n.Content) {
+				next = n.Content[k]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			break
+		}
+		n = next
+	}
+	return line
+}
+
+// ApplyFile applies the sections present in f in a single update, so
+// concurrent readers see either the previous or the new settings. The
+// username and password of the auth section create or update an admin user.
+func (c *Config) ApplyFile(f *File) error {
+	var admin User
+	if f.Auth != nil && f.Auth.Username != "" && f.Auth.Password != "" {
+		admin = User{Name: f.Auth.Username, Role: RoleAdmin}
+		for _, u := range c.GetUsers() {
+			if u.Name == admin.Name && verifyPassword(u.PasswordHash, f.Auth.Password) {
+				admin.PasswordHash = u.PasswordHash
+			}
+		}
+		if admin.PasswordHash == "" {
+			hash, err := HashPassword(f.Auth.Password)
+			if err != nil {
+				return err
+			}
+			admin.PasswordHash = hash
+		}
+	}
+	defer c.accessChanged()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// As with SetAuth, authentication cannot be enabled without an admin,
+	// which the admin of the file, when given, would be.
+	if f.Auth != nil && f.Auth.Enabled && admin.Name == "" && len(c.Users) > 0 && !c.hasAdmin() {
+		return fmt.Errorf("enabling authentication requires an admin user")
+	}
+	if f.Listeners != nil {
+		c.Listeners = append([]Listener(nil), f.Listeners...)
+	}
+	if f.Headers != nil {
+		c.Headers = make(map[string]string, len(f.Headers))
+		for k, v := range f.Headers {
+			c.Headers[k] = v
+		}
+	}
+	if f.ClientHeaders != nil {
+		c.ClientHeaders = make(map[string]map[string]string, len(f.ClientHeaders))
+		for client, hdrs := range f.ClientHeaders {
+			sel, _ := ParseSelector(client)
+			m := make(map[string]string, len(hdrs))
+			for k, v := range hdrs {
+				m[k] = v
+			}
+			c.ClientHeaders[sel.String()] = m
+		}
+	}
+	if f.TrustedProxies != nil {
+		c.TrustedProxies = append([]string(nil), f.TrustedProxies...)
+	}
+	if admin.Name != "" {
+		found := false
+		for i, u := range c.Users {
+			if u.Name == admin.Name {
+				c.Users[i], found = admin, true
+			}
+		}
+		if !found {
+			c.Users = append(c.Users, admin)
+		}
+	}
+	if f.Auth != nil {
+		c.AuthEnabled = f.Auth.Enabled
+	}
+	if f.Identity != nil {
+		c.ProxyName = f.Identity.Name
+		c.ProxyID = f.Identity.ID
+	}
+	if f.Stats != nil {
+		c.StatsEnabled = *f.Stats
+	}
+	if f.LogLevel != "" {
+		c.LogLevel = ParseLogLevel(f.LogLevel)
+	}
+	return nil
+}
+
+// WatchFile calls changed whenever the modification time or size of the file
+// at path changes, checking every interval until stop is closed. Files
+// replaced by renaming, as many editors do, are detected as well.
+func WatchFile(path string, interval time.Duration, stop <-chan struct{}, changed func()) {
+	var lastMod time.Time
+	var lastSize int64
+	if fi, err := os.Stat(path); err == nil {
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !fi.ModTime().Equal(lastMod) || fi.Size() != lastSize {
+			lastMod, lastSize = fi.ModTime(), fi.Size()
+			changed()
+		}
+	}
+}
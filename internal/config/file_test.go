@@ -0,0 +1,162 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeFile(t, "proxy.yaml", `
+listeners:
+  - name: egress
+    addr: ":3128"
+    mode: forward
+    timeouts:
+      write: 5m
+      response_header: 30
+      idle: 0s
+headers:
+  X-Env: prod
+client_headers:
+  10.0.0.0/8:
+    X-Office: hq
+auth:
+  enabled: true
+  username: admin
+  password: secret
+identity:
+  name: edge
+stats: true
+log_level: debug
+`)
+	f, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Headers: map[string]string{"X-Old": "1"}, ProxyID: "keep"}
+	cfg.ApplyFile(f)
+	if h := cfg.GetHeaders(); len(h) != 1 || h["X-Env"] != "prod" {
+		t.Fatalf("headers not replaced: %v", h)
+	}
+	if l := cfg.GetListeners(); len(l) != 1 || l[0].Name != "egress" {
+		t.Fatalf("unexpected listeners: %+v", l)
+	}
+	cfg.Timeouts = ServerTimeouts{ReadHeader: Duration(10 * time.Second), Write: Duration(time.Minute), Idle: Duration(time.Minute)}
+	// The listener's idle timeout of zero disables the server-wide one.
+	if tt := cfg.ListenerTimeouts(cfg.GetListeners()[0]); tt.ReadHeader.Std() != 10*time.Second || tt.Write.Std() != 5*time.Minute || tt.ResponseHeader.Std() != 30*time.Second || tt.Idle != 0 {
+		t.Fatalf("unexpected listener timeouts: %+v", tt)
+	}
+	if _, ok := cfg.Authenticate("admin", "secret"); !ok || !cfg.AuthRequired() {
+		t.Fatalf("auth not applied")
+	}
+	if name, id := cfg.GetIdentity(); name != "edge" || id != "" {
+		t.Fatalf("identity not replaced: %s %s", name, id)
+	}
+	if !cfg.StatsEnabledState() || LevelString(cfg.GetLogLevel()) != "DEBUG" {
+		t.Fatalf("stats or log level not applied")
+	}
+	if cfg.GetAllClientHeaders()["10.0.0.0/8"]["X-Office"] != "hq" {
+		t.Fatalf("client headers not applied")
+	}
+
+	json := writeFile(t, "proxy.json", `{"headers": {"X-Json": "1"}, "stats": false}`)
+	f, err = LoadFile(json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ApplyFile(f)
+	if cfg.GetHeaders()["X-Json"] != "1" || cfg.StatsEnabledState() {
+		t.Fatalf("json config not applied")
+	}
+	if !cfg.AuthRequired() {
+		t.Fatalf("absent section should be kept")
+	}
+}
+
+func TestApplyFileRequiresAdmin(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.SetUser("bob", RoleProxyUser, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	f := &File{Headers: map[string]string{"X-Env": "prod"}, Auth: &FileAuth{Enabled: true}}
+	if err := cfg.ApplyFile(f); err == nil {
+		t.Fatal("authentication enabled without an admin")
+	}
+	if cfg.AuthRequired() || len(cfg.GetHeaders()) != 0 {
+		t.Fatalf("rejected file partly applied")
+	}
+	f.Auth.Username, f.Auth.Password = "admin", "secret"
+	if err := cfg.ApplyFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.AuthRequired() || cfg.GetHeaders()["X-Env"] != "prod" {
+		t.Fatalf("file with an admin not applied")
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	path := writeFile(t, "proxy.yaml", `listeners:
+  - name: a
+    addr: ":1"
+    mode: forward
+  - name: b
+    addr: ":2"
+    mode: tunnel
+client_headers:
+  laptop:
+    X-A: "1"
+log_level: loud
+`)
+	_, err := LoadFile(path)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"proxy.yaml:5: listener b: unknown mode", "proxy.yaml:9: invalid client selector", "proxy.yaml:11: unknown log level"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("missing %q in:\n%v", want, err)
+		}
+	}
+
+	path = writeFile(t, "proxy.yaml", "stats: true\nlisten: x\n")
+	if _, err := LoadFile(path); err == nil || !strings.Contains(err.Error(), "proxy.yaml:2: field listen not found") {
+		t.Fatalf("unexpected error for unknown field: %v", err)
+	}
+	path = writeFile(t, "proxy.yaml", "stats: maybe\n")
+	if _, err := LoadFile(path); err == nil || !strings.Contains(err.Error(), "proxy.yaml:1:") {
+		t.Fatalf("unexpected error for bad type: %v", err)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	path := writeFile(t, "proxy.yaml", "stats: true\n")
+	changed := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go WatchFile(path, 10*time.Millisecond, stop, func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	time.Sleep(30 * time.Millisecond)
+	if err := os.WriteFile(path, []byte("stats: false\nlog_level: info\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("change not detected")
+	}
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// Trust modes for the X-Forwarded-For and Forwarded headers received from
+// clients.
+const (
+	TrustAll     = "all"
+	TrustTrusted = "trusted"
+	TrustNone    = "none"
+)
+
+// Anonymization modes for the client address added to forwarded requests.
+const (
+	AnonymizeTruncate = "truncate"
+	AnonymizeHide     = "hide"
+)
+
+// Forwarding configures the headers forward mode adds to requests about the
+// proxy and its clients.
+//
+// Via adds the proxy to the Via header of requests and responses.
+// XForwardedFor and Forwarded append the client address to the
+// X-Forwarded-For and RFC 7239 Forwarded headers. Trust decides which of
+// those headers received from clients are kept: all of them (TrustAll, the
+// default), only those of the trusted proxies (TrustTrusted) or none
+// (TrustNone). Anonymize hides the client address added: AnonymizeTruncate
+// zeroes the last IPv4 octet or the last 80 bits of IPv6 addresses and
+// AnonymizeHide replaces it with "unknown".
+type Forwarding struct {
+	Via           bool   `json:"via"`
+	XForwardedFor bool   `json:"x_forwarded_for"`
+	Forwarded     bool   `json:"forwarded"`
+	Trust         string `json:"trust"`
+	Anonymize     string `json:"anonymize"`
+}
+
+// Validate checks the trust and anonymization modes.
+func (f Forwarding) Validate() error {
+	switch f.Trust {
+	case "", TrustAll, TrustTrusted, TrustNone:
+	default:
+		return fmt.Errorf("unknown forwarding trust %q", f.Trust)
+	}
+	switch f.Anonymize {
+	case "", AnonymizeTruncate, AnonymizeHide:
+	default:
+		return fmt.Errorf("unknown anonymization %q", f.Anonymize)
+	}
+	return nil
+}
+
+// ClientAddr returns ip as added to forwarded requests, anonymized as
+// configured.
+func (f Forwarding) ClientAddr(ip net.IP) string {
+	if ip == nil || f.Anonymize == AnonymizeHide {
+		return "unknown"
+	}
+	if f.Anonymize == AnonymizeTruncate {
+		if v4 := ip.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+	return ip.String()
+}
+
+// SetForwarding replaces the forwarding header settings.
+func (c *Config) SetForwarding(f Forwarding) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Forwarding = f
+	return nil
+}
+
+// GetForwarding returns the forwarding header settings.
+func (c *Config) GetForwarding() Forwarding {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Forwarding
+}
+
+// TrustedProxy reports whether ip belongs to a trusted proxy.
+func (c *Config) TrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, p := range c.GetTrustedProxies() {
+		if n, err := ParseClientNet(p); err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
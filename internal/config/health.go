@@ -0,0 +1,99 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// HealthCheck configures active probing and passive outlier ejection of the
+// reverse proxy pool.
+//
+// When Enabled, every target is probed with a GET request to Path each
+// Interval. A probe succeeds if it answers within Timeout with
+// ExpectedStatus, or any 2xx/3xx status when ExpectedStatus is zero. A target
+// is taken out of rotation after UnhealthyThreshold consecutive failed probes
+// and put back after HealthyThreshold consecutive successful ones.
+//
+// Independently of probing, a target is ejected for EjectDuration after
+// MaxFailures consecutive 5xx responses or connection errors. A MaxFailures
+// of zero disables passive ejection.
+type HealthCheck struct {
+	Enabled            bool     `json:"enabled"`
+	Path               string   `json:"path"`
+	Interval           Duration `json:"interval"`
+	Timeout            Duration `json:"timeout"`
+	ExpectedStatus     int      `json:"expected_status"`
+	HealthyThreshold   int      `json:"healthy_threshold"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold"`
+	MaxFailures        int      `json:"max_failures"`
+	EjectDuration      Duration `json:"eject_duration"`
+}
+
+// DefaultHealthCheck returns the health check settings used when none are configured.
+func DefaultHealthCheck() HealthCheck {
+	return HealthCheck{
+		Path:               "/",
+		Interval:           Duration(10 * time.Second),
+		Timeout:            Duration(2 * time.Second),
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+		MaxFailures:        5,
+		EjectDuration:      Duration(30 * time.Second),
+	}
+}
+
+// WithDefaults fills unset fields from DefaultHealthCheck.
+func (h HealthCheck) WithDefaults() HealthCheck {
+	def := DefaultHealthCheck()
+	if h.Path == "" {
+		h.Path = def.Path
+	}
+	if h.Interval <= 0 {
+		h.Interval = def.Interval
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = def.Timeout
+	}
+	if h.HealthyThreshold <= 0 {
+		h.HealthyThreshold = def.HealthyThreshold
+	}
+	if h.UnhealthyThreshold <= 0 {
+		h.UnhealthyThreshold = def.UnhealthyThreshold
+	}
+	if h.EjectDuration <= 0 {
+		h.EjectDuration = def.EjectDuration
+	}
+	return h
+}
+
+// Validate checks the health check settings.
+func (h HealthCheck) Validate() error {
+	if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+		return errors.New("health check path must start with /")
+	}
+	if h.Interval < 0 || h.Timeout < 0 || h.EjectDuration < 0 {
+		return errors.New("health check durations must not be negative")
+	}
+	if h.ExpectedStatus != 0 && (h.ExpectedStatus < 100 || h.ExpectedStatus > 599) {
+		return errors.New("expected status must be a valid HTTP status code")
+	}
+	if h.HealthyThreshold < 0 || h.UnhealthyThreshold < 0 || h.MaxFailures < 0 {
+		return errors.New("health check thresholds must not be negative")
+	}
+	return nil
+}
+
+// SetHealthCheck replaces the health check settings.
+func (c *Config) SetHealthCheck(h HealthCheck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Health = h
+}
+
+// GetHealthCheck returns the health check settings with defaults applied.
+func (c *Config) GetHealthCheck() HealthCheck {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Health.WithDefaults()
+}
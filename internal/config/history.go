@@ -0,0 +1,378 @@
+package config
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyLimit is the number of configuration revisions kept in the store.
+const historyLimit = 1000
+
+// ErrNoRevision is returned for configuration revisions that do not exist.
+var ErrNoRevision = errors.New("no such configuration revision")
+
+// Snapshot is the persisted part of the configuration, as recorded in the
+// configuration history. Listeners and the settings that only come from
+// flags are not part of it.
+type Snapshot struct {
+	Headers        map[string]string            `json:"headers"`
+	ClientHeaders  map[string]map[string]string `json:"client_headers"`
+	TrustedProxies []string                     `json:"trusted_proxies"`
+	Forwarding     Forwarding                   `json:"forwarding"`
+	AccessLog      AccessLog                    `json:"access_log"`
+	Tunnels        TunnelTimeouts               `json:"tunnels"`
+	LogLevel       string                       `json:"log_level"`
+	AuthEnabled    bool                         `json:"auth_enabled"`
+	Users          []User                       `json:"users"`
+	Identity       FileIdentity                 `json:"identity"`
+	Stats          bool                         `json:"stats"`
+	MITM           SnapshotMITM                 `json:"mitm"`
+	Parents        ParentProxies                `json:"parents"`
+	Pool           UpstreamPool                 `json:"pool"`
+	Health         HealthCheck                  `json:"health"`
+	Routes         []Route                      `json:"routes"`
+	RateLimits     []RateLimit                  `json:"rate_limits"`
+	ACL            AccessControl                `json:"acl"`
+}
+
+// SnapshotMITM is the TLS interception part of a Snapshot.
+type SnapshotMITM struct {
+	Enabled bool     `json:"enabled"`
+	Bypass  []string `json:"bypass"`
+}
+
+// Snapshot returns a copy of the persisted settings.
+func (c *Config) Snapshot() Snapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s := Snapshot{
+		Headers:        make(map[string]string, len(c.Headers)),
+		ClientHeaders:  make(map[string]map[string]string, len(c.ClientHeaders)),
+		TrustedProxies: append([]string(nil), c.TrustedProxies...),
+		Forwarding:     c.Forwarding,
+		AccessLog:      c.AccessLog,
+		Tunnels:        c.Tunnels,
+		LogLevel:       LevelString(c.LogLevel),
+		AuthEnabled:    c.AuthEnabled,
+		Users:          append([]User(nil), c.Users...),
+		Identity:       FileIdentity{Name: c.ProxyName, ID: c.ProxyID},
+		Stats:          c.StatsEnabled,
+		MITM:           SnapshotMITM{Enabled: c.MITMEnabled, Bypass: append([]string(nil), c.MITMBypass...)},
+		Parents:        c.Parents.clone(),
+		Pool:           c.Pool.clone(),
+		Health:         c.Health.WithDefaults(),
+		RateLimits:     append([]RateLimit(nil), c.RateLimits...),
+		ACL:            c.ACL.clone(),
+	}
+	for k, v := range c.Headers {
+		s.Headers[k] = v
+	}
+	for client, hdrs := range c.ClientHeaders {
+		m := make(map[string]string, len(hdrs))
+		for k, v := range hdrs {
+			m[k] = v
+		}
+		s.ClientHeaders[client] = m
+	}
+	for _, r := range c.Routes {
+		s.Routes = append(s.Routes, r.clone())
+	}
+	return s
+}
+
+// Restore replaces the persisted settings with those of s in a single update.
+// The users and the authentication switch are only replaced when users is
+// set, so that restoring other settings never brings back deleted accounts
+// or old passwords.
+func (c *Config) Restore(s Snapshot, users bool) {
+	s = s.clone()
+	defer c.accessChanged()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !users {
+		s.AuthEnabled, s.Users = c.AuthEnabled, append([]User(nil), c.Users...)
+	}
+	c.Headers = s.Headers
+	c.ClientHeaders = s.ClientHeaders
+	c.TrustedProxies = s.TrustedProxies
+	c.Forwarding = s.Forwarding
+	c.AccessLog = s.AccessLog
+	c.Tunnels = s.Tunnels
+	c.LogLevel = ParseLogLevel(s.LogLevel)
+	c.AuthEnabled, c.Users = s.AuthEnabled, s.Users
+	c.ProxyName, c.ProxyID = s.Identity.Name, s.Identity.ID
+	c.StatsEnabled = s.Stats
+	c.MITMEnabled, c.MITMBypass = s.MITM.Enabled, s.MITM.Bypass
+	c.Parents = s.Parents
+	c.Pool = s.Pool
+	c.Health = s.Health
+	c.Routes = s.Routes
+	c.RateLimits = s.RateLimits
+	c.ACL = s.ACL
+}
+
+func (s Snapshot) clone() Snapshot {
+	out := s
+	out.Headers = make(map[string]string, len(s.Headers))
+	for k, v := range s.Headers {
+		out.Headers[k] = v
+	}
+	out.ClientHeaders = make(map[string]map[string]string, len(s.ClientHeaders))
+	for client, hdrs := range s.ClientHeaders {
+		m := make(map[string]string, len(hdrs))
+		for k, v := range hdrs {
+			m[k] = v
+		}
+		out.ClientHeaders[client] = m
+	}
+	out.TrustedProxies = append([]string(nil), s.TrustedProxies...)
+	out.Users = append([]User(nil), s.Users...)
+	out.MITM.Bypass = append([]string(nil), s.MITM.Bypass...)
+	out.Parents = s.Parents.clone()
+	out.Pool = s.Pool.clone()
+	out.Routes = nil
+	for _, r := range s.Routes {
+		out.Routes = append(out.Routes, r.clone())
+	}
+	out.RateLimits = append([]RateLimit(nil), s.RateLimits...)
+	out.ACL = s.ACL.clone()
+	return out
+}
+
+// Change is a difference between two snapshots. Path names the setting, such
+// as "headers.X-Env" or "routes[billing].target"; Old is empty for added
+// settings and New for removed ones. Secrets are masked.
+type Change struct {
+	Path string `json:"path"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// Diff returns the changes from one snapshot to another, ordered by path.
+func Diff(from, to Snapshot) []Change {
+	a, b := flattenSnapshot(from), flattenSnapshot(to)
+	var changes []Change
+	for path, old := range a {
+		if nv, ok := b[path]; !ok || nv != old {
+			changes = append(changes, Change{Path: path, Old: old, New: nv})
+		}
+	}
+	for path, nv := range b {
+		if _, ok := a[path]; !ok {
+			changes = append(changes, Change{Path: path, New: nv})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	for i := range changes {
+		changes[i].Old = redactValue(changes[i].Path, changes[i].Old)
+		changes[i].New = redactValue(changes[i].Path, changes[i].New)
+	}
+	return changes
+}
+
+// redactValue masks the values of settings holding secrets.
+func redactValue(path, v string) string {
+	if v == "" {
+		return v
+	}
+	if strings.HasPrefix(path, "users[") && strings.HasSuffix(path, "].password_hash") {
+		return "********"
+	}
+	switch path {
+	case "parents.http", "parents.socks":
+		if u, err := url.Parse(v); err == nil {
+			return u.Redacted()
+		}
+	}
+	return v
+}
+
+// flattenSnapshot maps the path of every leaf setting of s to its value.
+// Elements of lists of objects are keyed by their name or URL when they have
+// one, so reordering or inserting entries does not change unrelated paths.
+// Lists of plain values are leaves.
+func flattenSnapshot(s Snapshot) map[string]string {
+	raw, _ := json.Marshal(s)
+	var v interface{}
+	json.Unmarshal(raw, &v)
+	out := make(map[string]string)
+	flattenValue(out, "", v)
+	return out
+}
+
+func flattenValue(out map[string]string, path string, v interface{}) {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			flattenValue(out, join(k), e)
+		}
+	case []interface{}:
+		objects := len(t) > 0
+		for _, e := range t {
+			if _, ok := e.(map[string]interface{}); !ok {
+				objects = false
+			}
+		}
+		if !objects {
+			if len(t) > 0 {
+				raw, _ := json.Marshal(t)
+				out[path] = string(raw)
+			}
+			return
+		}
+		for i, e := range t {
+			m := e.(map[string]interface{})
+			key := strconv.Itoa(i)
+			if name, ok := m["name"].(string); ok && name != "" {
+				key = name
+			} else if u, ok := m["url"].(string); ok && u != "" {
+				key = u
+			}
+			flattenValue(out, fmt.Sprintf("%s[%s]", path, key), e)
+		}
+	case nil:
+	case string:
+		if t != "" {
+			out[path] = t
+		}
+	default:
+		raw, _ := json.Marshal(t)
+		out[path] = string(raw)
+	}
+}
+
+// Revision is a recorded version of the configuration.
+type Revision struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Comment string    `json:"comment,omitempty"`
+	// Changes are the differences from the previous revision.
+	Changes []Change `json:"changes"`
+}
+
+// sealSnapshot encodes s for the history table with its secrets encrypted.
+func sealSnapshot(cfg *Config, s Snapshot) (string, error) {
+	s.Parents.HTTP = sealSetting(cfg, s.Parents.HTTP)
+	s.Parents.SOCKS = sealSetting(cfg, s.Parents.SOCKS)
+	raw, err := json.Marshal(s)
+	return string(raw), err
+}
+
+// openSnapshot reverses sealSnapshot.
+func openSnapshot(cfg *Config, raw string) (Snapshot, error) {
+	var s Snapshot
+	if err := json.Unmarshal([]byte(raw), &s); err != nil {
+		return Snapshot{}, err
+	}
+	s.Parents.HTTP = openSetting(cfg, s.Parents.HTTP)
+	s.Parents.SOCKS = openSetting(cfg, s.Parents.SOCKS)
+	return s, nil
+}
+
+// recordHistory adds a revision for the current settings of cfg unless they
+// equal the latest revision, and drops revisions beyond historyLimit.
+func recordHistory(tx *sql.Tx, cfg *Config, actor, comment string) error {
+	snap := cfg.Snapshot()
+	var prev Snapshot
+	var raw string
+	err := tx.QueryRow(`SELECT snapshot FROM config_history ORDER BY version DESC LIMIT 1`).Scan(&raw)
+	first := errors.Is(err, sql.ErrNoRows)
+	if err != nil && !first {
+		return err
+	}
+	if !first {
+		if prev, err = openSnapshot(cfg, raw); err != nil {
+			return err
+		}
+	}
+	changes := Diff(prev, snap)
+	if !first && len(changes) == 0 && comment == "" {
+		return nil
+	}
+	sealed, err := sealSnapshot(cfg, snap)
+	if err != nil {
+		return err
+	}
+	diff, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO config_history(created, actor, comment, snapshot, changes) VALUES(?, ?, ?, ?, ?)`,
+		time.Now().UnixNano(), actor, comment, sealed, string(diff)); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM config_history WHERE version <= (SELECT MAX(version) FROM config_history) - ?`, historyLimit)
+	return err
+}
+
+// History returns up to limit revisions, newest first. A limit of zero or
+// less returns every revision.
+func (s *Store) History(limit int) ([]Revision, error) {
+	if s == nil || s.db == nil {
+		return nil, nil
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(`SELECT version, created, actor, comment, changes FROM config_history ORDER BY version DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Revision
+	for rows.Next() {
+		var rev Revision
+		var created int64
+		var changes string
+		if err := rows.Scan(&rev.Version, &created, &rev.Actor, &rev.Comment, &changes); err != nil {
+			return nil, err
+		}
+		rev.Time = time.Unix(0, created)
+		json.Unmarshal([]byte(changes), &rev.Changes)
+		out = append(out, rev)
+	}
+	return out, rows.Err()
+}
+
+// Snapshot returns the settings recorded in the given revision. cfg provides
+// the key decrypting its secrets.
+func (s *Store) Snapshot(cfg *Config, version int) (Snapshot, error) {
+	if s == nil || s.db == nil {
+		return Snapshot{}, ErrNoRevision
+	}
+	var raw string
+	err := s.db.QueryRow(`SELECT snapshot FROM config_history WHERE version = ?`, version).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Snapshot{}, fmt.Errorf("%w %d", ErrNoRevision, version)
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return openSnapshot(cfg, raw)
+}
+
+// Rollback restores cfg to the settings of the given revision and saves
+// them as a new revision attributed to actor. The users of the revision are
+// restored too only when users is set.
+func (s *Store) Rollback(cfg *Config, version int, actor string, users bool) error {
+	snap, err := s.Snapshot(cfg, version)
+	if err != nil {
+		return err
+	}
+	cfg.Restore(snap, users)
+	return s.SaveWithComment(cfg, actor, fmt.Sprintf("rollback to version %d", version))
+}
@@ -0,0 +1,147 @@
+package config
+
+import "fmt"
+
+// Listener modes.
+const (
+	ModeForward = "forward"
+	ModeReverse = "reverse"
+	ModeSOCKS   = "socks5"
+)
+
+// Listener is an address served by the proxy in a given mode. All listeners
+// share the admin UI and API, the client tracker and the metrics.
+//
+// Reverse listeners balance over Targets when set and over the shared Pool
+// otherwise; Routes restricts the routing table to the named routes. TLS is
+// enabled when both CertFile and KeyFile are set. NoAuth exempts the listener
+// from basic authentication. Timeouts left unset default to the server-wide
+// Config.Timeouts; they do not apply to socks5 listeners.
+type Listener struct {
+	Name     string   `json:"name" yaml:"name"`
+	Addr     string   `json:"addr" yaml:"addr"`
+	Mode     string   `json:"mode" yaml:"mode"`
+	Targets  []string `json:"targets,omitempty" yaml:"targets"`
+	Routes   []string `json:"routes,omitempty" yaml:"routes"`
+	CertFile string   `json:"cert_file,omitempty" yaml:"cert_file"`
+	KeyFile  string   `json:"key_file,omitempty" yaml:"key_file"`
+	NoAuth   bool     `json:"no_auth,omitempty" yaml:"no_auth"`
+
+	Timeouts TimeoutOverrides `json:"timeouts" yaml:"timeouts"`
+}
+
+// TLS reports whether the listener serves HTTPS.
+func (l Listener) TLS() bool {
+	return l.CertFile != "" && l.KeyFile != ""
+}
+
+// Validate checks the listener mode, address and targets.
+func (l Listener) Validate() error {
+	if l.Name == "" {
+		return fmt.Errorf("listener name is required")
+	}
+	if l.Addr == "" {
+		return fmt.Errorf("listener %s: address is required", l.Name)
+	}
+	switch l.Mode {
+	case ModeForward, ModeReverse:
+	case ModeSOCKS:
+		if l.TLS() {
+			return fmt.Errorf("listener %s: TLS is not supported for socks5", l.Name)
+		}
+	default:
+		return fmt.Errorf("listener %s: unknown mode %q", l.Name, l.Mode)
+	}
+	if (l.CertFile == "") != (l.KeyFile == "") {
+		return fmt.Errorf("listener %s: both cert_file and key_file are required for TLS", l.Name)
+	}
+	if l.Mode != ModeReverse && (len(l.Targets) > 0 || len(l.Routes) > 0) {
+		return fmt.Errorf("listener %s: targets and routes require reverse mode", l.Name)
+	}
+	for _, t := range l.Targets {
+		if err := validateUpstreamURL(t); err != nil {
+			return fmt.Errorf("listener %s: %v", l.Name, err)
+		}
+	}
+	if err := l.Timeouts.Validate(); err != nil {
+		return fmt.Errorf("listener %s: %v", l.Name, err)
+	}
+	return nil
+}
+
+// ValidateListeners checks every listener and that names and addresses are unique.
+func ValidateListeners(ls []Listener) error {
+	names := make(map[string]bool)
+	addrs := make(map[string]bool)
+	for _, l := range ls {
+		if err := l.Validate(); err != nil {
+			return err
+		}
+		if names[l.Name] {
+			return fmt.Errorf("duplicate listener name %s", l.Name)
+		}
+		if addrs[l.Addr] {
+			return fmt.Errorf("duplicate listener address %s", l.Addr)
+		}
+		names[l.Name] = true
+		addrs[l.Addr] = true
+	}
+	return nil
+}
+
+// GetListeners returns the configured listeners. Without explicit listeners
+// they are derived from Mode, HTTPAddr, HTTPSAddr and SOCKSAddr.
+func (c *Config) GetListeners() []Listener {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.Listeners) > 0 {
+		out := make([]Listener, len(c.Listeners))
+		copy(out, c.Listeners)
+		return out
+	}
+	var out []Listener
+	if c.HTTPAddr != "" {
+		out = append(out, Listener{Name: "http", Addr: c.HTTPAddr, Mode: c.Mode})
+	}
+	if c.HTTPSAddr != "" && c.CertFile != "" && c.KeyFile != "" {
+		out = append(out, Listener{Name: "https", Addr: c.HTTPSAddr, Mode: c.Mode, CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+	if c.SOCKSAddr != "" {
+		out = append(out, Listener{Name: "socks", Addr: c.SOCKSAddr, Mode: ModeSOCKS})
+	}
+	return out
+}
+
+// RoutesFor returns the routes in evaluation order restricted to names. All
+// routes are returned when names is empty.
+func (c *Config) RoutesFor(names []string) []Route {
+	routes := c.GetRoutes()
+	if len(names) == 0 {
+		return routes
+	}
+	want := make(map[string]bool, len(names))
+	for _, n := range names {
+		want[n] = true
+	}
+	out := routes[:0]
+	for _, r := range routes {
+		if want[r.Name] {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// ListenerPool returns the pool served by a reverse listener: its own targets
+// balanced with the shared policy, or the shared Pool when it has none.
+func (c *Config) ListenerPool(l Listener) UpstreamPool {
+	p := c.GetPool()
+	if len(l.Targets) == 0 {
+		return p
+	}
+	p.Targets = make([]Upstream, 0, len(l.Targets))
+	for _, t := range l.Targets {
+		p.Targets = append(p.Targets, Upstream{URL: t, Weight: 1})
+	}
+	return p
+}
@@ -0,0 +1,37 @@
+package config
+
+import "strings"
+
+// MatchHost reports whether host matches pattern. A pattern of the form
+// "*.example.com" matches any subdomain of example.com, ".example.com" matches
+// example.com and its subdomains and "*" matches every host. Any other pattern
+// must equal the host. Matching is case-insensitive and ignores a port on host.
+func MatchHost(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	host = strings.ToLower(stripPort(host))
+	switch {
+	case pattern == "":
+		return false
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	case strings.HasPrefix(pattern, "."):
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	default:
+		return host == pattern
+	}
+}
+
+func stripPort(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if i := strings.Index(host, "]"); i > 0 {
+			return host[1:i]
+		}
+		return host
+	}
+	if strings.Count(host, ":") == 1 {
+		return host[:strings.Index(host, ":")]
+	}
+	return host
+}
@@ -0,0 +1,88 @@
+package config
+
+import "fmt"
+
+// Rate limit keys.
+const (
+	LimitByIP    = "ip"
+	LimitByUser  = "user"
+	LimitByHost  = "host"
+	LimitByRoute = "route"
+)
+
+// RateLimit is a token bucket limit applied separately to every value of
+// Key: the client IP, the authenticated user, the destination host or the
+// matched reverse proxy route. Rate is the sustained number of requests per
+// second and Burst the bucket size, defaulting to the rate rounded up.
+// Concurrent caps the requests in flight. A zero Rate or Concurrent leaves
+// that dimension unlimited.
+type RateLimit struct {
+	Name       string  `json:"name"`
+	Key        string  `json:"key"`
+	Rate       float64 `json:"rate"`
+	Burst      int     `json:"burst,omitempty"`
+	Concurrent int     `json:"concurrent,omitempty"`
+}
+
+// Validate checks the limit's key and values.
+func (l RateLimit) Validate() error {
+	if l.Name == "" {
+		return fmt.Errorf("rate limit name is required")
+	}
+	switch l.Key {
+	case LimitByIP, LimitByUser, LimitByHost, LimitByRoute:
+	default:
+		return fmt.Errorf("rate limit %s: unknown key %q", l.Name, l.Key)
+	}
+	if l.Rate < 0 || l.Burst < 0 || l.Concurrent < 0 {
+		return fmt.Errorf("rate limit %s: values must not be negative", l.Name)
+	}
+	if l.Rate == 0 && l.Concurrent == 0 {
+		return fmt.Errorf("rate limit %s: rate or concurrent is required", l.Name)
+	}
+	return nil
+}
+
+// SetRateLimit adds a rate limit or replaces the one with the same name.
+func (c *Config) SetRateLimit(l RateLimit) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, existing := range c.RateLimits {
+		if existing.Name == l.Name {
+			c.RateLimits[i] = l
+			return nil
+		}
+	}
+	c.RateLimits = append(c.RateLimits, l)
+	return nil
+}
+
+// DeleteRateLimit removes the named rate limit.
+func (c *Config) DeleteRateLimit(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.RateLimits[:0]
+	for _, l := range c.RateLimits {
+		if l.Name != name {
+			out = append(out, l)
+		}
+	}
+	c.RateLimits = out
+}
+
+// SetRateLimits replaces all rate limits.
+func (c *Config) SetRateLimits(limits []RateLimit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.RateLimits = append([]RateLimit(nil), limits...)
+}
+
+// GetRateLimits returns a copy of the rate limits.
+func (c *Config) GetRateLimits() []RateLimit {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]RateLimit{}, c.RateLimits...)
+}
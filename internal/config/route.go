@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Route sends matching reverse proxy requests to a dedicated target instead
+// of the upstream pool. Empty match fields match everything.
+//
+// Host is a host pattern as accepted by MatchHost. PathPrefix and PathRegex
+// match the request path; Methods lists accepted methods and Headers maps
+// header names to required values, where an empty value only requires the
+// header to be present.
+//
+// Before forwarding, StripPrefix removes PathPrefix from the path. Rewrite
+// replaces the matched part of the path: the PathRegex match when a regex is
+// set, in which case $1 style references are expanded, or PathPrefix
+// otherwise. Routes are evaluated by descending Priority and then in the
+// order they were added.
+type Route struct {
+	Name        string            `json:"name"`
+	Priority    int               `json:"priority"`
+	Host        string            `json:"host,omitempty"`
+	PathPrefix  string            `json:"path_prefix,omitempty"`
+	PathRegex   string            `json:"path_regex,omitempty"`
+	Methods     []string          `json:"methods,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Target      string            `json:"target"`
+	StripPrefix bool              `json:"strip_prefix,omitempty"`
+	Rewrite     string            `json:"rewrite,omitempty"`
+}
+
+// Validate checks that the route is named, has a valid target and compiles.
+func (r Route) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("route name is required")
+	}
+	if err := validateUpstreamURL(r.Target); err != nil {
+		return fmt.Errorf("route %s: %v", r.Name, err)
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+		return fmt.Errorf("route %s: path prefix must start with /", r.Name)
+	}
+	if r.PathRegex != "" {
+		if _, err := regexp.Compile(r.PathRegex); err != nil {
+			return fmt.Errorf("route %s: %v", r.Name, err)
+		}
+	}
+	if r.StripPrefix && r.PathPrefix == "" {
+		return fmt.Errorf("route %s: strip_prefix requires path_prefix", r.Name)
+	}
+	if r.Rewrite != "" && r.PathRegex == "" && r.PathPrefix == "" {
+		return fmt.Errorf("route %s: rewrite requires path_prefix or path_regex", r.Name)
+	}
+	for _, m := range r.Methods {
+		if m == "" || strings.ToUpper(m) != m {
+			return fmt.Errorf("route %s: invalid method %q", r.Name, m)
+		}
+	}
+	for k := range r.Headers {
+		if k == "" {
+			return fmt.Errorf("route %s: empty header name", r.Name)
+		}
+	}
+	return nil
+}
+
+func (r Route) clone() Route {
+	r.Methods = append([]string(nil), r.Methods...)
+	if r.Headers != nil {
+		h := make(map[string]string, len(r.Headers))
+		for k, v := range r.Headers {
+			h[http.CanonicalHeaderKey(k)] = v
+		}
+		r.Headers = h
+	}
+	return r
+}
+
+// SetRoute adds a route or replaces the route with the same name.
+func (c *Config) SetRoute(r Route) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, existing := range c.Routes {
+		if existing.Name == r.Name {
+			c.Routes[i] = r.clone()
+			return nil
+		}
+	}
+	c.Routes = append(c.Routes, r.clone())
+	return nil
+}
+
+// DeleteRoute removes the named route.
+func (c *Config) DeleteRoute(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.Routes[:0]
+	for _, r := range c.Routes {
+		if r.Name != name {
+			out = append(out, r)
+		}
+	}
+	c.Routes = out
+}
+
+// SetRoutes replaces the routing table.
+func (c *Config) SetRoutes(routes []Route) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Routes = make([]Route, 0, len(routes))
+	for _, r := range routes {
+		c.Routes = append(c.Routes, r.clone())
+	}
+}
+
+// GetRoutes returns a copy of the routing table in evaluation order.
+func (c *Config) GetRoutes() []Route {
+	c.mu.RLock()
+	out := make([]Route, 0, len(c.Routes))
+	for _, r := range c.Routes {
+		out = append(out, r.clone())
+	}
+	c.mu.RUnlock()
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Priority > out[j].Priority })
+	return out
+}
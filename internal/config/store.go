@@ -7,9 +7,13 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -73,15 +77,119 @@ func NewStore(path string) (*Store, error) {
 		db.Close()
 		return nil, err
 	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
 	return &Store{db: db}, nil
 }
 
+// migrations upgrade the schema created by initSchema. They are applied in
+// order, each in its own transaction, and the index of the last applied
+// migration plus one is recorded as the schema version. Append new
+// migrations to the end and never change or reorder existing ones.
+var migrations = []func(tx *sql.Tx) error{
+	// 1: per-client headers.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS client_headers (client TEXT, name TEXT, value TEXT, PRIMARY KEY (client, name));`)
+		return err
+	},
+	// 2: configuration history.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS config_history (version INTEGER PRIMARY KEY AUTOINCREMENT, created INTEGER NOT NULL, actor TEXT, comment TEXT, snapshot TEXT, changes TEXT);`)
+		return err
+	},
+	// 3: user accounts.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS users (name TEXT PRIMARY KEY, role TEXT, password_hash TEXT);`)
+		return err
+	},
+	// 4: API tokens.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS api_tokens (name TEXT PRIMARY KEY, scopes TEXT, hash TEXT, created INTEGER, expires INTEGER, last_used INTEGER);`)
+		return err
+	},
+}
+
+// migrate applies the migrations newer than the recorded schema version.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL);`); err != nil {
+		return err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := migrations[i](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("schema migration %d: %v", i+1, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_version`); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version(version) VALUES(?)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return version, err
+}
+
+// SchemaVersion returns the version of the database schema.
+func (s *Store) SchemaVersion() (int, error) {
+	if s == nil || s.db == nil {
+		return 0, nil
+	}
+	return schemaVersion(s.db)
+}
+
 func initSchema(db *sql.DB) error {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS headers (name TEXT PRIMARY KEY, value TEXT);`)
 	if err != nil {
 		return err
 	}
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS settings (key TEXT PRIMARY KEY, value TEXT);`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS parent_rules (position INTEGER PRIMARY KEY, pattern TEXT, via TEXT);`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS upstreams (position INTEGER PRIMARY KEY, url TEXT, weight INTEGER);`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS routes (position INTEGER PRIMARY KEY, name TEXT, priority INTEGER, host TEXT, path_prefix TEXT, path_regex TEXT, methods TEXT, headers TEXT, target TEXT, strip_prefix INTEGER, rewrite TEXT);`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS rate_limits (position INTEGER PRIMARY KEY, name TEXT, key TEXT, rate REAL, burst INTEGER, concurrent INTEGER);`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS acl_rules (position INTEGER PRIMARY KEY, name TEXT, action TEXT, hosts TEXT, host_regex TEXT, ports TEXT, clients TEXT, users TEXT, methods TEXT);`)
 	return err
 }
 
@@ -110,6 +218,9 @@ func (s *Store) Load(cfg *Config) error {
 		}
 		cfg.SetHeader(name, value)
 	}
+	if err := s.loadClientHeaders(cfg); err != nil {
+		return err
+	}
 	// settings
 	var val string
 	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='log_level'`).Scan(&val); err == nil {
@@ -127,6 +238,64 @@ func (s *Store) Load(cfg *Config) error {
 	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='proxy_id'`).Scan(&val); err == nil {
 		cfg.ProxyID = val
 	}
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='mitm_enabled'`).Scan(&val); err == nil {
+		cfg.MITMEnabled, _ = strconv.ParseBool(val)
+	}
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='mitm_bypass'`).Scan(&val); err == nil {
+		cfg.MITMBypass = splitList(val)
+	}
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='trusted_proxies'`).Scan(&val); err == nil {
+		if proxies := splitList(val); len(proxies) > 0 {
+			cfg.SetTrustedProxies(proxies)
+		}
+	}
+	if err := s.loadParents(cfg); err != nil {
+		return err
+	}
+	if err := s.loadPool(cfg); err != nil {
+		return err
+	}
+	if err := s.loadRoutes(cfg); err != nil {
+		return err
+	}
+	if err := s.loadRateLimits(cfg); err != nil {
+		return err
+	}
+	if err := s.loadACL(cfg); err != nil {
+		return err
+	}
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='health_check'`).Scan(&val); err == nil {
+		var hc HealthCheck
+		if json.Unmarshal([]byte(val), &hc) == nil {
+			cfg.SetHealthCheck(hc)
+		}
+	}
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='forwarding'`).Scan(&val); err == nil {
+		var f Forwarding
+		if json.Unmarshal([]byte(val), &f) == nil {
+			cfg.SetForwarding(f)
+		}
+	}
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='access_log'`).Scan(&val); err == nil {
+		var a AccessLog
+		if json.Unmarshal([]byte(val), &a) == nil {
+			cfg.SetAccessLog(a)
+		}
+	}
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='tunnels'`).Scan(&val); err == nil {
+		var t TunnelTimeouts
+		if json.Unmarshal([]byte(val), &t) == nil {
+			cfg.SetTunnelTimeouts(t)
+		}
+	}
+	if err := s.loadUsers(cfg); err != nil {
+		return err
+	}
+	if err := s.loadTokens(cfg); err != nil {
+		return err
+	}
+	// Credentials saved by older versions, turned into a user by
+	// Config.BootstrapAdmin and dropped on the next save.
 	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='username'`).Scan(&val); err == nil {
 		if cfg.SecretKey != "" {
 			if dec, err := decrypt(cfg.SecretKey, val); err == nil {
@@ -148,8 +317,21 @@ func (s *Store) Load(cfg *Config) error {
 	return rows.Err()
 }
 
-// Save writes the given configuration to the store.
+// Save writes the given configuration to the store on behalf of the proxy
+// itself.
 func (s *Store) Save(cfg *Config) error {
+	return s.SaveAs(cfg, "system")
+}
+
+// SaveAs writes the given configuration to the store and records it in the
+// configuration history as changed by actor.
+func (s *Store) SaveAs(cfg *Config, actor string) error {
+	return s.SaveWithComment(cfg, actor, "")
+}
+
+// SaveWithComment is SaveAs with a comment describing the change, which is
+// recorded even if no setting changed.
+func (s *Store) SaveWithComment(cfg *Config, actor, comment string) error {
 	if s == nil || s.db == nil {
 		return nil
 	}
@@ -168,6 +350,10 @@ func (s *Store) Save(cfg *Config) error {
 			return err
 		}
 	}
+	if err := saveClientHeaders(tx, cfg); err != nil {
+		tx.Rollback()
+		return err
+	}
 	// log level
 	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('log_level', ?)`, LevelString(cfg.GetLogLevel())); err != nil {
 		tx.Rollback()
@@ -189,23 +375,494 @@ func (s *Store) Save(cfg *Config) error {
 		tx.Rollback()
 		return err
 	}
-	user := cfg.Username
-	pass := cfg.Password
-	if cfg.SecretKey != "" {
-		if enc, err := encrypt(cfg.SecretKey, cfg.Username); err == nil {
-			user = enc
-		}
-		if enc, err := encrypt(cfg.SecretKey, cfg.Password); err == nil {
-			pass = enc
-		}
+	mitmEnabled, mitmBypass := cfg.GetMITM()
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('mitm_enabled', ?)`, strconv.FormatBool(mitmEnabled)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('mitm_bypass', ?)`, strings.Join(mitmBypass, "\n")); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('trusted_proxies', ?)`, strings.Join(cfg.GetTrustedProxies(), "\n")); err != nil {
+		tx.Rollback()
+		return err
 	}
-	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('username', ?)`, user); err != nil {
+	if err := saveParents(tx, cfg); err != nil {
 		tx.Rollback()
 		return err
 	}
-	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('password', ?)`, pass); err != nil {
+	if err := savePool(tx, cfg); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := saveRoutes(tx, cfg); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := saveRateLimits(tx, cfg); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := saveACL(tx, cfg); err != nil {
+		tx.Rollback()
+		return err
+	}
+	health, _ := json.Marshal(cfg.GetHealthCheck())
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('health_check', ?)`, string(health)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	forwarding, _ := json.Marshal(cfg.GetForwarding())
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('forwarding', ?)`, string(forwarding)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	accessLog, _ := json.Marshal(cfg.GetAccessLog())
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('access_log', ?)`, string(accessLog)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	tunnels, _ := json.Marshal(cfg.GetTunnelTimeouts())
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('tunnels', ?)`, string(tunnels)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := saveUsers(tx, cfg); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := saveTokens(tx, cfg); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := recordHistory(tx, cfg, actor, comment); err != nil {
 		tx.Rollback()
 		return err
 	}
 	return tx.Commit()
 }
+
+// splitList splits a newline separated settings value, dropping empty entries.
+func splitList(val string) []string {
+	var out []string
+	for _, v := range strings.Split(val, "\n") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// sealSetting encrypts a sensitive settings value when a secret key is configured.
+func sealSetting(cfg *Config, val string) string {
+	if cfg.SecretKey == "" || val == "" {
+		return val
+	}
+	if enc, err := encrypt(cfg.SecretKey, val); err == nil {
+		return enc
+	}
+	return val
+}
+
+// openSetting reverses sealSetting.
+func openSetting(cfg *Config, val string) string {
+	if cfg.SecretKey == "" || val == "" {
+		return val
+	}
+	if dec, err := decrypt(cfg.SecretKey, val); err == nil {
+		return dec
+	}
+	return val
+}
+
+func (s *Store) loadParents(cfg *Config) error {
+	p := cfg.GetParents()
+	var val string
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='parent_http'`).Scan(&val); err == nil {
+		p.HTTP = openSetting(cfg, val)
+	}
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='parent_socks'`).Scan(&val); err == nil {
+		p.SOCKS = openSetting(cfg, val)
+	}
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='parent_default'`).Scan(&val); err == nil {
+		p.Default = val
+	}
+	rows, err := s.db.Query(`SELECT pattern, via FROM parent_rules ORDER BY position`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var rules []ParentRule
+	for rows.Next() {
+		var r ParentRule
+		if err := rows.Scan(&r.Pattern, &r.Via); err != nil {
+			return err
+		}
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(rules) > 0 {
+		p.Rules = rules
+	}
+	cfg.SetParents(p)
+	return nil
+}
+
+func saveParents(tx *sql.Tx, cfg *Config) error {
+	p := cfg.GetParents()
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('parent_http', ?)`, sealSetting(cfg, p.HTTP)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('parent_socks', ?)`, sealSetting(cfg, p.SOCKS)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('parent_default', ?)`, p.Default); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM parent_rules`); err != nil {
+		return err
+	}
+	for i, r := range p.Rules {
+		if _, err := tx.Exec(`INSERT INTO parent_rules(position, pattern, via) VALUES(?, ?, ?)`, i, r.Pattern, r.Via); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) loadPool(cfg *Config) error {
+	p := cfg.GetPool()
+	var val string
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='balance_policy'`).Scan(&val); err == nil {
+		p.Policy = val
+	}
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='balance_hash_key'`).Scan(&val); err == nil {
+		p.HashKey = val
+	}
+	rows, err := s.db.Query(`SELECT url, weight FROM upstreams ORDER BY position`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var targets []Upstream
+	for rows.Next() {
+		var u Upstream
+		if err := rows.Scan(&u.URL, &u.Weight); err != nil {
+			return err
+		}
+		targets = append(targets, u)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(targets) > 0 {
+		p.Targets = targets
+	}
+	cfg.SetPool(p)
+	return nil
+}
+
+func savePool(tx *sql.Tx, cfg *Config) error {
+	p := cfg.GetPool()
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('balance_policy', ?)`, p.Policy); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('balance_hash_key', ?)`, p.HashKey); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM upstreams`); err != nil {
+		return err
+	}
+	for i, u := range p.Targets {
+		if _, err := tx.Exec(`INSERT INTO upstreams(position, url, weight) VALUES(?, ?, ?)`, i, u.URL, u.Weight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) loadRoutes(cfg *Config) error {
+	rows, err := s.db.Query(`SELECT name, priority, host, path_prefix, path_regex, methods, headers, target, strip_prefix, rewrite FROM routes ORDER BY position`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var routes []Route
+	for rows.Next() {
+		var r Route
+		var methods, headers string
+		if err := rows.Scan(&r.Name, &r.Priority, &r.Host, &r.PathPrefix, &r.PathRegex, &methods, &headers, &r.Target, &r.StripPrefix, &r.Rewrite); err != nil {
+			return err
+		}
+		r.Methods = splitList(methods)
+		if headers != "" {
+			if err := json.Unmarshal([]byte(headers), &r.Headers); err != nil {
+				return err
+			}
+		}
+		routes = append(routes, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(routes) > 0 {
+		cfg.SetRoutes(routes)
+	}
+	return nil
+}
+
+func saveRoutes(tx *sql.Tx, cfg *Config) error {
+	if _, err := tx.Exec(`DELETE FROM routes`); err != nil {
+		return err
+	}
+	for i, r := range cfg.GetRoutes() {
+		var headers []byte
+		if len(r.Headers) > 0 {
+			headers, _ = json.Marshal(r.Headers)
+		}
+		if _, err := tx.Exec(`INSERT INTO routes(position, name, priority, host, path_prefix, path_regex, methods, headers, target, strip_prefix, rewrite) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			i, r.Name, r.Priority, r.Host, r.PathPrefix, r.PathRegex, strings.Join(r.Methods, "\n"), string(headers), r.Target, r.StripPrefix, r.Rewrite); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) loadRateLimits(cfg *Config) error {
+	rows, err := s.db.Query(`SELECT name, key, rate, burst, concurrent FROM rate_limits ORDER BY position`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var limits []RateLimit
+	for rows.Next() {
+		var l RateLimit
+		if err := rows.Scan(&l.Name, &l.Key, &l.Rate, &l.Burst, &l.Concurrent); err != nil {
+			return err
+		}
+		limits = append(limits, l)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(limits) > 0 {
+		cfg.SetRateLimits(limits)
+	}
+	return nil
+}
+
+func saveRateLimits(tx *sql.Tx, cfg *Config) error {
+	if _, err := tx.Exec(`DELETE FROM rate_limits`); err != nil {
+		return err
+	}
+	for i, l := range cfg.GetRateLimits() {
+		if _, err := tx.Exec(`INSERT INTO rate_limits(position, name, key, rate, burst, concurrent) VALUES(?, ?, ?, ?, ?, ?)`, i, l.Name, l.Key, l.Rate, l.Burst, l.Concurrent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) loadACL(cfg *Config) error {
+	a := cfg.GetACL()
+	var val string
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='acl_default'`).Scan(&val); err == nil {
+		a.Default = val
+	}
+	if err := s.db.QueryRow(`SELECT value FROM settings WHERE key='acl_deny_page'`).Scan(&val); err == nil {
+		a.DenyPage = val
+	}
+	rows, err := s.db.Query(`SELECT name, action, hosts, host_regex, ports, clients, users, methods FROM acl_rules ORDER BY position`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var rules []ACLRule
+	for rows.Next() {
+		var r ACLRule
+		var hosts, ports, clients, users, methods string
+		if err := rows.Scan(&r.Name, &r.Action, &hosts, &r.HostRegex, &ports, &clients, &users, &methods); err != nil {
+			return err
+		}
+		r.Hosts = splitList(hosts)
+		for _, p := range splitList(ports) {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return err
+			}
+			r.Ports = append(r.Ports, n)
+		}
+		r.Clients = splitList(clients)
+		r.Users = splitList(users)
+		r.Methods = splitList(methods)
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(rules) > 0 {
+		a.Rules = rules
+	}
+	return cfg.SetACL(a)
+}
+
+func saveACL(tx *sql.Tx, cfg *Config) error {
+	a := cfg.GetACL()
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('acl_default', ?)`, a.Default); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO settings(key, value) VALUES('acl_deny_page', ?)`, a.DenyPage); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM acl_rules`); err != nil {
+		return err
+	}
+	for i, r := range a.Rules {
+		ports := make([]string, 0, len(r.Ports))
+		for _, p := range r.Ports {
+			ports = append(ports, strconv.Itoa(p))
+		}
+		if _, err := tx.Exec(`INSERT INTO acl_rules(position, name, action, hosts, host_regex, ports, clients, users, methods) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			i, r.Name, r.Action, strings.Join(r.Hosts, "\n"), r.HostRegex, strings.Join(ports, "\n"), strings.Join(r.Clients, "\n"), strings.Join(r.Users, "\n"), strings.Join(r.Methods, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) loadClientHeaders(cfg *Config) error {
+	rows, err := s.db.Query(`SELECT client, name, value FROM client_headers`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var client, name, value string
+		if err := rows.Scan(&client, &name, &value); err != nil {
+			return err
+		}
+		cfg.SetClientHeader(client, name, value)
+	}
+	return rows.Err()
+}
+
+func saveClientHeaders(tx *sql.Tx, cfg *Config) error {
+	if _, err := tx.Exec(`DELETE FROM client_headers`); err != nil {
+		return err
+	}
+	for client, hdrs := range cfg.GetAllClientHeaders() {
+		for name, value := range hdrs {
+			if _, err := tx.Exec(`INSERT INTO client_headers(client, name, value) VALUES(?, ?, ?)`, client, name, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) loadUsers(cfg *Config) error {
+	rows, err := s.db.Query(`SELECT name, role, password_hash FROM users ORDER BY name`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.Name, &u.Role, &u.PasswordHash); err != nil {
+			return err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		cfg.SetUsers(users)
+	}
+	return nil
+}
+
+func saveUsers(tx *sql.Tx, cfg *Config) error {
+	if _, err := tx.Exec(`DELETE FROM settings WHERE key IN ('username', 'password')`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM users`); err != nil {
+		return err
+	}
+	for _, u := range cfg.GetUsers() {
+		if _, err := tx.Exec(`INSERT INTO users(name, role, password_hash) VALUES(?, ?, ?)`, u.Name, u.Role, u.PasswordHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) loadTokens(cfg *Config) error {
+	rows, err := s.db.Query(`SELECT name, scopes, hash, created, expires, last_used FROM api_tokens ORDER BY name`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var tokens []Token
+	for rows.Next() {
+		var t Token
+		var scopes string
+		var created, expires, lastUsed int64
+		if err := rows.Scan(&t.Name, &scopes, &t.Hash, &created, &expires, &lastUsed); err != nil {
+			return err
+		}
+		t.Scopes = splitList(scopes)
+		t.Created, t.Expires, t.LastUsed = unixTime(created), unixTime(expires), unixTime(lastUsed)
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(tokens) > 0 {
+		cfg.SetTokens(tokens)
+	}
+	return nil
+}
+
+func saveTokens(tx *sql.Tx, cfg *Config) error {
+	if _, err := tx.Exec(`DELETE FROM api_tokens`); err != nil {
+		return err
+	}
+	for _, t := range cfg.GetTokens() {
+		if _, err := tx.Exec(`INSERT INTO api_tokens(name, scopes, hash, created, expires, last_used) VALUES(?, ?, ?, ?, ?, ?)`,
+			t.Name, strings.Join(t.Scopes, "\n"), t.Hash, timeUnix(t.Created), timeUnix(t.Expires), timeUnix(t.LastUsed)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TouchToken records when the named API token was last used without
+// saving the rest of the configuration.
+func (s *Store) TouchToken(name string, t time.Time) error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	_, err := s.db.Exec(`UPDATE api_tokens SET last_used = ? WHERE name = ?`, timeUnix(t), name)
+	return err
+}
+
+// timeUnix and unixTime convert between times and Unix seconds, with zero
+// standing for the zero time.
+func timeUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func unixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
@@ -1,9 +1,13 @@
 package config
 
 import (
+	"errors"
 	log "github.com/pod32g/simple-logger"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -31,10 +35,23 @@ func TestStoreSaveLoad(t *testing.T) {
 	}
 	cfg := &Config{SecretKey: "k"}
 	cfg.SetHeader("H", "v")
+	cfg.SetClientHeader("10.0.0.0/8", "X-Office", "hq")
+	cfg.SetClientHeader("user:alice", "X-Team", "ops")
 	cfg.SetLogLevel(log.DEBUG)
 	cfg.SetAuth(true, "u", "p")
 	cfg.SetStatsEnabled(true)
 	cfg.SetIdentity("n", "id")
+	cfg.SetMITM(true, []string{"a.example", "b.example"})
+	cfg.SetPool(UpstreamPool{Targets: []Upstream{{URL: "http://a:1", Weight: 2}}, Policy: BalanceHash, HashKey: "ip"})
+	cfg.SetHealthCheck(HealthCheck{Enabled: true, Path: "/healthz", MaxFailures: 7})
+	cfg.SetForwarding(Forwarding{XForwardedFor: true, Anonymize: AnonymizeTruncate})
+	cfg.SetAccessLog(AccessLog{Enabled: true, Format: LogFormatJSON, MaxAge: Duration(time.Hour)})
+	cfg.SetTunnelTimeouts(TunnelTimeouts{Idle: Duration(time.Minute), Dial: Duration(5 * time.Second)})
+	cfg.SetTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	cfg.SetRateLimit(RateLimit{Name: "agents", Key: LimitByUser, Rate: 2.5, Burst: 5})
+	cfg.SetACL(AccessControl{Default: ACLDeny, DenyPage: "<p>blocked</p>", Rules: []ACLRule{{Name: "lab", Action: ACLAllow, Hosts: []string{".corp"}, Ports: []int{80, 443}, Clients: []string{"10.0.0.0/8"}}}})
+	cfg.SetRoute(Route{Name: "billing", PathPrefix: "/billing/", Methods: []string{"GET", "POST"}, Headers: map[string]string{"X-Team": "pay"}, Target: "http://b:1", StripPrefix: true})
+	cfg.SetParents(ParentProxies{HTTP: "http://u:p@proxy:3128", Rules: []ParentRule{{Pattern: "*.corp", Via: ViaHTTP}}})
 	if err := store.Save(cfg); err != nil {
 		t.Fatal(err)
 	}
@@ -45,8 +62,10 @@ func TestStoreSaveLoad(t *testing.T) {
 	if loaded.GetHeaders()["H"] != "v" || loaded.GetLogLevel() != log.DEBUG {
 		t.Fatalf("load mismatch")
 	}
-	e, u, p := loaded.GetAuth()
-	if !e || u != "u" || p != "p" {
+	if ch := loaded.GetAllClientHeaders(); ch["10.0.0.0/8"]["X-Office"] != "hq" || ch["user:alice"]["X-Team"] != "ops" {
+		t.Fatalf("client headers mismatch: %v", ch)
+	}
+	if role, ok := loaded.Authenticate("u", "p"); !ok || role != RoleAdmin || !loaded.AuthRequired() {
 		t.Fatalf("auth mismatch")
 	}
 	if !loaded.StatsEnabledState() {
@@ -56,5 +75,217 @@ func TestStoreSaveLoad(t *testing.T) {
 	if n != "n" || id2 != "id" {
 		t.Fatalf("id mismatch")
 	}
+	if mitm, bypass := loaded.GetMITM(); !mitm || len(bypass) != 2 {
+		t.Fatalf("mitm mismatch: %v %v", mitm, bypass)
+	}
+	if p := loaded.GetParents(); p.HTTP != "http://u:p@proxy:3128" || len(p.Rules) != 1 {
+		t.Fatalf("parents mismatch: %+v", p)
+	}
+	if p := loaded.GetPool(); len(p.Targets) != 1 || p.Targets[0].Weight != 2 || p.Policy != BalanceHash {
+		t.Fatalf("pool mismatch: %+v", p)
+	}
+	if hc := loaded.GetHealthCheck(); !hc.Enabled || hc.Path != "/healthz" || hc.MaxFailures != 7 {
+		t.Fatalf("health check mismatch: %+v", hc)
+	}
+	if f := loaded.GetForwarding(); !f.XForwardedFor || f.Anonymize != AnonymizeTruncate {
+		t.Fatalf("forwarding not persisted: %+v", f)
+	}
+	if a := loaded.GetAccessLog(); !a.Enabled || a.Format != LogFormatJSON || a.MaxAge.Std() != time.Hour {
+		t.Fatalf("access log not persisted: %+v", a)
+	}
+	if tt := loaded.GetTunnelTimeouts(); tt.Idle.Std() != time.Minute || tt.Dial.Std() != 5*time.Second || tt.MaxLifetime != 0 {
+		t.Fatalf("tunnel timeouts not persisted: %+v", tt)
+	}
+	if r := loaded.GetRoutes(); len(r) != 1 || len(r[0].Methods) != 2 || r[0].Headers["X-Team"] != "pay" || !r[0].StripPrefix {
+		t.Fatalf("routes mismatch: %+v", r)
+	}
+	if l := loaded.GetRateLimits(); len(l) != 1 || l[0].Rate != 2.5 || l[0].Key != LimitByUser {
+		t.Fatalf("rate limits mismatch: %+v", l)
+	}
+	if p := loaded.GetTrustedProxies(); len(p) != 2 || p[1] != "192.0.2.1" {
+		t.Fatalf("trusted proxies mismatch: %v", p)
+	}
+	if a := loaded.GetACL(); a.Default != ACLDeny || a.DenyPage != "<p>blocked</p>" || len(a.Rules) != 1 || len(a.Rules[0].Ports) != 2 || a.Rules[0].Clients[0] != "10.0.0.0/8" {
+		t.Fatalf("acl mismatch: %+v", a)
+	}
 	store.Close()
 }
+
+func TestStoreMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.db")
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := store.SchemaVersion(); err != nil || v != len(migrations) {
+		t.Fatalf("unexpected schema version %d: %v", v, err)
+	}
+	store.Close()
+
+	// Reopening applies nothing and keeps the version.
+	store, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := store.SchemaVersion(); v != len(migrations) {
+		t.Fatalf("version changed on reopen: %d", v)
+	}
+	if _, err := store.db.Exec(`UPDATE schema_version SET version = ?`, len(migrations)+1); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	if _, err := NewStore(path); err == nil {
+		t.Fatalf("expected error for a newer schema")
+	}
+}
+
+func TestStoreLegacyCredentials(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "config.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	user, _ := encrypt("k", "old")
+	pass, _ := encrypt("k", "secret")
+	store.db.Exec(`INSERT INTO settings(key, value) VALUES('username', ?), ('password', ?)`, user, pass)
+
+	cfg := &Config{SecretKey: "k"}
+	if err := store.Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.BootstrapAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(cfg); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	store.db.QueryRow(`SELECT COUNT(*) FROM settings WHERE key IN ('username', 'password')`).Scan(&n)
+	if n != 0 {
+		t.Fatalf("legacy credentials kept")
+	}
+	loaded := &Config{SecretKey: "k"}
+	store.Load(loaded)
+	if role, ok := loaded.Authenticate("old", "secret"); !ok || role != RoleAdmin {
+		t.Fatalf("legacy credentials not migrated to a user")
+	}
+}
+
+func TestStoreTokens(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "config.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	cfg := &Config{}
+	secret, _ := cfg.CreateToken("terraform", []string{ScopeRead, ScopeWrite}, time.Hour)
+	if err := store.Save(cfg); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	store.db.QueryRow(`SELECT COUNT(*) FROM api_tokens WHERE hash = ?`, secret).Scan(&n)
+	if n != 0 {
+		t.Fatalf("token secret stored in plain text")
+	}
+	used := time.Now().Add(time.Minute)
+	if err := store.TouchToken("terraform", used); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &Config{}
+	if err := store.Load(loaded); err != nil {
+		t.Fatal(err)
+	}
+	tokens := loaded.GetTokens()
+	if len(tokens) != 1 || len(tokens[0].Scopes) != 2 || tokens[0].Expires.IsZero() || tokens[0].LastUsed.Unix() != used.Unix() {
+		t.Fatalf("unexpected tokens: %+v", tokens)
+	}
+	if _, ok := loaded.AuthenticateToken(secret); !ok {
+		t.Fatalf("loaded token not accepted")
+	}
+}
+
+func TestStoreHistory(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "config.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	cfg := &Config{SecretKey: "k"}
+	cfg.SetHeader("X-Env", "dev")
+	if err := store.SaveAs(cfg, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// Saving unchanged settings records nothing.
+	store.Save(cfg)
+	cfg.SetHeader("X-Env", "prod")
+	cfg.SetAuth(true, "u", "secret")
+	store.SaveAs(cfg, "api")
+
+	revs, err := store.History(0)
+	if err != nil || len(revs) != 2 {
+		t.Fatalf("unexpected history %+v: %v", revs, err)
+	}
+	if revs[0].Version != 2 || revs[0].Actor != "api" || revs[1].Actor != "alice" {
+		t.Fatalf("unexpected revisions: %+v", revs)
+	}
+	changes := map[string]Change{}
+	for _, c := range revs[0].Changes {
+		changes[c.Path] = c
+	}
+	if c := changes["headers.X-Env"]; c.Old != "dev" || c.New != "prod" {
+		t.Fatalf("unexpected header change: %+v", revs[0].Changes)
+	}
+	if c := changes["users[u].password_hash"]; c.New != "********" {
+		t.Fatalf("password not masked: %+v", c)
+	}
+
+	if err := store.Rollback(cfg, 1, "bob", false); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GetHeaders()["X-Env"] != "dev" {
+		t.Fatalf("rollback not applied: %v", cfg.GetHeaders())
+	}
+	if !cfg.AuthEnabledState() || len(cfg.GetUsers()) != 1 {
+		t.Fatalf("users rolled back without being asked for")
+	}
+	revs, _ = store.History(1)
+	if revs[0].Version != 3 || revs[0].Actor != "bob" || revs[0].Comment != "rollback to version 1" {
+		t.Fatalf("rollback not recorded: %+v", revs[0])
+	}
+	if err := store.Rollback(cfg, 1, "bob", true); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AuthEnabledState() || len(cfg.GetUsers()) != 0 {
+		t.Fatalf("auth not rolled back")
+	}
+	snap, err := store.Snapshot(cfg, 2)
+	if err != nil || len(snap.Users) != 1 || !strings.HasPrefix(snap.Users[0].PasswordHash, "$2") {
+		t.Fatalf("snapshot users not restored: %+v %v", snap.Users, err)
+	}
+	if _, err := store.Snapshot(cfg, 9); !errors.Is(err, ErrNoRevision) {
+		t.Fatalf("expected ErrNoRevision, got %v", err)
+	}
+}
+
+func TestDiffKeysListsByName(t *testing.T) {
+	from := Snapshot{Routes: []Route{{Name: "a", Target: "http://a"}, {Name: "b", Target: "http://b"}}}
+	to := Snapshot{Routes: []Route{{Name: "b", Target: "http://b2"}}, Parents: ParentProxies{HTTP: "http://u:pw@p:3128"}}
+	got := Diff(from, to)
+	want := []Change{
+		{Path: "parents.http", New: "http://u:xxxxx@p:3128"},
+		{Path: "routes[a].name", Old: "a"},
+		{Path: "routes[a].priority", Old: "0"},
+		{Path: "routes[a].target", Old: "http://a"},
+		{Path: "routes[b].target", Old: "http://b", New: "http://b2"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected diff: %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("change %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package config
+
+import "errors"
+
+// ServerTimeouts are the timeouts of an HTTP listener. ReadHeader, Read,
+// Write and Idle are those of http.Server: Read covers the whole request,
+// body included, and Write the response from the end of the request header.
+// The write deadline is extended by Write for every chunk of streaming
+// responses, so that event streams and long polling outlive it as long as
+// they make progress. ResponseHeader limits the wait for the response header
+// of the upstream server once the request has been sent. Zero disables a
+// timeout.
+type ServerTimeouts struct {
+	ReadHeader     Duration `json:"read_header,omitempty" yaml:"read_header"`
+	Read           Duration `json:"read,omitempty" yaml:"read"`
+	Write          Duration `json:"write,omitempty" yaml:"write"`
+	Idle           Duration `json:"idle,omitempty" yaml:"idle"`
+	ResponseHeader Duration `json:"response_header,omitempty" yaml:"response_header"`
+}
+
+// Validate checks that no timeout is negative.
+func (t ServerTimeouts) Validate() error {
+	if t.ReadHeader < 0 || t.Read < 0 || t.Write < 0 || t.Idle < 0 || t.ResponseHeader < 0 {
+		return errors.New("server timeouts must not be negative")
+	}
+	return nil
+}
+
+// TimeoutOverrides are the timeouts set by a listener. Those left nil take
+// the server-wide value, while zero disables a timeout on the listener even
+// when it is set server-wide.
+type TimeoutOverrides struct {
+	ReadHeader     *Duration `json:"read_header,omitempty" yaml:"read_header"`
+	Read           *Duration `json:"read,omitempty" yaml:"read"`
+	Write          *Duration `json:"write,omitempty" yaml:"write"`
+	Idle           *Duration `json:"idle,omitempty" yaml:"idle"`
+	ResponseHeader *Duration `json:"response_header,omitempty" yaml:"response_header"`
+}
+
+// Validate checks that no timeout is negative.
+func (t TimeoutOverrides) Validate() error {
+	for _, d := range []*Duration{t.ReadHeader, t.Read, t.Write, t.Idle, t.ResponseHeader} {
+		if d != nil && *d < 0 {
+			return errors.New("server timeouts must not be negative")
+		}
+	}
+	return nil
+}
+
+// Or returns the timeouts of def with those set in t replaced.
+func (t TimeoutOverrides) Or(def ServerTimeouts) ServerTimeouts {
+	for _, f := range []struct{ v, def *Duration }{
+		{t.ReadHeader, &def.ReadHeader},
+		{t.Read, &def.Read},
+		{t.Write, &def.Write},
+		{t.Idle, &def.Idle},
+		{t.ResponseHeader, &def.ResponseHeader},
+	} {
+		if f.v != nil {
+			*f.def = *f.v
+		}
+	}
+	return def
+}
+
+// ListenerTimeouts returns the timeouts of l, those it does not set being
+// the server-wide Timeouts.
+func (c *Config) ListenerTimeouts(l Listener) ServerTimeouts {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return l.Timeouts.Or(c.Timeouts)
+}
+
+// GetServerTimeouts returns the server-wide timeouts of HTTP listeners.
+func (c *Config) GetServerTimeouts() ServerTimeouts {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Timeouts
+}
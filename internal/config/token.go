@@ -0,0 +1,168 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// API token scopes. ScopeRead allows every read, ScopeWrite every change,
+// and the other scopes the changes of one area of the API.
+const (
+	ScopeRead           = "read"
+	ScopeWrite          = "write"
+	ScopeWriteHeaders   = "write:headers"
+	ScopeWriteSettings  = "write:settings"
+	ScopeWriteAuth      = "write:auth"
+	ScopeWriteUpstreams = "write:upstreams"
+	ScopeWriteACL       = "write:acl"
+	ScopeWriteCache     = "write:cache"
+	ScopeWriteConfig    = "write:config"
+)
+
+// Scopes lists the valid API token scopes.
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeWriteHeaders, ScopeWriteSettings, ScopeWriteAuth, ScopeWriteUpstreams, ScopeWriteACL, ScopeWriteCache, ScopeWriteConfig}
+
+// tokenPrefix starts every API token, so leaked tokens are easy to spot.
+const tokenPrefix = "pxt_"
+
+// Token is a bearer token for the API. Only the SHA-256 hash of the secret
+// is kept. A zero Expires never expires and a zero LastUsed was never used.
+type Token struct {
+	Name     string
+	Scopes   []string
+	Hash     string
+	Created  time.Time
+	Expires  time.Time
+	LastUsed time.Time
+}
+
+// Validate checks the name and scopes of the token.
+func (t Token) Validate() error {
+	if t.Name == "" || strings.ContainsAny(t.Name, " \n") {
+		return fmt.Errorf("invalid token name %q", t.Name)
+	}
+	if len(t.Scopes) == 0 {
+		return fmt.Errorf("token %s has no scopes", t.Name)
+	}
+	for _, s := range t.Scopes {
+		if !validScope(s) {
+			return fmt.Errorf("token %s: unknown scope %q", t.Name, s)
+		}
+	}
+	return nil
+}
+
+func validScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the token grants scope. ScopeWrite grants every
+// write scope; it does not grant ScopeRead.
+func (t Token) Allows(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || (s == ScopeWrite && strings.HasPrefix(scope, ScopeWrite+":")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token has expired at now.
+func (t Token) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken adds a token with the given scopes, expiring after ttl unless
+// ttl is zero, and returns its secret. The secret cannot be retrieved
+// later. A token with the same name is replaced, which revokes it.
+func (c *Config) CreateToken(name string, scopes []string, ttl time.Duration) (string, error) {
+	if ttl < 0 {
+		return "", fmt.Errorf("token %s: negative expiry", name)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now().UTC()
+	t := Token{Name: name, Scopes: append([]string(nil), scopes...), Hash: hashToken(secret), Created: now}
+	if ttl > 0 {
+		t.Expires = now.Add(ttl)
+	}
+	if err := t.Validate(); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, e := range c.Tokens {
+		if e.Name == name {
+			c.Tokens[i] = t
+			return secret, nil
+		}
+	}
+	c.Tokens = append(c.Tokens, t)
+	return secret, nil
+}
+
+// DeleteToken revokes the named token.
+func (c *Config) DeleteToken(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.Tokens[:0]
+	for _, t := range c.Tokens {
+		if t.Name != name {
+			out = append(out, t)
+		}
+	}
+	c.Tokens = out
+}
+
+// SetTokens replaces all tokens.
+func (c *Config) SetTokens(tokens []Token) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Tokens = append([]Token(nil), tokens...)
+}
+
+// GetTokens returns a copy of the tokens, hashes included.
+func (c *Config) GetTokens() []Token {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]Token{}, c.Tokens...)
+}
+
+// AuthenticateToken returns the unexpired token with the given secret and
+// records its use. Hashes are compared in constant time.
+func (c *Config) AuthenticateToken(secret string) (Token, bool) {
+	hash := []byte(hashToken(secret))
+	now := time.Now().UTC()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found := -1
+	for i, t := range c.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), hash) == 1 {
+			found = i
+		}
+	}
+	if found < 0 || c.Tokens[found].Expired(now) {
+		return Token{}, false
+	}
+	c.Tokens[found].LastUsed = now
+	return c.Tokens[found], true
+}
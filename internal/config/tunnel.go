@@ -0,0 +1,42 @@
+package config
+
+import "errors"
+
+// TunnelTimeouts bounds the CONNECT tunnels of forward mode.
+//
+// A tunnel is closed once no bytes have been relayed in either direction for
+// Idle, or once it has been open for MaxLifetime. Dial limits the time taken
+// to connect to the destination, directly or through a parent proxy, and
+// also applies to SOCKS5 connections. Zero disables a limit. Changes apply to
+// the tunnels opened afterwards.
+type TunnelTimeouts struct {
+	Idle        Duration `json:"idle"`
+	MaxLifetime Duration `json:"max_lifetime"`
+	Dial        Duration `json:"dial"`
+}
+
+// Validate checks that no timeout is negative.
+func (t TunnelTimeouts) Validate() error {
+	if t.Idle < 0 || t.MaxLifetime < 0 || t.Dial < 0 {
+		return errors.New("tunnel timeouts must not be negative")
+	}
+	return nil
+}
+
+// SetTunnelTimeouts replaces the CONNECT tunnel timeouts.
+func (c *Config) SetTunnelTimeouts(t TunnelTimeouts) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Tunnels = t
+	return nil
+}
+
+// GetTunnelTimeouts returns the CONNECT tunnel timeouts.
+func (c *Config) GetTunnelTimeouts() TunnelTimeouts {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Tunnels
+}
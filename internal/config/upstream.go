@@ -0,0 +1,125 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Load balancing policies for the reverse proxy pool.
+const (
+	BalanceRoundRobin    = "round_robin"
+	BalanceWeighted      = "weighted"
+	BalanceLeastRequests = "least_requests"
+	BalanceHash          = "hash"
+)
+
+// Upstream is a backend target of the reverse proxy pool. Weight is only
+// used by the weighted and hash policies and defaults to 1.
+type Upstream struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// UpstreamPool is the set of reverse proxy targets and how requests are
+// spread over them. HashKey selects the key for the hash policy: "ip" for the
+// client address or "header:<Name>" for a request header.
+type UpstreamPool struct {
+	Targets []Upstream `json:"targets"`
+	Policy  string     `json:"policy"`
+	HashKey string     `json:"hash_key"`
+}
+
+// Validate checks the target URLs, weights and balancing policy.
+func (p UpstreamPool) Validate() error {
+	switch p.Policy {
+	case "", BalanceRoundRobin, BalanceWeighted, BalanceLeastRequests, BalanceHash:
+	default:
+		return fmt.Errorf("unknown balancing policy %q", p.Policy)
+	}
+	if p.HashKey != "" && p.HashKey != "ip" && !strings.HasPrefix(p.HashKey, "header:") {
+		return fmt.Errorf("hash key must be \"ip\" or \"header:<Name>\"")
+	}
+	seen := make(map[string]bool)
+	for _, t := range p.Targets {
+		if err := validateUpstreamURL(t.URL); err != nil {
+			return err
+		}
+		if t.Weight < 0 {
+			return fmt.Errorf("weight for %s must not be negative", t.URL)
+		}
+		if seen[t.URL] {
+			return fmt.Errorf("duplicate upstream %s", t.URL)
+		}
+		seen[t.URL] = true
+	}
+	return nil
+}
+
+func validateUpstreamURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("upstream %q: %v", raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("upstream %q must be an absolute http or https URL", raw)
+	}
+	return nil
+}
+
+func (p UpstreamPool) clone() UpstreamPool {
+	p.Targets = append([]Upstream(nil), p.Targets...)
+	return p
+}
+
+// SetPool replaces the reverse proxy pool.
+func (c *Config) SetPool(p UpstreamPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Pool = p.clone()
+}
+
+// GetPool returns a copy of the reverse proxy pool.
+func (c *Config) GetPool() UpstreamPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Pool.clone()
+}
+
+// SetUpstream adds a target to the pool or updates the weight of an existing one.
+func (c *Config) SetUpstream(u Upstream) error {
+	if err := validateUpstreamURL(u.URL); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, t := range c.Pool.Targets {
+		if t.URL == u.URL {
+			c.Pool.Targets[i] = u
+			return nil
+		}
+	}
+	c.Pool.Targets = append(c.Pool.Targets, u)
+	return nil
+}
+
+// DeleteUpstream removes a target from the pool.
+func (c *Config) DeleteUpstream(rawURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.Pool.Targets[:0]
+	for _, t := range c.Pool.Targets {
+		if t.URL != rawURL {
+			out = append(out, t)
+		}
+	}
+	c.Pool.Targets = out
+}
+
+// SetBalancing updates the balancing policy and hash key of the pool.
+func (c *Config) SetBalancing(policy, hashKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Pool.Policy = policy
+	c.Pool.HashKey = hashKey
+}
@@ -0,0 +1,313 @@
+package config
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User roles, from the least to the most privileged. Each role may do what
+// the roles before it may: proxy users may only use the proxy, viewers may
+// also read the UI, API and metrics, and admins may change the configuration.
+const (
+	RoleProxyUser = "proxy-user"
+	RoleViewer    = "viewer"
+	RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{RoleProxyUser: 1, RoleViewer: 2, RoleAdmin: 3}
+
+// ValidRole reports whether role is a known role.
+func ValidRole(role string) bool {
+	return roleRanks[role] > 0
+}
+
+// RoleAllows reports whether a user with role may do what required needs.
+func RoleAllows(role, required string) bool {
+	return ValidRole(role) && roleRanks[role] >= roleRanks[required]
+}
+
+// User is an account authenticating with basic authentication, either for
+// the proxy or the admin UI and API. Passwords are only kept as bcrypt hashes.
+type User struct {
+	Name         string `json:"name"`
+	Role         string `json:"role"`
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// Validate checks the name, role and password hash of the user.
+func (u User) Validate() error {
+	if u.Name == "" || strings.ContainsAny(u.Name, ":\n") {
+		return fmt.Errorf("invalid user name %q", u.Name)
+	}
+	if !ValidRole(u.Role) {
+		return fmt.Errorf("user %s: unknown role %q", u.Name, u.Role)
+	}
+	if u.PasswordHash == "" {
+		return fmt.Errorf("user %s has no password", u.Name)
+	}
+	if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+		return fmt.Errorf("user %s: invalid password hash", u.Name)
+	}
+	return nil
+}
+
+// HashPassword returns the bcrypt hash of password.
+func HashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(h), err
+}
+
+// SetUser adds a user or updates the role and, unless password is empty,
+// the password of the existing user with the same name. New users need a
+// password.
+func (c *Config) SetUser(name, role, password string) error {
+	var hash string
+	if password != "" {
+		var err error
+		if hash, err = HashPassword(password); err != nil {
+			return err
+		}
+	}
+	defer c.accessChanged()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, u := range c.Users {
+		if u.Name != name {
+			continue
+		}
+		u.Role = role
+		if hash != "" {
+			u.PasswordHash = hash
+		}
+		if err := u.Validate(); err != nil {
+			return err
+		}
+		if u.Role != RoleAdmin && c.lastAdmin(name) {
+			return fmt.Errorf("cannot demote %s, the last admin", name)
+		}
+		c.Users[i] = u
+		return nil
+	}
+	u := User{Name: name, Role: role, PasswordHash: hash}
+	if err := u.Validate(); err != nil {
+		return err
+	}
+	c.Users = append(c.Users, u)
+	return nil
+}
+
+// DeleteUser removes the named user. The last admin cannot be removed while
+// authentication is enabled.
+func (c *Config) DeleteUser(name string) error {
+	defer c.accessChanged()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.AuthEnabled && c.lastAdmin(name) {
+		return fmt.Errorf("cannot delete %s, the last admin", name)
+	}
+	out := c.Users[:0]
+	for _, u := range c.Users {
+		if u.Name != name {
+			out = append(out, u)
+		}
+	}
+	c.Users = out
+	return nil
+}
+
+// lastAdmin reports whether name is the only admin. c.mu must be held.
+func (c *Config) lastAdmin(name string) bool {
+	found := false
+	for _, u := range c.Users {
+		if u.Role != RoleAdmin {
+			continue
+		}
+		if u.Name != name {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// SetUsers replaces all users.
+func (c *Config) SetUsers(users []User) {
+	defer c.accessChanged()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Users = append([]User(nil), users...)
+}
+
+// GetUsers returns a copy of the users, password hashes included.
+func (c *Config) GetUsers() []User {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]User{}, c.Users...)
+}
+
+// AuthRequired reports whether clients must authenticate: authentication is
+// enabled and at least one user exists.
+func (c *Config) AuthRequired() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.AuthEnabled && len(c.Users) > 0
+}
+
+// AuthEnabledState returns whether authentication is enabled.
+func (c *Config) AuthEnabledState() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.AuthEnabled
+}
+
+// Authenticate checks the credentials of a user and returns its role. Names
+// are compared in constant time and unknown users cost a bcrypt comparison
+// like wrong passwords do, so the time taken does not tell them apart.
+func (c *Config) Authenticate(name, password string) (string, bool) {
+	var user User
+	found := false
+	c.mu.RLock()
+	for _, u := range c.Users {
+		if subtle.ConstantTimeCompare([]byte(u.Name), []byte(name)) == 1 {
+			user, found = u, true
+		}
+	}
+	c.mu.RUnlock()
+	if !found {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return "", false
+	}
+	if !verifyPassword(user.PasswordHash, password) {
+		return "", false
+	}
+	return user.Role, true
+}
+
+// dummyHash is compared with the passwords given for unknown users.
+var dummyHash = sync.OnceValue(func() []byte {
+	h, _ := bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+	return h
+})
+
+// verified remembers recently verified hash and password pairs, so that
+// requests carrying the same basic credentials do not each pay for a bcrypt
+// comparison. Pairs are keyed by their HMAC-SHA256 under a random key chosen
+// per process, so the keys cannot be used to check guessed passwords without
+// it. Changing a password changes its hash and so never matches old entries.
+var verified = struct {
+	sync.Mutex
+	secret []byte
+	// m maps keys to their elements in lru, most recently used first.
+	m   map[[32]byte]*list.Element
+	lru *list.List
+}{secret: randomSecret(), m: make(map[[32]byte]*list.Element), lru: list.New()}
+
+// maxVerified bounds the verified cache, which forgets the least recently
+// used pair when full.
+const maxVerified = 1024
+
+func randomSecret() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func verifyPassword(hash, password string) bool {
+	key := verifiedKey(hash, password)
+	verified.Lock()
+	el, ok := verified.m[key]
+	if ok {
+		verified.lru.MoveToFront(el)
+	}
+	verified.Unlock()
+	if ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	rememberVerified(key)
+	return true
+}
+
+func verifiedKey(hash, password string) [32]byte {
+	mac := hmac.New(sha256.New, verified.secret)
+	mac.Write([]byte(hash + "\x00" + password))
+	var key [32]byte
+	mac.Sum(key[:0])
+	return key
+}
+
+func rememberVerified(key [32]byte) {
+	verified.Lock()
+	defer verified.Unlock()
+	if _, ok := verified.m[key]; ok {
+		return
+	}
+	verified.m[key] = verified.lru.PushFront(key)
+	if verified.lru.Len() > maxVerified {
+		oldest := verified.lru.Back()
+		verified.lru.Remove(oldest)
+		delete(verified.m, oldest.Value.([32]byte))
+	}
+}
+
+// SetAuth enables or disables authentication. When both username and
+// password are given, the user is also created or updated as an admin.
+func (c *Config) SetAuth(enabled bool, username, password string) error {
+	defer c.accessChanged()
+	if username != "" && password != "" {
+		if err := c.SetUser(username, RoleAdmin, password); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if enabled && len(c.Users) > 0 && !c.hasAdmin() {
+		return fmt.Errorf("enabling authentication requires an admin user")
+	}
+	c.AuthEnabled = enabled
+	return nil
+}
+
+// hasAdmin reports whether any user is an admin. c.mu must be held.
+func (c *Config) hasAdmin() bool {
+	for _, u := range c.Users {
+		if u.Role == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// BootstrapAdmin turns the Username and Password given with flags or
+// loaded from older databases into an admin user, unless a user with that
+// name already exists, and forgets the plain text password.
+func (c *Config) BootstrapAdmin() error {
+	c.mu.RLock()
+	name, password := c.Username, c.Password
+	exists := false
+	for _, u := range c.Users {
+		exists = exists || u.Name == name
+	}
+	c.mu.RUnlock()
+	if name != "" && password != "" && !exists {
+		if err := c.SetUser(name, RoleAdmin, password); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Password = ""
+	return nil
+}
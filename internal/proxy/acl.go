@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"context"
+	"html"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pod32g/proxy/internal/accesslog"
+	"github.com/pod32g/proxy/internal/config"
+	log "github.com/pod32g/simple-logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultDenyPage = "<html><body><h1>Access denied</h1><p>Access to {host} is blocked by the proxy policy.</p></body></html>"
+
+var aclHitsDesc = prometheus.NewDesc("proxy_acl_hits_total", "Forward proxy requests decided by each access control rule.", []string{"rule", "action"}, nil)
+
+// ACL enforces the forward proxy access control list and counts how many
+// requests each rule decided. The list is read on every request so changes
+// take effect immediately.
+type ACL struct {
+	policy func() config.AccessControl
+	Logger *log.Logger
+
+	mu      sync.Mutex
+	hits    map[string]uint64
+	actions map[string]string
+	regexps map[string]*regexp.Regexp
+	nets    map[string]*net.IPNet
+}
+
+// NewACL creates an access control engine over the list returned by policy.
+func NewACL(policy func() config.AccessControl) *ACL {
+	a := &ACL{
+		policy:  policy,
+		hits:    make(map[string]uint64),
+		actions: make(map[string]string),
+	}
+	a.Update()
+	return a
+}
+
+// Update compiles the host regexes and client ranges of the current rules,
+// forgetting those of removed rules along with their hit counters. It is
+// meant to be called when the list changes; patterns not compiled yet are
+// compiled on every use.
+func (a *ACL) Update() {
+	p := a.policy()
+	regexps := make(map[string]*regexp.Regexp)
+	nets := make(map[string]*net.IPNet)
+	names := map[string]bool{config.ACLDefaultRule: true}
+	for _, rule := range p.Rules {
+		names[rule.Name] = true
+		if rule.HostRegex != "" {
+			if _, ok := regexps[rule.HostRegex]; !ok {
+				regexps[rule.HostRegex] = a.compile(rule.HostRegex)
+			}
+		}
+		for _, c := range rule.Clients {
+			nets[c], _ = config.ParseClientNet(c)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.regexps, a.nets = regexps, nets
+	for name := range a.hits {
+		if !names[name] {
+			delete(a.hits, name)
+			delete(a.actions, name)
+		}
+	}
+}
+
+// Check evaluates r and returns the name of the deciding rule, or
+// config.ACLDefaultRule when no rule matched, and whether r is allowed.
+func (a *ACL) Check(r *http.Request) (string, bool) {
+	host, port := requestTarget(r)
+	return a.decide(r.Method, host, port, clientIP(r.RemoteAddr), RequestUser(r))
+}
+
+// AllowConn checks a SOCKS5 connection to addr opened by the client of conn
+// as the authenticated user, which is empty without authentication, as if it
+// were a CONNECT request for addr. It logs denials and reports whether the
+// connection may proceed.
+func (a *ACL) AllowConn(conn net.Conn, user, addr string) bool {
+	host, port := addr, 0
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		host = h
+		port, _ = strconv.Atoi(p)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	rule, ok := a.decide(http.MethodConnect, host, port, clientIP(conn.RemoteAddr().String()), user)
+	if !ok && a.Logger != nil {
+		a.Logger.Info("SOCKS request denied by ACL", rule, host, conn.RemoteAddr())
+	}
+	return ok
+}
+
+// decide evaluates a request and counts the hit of the deciding rule.
+func (a *ACL) decide(method, host string, port int, client net.IP, user string) (string, bool) {
+	p := a.policy()
+	name, action := config.ACLDefaultRule, p.Default
+	for _, rule := range p.Rules {
+		if a.match(rule, method, host, port, client, user) {
+			name, action = rule.Name, rule.Action
+			break
+		}
+	}
+	if action == "" {
+		action = config.ACLAllow
+	}
+	a.mu.Lock()
+	a.hits[name]++
+	a.actions[name] = action
+	a.mu.Unlock()
+	return name, action == config.ACLAllow
+}
+
+// Allow checks r and answers denied requests with 403 Forbidden and the
+// configured deny page. It reports whether the request may proceed.
+func (a *ACL) Allow(w http.ResponseWriter, r *http.Request) bool {
+	rule, ok := a.Check(r)
+	if ok {
+		return true
+	}
+	host, _ := requestTarget(r)
+	accesslog.SetErrorClass(r.Context(), accesslog.ErrorACL)
+	if a.Logger != nil {
+		a.Logger.Info("Request denied by ACL", rule, r.Method, host, r.RemoteAddr)
+	}
+	page := a.policy().DenyPage
+	if page == "" {
+		page = defaultDenyPage
+	}
+	page = strings.NewReplacer(
+		"{host}", html.EscapeString(host),
+		"{rule}", html.EscapeString(rule),
+		"{client}", html.EscapeString(clientIP(r.RemoteAddr).String()),
+	).Replace(page)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(page))
+	return false
+}
+
+// WithACL answers the requests of next denied by acl, which may be nil,
+// before they reach it. It wraps the forward proxy outside of the cache, so
+// that cached responses are only served to clients allowed to fetch them.
+func WithACL(next http.Handler, acl *ACL) http.Handler {
+	if acl == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acl.Allow(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Hits returns the number of requests decided by each rule.
+func (a *ACL) Hits() map[string]uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make(map[string]uint64, len(a.hits))
+	for k, v := range a.hits {
+		out[k] = v
+	}
+	return out
+}
+
+func (a *ACL) match(rule config.ACLRule, method, host string, port int, client net.IP, user string) bool {
+	if len(rule.Methods) > 0 && !containsString(rule.Methods, method) {
+		return false
+	}
+	if len(rule.Hosts) > 0 {
+		ok := false
+		for _, pattern := range rule.Hosts {
+			if config.MatchHost(pattern, host) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if rule.HostRegex != "" {
+		re := a.regexp(rule.HostRegex)
+		if re == nil || !re.MatchString(host) {
+			return false
+		}
+	}
+	if len(rule.Ports) > 0 {
+		ok := false
+		for _, p := range rule.Ports {
+			if p == port {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(rule.Clients) > 0 {
+		ok := false
+		for _, c := range rule.Clients {
+			if n := a.ipNet(c); n != nil && client != nil && n.Contains(client) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(rule.Users) > 0 && (user == "" || !containsString(rule.Users, user)) {
+		return false
+	}
+	return true
+}
+
+func (a *ACL) regexp(pattern string) *regexp.Regexp {
+	a.mu.Lock()
+	re, ok := a.regexps[pattern]
+	a.mu.Unlock()
+	if ok {
+		return re
+	}
+	return a.compile(pattern)
+}
+
+// compile compiles a host regex so that it must match the whole host.
+func (a *ACL) compile(pattern string) *regexp.Regexp {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil && a.Logger != nil {
+		a.Logger.Error("Invalid ACL host regex", pattern, err)
+	}
+	return re
+}
+
+func (a *ACL) ipNet(s string) *net.IPNet {
+	a.mu.Lock()
+	n, ok := a.nets[s]
+	a.mu.Unlock()
+	if ok {
+		return n
+	}
+	n, _ = config.ParseClientNet(s)
+	return n
+}
+
+// Describe implements prometheus.Collector.
+func (a *ACL) Describe(ch chan<- *prometheus.Desc) {
+	ch <- aclHitsDesc
+}
+
+// Collect implements prometheus.Collector, exporting the rule hit counters.
+func (a *ACL) Collect(ch chan<- prometheus.Metric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name, n := range a.hits {
+		ch <- prometheus.MustNewConstMetric(aclHitsDesc, prometheus.CounterValue, float64(n), name, a.actions[name])
+	}
+}
+
+// requestTarget returns the lower-cased destination host of r and its port,
+// defaulting to the scheme's port.
+func requestTarget(r *http.Request) (string, int) {
+	hostport := r.URL.Host
+	if hostport == "" || r.Method == http.MethodConnect {
+		hostport = r.Host
+	}
+	port := 80
+	if r.Method == http.MethodConnect || r.URL.Scheme == "https" {
+		port = 443
+	}
+	host := hostport
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+		if n, err := strconv.Atoi(p); err == nil {
+			port = n
+		}
+	}
+	return strings.ToLower(strings.TrimSuffix(host, ".")), port
+}
+
+func clientIP(remoteAddr string) net.IP {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	return net.ParseIP(host)
+}
+
+type userKey struct{}
+
+// WithUser records user as authenticated for the requests of ctx, and for
+// the requests decrypted from an intercepted tunnel opened with it.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// RequestUser returns the user authenticated for r, or for the intercepted
+// tunnel r was read from. It is empty when authentication is disabled, so
+// credentials that were not checked never name a user.
+func RequestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pod32g/proxy/internal/accesslog"
+	"github.com/pod32g/proxy/internal/config"
+	log "github.com/pod32g/simple-logger"
+)
+
+// ringPointsPerWeight is the number of points each unit of weight places on
+// the consistent hashing ring.
+const ringPointsPerWeight = 100
+
+// ErrNoUpstream is returned when the pool has no usable target.
+var ErrNoUpstream = errors.New("no upstream available")
+
+type backend struct {
+	url      *url.URL
+	director func(*http.Request)
+	weight   int
+	active   int64
+	// current is the smooth weighted round robin state, guarded by Balancer.mu.
+	current int
+
+	// Health state, guarded by Balancer.mu.
+	healthy      bool
+	probeOK      int
+	probeFail    int
+	passiveFail  int
+	ejectedUntil time.Time
+	lastCheck    time.Time
+	lastError    string
+}
+
+// availableLocked reports whether be may receive requests at time now.
+func (be *backend) availableLocked(now time.Time) bool {
+	return be.healthy && !now.Before(be.ejectedUntil)
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+// Balancer picks a target from a pool of upstreams for each request. The pool
+// is read on every pick so runtime changes take effect immediately.
+type Balancer struct {
+	pool func() config.UpstreamPool
+	// Health returns the health check settings. A nil function disables
+	// active probing and passive ejection.
+	Health func() config.HealthCheck
+	Logger *log.Logger
+
+	mu       sync.Mutex
+	backends map[string]*backend
+	rr       uint64
+	ringKey  string
+	ring     []ringPoint
+}
+
+// UpstreamStatus describes a pool member, its in-flight request count and
+// its health.
+type UpstreamStatus struct {
+	URL          string    `json:"url"`
+	Weight       int       `json:"weight"`
+	Active       int64     `json:"active"`
+	Healthy      bool      `json:"healthy"`
+	EjectedUntil time.Time `json:"ejected_until,omitempty"`
+	LastCheck    time.Time `json:"last_check,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// Available reports whether the upstream is currently in rotation.
+func (s UpstreamStatus) Available() bool {
+	return s.Healthy && !time.Now().Before(s.EjectedUntil)
+}
+
+// NewBalancer creates a balancer over the pool returned by the pool function.
+func NewBalancer(pool func() config.UpstreamPool) *Balancer {
+	return &Balancer{pool: pool, backends: make(map[string]*backend)}
+}
+
+// membersLocked returns the backends of p in pool order, creating state for
+// new targets and dropping state for removed ones.
+func (b *Balancer) membersLocked(p config.UpstreamPool) []*backend {
+	out := make([]*backend, 0, len(p.Targets))
+	keep := make(map[string]bool, len(p.Targets))
+	for _, t := range p.Targets {
+		be, ok := b.backends[t.URL]
+		if !ok {
+			u, err := url.Parse(t.URL)
+			if err != nil || u.Host == "" {
+				continue
+			}
+			be = &backend{url: u, director: httputil.NewSingleHostReverseProxy(u).Director, healthy: true}
+			b.backends[t.URL] = be
+		}
+		be.weight = t.Weight
+		if be.weight <= 0 {
+			be.weight = 1
+		}
+		keep[t.URL] = true
+		out = append(out, be)
+	}
+	for k := range b.backends {
+		if !keep[k] {
+			delete(b.backends, k)
+		}
+	}
+	return out
+}
+
+// pick selects the backend for r according to the pool's policy. Unhealthy
+// and ejected targets are skipped.
+func (b *Balancer) pick(r *http.Request) (*backend, error) {
+	p := b.pool()
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var members []*backend
+	for _, be := range b.membersLocked(p) {
+		if be.availableLocked(now) {
+			members = append(members, be)
+		}
+	}
+	if len(members) == 0 {
+		return nil, ErrNoUpstream
+	}
+	switch p.Policy {
+	case config.BalanceWeighted:
+		return b.pickWeightedLocked(members), nil
+	case config.BalanceLeastRequests:
+		return b.pickLeastLocked(members), nil
+	case config.BalanceHash:
+		return b.pickHashLocked(members, hashKey(r, p.HashKey)), nil
+	default:
+		b.rr++
+		return members[b.rr%uint64(len(members))], nil
+	}
+}
+
+// pickWeightedLocked implements smooth weighted round robin.
+func (b *Balancer) pickWeightedLocked(members []*backend) *backend {
+	total := 0
+	var best *backend
+	for _, be := range members {
+		be.current += be.weight
+		total += be.weight
+		if best == nil || be.current > best.current {
+			best = be
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// pickLeastLocked returns the backend with the fewest in-flight requests,
+// rotating the starting point so ties are spread evenly.
+func (b *Balancer) pickLeastLocked(members []*backend) *backend {
+	b.rr++
+	start := int(b.rr % uint64(len(members)))
+	best := members[start]
+	for i := 1; i < len(members); i++ {
+		be := members[(start+i)%len(members)]
+		if atomic.LoadInt64(&be.active) < atomic.LoadInt64(&best.active) {
+			best = be
+		}
+	}
+	return best
+}
+
+func (b *Balancer) pickHashLocked(members []*backend, key string) *backend {
+	var sig strings.Builder
+	for _, be := range members {
+		sig.WriteString(be.url.String())
+		sig.WriteByte('|')
+		sig.WriteString(strconv.Itoa(be.weight))
+		sig.WriteByte(';')
+	}
+	if sig.String() != b.ringKey || b.ring == nil {
+		b.ring = buildRing(members)
+		b.ringKey = sig.String()
+	}
+	h := hash32(key)
+	i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	if i == len(b.ring) {
+		i = 0
+	}
+	return b.ring[i].backend
+}
+
+func buildRing(members []*backend) []ringPoint {
+	var ring []ringPoint
+	for _, be := range members {
+		for i := 0; i < be.weight*ringPointsPerWeight; i++ {
+			ring = append(ring, ringPoint{hash: hash32(be.url.String() + "#" + strconv.Itoa(i)), backend: be})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func hash32(s string) uint32 {
+	return crc32.ChecksumIEEE([]byte(s))
+}
+
+// hashKey returns the value requests are hashed on. Requests without the
+// configured header fall back to the client IP.
+func hashKey(r *http.Request, key string) string {
+	if name, ok := strings.CutPrefix(key, "header:"); ok {
+		if v := r.Header.Get(name); v != "" {
+			return v
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Status returns the current pool members in pool order.
+func (b *Balancer) Status() []UpstreamStatus {
+	p := b.pool()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	members := b.membersLocked(p)
+	out := make([]UpstreamStatus, 0, len(members))
+	for _, be := range members {
+		out = append(out, UpstreamStatus{
+			URL:          be.url.String(),
+			Weight:       be.weight,
+			Active:       atomic.LoadInt64(&be.active),
+			Healthy:      be.healthy,
+			EjectedUntil: be.ejectedUntil,
+			LastCheck:    be.lastCheck,
+			LastError:    be.lastError,
+		})
+	}
+	return out
+}
+
+type backendKey struct{}
+
+// NewBalanced creates a reverse proxy that spreads requests over the pool of
+// the given balancer. The headers function receives the client request and
+// returns headers to set on each upstream request.
+func NewBalanced(b *Balancer, logger *log.Logger, headers func(*http.Request) map[string]string) http.Handler {
+	rp := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			be := req.Context().Value(backendKey{}).(*backend)
+			logger.Debug("Reverse proxy request", req.Method, sanitizedURL(req.URL), be.url.Host)
+			be.director(req)
+			for k, v := range headers(req) {
+				req.Header.Set(k, v)
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			be := resp.Request.Context().Value(backendKey{}).(*backend)
+			b.observe(be, resp.StatusCode < http.StatusInternalServerError)
+			return nil
+		},
+		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
+			logger.Error("Upstream Error: %v", err)
+			if be, ok := req.Context().Value(backendKey{}).(*backend); ok &&
+				(req.Context().Err() == nil || context.Cause(req.Context()) == errResponseHeaderTimeout) {
+				b.observe(be, false)
+			}
+			upstreamError(rw, req, err)
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		be, err := b.pick(r)
+		if err != nil {
+			logger.Error("Upstream Error: %v", err)
+			accesslog.SetErrorClass(r.Context(), accesslog.ErrorUnavailable)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt64(&be.active, 1)
+		defer atomic.AddInt64(&be.active, -1)
+		ctx, release := awaitResponseHeader(r.Context())
+		defer release()
+		r = r.WithContext(context.WithValue(accesslog.Trace(ctx), backendKey{}, be))
+		rp.ServeHTTP(newStreamWriter(w, r), r)
+	})
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pod32g/proxy/internal/config"
+)
+
+func staticPool(p config.UpstreamPool) func() config.UpstreamPool {
+	return func() config.UpstreamPool { return p }
+}
+
+func pickCounts(t *testing.T, b *Balancer, n int, req *http.Request) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		be, err := b.pick(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[be.url.Host]++
+	}
+	return counts
+}
+
+func TestBalancerRoundRobinAndWeighted(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	targets := []config.Upstream{{URL: "http://a", Weight: 3}, {URL: "http://b", Weight: 1}}
+
+	rr := NewBalancer(staticPool(config.UpstreamPool{Targets: targets}))
+	if c := pickCounts(t, rr, 100, req); c["a"] != 50 || c["b"] != 50 {
+		t.Fatalf("unexpected round robin distribution: %v", c)
+	}
+	w := NewBalancer(staticPool(config.UpstreamPool{Targets: targets, Policy: config.BalanceWeighted}))
+	if c := pickCounts(t, w, 100, req); c["a"] != 75 || c["b"] != 25 {
+		t.Fatalf("unexpected weighted distribution: %v", c)
+	}
+}
+
+func TestBalancerLeastRequests(t *testing.T) {
+	b := NewBalancer(staticPool(config.UpstreamPool{
+		Targets: []config.Upstream{{URL: "http://a"}, {URL: "http://b"}},
+		Policy:  config.BalanceLeastRequests,
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	busy, _ := b.pick(req)
+	busy.active = 5
+	for i := 0; i < 10; i++ {
+		if be, _ := b.pick(req); be == busy {
+			t.Fatalf("picked busy backend")
+		}
+	}
+}
+
+func TestBalancerHash(t *testing.T) {
+	pool := config.UpstreamPool{
+		Targets: []config.Upstream{{URL: "http://a"}, {URL: "http://b"}, {URL: "http://c"}},
+		Policy:  config.BalanceHash,
+		HashKey: "header:X-User",
+	}
+	b := NewBalancer(staticPool(pool))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-User", "alice")
+	if c := pickCounts(t, b, 20, req); len(c) != 1 {
+		t.Fatalf("hash policy should be sticky: %v", c)
+	}
+	users := make(map[string]bool)
+	for _, u := range []string{"u1", "u2", "u3", "u4", "u5", "u6", "u7", "u8"} {
+		req.Header.Set("X-User", u)
+		be, _ := b.pick(req)
+		users[be.url.Host] = true
+	}
+	if len(users) < 2 {
+		t.Fatalf("hash policy should spread keys: %v", users)
+	}
+}
+
+func TestBalancedProxy(t *testing.T) {
+	var hits [2]int
+	backends := make([]*httptest.Server, 2)
+	for i := range backends {
+		i := i
+		backends[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i]++
+			io.WriteString(w, r.Header.Get("X-Test"))
+		}))
+		defer backends[i].Close()
+	}
+	cfg := &config.Config{}
+	cfg.SetUpstream(config.Upstream{URL: backends[0].URL})
+	cfg.SetUpstream(config.Upstream{URL: backends[1].URL})
+	h := NewBalanced(NewBalancer(cfg.GetPool), newLogger(), func(*http.Request) map[string]string { return map[string]string{"X-Test": "value"} })
+	proxySrv := httptest.NewServer(h)
+	defer proxySrv.Close()
+
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(proxySrv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "value" {
+			t.Fatalf("header not injected: %q", body)
+		}
+	}
+	if hits[0] != 2 || hits[1] != 2 {
+		t.Fatalf("requests not balanced: %v", hits)
+	}
+
+	cfg.DeleteUpstream(backends[0].URL)
+	cfg.DeleteUpstream(backends[1].URL)
+	resp, err := http.Get(proxySrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 with empty pool, got %d", resp.StatusCode)
+	}
+}
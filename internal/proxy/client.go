@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/pod32g/proxy/internal/config"
+)
+
+// IdentifyClient describes the client of r for matching client selectors.
+func IdentifyClient(cfg *config.Config, r *http.Request) config.ClientInfo {
+	return cfg.IdentifyClient(r.RemoteAddr, RequestUser(r), r.Header)
+}
+
+// ClientHeaders returns a headers function adding the global headers of cfg
+// and those of the client selectors matching each request.
+func ClientHeaders(cfg *config.Config) func(*http.Request) map[string]string {
+	return func(r *http.Request) map[string]string {
+		headers, _ := cfg.HeadersForClient(IdentifyClient(cfg, r))
+		return headers
+	}
+}
+
+// ClientSelector returns the client selector with the highest precedence
+// matching r, or "" if none does.
+func ClientSelector(cfg *config.Config, r *http.Request) string {
+	_, selector := cfg.HeadersForClient(IdentifyClient(cfg, r))
+	return selector
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pod32g/proxy/internal/config"
+)
+
+func TestClientHeaders(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.SetClientHeader("192.0.2.10", "X-Client", "ip")
+	cfg.SetClientHeader("user:alice", "X-Client", "alice")
+	headers := ClientHeaders(cfg)
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.10:51234"
+	if h := headers(req); h["X-Client"] != "ip" {
+		t.Fatalf("ip selector not matched: %v", h)
+	}
+	req = req.WithContext(WithUser(req.Context(), "alice"))
+	if h := headers(req); h["X-Client"] != "alice" {
+		t.Fatalf("user selector should take precedence: %v", h)
+	}
+	if s := ClientSelector(cfg, req); s != "user:alice" {
+		t.Fatalf("unexpected selector %q", s)
+	}
+}
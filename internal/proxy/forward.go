@@ -1,67 +1,153 @@
 package proxy
 
 import (
+	"context"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"sync"
 
+	"github.com/pod32g/proxy/internal/accesslog"
+	"github.com/pod32g/proxy/internal/config"
 	log "github.com/pod32g/simple-logger"
 )
 
-// NewForward creates a forward proxy handler. It supports HTTPS via CONNECT
-// without requiring TLS certificates. The headers function returns the headers
-// that should be added to outbound requests.
-// NewForward creates a forward proxy handler. It supports HTTPS via CONNECT
-// without requiring TLS certificates. The headers function returns the headers
-// that should be added to outbound requests and receives the client address.
-func NewForward(logger *log.Logger, headers func(string) map[string]string) http.Handler {
+// Forward is a forward proxy handler. It supports HTTPS via CONNECT without
+// requiring TLS certificates.
+type Forward struct {
+	Logger *log.Logger
+	// Headers returns the headers that should be added to outbound requests
+	// and receives the client request.
+	Headers func(*http.Request) map[string]string
+	// Transport is used to send plain HTTP and intercepted HTTPS requests upstream.
+	Transport *http.Transport
+	// Parent returns the parent proxy to use for the given destination host,
+	// or nil to connect directly. It applies to plain requests and CONNECT
+	// tunnels alike.
+	Parent func(string) *url.URL
+	// Forwarding returns the settings of the Via, X-Forwarded-For and
+	// Forwarded headers; nil adds none. TrustedProxy reports the clients
+	// whose forwarding headers are kept with config.TrustTrusted, and Name
+	// returns the name of the proxy in Via headers.
+	Forwarding   func() config.Forwarding
+	TrustedProxy func(net.IP) bool
+	Name         func() string
+	// OnTunnelOpen and OnTunnelClose, when set, are called when a CONNECT
+	// tunnel to a host is established and once it has closed.
+	OnTunnelOpen  func(host string)
+	OnTunnelClose func(TunnelStats)
+	// Timeouts, when set, returns the idle, lifetime and dial timeouts of
+	// CONNECT tunnels. The dial timeout also applies to DialContext.
+	Timeouts func() config.TunnelTimeouts
+
+	tunnelsMu  sync.Mutex
+	tunnels    map[uint64]*liveTunnel
+	lastTunnel uint64
+}
+
+// NewForward creates a forward proxy handler. The headers function returns the
+// headers that should be added to outbound requests and receives the client request.
+func NewForward(logger *log.Logger, headers func(*http.Request) map[string]string) *Forward {
 	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.Proxy = nil
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodConnect {
-			logger.Debug("CONNECT request", r.Host)
-			handleConnect(w, r, logger)
-			return
-		}
-		logger.Debug("Forward proxy request", r.Method, sanitizedURL(r.URL))
-		if r.URL.Scheme == "" || r.URL.Host == "" {
-			logger.Error("Invalid request URL: missing scheme or host")
-			http.Error(w, "Bad request", http.StatusBadRequest)
-			return
+	f := &Forward{Logger: logger, Headers: headers, Transport: transport}
+	transport.Proxy = f.proxyFor
+	return f
+}
+
+func (f *Forward) proxyFor(r *http.Request) (*url.URL, error) {
+	if f.Parent == nil {
+		return nil, nil
+	}
+	return f.Parent(r.URL.Host), nil
+}
+
+// DialContext connects to addr, honouring the configured parent proxies. It
+// can be used by other listeners, such as SOCKS5, that share the forward
+// proxy's upstream routing.
+func (f *Forward) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if f.Timeouts != nil {
+		if d := f.Timeouts().Dial.Std(); d > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
 		}
-		outReq := r.Clone(r.Context())
-		outReq.RequestURI = ""
-		for k, v := range headers(r.RemoteAddr) {
+	}
+	var parent *url.URL
+	if f.Parent != nil {
+		parent = f.Parent(addr)
+	}
+	return dialUpstream(ctx, parent, addr)
+}
+
+func (f *Forward) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := f.Logger
+	if r.Method == http.MethodConnect {
+		logger.Debug("CONNECT request", r.Host)
+		f.handleConnect(w, r)
+		return
+	}
+	logger.Debug("Forward proxy request", r.Method, sanitizedURL(r.URL))
+	if r.URL.Scheme == "" || r.URL.Host == "" {
+		logger.Error("Invalid request URL: missing scheme or host")
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	ctx, release := awaitResponseHeader(r.Context())
+	defer release()
+	r = r.WithContext(ctx)
+	outReq := r.Clone(accesslog.Trace(ctx))
+	outReq.RequestURI = ""
+	removeHopHeaders(outReq.Header)
+	var fwd config.Forwarding
+	var name string
+	if f.Forwarding != nil {
+		fwd = f.Forwarding()
+	}
+	if f.Name != nil {
+		name = f.Name()
+	}
+	forwardHeaders(outReq, r, fwd, f.TrustedProxy, name)
+	if f.Headers != nil {
+		for k, v := range f.Headers(r) {
 			outReq.Header.Set(k, v)
 		}
-		resp, err := transport.RoundTrip(outReq)
-		if err != nil {
-			logger.Error("Upstream Error: %v", err)
-			http.Error(w, "Bad gateway", http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-		copyHeader(w.Header(), resp.Header)
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
-	})
+	}
+	resp, err := f.Transport.RoundTrip(outReq)
+	if err != nil {
+		logger.Error("Upstream Error: %v", err)
+		upstreamError(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	if fwd.Via {
+		addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, name)
+	}
+	sw := newStreamWriter(w, r)
+	copyHeader(sw.Header(), resp.Header)
+	sw.WriteHeader(resp.StatusCode)
+	io.Copy(sw, resp.Body)
 }
 
-func handleConnect(w http.ResponseWriter, r *http.Request, logger *log.Logger) {
+func (f *Forward) handleConnect(w http.ResponseWriter, r *http.Request) {
+	logger := f.Logger
 	logger.Debug("CONNECT tunnel", r.Host)
-	destConn, err := net.Dial("tcp", r.Host)
+	destConn, err := f.DialContext(r.Context(), "tcp", r.Host)
 	if err != nil {
 		logger.Error("CONNECT dial error: %v", err)
+		accesslog.SetError(r.Context(), err)
 		http.Error(w, "Bad gateway", http.StatusBadGateway)
 		return
 	}
+	accesslog.SetUpstream(r.Context(), destConn.RemoteAddr().String())
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
 		destConn.Close()
 		return
 	}
-	clientConn, _, err := hijacker.Hijack()
+	clientConn, brw, err := hijacker.Hijack()
 	if err != nil {
 		logger.Error("Hijack error: %v", err)
 		http.Error(w, "Hijack failed", http.StatusInternalServerError)
@@ -74,14 +160,10 @@ func handleConnect(w http.ResponseWriter, r *http.Request, logger *log.Logger) {
 		clientConn.Close()
 		return
 	}
-	go transfer(destConn, clientConn)
-	go transfer(clientConn, destConn)
-}
-
-func transfer(dst io.WriteCloser, src io.ReadCloser) {
-	io.Copy(dst, src)
-	dst.Close()
-	src.Close()
+	if brw != nil && brw.Reader.Buffered() > 0 {
+		clientConn = &bufferedConn{Conn: clientConn, r: brw.Reader}
+	}
+	f.tunnel(r, clientConn, destConn)
 }
 
 func copyHeader(dst, src http.Header) {
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pod32g/proxy/internal/config"
+)
+
+// hopHeaders are the hop-by-hop headers of RFC 9110 section 7.6.1, which
+// apply to a single connection and must not be forwarded. Proxy-Connection
+// is a non-standard equivalent of Connection still sent by some clients.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, including those
+// listed in its Connection header. A TE header accepting trailers is kept,
+// as the next hop needs it to send them.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	trailers := false
+	for _, v := range h.Values("TE") {
+		for _, coding := range strings.Split(v, ",") {
+			if name, _, _ := strings.Cut(coding, ";"); strings.EqualFold(strings.TrimSpace(name), "trailers") {
+				trailers = true
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	if trailers {
+		h.Set("TE", "trailers")
+	}
+}
+
+// addVia appends the proxy to the Via header of h for a message of the
+// given protocol version.
+func addVia(h http.Header, major, minor int, name string) {
+	if name == "" {
+		name = "proxy"
+	}
+	proto := strconv.Itoa(major)
+	if major < 2 {
+		proto += "." + strconv.Itoa(minor)
+	}
+	h.Add("Via", proto+" "+name)
+}
+
+// forwardHeaders applies the forwarding settings to out, the request
+// forwarded for r: received X-Forwarded-For and Forwarded headers are dropped
+// unless trusted, and the client address and the proxy are appended.
+func forwardHeaders(out, r *http.Request, f config.Forwarding, trusted func(net.IP) bool, name string) {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	peer := net.ParseIP(host)
+	keep := true
+	switch f.Trust {
+	case config.TrustNone:
+		keep = false
+	case config.TrustTrusted:
+		keep = trusted != nil && trusted(peer)
+	}
+	if !keep {
+		out.Header.Del("X-Forwarded-For")
+		out.Header.Del("Forwarded")
+	}
+	addr := f.ClientAddr(peer)
+	if f.XForwardedFor {
+		appendList(out.Header, "X-Forwarded-For", addr)
+	}
+	if f.Forwarded {
+		node := addr
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+			node = `"[` + addr + `]"`
+		}
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		appendList(out.Header, "Forwarded", "for="+node+";proto="+proto)
+	}
+	if f.Via {
+		addVia(out.Header, r.ProtoMajor, r.ProtoMinor, name)
+	}
+}
+
+// appendList appends v to the comma separated list header name, merging
+// multiple header lines into one.
+func appendList(h http.Header, name, v string) {
+	if prior := h.Values(name); len(prior) > 0 {
+		v = strings.Join(prior, ", ") + ", " + v
+	}
+	h.Set(name, v)
+}
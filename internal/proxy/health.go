@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pod32g/proxy/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	upstreamHealthyDesc = prometheus.NewDesc(
+		"proxy_upstream_healthy",
+		"Whether the upstream is in rotation (1) or not (0).",
+		[]string{"upstream"}, nil,
+	)
+	upstreamActiveDesc = prometheus.NewDesc(
+		"proxy_upstream_active_requests",
+		"In-flight requests per upstream.",
+		[]string{"upstream"}, nil,
+	)
+)
+
+// observe records the outcome of a proxied request for passive ejection.
+func (b *Balancer) observe(be *backend, ok bool) {
+	if b.Health == nil {
+		return
+	}
+	hc := b.Health()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		be.passiveFail = 0
+		return
+	}
+	be.passiveFail++
+	if hc.MaxFailures == 0 || be.passiveFail < hc.MaxFailures {
+		return
+	}
+	be.passiveFail = 0
+	be.ejectedUntil = time.Now().Add(hc.EjectDuration.Std())
+	if b.Logger != nil {
+		b.Logger.Info("Upstream ejected after consecutive failures", be.url.String(), hc.EjectDuration.Std())
+	}
+}
+
+// RunHealthChecks probes the pool members until ctx is cancelled. Settings
+// are re-read before every round so changes apply without a restart. While
+// active checks are disabled all targets are considered healthy.
+func (b *Balancer) RunHealthChecks(ctx context.Context) {
+	client := &http.Client{
+		Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+	for {
+		wait := config.DefaultHealthCheck().Interval.Std()
+		if b.Health != nil {
+			hc := b.Health()
+			wait = hc.Interval.Std()
+			if hc.Enabled {
+				b.checkAll(ctx, client, hc)
+			} else {
+				b.resetHealth()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (b *Balancer) resetHealth() {
+	p := b.pool()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, be := range b.membersLocked(p) {
+		be.healthy = true
+		be.probeOK, be.probeFail = 0, 0
+	}
+}
+
+// checkAll probes every member concurrently and applies the thresholds.
+func (b *Balancer) checkAll(ctx context.Context, client *http.Client, hc config.HealthCheck) {
+	p := b.pool()
+	b.mu.Lock()
+	members := b.membersLocked(p)
+	b.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, be := range members {
+		wg.Add(1)
+		go func(be *backend) {
+			defer wg.Done()
+			err := probe(ctx, client, be, hc)
+			b.record(be, hc, err)
+		}(be)
+	}
+	wg.Wait()
+}
+
+func (b *Balancer) record(be *backend, hc config.HealthCheck, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	be.lastCheck = time.Now()
+	if err == nil {
+		be.lastError = ""
+		be.probeFail = 0
+		be.probeOK++
+		if !be.healthy && be.probeOK >= hc.HealthyThreshold {
+			be.healthy = true
+			if b.Logger != nil {
+				b.Logger.Info("Upstream healthy", be.url.String())
+			}
+		}
+		return
+	}
+	be.lastError = err.Error()
+	be.probeOK = 0
+	be.probeFail++
+	if be.healthy && be.probeFail >= hc.UnhealthyThreshold {
+		be.healthy = false
+		if b.Logger != nil {
+			b.Logger.Info("Upstream unhealthy", be.url.String(), err)
+		}
+	}
+}
+
+// probe sends a single health check request to be.
+func probe(ctx context.Context, client *http.Client, be *backend, hc config.HealthCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout.Std())
+	defer cancel()
+	u := *be.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + hc.Path
+	u.RawPath = ""
+	u.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if hc.ExpectedStatus != 0 {
+		if resp.StatusCode != hc.ExpectedStatus {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (b *Balancer) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upstreamHealthyDesc
+	ch <- upstreamActiveDesc
+}
+
+// Collect implements prometheus.Collector, exporting the health and load of
+// the current pool members.
+func (b *Balancer) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range b.Status() {
+		healthy := 0.0
+		if s.Available() {
+			healthy = 1
+		}
+		ch <- prometheus.MustNewConstMetric(upstreamHealthyDesc, prometheus.GaugeValue, healthy, s.URL)
+		ch <- prometheus.MustNewConstMetric(upstreamActiveDesc, prometheus.GaugeValue, float64(s.Active), s.URL)
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pod32g/proxy/internal/config"
+)
+
+func TestPassiveEjection(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer good.Close()
+
+	cfg := &config.Config{}
+	cfg.SetUpstream(config.Upstream{URL: bad.URL})
+	cfg.SetUpstream(config.Upstream{URL: good.URL})
+	cfg.SetHealthCheck(config.HealthCheck{MaxFailures: 2, EjectDuration: config.Duration(time.Hour)})
+	b := NewBalancer(cfg.GetPool)
+	b.Health = cfg.GetHealthCheck
+	srv := httptest.NewServer(NewBalanced(b, newLogger(), func(*http.Request) map[string]string { return nil }))
+	defer srv.Close()
+
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	for _, s := range b.Status() {
+		if s.URL == bad.URL && s.Available() {
+			t.Fatalf("failing upstream not ejected: %+v", s)
+		}
+		if s.URL == good.URL && !s.Available() {
+			t.Fatalf("healthy upstream ejected: %+v", s)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request routed to ejected upstream: %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{}
+	cfg.SetUpstream(config.Upstream{URL: backend.URL})
+	cfg.SetHealthCheck(config.HealthCheck{
+		Enabled:            true,
+		Path:               "/healthz",
+		Interval:           config.Duration(10 * time.Millisecond),
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 2,
+	})
+	b := NewBalancer(cfg.GetPool)
+	b.Health = cfg.GetHealthCheck
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.RunHealthChecks(ctx)
+
+	waitFor := func(healthy bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if s := b.Status(); len(s) == 1 && s[0].Healthy == healthy {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("upstream never became healthy=%v: %+v", healthy, b.Status())
+	}
+	waitFor(false)
+	if _, err := b.pick(httptest.NewRequest("GET", "/", nil)); err != ErrNoUpstream {
+		t.Fatalf("expected unhealthy upstream to leave rotation, got %v", err)
+	}
+	status.Store(http.StatusOK)
+	waitFor(true)
+}
@@ -0,0 +1,487 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pod32g/proxy/internal/accesslog"
+	log "github.com/pod32g/simple-logger"
+)
+
+// leafValidity is how long minted leaf certificates remain valid.
+const leafValidity = 365 * 24 * time.Hour
+
+// leafCacheSize is the number of leaf certificates kept by a CertAuthority.
+const leafCacheSize = 1024
+
+// helloTimeout is how long the Interceptor waits for the first bytes of a
+// tunnel to tell TLS from other protocols, which may wait for the server to
+// speak first.
+const helloTimeout = time.Second
+
+// recordTypeHandshake starts the TLS record carrying a ClientHello.
+const recordTypeHandshake = 0x16
+
+// CertAuthority mints leaf certificates signed by a local CA. The most
+// recently used certificates are cached per host name.
+type CertAuthority struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	leafKey *ecdsa.PrivateKey
+
+	mu sync.Mutex
+	// cache maps host names to their elements in lru, whose values are
+	// *leafEntry, most recently used first.
+	cache map[string]*list.Element
+	lru   *list.List
+}
+
+type leafEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+// LoadCA reads a PEM encoded CA certificate and private key from disk.
+func LoadCA(certFile, keyFile string) (*CertAuthority, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, errors.New("certificate is not a CA")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported CA key type")
+	}
+	return newCertAuthority(cert, key, certPEM)
+}
+
+// GenerateCA creates a new self-signed CA and writes it to certFile and keyFile.
+func GenerateCA(certFile, keyFile string) (*CertAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Proxy Interception CA", Organization: []string{"proxy"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pemEncode("CERTIFICATE", der)
+	if err := os.WriteFile(keyFile, pemEncode("PRIVATE KEY", keyDER), 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return newCertAuthority(cert, key, certPEM)
+}
+
+// LoadOrCreateCA loads the CA from disk, generating a new one if the
+// certificate file does not exist yet.
+func LoadOrCreateCA(certFile, keyFile string) (*CertAuthority, error) {
+	if _, err := os.Stat(certFile); errors.Is(err, os.ErrNotExist) {
+		return GenerateCA(certFile, keyFile)
+	}
+	return LoadCA(certFile, keyFile)
+}
+
+func newCertAuthority(cert *x509.Certificate, key crypto.Signer, certPEM []byte) (*CertAuthority, error) {
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &CertAuthority{
+		cert:    cert,
+		key:     key,
+		certPEM: certPEM,
+		leafKey: leafKey,
+		cache:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+// CertPEM returns the PEM encoded CA certificate for installation in clients.
+func (ca *CertAuthority) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// Certificate returns a leaf certificate for host, minting and caching it on
+// first use. The least recently used certificate is evicted once the cache
+// holds leafCacheSize of them.
+func (ca *CertAuthority) Certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if el, ok := ca.cache[host]; ok {
+		if c := el.Value.(*leafEntry).cert; time.Now().Before(c.Leaf.NotAfter) {
+			ca.lru.MoveToFront(el)
+			return c, nil
+		}
+		ca.lru.Remove(el)
+		delete(ca.cache, host)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().Add(leafValidity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &ca.leafKey.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}
+	ca.cache[host] = ca.lru.PushFront(&leafEntry{host: host, cert: c})
+	if ca.lru.Len() > leafCacheSize {
+		oldest := ca.lru.Back()
+		ca.lru.Remove(oldest)
+		delete(ca.cache, oldest.Value.(*leafEntry).host)
+	}
+	return c, nil
+}
+
+func pemEncode(typ string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Interceptor terminates TLS inside CONNECT tunnels using certificates minted
+// by a CertAuthority and passes the decrypted requests to the next handler.
+// Requests that are not intercepted are passed through unchanged.
+type Interceptor struct {
+	// ACL, when set, is checked for CONNECT requests before they are
+	// intercepted, since those do not reach the forward proxy.
+	ACL *ACL
+	// Tunnels, when set, registers the intercepted tunnels with the forward
+	// proxy, which lists them, applies its tunnel timeouts, terminates them
+	// and drains them on shutdown like those it relays.
+	Tunnels *Forward
+
+	next    http.Handler
+	ca      *CertAuthority
+	logger  *log.Logger
+	enabled func() bool
+	bypass  func(string) bool
+}
+
+// NewInterceptor wraps next with TLS interception. The enabled function toggles
+// interception at runtime and bypass reports hosts whose tunnels must be left
+// untouched, such as applications using certificate pinning. Either may be nil.
+func NewInterceptor(next http.Handler, ca *CertAuthority, logger *log.Logger, enabled func() bool, bypass func(string) bool) *Interceptor {
+	return &Interceptor{next: next, ca: ca, logger: logger, enabled: enabled, bypass: bypass}
+}
+
+func (i *Interceptor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect || i.ca == nil || (i.enabled != nil && !i.enabled()) {
+		i.next.ServeHTTP(w, r)
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if i.bypass != nil && i.bypass(host) {
+		i.logger.Debug("TLS interception bypassed", host)
+		i.next.ServeHTTP(w, r)
+		return
+	}
+	if i.ACL != nil && !i.ACL.Allow(w, r) {
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		i.logger.Error("Hijack error: %v", err)
+		return
+	}
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		clientConn.Close()
+		return
+	}
+	if brw != nil && brw.Reader.Buffered() > 0 {
+		clientConn = &bufferedConn{Conn: clientConn, r: brw.Reader}
+	}
+	// Only TLS is intercepted; other protocols, such as ssh, are relayed
+	// by the next handler.
+	clientConn, isTLS := peekTLS(clientConn)
+	if !isTLS {
+		i.logger.Debug("Not intercepting non-TLS tunnel", r.Host)
+		w := &hijackedWriter{conn: clientConn, header: make(http.Header)}
+		i.next.ServeHTTP(w, r)
+		if !w.hijacked {
+			clientConn.Close()
+		}
+		return
+	}
+	srv := &http.Server{ReadHeaderTimeout: 30 * time.Second}
+	if i.Tunnels != nil {
+		var done func()
+		clientConn, done = i.Tunnels.intercepted(r, clientConn, func() { srv.SetKeepAlivesEnabled(false) })
+		defer done()
+	}
+	i.logger.Debug("Intercepting TLS tunnel", r.Host)
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		// Certificates are only minted for the CONNECT host, so that clients
+		// cannot make the proxy sign arbitrary names.
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" && !strings.EqualFold(strings.TrimSuffix(hello.ServerName, "."), host) {
+				return nil, fmt.Errorf("TLS server name %q does not match the CONNECT host %q", hello.ServerName, host)
+			}
+			return i.ca.Certificate(host)
+		},
+	})
+	connectHost := r.Host
+	connectUser := RequestUser(r)
+	reauthorize, _ := r.Context().Value(reauthorizeKey{}).(func() bool)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if reauthorize != nil && !reauthorize() {
+			accesslog.SetErrorClass(req.Context(), accesslog.ErrorForbidden)
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		req.URL.Scheme = "https"
+		req.URL.Host = req.Host
+		if req.URL.Host == "" {
+			req.URL.Host = connectHost
+		}
+		if connectUser != "" {
+			req = req.WithContext(WithUser(req.Context(), connectUser))
+		}
+		i.next.ServeHTTP(w, req)
+	})
+	srv.Handler = inner
+	srv.Serve(newSingleConnListener(tlsConn))
+}
+
+// peekTLS waits up to helloTimeout for the client of conn to start a TLS
+// handshake. It returns the connection to use instead of conn, which replays
+// the bytes read, and whether the client speaks TLS.
+func peekTLS(conn net.Conn) (net.Conn, bool) {
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	b, err := br.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		// The reader keeps the error, so a fresh one is used; nothing
+		// was read.
+		return conn, false
+	}
+	return &bufferedConn{Conn: conn, r: br}, b[0] == recordTypeHandshake
+}
+
+// hijackedWriter hands a tunnel already hijacked and answered by the
+// Interceptor to the next handler. Responses written before Hijack, such as
+// dial errors, are dropped since the client has been told the tunnel is
+// established, and the tunnel is closed instead.
+type hijackedWriter struct {
+	conn     net.Conn
+	header   http.Header
+	hijacked bool
+}
+
+func (w *hijackedWriter) Header() http.Header         { return w.header }
+func (w *hijackedWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *hijackedWriter) WriteHeader(int)             {}
+
+func (w *hijackedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	w.hijacked = true
+	return &establishedConn{Conn: w.conn}, nil, nil
+}
+
+// establishedConn drops the response to the CONNECT request written by the
+// handler relaying a tunnel, which the client has already received.
+type establishedConn struct {
+	net.Conn
+	answered bool
+}
+
+func (c *establishedConn) Write(p []byte) (int, error) {
+	if !c.answered {
+		c.answered = true
+		if bytes.HasPrefix(p, []byte("HTTP/1.1 200 ")) {
+			return len(p), nil
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+// CloseWrite shuts down the write side of the underlying connection.
+func (c *establishedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// bufferedConn replays bytes buffered by the HTTP server before the hijack.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite shuts down the write side of the underlying connection.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// singleConnListener is a net.Listener that yields a single connection and
+// then blocks until that connection is closed.
+type singleConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newSingleConnListener(c net.Conn) *singleConnListener {
+	l := &singleConnListener{closed: make(chan struct{})}
+	l.conn = &notifyCloseConn{Conn: c, onClose: l.close}
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if c := l.conn; c != nil {
+		l.conn = nil
+		return c, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) close() {
+	l.once.Do(func() { close(l.closed) })
+}
+
+func (l *singleConnListener) Close() error {
+	l.close()
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return dummyAddr{}
+}
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "tcp" }
+func (dummyAddr) String() string  { return "intercepted" }
+
+type notifyCloseConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *notifyCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	return err
+}
+
+type reauthorizeKey struct{}
+
+// WithReauthorize attaches to a CONNECT request a function reporting whether
+// the credentials it was authorized with are still valid. Intercepted
+// tunnels call it before every request decrypted from them and close the
+// tunnel once it reports false, so credential changes also apply to
+// keep-alive sessions opened before them. Forward.Reauthorize calls it to
+// close the tunnels of revoked credentials.
+func WithReauthorize(ctx context.Context, reauthorize func() bool) context.Context {
+	return context.WithValue(ctx, reauthorizeKey{}, reauthorize)
+}
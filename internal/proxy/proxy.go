@@ -13,21 +13,21 @@ func sanitizedURL(u *url.URL) string {
 }
 
 // New creates a reverse proxy to the given target URL.
-// The headers function receives the client address and returns headers to set on each upstream request.
-func New(target *url.URL, logger *log.Logger, headers func(string) map[string]string) *httputil.ReverseProxy {
+// The headers function receives the client request and returns headers to set on each upstream request.
+func New(target *url.URL, logger *log.Logger, headers func(*http.Request) map[string]string) *httputil.ReverseProxy {
 	proxy := httputil.NewSingleHostReverseProxy(target)
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		logger.Debug("Reverse proxy request", req.Method, sanitizedURL(req.URL))
 		originalDirector(req)
-		for k, v := range headers(req.RemoteAddr) {
+		for k, v := range headers(req) {
 			req.Header.Set(k, v)
 		}
 	}
 
 	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
 		logger.Error("Upstream Error: %v", err)
-		http.Error(rw, "Bad gateway", http.StatusBadGateway)
+		upstreamError(rw, req, err)
 	}
 
 	return proxy
@@ -2,15 +2,23 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/pod32g/proxy/internal/config"
 	log "github.com/pod32g/simple-logger"
 )
 
@@ -31,7 +39,7 @@ func TestNewAddsHeader(t *testing.T) {
 	}
 
 	headers := map[string]string{"X-Test": "value"}
-	rp := New(u, newLogger(), func(string) map[string]string { return headers })
+	rp := New(u, newLogger(), func(*http.Request) map[string]string { return headers })
 	proxySrv := httptest.NewServer(rp)
 	defer proxySrv.Close()
 
@@ -48,7 +56,7 @@ func TestNewAddsHeader(t *testing.T) {
 
 func TestErrorHandlerReturnsBadGateway(t *testing.T) {
 	u, _ := url.Parse("http://127.0.0.1:1")
-	rp := New(u, newLogger(), func(string) map[string]string { return nil })
+	rp := New(u, newLogger(), func(*http.Request) map[string]string { return nil })
 	proxySrv := httptest.NewServer(rp)
 	defer proxySrv.Close()
 
@@ -69,7 +77,7 @@ func TestForwardAddsHeader(t *testing.T) {
 	}))
 	defer backend.Close()
 
-	fp := NewForward(newLogger(), func(string) map[string]string { return map[string]string{"X-Test": "value"} })
+	fp := NewForward(newLogger(), func(*http.Request) map[string]string { return map[string]string{"X-Test": "value"} })
 	proxySrv := httptest.NewServer(fp)
 	defer proxySrv.Close()
 
@@ -102,7 +110,7 @@ func TestForwardConnect(t *testing.T) {
 		close(done)
 	}()
 
-	fp := NewForward(newLogger(), func(string) map[string]string { return nil })
+	fp := NewForward(newLogger(), func(*http.Request) map[string]string { return nil })
 	proxySrv := httptest.NewServer(fp)
 	defer proxySrv.Close()
 
@@ -125,7 +133,7 @@ func TestForwardConnect(t *testing.T) {
 }
 
 func TestForwardInvalidRequest(t *testing.T) {
-	fp := NewForward(newLogger(), func(string) map[string]string { return nil })
+	fp := NewForward(newLogger(), func(*http.Request) map[string]string { return nil })
 	proxySrv := httptest.NewServer(fp)
 	defer proxySrv.Close()
 
@@ -138,3 +146,827 @@ func TestForwardInvalidRequest(t *testing.T) {
 		t.Fatalf("expected 400 status, got %d", resp.StatusCode)
 	}
 }
+
+func newTestCA(t *testing.T) *CertAuthority {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func TestInterceptorInjectsHeader(t *testing.T) {
+	var received string
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("X-Test")
+	}))
+	defer backend.Close()
+
+	ca := newTestCA(t)
+	fp := NewForward(newLogger(), func(*http.Request) map[string]string { return map[string]string{"X-Test": "value"} })
+	fp.Transport.TLSClientConfig = backend.Client().Transport.(*http.Transport).TLSClientConfig
+	proxySrv := httptest.NewServer(NewInterceptor(fp, ca, newLogger(), nil, nil))
+	defer proxySrv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertPEM())
+	proxyURL, _ := url.Parse(proxySrv.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	resp.Body.Close()
+	if received != "value" {
+		t.Fatalf("expected header 'value', got %q", received)
+	}
+	if len(resp.TLS.PeerCertificates) == 0 || resp.TLS.PeerCertificates[0].Issuer.CommonName != "Proxy Interception CA" {
+		t.Fatalf("certificate not minted by interception CA")
+	}
+}
+
+func TestInterceptorReauthorize(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	ca := newTestCA(t)
+	fp := NewForward(newLogger(), nil)
+	fp.Transport.TLSClientConfig = backend.Client().Transport.(*http.Transport).TLSClientConfig
+	var valid atomic.Bool
+	valid.Store(true)
+	interceptor := NewInterceptor(fp, ca, newLogger(), nil, nil)
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		interceptor.ServeHTTP(w, r.WithContext(WithReauthorize(r.Context(), valid.Load)))
+	}))
+	defer proxySrv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertPEM())
+	proxyURL, _ := url.Parse(proxySrv.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// The next request reuses the tunnel, whose credentials are now revoked.
+	valid.Store(false)
+	resp, err = client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || !resp.Close {
+		t.Fatalf("revoked tunnel not closed: %d close=%v", resp.StatusCode, resp.Close)
+	}
+}
+
+func TestInterceptorBypass(t *testing.T) {
+	var received string
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("X-Test")
+	}))
+	defer backend.Close()
+
+	ca := newTestCA(t)
+	fp := NewForward(newLogger(), func(*http.Request) map[string]string { return map[string]string{"X-Test": "value"} })
+	bypass := func(string) bool { return true }
+	proxySrv := httptest.NewServer(NewInterceptor(fp, ca, newLogger(), nil, bypass))
+	defer proxySrv.Close()
+
+	proxyURL, _ := url.Parse(proxySrv.URL)
+	transport := backend.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	resp, err := (&http.Client{Transport: transport}).Get(backend.URL)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	resp.Body.Close()
+	if received != "" {
+		t.Fatalf("bypassed tunnel should not be modified, got %q", received)
+	}
+}
+
+func TestForwardReauthorize(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	fp := NewForward(newLogger(), nil)
+	closed := make(chan TunnelStats, 1)
+	fp.OnTunnelClose = func(s TunnelStats) { closed <- s }
+	var valid atomic.Bool
+	valid.Store(true)
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fp.ServeHTTP(w, r.WithContext(WithReauthorize(r.Context(), valid.Load)))
+	}))
+	defer proxySrv.Close()
+
+	conn, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host := ln.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := fp.Reauthorize(); n != 0 || len(fp.Tunnels()) != 1 {
+		t.Fatalf("valid tunnel closed: %d", n)
+	}
+
+	valid.Store(false)
+	if n := fp.Reauthorize(); n != 1 {
+		t.Fatalf("expected 1 revoked tunnel, got %d", n)
+	}
+	select {
+	case s := <-closed:
+		if s.Reason != CloseRevoked {
+			t.Fatalf("unexpected close reason %q", s.Reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("revoked tunnel not closed")
+	}
+}
+
+func TestInterceptorPlainTunnel(t *testing.T) {
+	// The upstream greets its clients, then echoes.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.WriteString(conn, "SSH-2.0-test\r\n")
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	ca := newTestCA(t)
+	fp := NewForward(newLogger(), nil)
+	interceptor := NewInterceptor(fp, ca, newLogger(), nil, nil)
+	interceptor.Tunnels = fp
+	proxySrv := httptest.NewServer(interceptor)
+	defer proxySrv.Close()
+
+	conn, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host := ln.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	br := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+	// The client waits for the server to speak first, and sees no second
+	// response to its CONNECT request.
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if line, err := br.ReadString('\n'); err != nil || line != "SSH-2.0-test\r\n" {
+		t.Fatalf("unexpected greeting %q: %v", line, err)
+	}
+	io.WriteString(conn, "hello\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("unexpected echo %q: %v", line, err)
+	}
+	if tunnels := fp.Tunnels(); len(tunnels) != 1 || tunnels[0].Intercepted {
+		t.Fatalf("expected a plain tunnel, got %+v", tunnels)
+	}
+
+	// Clients speaking first without TLS are relayed as well.
+	conn2, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	fmt.Fprintf(conn2, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nping\n", host, host)
+	br2 := bufio.NewReader(conn2)
+	if resp, err := http.ReadResponse(br2, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+	conn2.SetReadDeadline(time.Now().Add(3 * time.Second))
+	br2.ReadString('\n')
+	if line, err := br2.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("unexpected echo %q: %v", line, err)
+	}
+}
+
+func TestInterceptorTunnels(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	ca := newTestCA(t)
+	var timeouts atomic.Value
+	timeouts.Store(config.TunnelTimeouts{})
+	fp := NewForward(newLogger(), nil)
+	fp.Transport.TLSClientConfig = backend.Client().Transport.(*http.Transport).TLSClientConfig
+	fp.Timeouts = func() config.TunnelTimeouts { return timeouts.Load().(config.TunnelTimeouts) }
+	interceptor := NewInterceptor(fp, ca, newLogger(), nil, nil)
+	interceptor.Tunnels = fp
+	proxySrv := httptest.NewServer(interceptor)
+	defer proxySrv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertPEM())
+	proxyURL, _ := url.Parse(proxySrv.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	get := func() {
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	waitGone := func() {
+		for deadline := time.Now().Add(2 * time.Second); len(fp.Tunnels()) > 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("intercepted tunnel still open: %+v", fp.Tunnels())
+			}
+		}
+	}
+
+	// The keep-alive tunnel is listed until it is terminated.
+	get()
+	tunnels := fp.Tunnels()
+	if len(tunnels) != 1 || !tunnels[0].Intercepted || tunnels[0].Host != "127.0.0.1" || tunnels[0].BytesUp == 0 || tunnels[0].BytesDown == 0 {
+		t.Fatalf("unexpected tunnels: %+v", tunnels)
+	}
+	if !fp.CloseTunnel(tunnels[0].ID) {
+		t.Fatal("intercepted tunnel not terminated")
+	}
+	waitGone()
+
+	// Idle intercepted tunnels are closed.
+	timeouts.Store(config.TunnelTimeouts{Idle: config.Duration(100 * time.Millisecond)})
+	client.CloseIdleConnections()
+	get()
+	if len(fp.Tunnels()) != 1 {
+		t.Fatalf("tunnel not listed: %+v", fp.Tunnels())
+	}
+	waitGone()
+}
+
+func TestInterceptorDrain(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	ca := newTestCA(t)
+	fp := NewForward(newLogger(), nil)
+	fp.Transport.TLSClientConfig = backend.Client().Transport.(*http.Transport).TLSClientConfig
+	interceptor := NewInterceptor(fp, ca, newLogger(), nil, nil)
+	interceptor.Tunnels = fp
+	proxySrv := httptest.NewServer(interceptor)
+	defer proxySrv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertPEM())
+	proxyURL, _ := url.Parse(proxySrv.URL)
+	newClient := func() *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+	}
+
+	// An idle keep-alive tunnel is closed at once.
+	resp, err := newClient().Get(backend.URL)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	resp.Body.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if n := fp.DrainTunnels(ctx); n != 0 || ctx.Err() != nil {
+		t.Fatalf("idle intercepted tunnel not drained: %d force-closed", n)
+	}
+
+	// A tunnel with a request in flight is force-closed at the deadline.
+	go newClient().Get(backend.URL + "/slow")
+	for deadline := time.Now().Add(2 * time.Second); len(fp.Tunnels()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("intercepted tunnel not opened")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if n := fp.DrainTunnels(ctx); n != 1 {
+		t.Fatalf("expected 1 force-closed tunnel, got %d", n)
+	}
+}
+
+func TestCertAuthorityCacheBounded(t *testing.T) {
+	ca := newTestCA(t)
+	first, err := ca.Certificate("host0.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n <= leafCacheSize; n++ {
+		if _, err := ca.Certificate(fmt.Sprintf("host%d.example", n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ca.cache) != leafCacheSize || ca.lru.Len() != leafCacheSize {
+		t.Fatalf("cache holds %d/%d certificates, want %d", len(ca.cache), ca.lru.Len(), leafCacheSize)
+	}
+	if _, ok := ca.cache["host0.example"]; ok {
+		t.Fatal("least recently used certificate not evicted")
+	}
+	again, err := ca.Certificate("host0.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == first {
+		t.Fatal("evicted certificate served from the cache")
+	}
+}
+
+func TestInterceptorServerNameMismatch(t *testing.T) {
+	ca := newTestCA(t)
+	proxySrv := httptest.NewServer(NewInterceptor(NewForward(newLogger(), nil), ca, newLogger(), nil, nil))
+	defer proxySrv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxySrv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertPEM())
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "other.example", RootCAs: roots})
+	if err := tlsConn.Handshake(); err == nil {
+		t.Fatal("handshake for a different server name succeeded")
+	}
+	if _, ok := ca.cache["other.example"]; ok {
+		t.Fatal("certificate minted for the client's server name")
+	}
+}
+
+func TestForwardThroughParent(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	var parentSeen []string
+	parentFwd := NewForward(newLogger(), nil)
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+		parentSeen = append(parentSeen, r.Method+" "+user+":"+pass)
+		parentFwd.ServeHTTP(w, r)
+	}))
+	defer parent.Close()
+	parentURL, _ := url.Parse(parent.URL)
+	parentURL.User = url.UserPassword("u", "p")
+
+	fp := NewForward(newLogger(), nil)
+	fp.Parent = func(string) *url.URL { return parentURL }
+	proxySrv := httptest.NewServer(fp)
+	defer proxySrv.Close()
+
+	proxyURL, _ := url.Parse(proxySrv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host := strings.TrimPrefix(backend.URL, "http://")
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil || !strings.Contains(line, "200") {
+		t.Fatalf("expected 200 response, got %q: %v", line, err)
+	}
+
+	if len(parentSeen) != 2 || parentSeen[0] != "GET u:p" || parentSeen[1] != "CONNECT u:p" {
+		t.Fatalf("parent proxy not used as expected: %v", parentSeen)
+	}
+}
+
+func parseProxyAuth(h string) (string, string, bool) {
+	r := &http.Request{Header: http.Header{"Authorization": {h}}}
+	return r.BasicAuth()
+}
+
+func TestForwardStripsHopHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("Proxy-Authenticate", `Basic realm="upstream"`)
+		w.Header().Set("X-End", "1")
+	}))
+	defer backend.Close()
+
+	fp := NewForward(newLogger(), nil)
+	req := httptest.NewRequest(http.MethodGet, backend.URL+"/", nil)
+	req.Header.Set("Proxy-Authorization", "Basic dTpw")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Connection", "X-Hop, keep-alive")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("TE", "trailers, deflate")
+	req.Header.Set("X-End", "1")
+	rec := httptest.NewRecorder()
+	fp.ServeHTTP(rec, req)
+
+	for _, name := range []string{"Proxy-Authorization", "Proxy-Connection", "Keep-Alive", "X-Hop", "Via", "X-Forwarded-For", "Forwarded"} {
+		if v := received.Get(name); v != "" {
+			t.Errorf("request header %s forwarded: %q", name, v)
+		}
+	}
+	if received.Get("X-End") != "1" {
+		t.Error("end-to-end request header dropped")
+	}
+	if te := received.Get("TE"); te != "trailers" {
+		t.Errorf("expected TE: trailers, got %q", te)
+	}
+	for _, name := range []string{"Connection", "X-Backend-Hop", "Proxy-Authenticate"} {
+		if v := rec.Header().Get(name); v != "" {
+			t.Errorf("response header %s forwarded: %q", name, v)
+		}
+	}
+	if rec.Header().Get("X-End") != "1" {
+		t.Error("end-to-end response header dropped")
+	}
+}
+
+func TestForwardingHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	var fwd config.Forwarding
+	fp := NewForward(newLogger(), nil)
+	fp.Forwarding = func() config.Forwarding { return fwd }
+	fp.TrustedProxy = func(ip net.IP) bool { return ip.Equal(net.ParseIP("192.0.2.1")) }
+	fp.Name = func() string { return "edge" }
+	send := func(remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, backend.URL+"/", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		req.Header.Set("Forwarded", "for=10.0.0.1")
+		rec := httptest.NewRecorder()
+		fp.ServeHTTP(rec, req)
+		return rec
+	}
+
+	fwd = config.Forwarding{Via: true, XForwardedFor: true, Forwarded: true}
+	rec := send("198.51.100.7:1234")
+	if v := received.Get("X-Forwarded-For"); v != "10.0.0.1, 198.51.100.7" {
+		t.Errorf("X-Forwarded-For = %q", v)
+	}
+	if v := received.Get("Forwarded"); v != "for=10.0.0.1, for=198.51.100.7;proto=http" {
+		t.Errorf("Forwarded = %q", v)
+	}
+	if v := received.Get("Via"); v != "1.1 edge" {
+		t.Errorf("request Via = %q", v)
+	}
+	if v := rec.Header().Get("Via"); v != "1.1 edge" {
+		t.Errorf("response Via = %q", v)
+	}
+
+	fwd = config.Forwarding{XForwardedFor: true, Forwarded: true, Trust: config.TrustTrusted, Anonymize: config.AnonymizeTruncate}
+	send("198.51.100.7:1234")
+	if v := received.Get("X-Forwarded-For"); v != "198.51.100.0" {
+		t.Errorf("untrusted X-Forwarded-For = %q", v)
+	}
+	send("192.0.2.1:1234")
+	if v := received.Get("X-Forwarded-For"); v != "10.0.0.1, 192.0.2.0" {
+		t.Errorf("trusted X-Forwarded-For = %q", v)
+	}
+	send("[2001:db8:1:2::1]:1234")
+	if v := received.Get("Forwarded"); v != `for="[2001:db8:1::]";proto=http` {
+		t.Errorf("IPv6 Forwarded = %q", v)
+	}
+
+	fwd = config.Forwarding{XForwardedFor: true, Trust: config.TrustNone, Anonymize: config.AnonymizeHide}
+	send("192.0.2.1:1234")
+	if v := received.Get("X-Forwarded-For"); v != "unknown" {
+		t.Errorf("hidden X-Forwarded-For = %q", v)
+	}
+	if v := received.Get("Forwarded"); v != "" {
+		t.Errorf("Forwarded kept with trust none: %q", v)
+	}
+}
+
+func TestForwardTunnelStats(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	fp := NewForward(newLogger(), nil)
+	var opened atomic.Value
+	closed := make(chan TunnelStats, 1)
+	fp.OnTunnelOpen = func(host string) { opened.Store(host) }
+	fp.OnTunnelClose = func(s TunnelStats) { closed <- s }
+	proxySrv := httptest.NewServer(fp)
+	defer proxySrv.Close()
+
+	conn, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := ln.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	br := bufio.NewReader(conn)
+	if _, err := http.ReadResponse(br, nil); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "hello\n")
+	if line, _ := br.ReadString('\n'); line != "hello\n" {
+		t.Fatalf("unexpected echo %q", line)
+	}
+	conn.Close()
+
+	select {
+	case s := <-closed:
+		if opened.Load() != "127.0.0.1" || s.Host != "127.0.0.1" || s.BytesUp != 6 || s.BytesDown != 6 || s.Reason != CloseClientEOF || s.Duration <= 0 {
+			t.Fatalf("unexpected tunnel stats: %+v", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel close not reported")
+	}
+}
+
+func TestForwardTunnelLifecycle(t *testing.T) {
+	// The upstream answers once the client has sent everything.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, _ := io.ReadAll(conn)
+				conn.Write(bytes.ToUpper(b))
+			}()
+		}
+	}()
+
+	var timeouts atomic.Value
+	timeouts.Store(config.TunnelTimeouts{})
+	fp := NewForward(newLogger(), nil)
+	fp.Timeouts = func() config.TunnelTimeouts { return timeouts.Load().(config.TunnelTimeouts) }
+	closed := make(chan TunnelStats, 1)
+	fp.OnTunnelClose = func(s TunnelStats) { closed <- s }
+	proxySrv := httptest.NewServer(fp)
+	defer proxySrv.Close()
+
+	open := func() (*net.TCPConn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		host := ln.Addr().String()
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+		br := bufio.NewReader(conn)
+		if _, err := http.ReadResponse(br, nil); err != nil {
+			t.Fatal(err)
+		}
+		return conn.(*net.TCPConn), br
+	}
+	waitClosed := func() TunnelStats {
+		select {
+		case s := <-closed:
+			return s
+		case <-time.After(2 * time.Second):
+			t.Fatal("tunnel close not reported")
+		}
+		return TunnelStats{}
+	}
+
+	// A half-closed tunnel still relays the response.
+	conn, br := open()
+	io.WriteString(conn, "hello")
+	conn.CloseWrite()
+	if b, _ := io.ReadAll(br); string(b) != "HELLO" {
+		t.Fatalf("unexpected response %q after half-close", b)
+	}
+	conn.Close()
+	if s := waitClosed(); s.Reason != CloseClientEOF || s.BytesUp != 5 || s.BytesDown != 5 {
+		t.Fatalf("unexpected half-closed tunnel stats: %+v", s)
+	}
+
+	// Live tunnels are listed and can be terminated.
+	conn, br = open()
+	defer conn.Close()
+	io.WriteString(conn, "abc")
+	var list []Tunnel
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if list = fp.Tunnels(); len(list) == 1 && list[0].BytesUp == 3 {
+			break
+		}
+	}
+	if len(list) != 1 || list[0].Host != "127.0.0.1" || list[0].Client != "127.0.0.1" || list[0].Upstream != ln.Addr().String() {
+		t.Fatalf("unexpected live tunnels: %+v", list)
+	}
+	if fp.CloseTunnel(list[0].ID + 1) {
+		t.Fatal("closed an unknown tunnel")
+	}
+	if !fp.CloseTunnel(list[0].ID) {
+		t.Fatal("live tunnel not closed")
+	}
+	if s := waitClosed(); s.Reason != CloseTerminated {
+		t.Fatalf("unexpected terminated tunnel stats: %+v", s)
+	}
+	if _, err := io.ReadAll(br); err != nil || len(fp.Tunnels()) != 0 {
+		t.Fatalf("terminated tunnel still open: %v %+v", err, fp.Tunnels())
+	}
+
+	// Draining waits for tunnels to finish, then closes those left.
+	conn, br = open()
+	defer conn.Close()
+	go func(conn *net.TCPConn) {
+		time.Sleep(50 * time.Millisecond)
+		conn.CloseWrite()
+		io.ReadAll(br)
+		conn.Close()
+	}(conn)
+	for len(fp.Tunnels()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if n := fp.DrainTunnels(ctx); n != 0 {
+		t.Fatalf("%d tunnels closed while draining", n)
+	}
+	if s := waitClosed(); s.Reason != CloseClientEOF {
+		t.Fatalf("unexpected drained tunnel stats: %+v", s)
+	}
+	conn, _ = open()
+	defer conn.Close()
+	for len(fp.Tunnels()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	if n := fp.DrainTunnels(short); n != 1 {
+		t.Fatalf("closed %d tunnels on shutdown, want 1", n)
+	}
+	if s := waitClosed(); s.Reason != CloseShutdown {
+		t.Fatalf("unexpected shutdown tunnel stats: %+v", s)
+	}
+
+	// Idle and long-lived tunnels are closed.
+	timeouts.Store(config.TunnelTimeouts{Idle: config.Duration(50 * time.Millisecond)})
+	conn, _ = open()
+	defer conn.Close()
+	if s := waitClosed(); s.Reason != CloseIdleTimeout {
+		t.Fatalf("unexpected idle tunnel stats: %+v", s)
+	}
+	timeouts.Store(config.TunnelTimeouts{MaxLifetime: config.Duration(50 * time.Millisecond)})
+	conn, _ = open()
+	defer conn.Close()
+	if s := waitClosed(); s.Reason != CloseLifetime {
+		t.Fatalf("unexpected long-lived tunnel stats: %+v", s)
+	}
+}
+
+func TestForwardStreaming(t *testing.T) {
+	// The events are sent further apart than the write timeout, which the
+	// stream outlives because every event extends it.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(60 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+	proxySrv := httptest.NewUnstartedServer(WithTimeouts(NewForward(newLogger(), nil), Timeouts{Write: 100 * time.Millisecond}))
+	proxySrv.Config.WriteTimeout = 100 * time.Millisecond
+	proxySrv.Start()
+	defer proxySrv.Close()
+
+	proxyURL, _ := url.Parse(proxySrv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	start := time.Now()
+	if line, _ := br.ReadString('\n'); line != "data: 0\n" {
+		t.Fatalf("unexpected first event %q", line)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("first event not flushed")
+	}
+	b, err := io.ReadAll(br)
+	if err != nil || strings.Count(string(b), "data: ") != 3 {
+		t.Fatalf("stream cut short: %q %v", b, err)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	timeouts := Timeouts{ResponseHeader: 50 * time.Millisecond}
+
+	forward := WithTimeouts(NewForward(newLogger(), nil), timeouts)
+	cfg := &config.Config{}
+	cfg.SetUpstream(config.Upstream{URL: upstream.URL, Weight: 1})
+	balanced := WithTimeouts(NewBalanced(NewBalancer(cfg.GetPool), newLogger(), func(*http.Request) map[string]string { return nil }), timeouts)
+	for name, tc := range map[string]struct {
+		h      http.Handler
+		prefix string
+	}{
+		"forward":  {forward, upstream.URL},
+		"balanced": {balanced, "http://proxy.example"},
+	} {
+		for path, want := range map[string]int{"/slow": http.StatusGatewayTimeout, "/fast": http.StatusOK} {
+			rec := httptest.NewRecorder()
+			tc.h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.prefix+path, nil))
+			if rec.Code != want {
+				t.Errorf("%s %s: got %d, want %d", name, path, rec.Code, want)
+			}
+		}
+	}
+}
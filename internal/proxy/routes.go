@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pod32g/proxy/internal/config"
+	log "github.com/pod32g/simple-logger"
+)
+
+// Routes dispatches reverse proxy requests using a routing table. Requests
+// that match no route are passed to the fallback handler. The table is read
+// on every request so changes take effect immediately.
+type Routes struct {
+	routes   func() []config.Route
+	fallback http.Handler
+	logger   *log.Logger
+	headers  func(*http.Request) map[string]string
+
+	mu      sync.Mutex
+	proxies map[string]*httputil.ReverseProxy
+	regexps map[string]*regexp.Regexp
+}
+
+// NewRoutes creates a routing handler over the table returned by routes. The
+// headers function receives the client request and returns headers to set
+// on each upstream request. A nil fallback answers unmatched requests with
+// 404.
+func NewRoutes(routes func() []config.Route, fallback http.Handler, logger *log.Logger, headers func(*http.Request) map[string]string) *Routes {
+	return &Routes{
+		routes:   routes,
+		fallback: fallback,
+		logger:   logger,
+		headers:  headers,
+		proxies:  make(map[string]*httputil.ReverseProxy),
+		regexps:  make(map[string]*regexp.Regexp),
+	}
+}
+
+// Match returns the first route that matches r.
+func (rt *Routes) Match(r *http.Request) (config.Route, bool) {
+	for _, route := range rt.routes() {
+		if rt.matches(route, r) {
+			return route, true
+		}
+	}
+	return config.Route{}, false
+}
+
+func (rt *Routes) matches(route config.Route, r *http.Request) bool {
+	if route.Host != "" && !config.MatchHost(route.Host, r.Host) {
+		return false
+	}
+	if route.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+		return false
+	}
+	if route.PathRegex != "" {
+		re := rt.regexp(route.PathRegex)
+		if re == nil || !re.MatchString(r.URL.Path) {
+			return false
+		}
+	}
+	if len(route.Methods) > 0 && !containsString(route.Methods, r.Method) {
+		return false
+	}
+	for name, want := range route.Headers {
+		got := r.Header.Values(name)
+		if len(got) == 0 || (want != "" && !containsString(got, want)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rt *Routes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, ok := rt.Match(r)
+	if !ok {
+		if rt.fallback == nil {
+			http.NotFound(w, r)
+			return
+		}
+		rt.fallback.ServeHTTP(w, r)
+		return
+	}
+	rp, err := rt.proxy(route.Target)
+	if err != nil {
+		rt.logger.Error("Invalid route target: %v", err)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+	rt.logger.Debug("Route matched", route.Name, r.Host, r.URL.Path)
+	if path := rt.rewritePath(route, r.URL.Path); path != r.URL.Path {
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path = path
+		u.RawPath = ""
+		r2.URL = &u
+		r = r2
+	}
+	ctx, release := awaitResponseHeader(r.Context())
+	defer release()
+	r = r.WithContext(ctx)
+	rp.ServeHTTP(newStreamWriter(w, r), r)
+}
+
+// rewritePath applies the route's prefix stripping and rewriting to path.
+func (rt *Routes) rewritePath(route config.Route, path string) string {
+	switch {
+	case route.Rewrite != "" && route.PathRegex != "":
+		if re := rt.regexp(route.PathRegex); re != nil {
+			path = re.ReplaceAllString(path, route.Rewrite)
+		}
+	case route.Rewrite != "":
+		path = joinPath(route.Rewrite, strings.TrimPrefix(path, route.PathPrefix))
+	case route.StripPrefix:
+		path = strings.TrimPrefix(path, route.PathPrefix)
+	default:
+		return path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// joinPath appends rest to prefix without doubling the slash between them.
+func joinPath(prefix, rest string) string {
+	if strings.HasSuffix(prefix, "/") && strings.HasPrefix(rest, "/") {
+		return prefix + rest[1:]
+	}
+	return prefix + rest
+}
+
+func (rt *Routes) proxy(target string) (*httputil.ReverseProxy, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rp, ok := rt.proxies[target]; ok {
+		return rp, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	rp := New(u, rt.logger, rt.headers)
+	rt.proxies[target] = rp
+	return rp, nil
+}
+
+func (rt *Routes) regexp(pattern string) *regexp.Regexp {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if re, ok := rt.regexps[pattern]; ok {
+		return re
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		rt.logger.Error("Invalid route regex: %v", err)
+	}
+	rt.regexps[pattern] = re
+	return re
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
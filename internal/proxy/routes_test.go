@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pod32g/proxy/internal/config"
+)
+
+func echoPath(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name+" "+r.URL.Path)
+	}))
+}
+
+func TestRoutes(t *testing.T) {
+	app1 := echoPath("app1")
+	defer app1.Close()
+	billing := echoPath("billing")
+	defer billing.Close()
+	api := echoPath("api")
+	defer api.Close()
+
+	cfg := &config.Config{}
+	for _, r := range []config.Route{
+		{Name: "app1", Host: "*.example.internal", Target: app1.URL},
+		{Name: "billing", Priority: 10, PathPrefix: "/billing/", StripPrefix: true, Target: billing.URL},
+		{Name: "api", PathRegex: `^/api/v(\d+)/`, Rewrite: "/version$1/", Methods: []string{"POST"}, Target: api.URL},
+		{Name: "beta", PathPrefix: "/beta", Rewrite: "/next", Headers: map[string]string{"X-Beta": ""}, Target: api.URL},
+	} {
+		if err := cfg.SetRoute(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "fallback "+r.URL.Path)
+	})
+	h := NewRoutes(cfg.GetRoutes, fallback, newLogger(), func(*http.Request) map[string]string { return nil })
+
+	tests := []struct {
+		method, host, path string
+		header             string
+		want               string
+	}{
+		{"GET", "app1.example.internal", "/x", "", "app1 /x"},
+		{"GET", "app1.example.internal", "/billing/invoices", "", "billing /invoices"},
+		{"POST", "other", "/api/v2/items", "", "api /version2/items"},
+		{"GET", "other", "/api/v2/items", "", "fallback /api/v2/items"},
+		{"GET", "other", "/beta/page", "1", "api /next/page"},
+		{"GET", "other", "/beta/page", "", "fallback /beta/page"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://"+tt.host+tt.path, nil)
+		if tt.header != "" {
+			req.Header.Set("X-Beta", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("%s %s%s: got %q, want %q", tt.method, tt.host, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/pod32g/proxy/internal/accesslog"
+)
+
+// Timeouts are the limits of a listener enforced by the proxy handlers
+// rather than by its http.Server.
+type Timeouts struct {
+	// ResponseHeader limits the wait for the response header of upstream
+	// servers once a request has been sent.
+	ResponseHeader time.Duration
+	// Write is the write timeout of the listener, extended by this much for
+	// every chunk of streaming responses.
+	Write time.Duration
+}
+
+type timeoutsKey struct{}
+
+// WithTimeouts makes the proxy handlers served by next apply t.
+func WithTimeouts(next http.Handler, t Timeouts) http.Handler {
+	if t == (Timeouts{}) {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), timeoutsKey{}, t)))
+	})
+}
+
+func timeoutsFrom(ctx context.Context) Timeouts {
+	t, _ := ctx.Value(timeoutsKey{}).(Timeouts)
+	return t
+}
+
+var errResponseHeaderTimeout = errors.New("timeout awaiting response header")
+
+// awaitResponseHeader returns ctx canceled unless the response header of an
+// upstream request made with it arrives within the ResponseHeader timeout,
+// and a function releasing its resources once the response is done.
+func awaitResponseHeader(ctx context.Context) (context.Context, context.CancelFunc) {
+	d := timeoutsFrom(ctx).ResponseHeader
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(d, func() { cancel(errResponseHeaderTimeout) })
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { timer.Stop() },
+	})
+	return ctx, func() {
+		timer.Stop()
+		cancel(context.Canceled)
+	}
+}
+
+// upstreamError answers a request whose upstream request failed with err:
+// 504 Gateway Timeout when the response header did not arrive in time and
+// 502 Bad Gateway otherwise.
+func upstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	if context.Cause(r.Context()) == errResponseHeaderTimeout {
+		accesslog.SetErrorClass(r.Context(), accesslog.ErrorTimeout)
+		http.Error(w, "Gateway timeout", http.StatusGatewayTimeout)
+		return
+	}
+	accesslog.SetError(r.Context(), err)
+	http.Error(w, "Bad gateway", http.StatusBadGateway)
+}
+
+// streaming reports whether a response with header h is streamed: an event
+// stream, or a body of unknown length.
+func streaming(h http.Header) bool {
+	if mt, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mt == "text/event-stream" {
+		return true
+	}
+	return h.Get("Content-Length") == ""
+}
+
+// streamWriter flushes streaming responses after every write, so that
+// chunks reach the client as soon as the upstream sends them, and extends
+// the write deadline of the connection by the Write timeout each time so
+// that streams outlive it as long as they make progress.
+type streamWriter struct {
+	http.ResponseWriter
+	rc          *http.ResponseController
+	write       time.Duration
+	wroteHeader bool
+	streaming   bool
+}
+
+// newStreamWriter wraps w for the responses of r.
+func newStreamWriter(w http.ResponseWriter, r *http.Request) *streamWriter {
+	return &streamWriter{ResponseWriter: w, rc: http.NewResponseController(w), write: timeoutsFrom(r.Context()).Write}
+}
+
+func (w *streamWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= http.StatusOK {
+		w.wroteHeader = true
+		w.streaming = streaming(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.streaming {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.write > 0 {
+		w.rc.SetWriteDeadline(time.Now().Add(w.write))
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if err == nil {
+		w.rc.Flush()
+	}
+	return n, err
+}
+
+// Flush allows the reverse proxy to flush responses itself.
+func (w *streamWriter) Flush() {
+	w.rc.Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter,
+// to hijack upgraded connections among others.
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
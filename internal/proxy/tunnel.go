@@ -0,0 +1,396 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons a CONNECT tunnel was closed for.
+const (
+	CloseClientEOF   = "client_eof"
+	CloseUpstreamEOF = "upstream_eof"
+	CloseIdleTimeout = "idle_timeout"
+	CloseLifetime    = "max_lifetime"
+	CloseTerminated  = "terminated"
+	CloseRevoked     = "revoked"
+	CloseShutdown    = "shutdown"
+	CloseError       = "error"
+)
+
+// TunnelStats describes a closed CONNECT tunnel. BytesUp were sent by the
+// client to the upstream and BytesDown by the upstream to the client. Reason
+// is why the tunnel was closed, such as CloseClientEOF.
+type TunnelStats struct {
+	Host      string
+	BytesUp   int64
+	BytesDown int64
+	Duration  time.Duration
+	Reason    string
+}
+
+// Tunnel describes a live CONNECT tunnel, as listed by Forward.Tunnels.
+// Intercepted tunnels have no Upstream, their decrypted requests being
+// forwarded one by one.
+type Tunnel struct {
+	ID          uint64    `json:"id"`
+	Client      string    `json:"client"`
+	User        string    `json:"user,omitempty"`
+	Host        string    `json:"host"`
+	Upstream    string    `json:"upstream"`
+	Intercepted bool      `json:"intercepted,omitempty"`
+	Started     time.Time `json:"started"`
+	BytesUp     int64     `json:"bytes_up"`
+	BytesDown   int64     `json:"bytes_down"`
+}
+
+// liveTunnel is a tunnel being relayed. Intercepted tunnels have no
+// upstream connection.
+type liveTunnel struct {
+	info             Tunnel
+	client, upstream net.Conn
+	up, down         atomic.Int64
+	// last is the time of the last read in either direction, in Unix
+	// nanoseconds.
+	last atomic.Int64
+	// drain, when set, asks the tunnel to close once it is done with the
+	// request in flight.
+	drain func()
+	// reauthorize, when set, reports whether the credentials of the tunnel
+	// are still valid.
+	reauthorize func() bool
+
+	mu     sync.Mutex
+	reason string
+}
+
+// close closes both connections, recording reason, and reports whether the
+// tunnel was still open.
+func (t *liveTunnel) close(reason string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reason != "" {
+		return false
+	}
+	t.reason = reason
+	t.client.Close()
+	if t.upstream != nil {
+		t.upstream.Close()
+	}
+	return true
+}
+
+func (t *liveTunnel) closeReason() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reason
+}
+
+// relay copies src to dst until src reaches EOF or either fails, counting
+// the bytes written in n.
+func (t *liveTunnel) relay(dst, src net.Conn, n *atomic.Int64) error {
+	buf := make([]byte, 32*1024)
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			t.last.Store(time.Now().UnixNano())
+			nw, werr := dst.Write(buf[:nr])
+			n.Add(int64(nw))
+			if werr != nil {
+				return werr
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// watch closes the tunnel once it has been idle for idle or open for
+// lifetime, zero disabling either, until done is closed.
+func (t *liveTunnel) watch(idle, lifetime time.Duration, done <-chan struct{}) {
+	var idleC, lifetimeC <-chan time.Time
+	var idleTimer *time.Timer
+	if idle > 0 {
+		idleTimer = time.NewTimer(idle)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
+	if lifetime > 0 {
+		lifetimeTimer := time.NewTimer(lifetime)
+		defer lifetimeTimer.Stop()
+		lifetimeC = lifetimeTimer.C
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-lifetimeC:
+			t.close(CloseLifetime)
+			return
+		case <-idleC:
+			if since := time.Since(time.Unix(0, t.last.Load())); since < idle {
+				idleTimer.Reset(idle - since)
+				continue
+			}
+			t.close(CloseIdleTimeout)
+			return
+		}
+	}
+}
+
+// copyResult is the outcome of relaying one direction of a tunnel.
+type copyResult struct {
+	err error
+	up  bool
+}
+
+// tunnel relays bytes between the client of r and upstream until both sides
+// are done, then reports the tunnel to OnTunnelClose. When one side closes
+// its end, the write side of the other is shut down and the tunnel goes on
+// in the opposite direction. Errors, the timeouts of the Timeouts settings
+// and CloseTunnel close both connections at once.
+func (f *Forward) tunnel(r *http.Request, client, upstream net.Conn) {
+	t := newTunnel(r, client)
+	t.info.Upstream = upstream.RemoteAddr().String()
+	t.upstream = upstream
+	host, start := t.info.Host, t.info.Started
+	f.track(t)
+	defer f.untrack(t)
+	if f.OnTunnelOpen != nil {
+		f.OnTunnelOpen(host)
+	}
+
+	done := make(chan copyResult, 2)
+	relay := func(dst, src net.Conn, n *atomic.Int64, up bool) {
+		res := copyResult{err: t.relay(dst, src, n), up: up}
+		if res.err != nil || !closeWrite(dst) {
+			t.close(closeReason(res))
+		}
+		done <- res
+	}
+	go relay(upstream, client, &t.up, true)
+	go relay(client, upstream, &t.down, false)
+	stop := make(chan struct{})
+	if f.Timeouts != nil {
+		timeouts := f.Timeouts()
+		go t.watch(timeouts.Idle.Std(), timeouts.MaxLifetime.Std(), stop)
+	}
+	first := <-done
+	<-done
+	close(stop)
+	t.close(closeReason(first))
+
+	stats := TunnelStats{
+		Host:      host,
+		BytesUp:   t.up.Load(),
+		BytesDown: t.down.Load(),
+		Duration:  time.Since(start),
+		Reason:    t.closeReason(),
+	}
+	if f.OnTunnelClose != nil {
+		f.OnTunnelClose(stats)
+	}
+}
+
+// intercepted registers the intercepted tunnel of r over client, so that it
+// is listed, timed out, terminated and drained like the tunnels relayed by f;
+// drain is called by DrainTunnels to close it between requests. It
+// returns the connection to serve the tunnel on, which counts the bytes read
+// from and written to the client, and a function to call once it is done.
+// Intercepted tunnels are not reported to OnTunnelOpen and OnTunnelClose,
+// their requests being accounted for individually.
+func (f *Forward) intercepted(r *http.Request, client net.Conn, drain func()) (net.Conn, func()) {
+	t := newTunnel(r, client)
+	t.info.Intercepted = true
+	t.drain = drain
+	f.track(t)
+	stop := make(chan struct{})
+	if f.Timeouts != nil {
+		timeouts := f.Timeouts()
+		go t.watch(timeouts.Idle.Std(), timeouts.MaxLifetime.Std(), stop)
+	}
+	return &tunnelConn{Conn: client, t: t}, func() {
+		close(stop)
+		t.close(CloseClientEOF)
+		f.untrack(t)
+	}
+}
+
+// newTunnel returns the tunnel of the CONNECT request r from client.
+func newTunnel(r *http.Request, client net.Conn) *liveTunnel {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	start := time.Now()
+	t := &liveTunnel{
+		info:   Tunnel{Host: host, User: RequestUser(r), Started: start},
+		client: client,
+	}
+	if ip := clientIP(r.RemoteAddr); ip != nil {
+		t.info.Client = ip.String()
+	}
+	t.last.Store(start.UnixNano())
+	t.reauthorize, _ = r.Context().Value(reauthorizeKey{}).(func() bool)
+	return t
+}
+
+// tunnelConn is the client connection of an intercepted tunnel, counting the
+// bytes relayed in either direction.
+type tunnelConn struct {
+	net.Conn
+	t *liveTunnel
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.t.last.Store(time.Now().UnixNano())
+		c.t.up.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *tunnelConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.t.last.Store(time.Now().UnixNano())
+		c.t.down.Add(int64(n))
+	}
+	return n, err
+}
+
+// closeReason returns why a tunnel closed when res was the first direction
+// to finish.
+func closeReason(res copyResult) string {
+	var netErr net.Error
+	switch {
+	case res.err == nil && res.up:
+		return CloseClientEOF
+	case res.err == nil:
+		return CloseUpstreamEOF
+	case errors.As(res.err, &netErr) && netErr.Timeout():
+		return CloseIdleTimeout
+	}
+	return CloseError
+}
+
+// closeWrite shuts down the write side of c, reporting whether c supports
+// half-closed connections.
+func closeWrite(c net.Conn) bool {
+	cw, ok := c.(interface{ CloseWrite() error })
+	return ok && cw.CloseWrite() == nil
+}
+
+func (f *Forward) track(t *liveTunnel) {
+	f.tunnelsMu.Lock()
+	defer f.tunnelsMu.Unlock()
+	if f.tunnels == nil {
+		f.tunnels = make(map[uint64]*liveTunnel)
+	}
+	f.lastTunnel++
+	t.info.ID = f.lastTunnel
+	f.tunnels[t.info.ID] = t
+}
+
+func (f *Forward) untrack(t *liveTunnel) {
+	f.tunnelsMu.Lock()
+	defer f.tunnelsMu.Unlock()
+	delete(f.tunnels, t.info.ID)
+}
+
+// Tunnels returns the live CONNECT tunnels, oldest first.
+func (f *Forward) Tunnels() []Tunnel {
+	f.tunnelsMu.Lock()
+	list := make([]Tunnel, 0, len(f.tunnels))
+	for _, t := range f.tunnels {
+		info := t.info
+		info.BytesUp, info.BytesDown = t.up.Load(), t.down.Load()
+		list = append(list, info)
+	}
+	f.tunnelsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CloseTunnel terminates the live tunnel with the given ID, reporting
+// whether it existed.
+func (f *Forward) CloseTunnel(id uint64) bool {
+	f.tunnelsMu.Lock()
+	t, ok := f.tunnels[id]
+	f.tunnelsMu.Unlock()
+	if ok {
+		t.close(CloseTerminated)
+	}
+	return ok
+}
+
+// Reauthorize closes the live tunnels whose credentials are no longer valid,
+// as reported by the function attached with WithReauthorize, and returns
+// their number. It is meant to be called when users or the authentication
+// settings change.
+func (f *Forward) Reauthorize() int {
+	f.tunnelsMu.Lock()
+	live := make([]*liveTunnel, 0, len(f.tunnels))
+	for _, t := range f.tunnels {
+		live = append(live, t)
+	}
+	f.tunnelsMu.Unlock()
+	n := 0
+	for _, t := range live {
+		if t.reauthorize != nil && !t.reauthorize() && t.close(CloseRevoked) {
+			n++
+		}
+	}
+	return n
+}
+
+// DrainTunnels waits for the live tunnels to finish until ctx is done, then
+// closes those left and returns their number. Intercepted tunnels are closed
+// as soon as they have no request in flight. Tunnels opened meanwhile are
+// awaited too, so new CONNECT requests must be stopped first.
+func (f *Forward) DrainTunnels(ctx context.Context) int {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		f.tunnelsMu.Lock()
+		n := len(f.tunnels)
+		var drain []func()
+		for _, t := range f.tunnels {
+			if t.drain != nil {
+				drain = append(drain, t.drain)
+			}
+		}
+		f.tunnelsMu.Unlock()
+		if n == 0 {
+			return 0
+		}
+		for _, d := range drain {
+			d()
+		}
+		select {
+		case <-ctx.Done():
+			f.tunnelsMu.Lock()
+			left := make([]*liveTunnel, 0, len(f.tunnels))
+			for _, t := range f.tunnels {
+				left = append(left, t)
+			}
+			f.tunnelsMu.Unlock()
+			for _, t := range left {
+				t.close(CloseShutdown)
+			}
+			return len(left)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pod32g/proxy/internal/socks"
+)
+
+var noDeadline time.Time
+
+// dialUpstream opens a connection to addr, either directly or through the
+// given parent proxy. Supported parent schemes are http, https, socks5 and
+// socks5h.
+func dialUpstream(ctx context.Context, parent *url.URL, addr string) (net.Conn, error) {
+	if parent == nil {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	switch parent.Scheme {
+	case "socks5", "socks5h":
+		user, pass := parentCredentials(parent)
+		return socks.Dial(ctx, parentAddr(parent), user, pass, addr)
+	case "http", "https":
+		return dialHTTPConnect(ctx, parent, addr)
+	default:
+		return nil, fmt.Errorf("unsupported parent proxy scheme %q", parent.Scheme)
+	}
+}
+
+// dialHTTPConnect establishes a tunnel to addr through an HTTP parent proxy
+// using the CONNECT method.
+func dialHTTPConnect(ctx context.Context, parent *url.URL, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", parentAddr(parent))
+	if err != nil {
+		return nil, err
+	}
+	if parent.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: parent.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user, pass := parentCredentials(parent); user != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("parent proxy refused CONNECT: %s", resp.Status)
+	}
+	conn.SetDeadline(noDeadline)
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+func parentCredentials(u *url.URL) (string, string) {
+	if u.User == nil {
+		return "", ""
+	}
+	pass, _ := u.User.Password()
+	return u.User.Username(), pass
+}
+
+// parentAddr returns host:port of the parent proxy, using the scheme's
+// default port when none is given.
+func parentAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(u.Hostname(), "1080")
+	default:
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Health answers the probes of orchestrators such as Kubernetes. /healthz
+// succeeds as long as the process serves requests, and /readyz until Drain is
+// called at the start of a graceful shutdown, so that new clients are sent
+// elsewhere while the connections in flight finish.
+type Health struct {
+	draining atomic.Bool
+}
+
+// Drain makes the readiness probe fail.
+func (h *Health) Drain() {
+	h.draining.Store(true)
+}
+
+// Ready reports whether the readiness probe succeeds.
+func (h *Health) Ready() bool {
+	return !h.draining.Load()
+}
+
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/readyz" && !h.Ready() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
@@ -8,13 +8,22 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/pod32g/proxy/internal/proxy"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Metrics struct {
-	Requests *prometheus.CounterVec
-	Duration *prometheus.HistogramVec
-	Clients  prometheus.Gauge
+	Requests      *prometheus.CounterVec
+	Duration      *prometheus.HistogramVec
+	Clients       prometheus.Gauge
+	SOCKSRequests *prometheus.CounterVec
+	CacheRequests *prometheus.CounterVec
+	RateLimited   *prometheus.CounterVec
+	// Tunnel metrics describe CONNECT tunnels by destination host.
+	TunnelsActive  *prometheus.GaugeVec
+	Tunnels        *prometheus.CounterVec
+	TunnelBytes    *prometheus.CounterVec
+	TunnelDuration *prometheus.HistogramVec
 }
 
 func NewMetrics() *Metrics {
@@ -24,7 +33,7 @@ func NewMetrics() *Metrics {
 				Name: "proxy_http_requests_total",
 				Help: "Total number of HTTP requests processed",
 			},
-			[]string{"method", "code"},
+			[]string{"listener", "method", "code"},
 		),
 		Duration: prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
@@ -32,7 +41,7 @@ func NewMetrics() *Metrics {
 				Help:    "Duration of HTTP requests",
 				Buckets: prometheus.DefBuckets,
 			},
-			[]string{"method"},
+			[]string{"listener", "method"},
 		),
 		Clients: prometheus.NewGauge(
 			prometheus.GaugeOpts{
@@ -40,13 +49,79 @@ func NewMetrics() *Metrics {
 				Help: "Number of active client connections",
 			},
 		),
+		SOCKSRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_socks_requests_total",
+				Help: "Total number of SOCKS5 commands processed",
+			},
+			[]string{"listener", "command", "reply"},
+		),
+		CacheRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_cache_requests_total",
+				Help: "Total number of cacheable requests by result (hit, miss, revalidated, stale, bypass)",
+			},
+			[]string{"listener", "result"},
+		),
+		RateLimited: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_ratelimit_rejected_total",
+				Help: "Total number of requests rejected by rate limits",
+			},
+			[]string{"listener", "limit", "reason"},
+		),
+		TunnelsActive: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_tunnels_active",
+				Help: "Number of open CONNECT tunnels",
+			},
+			[]string{"host"},
+		),
+		Tunnels: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_tunnels_total",
+				Help: "Total number of closed CONNECT tunnels by close reason (client_eof, upstream_eof, idle_timeout, max_lifetime, terminated, revoked, shutdown, error)",
+			},
+			[]string{"host", "reason"},
+		),
+		TunnelBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_tunnel_bytes_total",
+				Help: "Total bytes relayed through closed CONNECT tunnels by direction (upstream, downstream)",
+			},
+			[]string{"host", "direction"},
+		),
+		TunnelDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "proxy_tunnel_duration_seconds",
+				Help:    "Lifetime of CONNECT tunnels",
+				Buckets: []float64{0.1, 0.5, 1, 5, 15, 30, 60, 300, 900, 3600},
+			},
+			[]string{"host"},
+		),
 	}
-	prometheus.MustRegister(m.Requests, m.Duration, m.Clients)
+	prometheus.MustRegister(m.Requests, m.Duration, m.Clients, m.SOCKSRequests, m.CacheRequests, m.RateLimited,
+		m.TunnelsActive, m.Tunnels, m.TunnelBytes, m.TunnelDuration)
 	return m
 }
 
-// MetricsMiddleware records Prometheus metrics for requests.
-func MetricsMiddleware(next http.Handler, m *Metrics) http.Handler {
+// TunnelOpened counts a CONNECT tunnel to host as active.
+func (m *Metrics) TunnelOpened(host string) {
+	m.TunnelsActive.WithLabelValues(host).Inc()
+}
+
+// TunnelClosed records a closed CONNECT tunnel.
+func (m *Metrics) TunnelClosed(t proxy.TunnelStats) {
+	m.TunnelsActive.WithLabelValues(t.Host).Dec()
+	m.Tunnels.WithLabelValues(t.Host, t.Reason).Inc()
+	m.TunnelBytes.WithLabelValues(t.Host, "upstream").Add(float64(t.BytesUp))
+	m.TunnelBytes.WithLabelValues(t.Host, "downstream").Add(float64(t.BytesDown))
+	m.TunnelDuration.WithLabelValues(t.Host).Observe(t.Duration.Seconds())
+}
+
+// MetricsMiddleware records Prometheus metrics for requests received on the
+// named listener.
+func MetricsMiddleware(next http.Handler, m *Metrics, listener string) http.Handler {
 	if next == nil || m == nil {
 		return next
 	}
@@ -56,8 +131,8 @@ func MetricsMiddleware(next http.Handler, m *Metrics) http.Handler {
 		start := time.Now()
 		next.ServeHTTP(rec, r)
 		dur := time.Since(start).Seconds()
-		m.Duration.WithLabelValues(r.Method).Observe(dur)
-		m.Requests.WithLabelValues(r.Method, strconv.Itoa(rec.status)).Inc()
+		m.Duration.WithLabelValues(listener, r.Method).Observe(dur)
+		m.Requests.WithLabelValues(listener, r.Method, strconv.Itoa(rec.status)).Inc()
 	})
 }
 
@@ -95,6 +170,12 @@ func (r *statusRecorder) Flush() {
 	}
 }
 
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter,
+// e.g. to extend the write deadline of streaming responses
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 // CloseNotify lets callers be signaled when the client disconnects
 func (r *statusRecorder) CloseNotify() <-chan bool {
 	if cn, ok := r.ResponseWriter.(http.CloseNotifier); ok {
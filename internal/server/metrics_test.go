@@ -3,14 +3,21 @@ package server
 import (
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pod32g/proxy/internal/proxy"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
+// testMetrics returns the metrics shared by the tests, as they can only be
+// registered once.
+var testMetrics = sync.OnceValue(NewMetrics)
+
 func TestMetricsMiddleware(t *testing.T) {
-	metrics := NewMetrics()
-	handler := MetricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(201) }), metrics)
+	metrics := testMetrics()
+	handler := MetricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(201) }), metrics, "http")
 	req := httptest.NewRequest("POST", "http://host/", nil)
 	rw := httptest.NewRecorder()
 	handler.ServeHTTP(rw, req)
@@ -18,7 +25,29 @@ func TestMetricsMiddleware(t *testing.T) {
 	if code := rw.Result().StatusCode; code != 201 {
 		t.Fatalf("status %d", code)
 	}
-	if v := testutil.ToFloat64(metrics.Requests.WithLabelValues("POST", "201")); v != 1 {
+	if v := testutil.ToFloat64(metrics.Requests.WithLabelValues("http", "POST", "201")); v != 1 {
 		t.Fatalf("requests metric %f", v)
 	}
 }
+
+func TestTunnelMetrics(t *testing.T) {
+	metrics := testMetrics()
+	metrics.TunnelOpened("example.com")
+	metrics.TunnelOpened("example.com")
+	if v := testutil.ToFloat64(metrics.TunnelsActive.WithLabelValues("example.com")); v != 2 {
+		t.Fatalf("active tunnels %f", v)
+	}
+	metrics.TunnelClosed(proxy.TunnelStats{Host: "example.com", BytesUp: 10, BytesDown: 300, Duration: time.Second, Reason: proxy.CloseClientEOF})
+	if v := testutil.ToFloat64(metrics.TunnelsActive.WithLabelValues("example.com")); v != 1 {
+		t.Fatalf("active tunnels after close %f", v)
+	}
+	if v := testutil.ToFloat64(metrics.Tunnels.WithLabelValues("example.com", proxy.CloseClientEOF)); v != 1 {
+		t.Fatalf("closed tunnels %f", v)
+	}
+	if v := testutil.ToFloat64(metrics.TunnelBytes.WithLabelValues("example.com", "downstream")); v != 300 {
+		t.Fatalf("downstream bytes %f", v)
+	}
+	if n := testutil.CollectAndCount(metrics.TunnelDuration); n != 1 {
+		t.Fatalf("duration series %d", n)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"net"
 	"net/http"
 	"strings"
 )
@@ -23,3 +24,19 @@ func StatsMiddleware(next http.Handler, stats *DomainStats, enabled func() bool,
 		next.ServeHTTP(w, r)
 	})
 }
+
+// ClientMiddleware labels the connected client of each request in clients
+// with the value returned by label, such as the client selector it matched.
+func ClientMiddleware(next http.Handler, clients *ClientTracker, label func(*http.Request) string) http.Handler {
+	if next == nil || clients == nil || label == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		clients.Label(addr, label(r))
+		next.ServeHTTP(w, r)
+	})
+}
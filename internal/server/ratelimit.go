@@ -0,0 +1,192 @@
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pod32g/proxy/internal/accesslog"
+	"github.com/pod32g/proxy/internal/config"
+	"github.com/pod32g/proxy/internal/proxy"
+)
+
+// bucketIdle is how long an unused bucket is kept before it is dropped.
+const bucketIdle = 10 * time.Minute
+
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	inflight int
+}
+
+// RateLimiter enforces token bucket and concurrency limits. Limits are read
+// on every request so changes apply immediately.
+type RateLimiter struct {
+	// Client returns the address of the client of a request, which limits
+	// keyed by IP count against. By default it is the peer address.
+	Client func(*http.Request) string
+
+	limits func() []config.RateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a limiter enforcing the limits returned by limits.
+func NewRateLimiter(limits func() []config.RateLimit) *RateLimiter {
+	return &RateLimiter{limits: limits, buckets: make(map[string]*bucket)}
+}
+
+// rejection describes why a request was refused.
+type rejection struct {
+	limit      string
+	reason     string
+	retryAfter time.Duration
+}
+
+// acquire checks r against every limit, consuming a token and taking a
+// concurrency slot for each. It returns a release function when the request
+// may proceed, or the first limit that refused it; a refused request keeps no
+// tokens or slots.
+func (rl *RateLimiter) acquire(r *http.Request, route func(*http.Request) string) (func(), *rejection) {
+	limits := rl.limits()
+	if len(limits) == 0 {
+		return func() {}, nil
+	}
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.sweepLocked(now)
+	var held, spent []*bucket
+	release := func() {
+		rl.mu.Lock()
+		for _, b := range held {
+			b.inflight--
+		}
+		rl.mu.Unlock()
+	}
+	// undo gives back the slots and tokens taken from earlier limits when a
+	// later one refuses the request.
+	undo := func() {
+		for _, b := range held {
+			b.inflight--
+		}
+		for _, b := range spent {
+			b.tokens++
+		}
+	}
+	for _, l := range limits {
+		key := rl.limitKey(r, l.Key, route)
+		if key == "" {
+			continue
+		}
+		id := l.Name + "\x00" + key
+		b, ok := rl.buckets[id]
+		if !ok {
+			b = &bucket{tokens: burst(l), last: now}
+			rl.buckets[id] = b
+		}
+		if l.Concurrent > 0 && b.inflight >= l.Concurrent {
+			undo()
+			return nil, &rejection{limit: l.Name, reason: "concurrency", retryAfter: time.Second}
+		}
+		if l.Rate > 0 {
+			b.tokens = math.Min(burst(l), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+			b.last = now
+			if b.tokens < 1 {
+				undo()
+				wait := time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+				return nil, &rejection{limit: l.Name, reason: "rate", retryAfter: wait}
+			}
+			b.tokens--
+			spent = append(spent, b)
+		}
+		b.last = now
+		b.inflight++
+		held = append(held, b)
+	}
+	return release, nil
+}
+
+func (rl *RateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	for id, b := range rl.buckets {
+		if b.inflight == 0 && now.Sub(b.last) > bucketIdle {
+			delete(rl.buckets, id)
+		}
+	}
+}
+
+func burst(l config.RateLimit) float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// limitKey returns the value r is limited on for the given key kind, or an
+// empty string when the request has none.
+func (rl *RateLimiter) limitKey(r *http.Request, kind string, route func(*http.Request) string) string {
+	switch kind {
+	case config.LimitByIP:
+		if rl.Client != nil {
+			return rl.Client(r)
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	case config.LimitByUser:
+		return proxy.RequestUser(r)
+	case config.LimitByHost:
+		host := r.URL.Host
+		if host == "" || r.Method == http.MethodConnect {
+			host = r.Host
+		}
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.ToLower(host)
+	case config.LimitByRoute:
+		if route != nil {
+			return route(r)
+		}
+	}
+	return ""
+}
+
+// RateLimitMiddleware rejects requests exceeding the limiter's limits with
+// 429 Too Many Requests and a Retry-After header. The route function names
+// the reverse proxy route of a request for route keyed limits and may be nil.
+// Rejections are counted in m under the listener name.
+func RateLimitMiddleware(next http.Handler, rl *RateLimiter, route func(*http.Request) string, m *Metrics, listener string) http.Handler {
+	if next == nil || rl == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, rej := rl.acquire(r, route)
+		if rej != nil {
+			if m != nil && m.RateLimited != nil {
+				m.RateLimited.WithLabelValues(listener, rej.limit, rej.reason).Inc()
+			}
+			secs := int(math.Ceil(rej.retryAfter.Seconds()))
+			if secs < 1 {
+				secs = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			accesslog.SetErrorClass(r.Context(), accesslog.ErrorRateLimited)
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pod32g/proxy/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.SetRateLimit(config.RateLimit{Name: "per-ip", Key: config.LimitByIP, Rate: 0.001, Burst: 2})
+	m := &Metrics{RateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ratelimit_test"}, []string{"listener", "limit", "reason"})}
+	mw := RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), NewRateLimiter(cfg.GetRateLimits), nil, m, "http")
+
+	do := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		mw.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < 2; i++ {
+		if rec := do("10.0.0.1:1000"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d rejected", i)
+		}
+	}
+	rec := do("10.0.0.1:2000")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := do("10.0.0.2:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("other client limited")
+	}
+	if v := testutil.ToFloat64(m.RateLimited.WithLabelValues("http", "per-ip", "rate")); v != 1 {
+		t.Fatalf("rejected counter %f", v)
+	}
+
+	cfg.DeleteRateLimit("per-ip")
+	if rec := do("10.0.0.1:3000"); rec.Code != http.StatusOK {
+		t.Fatalf("limit still applied after deletion")
+	}
+}
+
+func TestRateLimitConcurrency(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.SetRateLimit(config.RateLimit{Name: "hosts", Key: config.LimitByHost, Concurrent: 1})
+	rl := NewRateLimiter(cfg.GetRateLimits)
+	req := httptest.NewRequest("GET", "http://example.com:8080/", nil)
+	release, rej := rl.acquire(req, nil)
+	if rej != nil {
+		t.Fatalf("first request rejected")
+	}
+	if _, rej := rl.acquire(req, nil); rej == nil || rej.reason != "concurrency" {
+		t.Fatalf("expected concurrency rejection, got %+v", rej)
+	}
+	release()
+	if _, rej := rl.acquire(req, nil); rej != nil {
+		t.Fatalf("slot not released")
+	}
+}
+
+func TestRateLimitRefund(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.SetRateLimit(config.RateLimit{Name: "per-ip", Key: config.LimitByIP, Rate: 0.001, Burst: 2, Concurrent: 1})
+	cfg.SetRateLimit(config.RateLimit{Name: "per-host", Key: config.LimitByHost, Rate: 0.001, Burst: 1})
+	rl := NewRateLimiter(cfg.GetRateLimits)
+	acquire := func(host string) (func(), *rejection) {
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		return rl.acquire(req, nil)
+	}
+	release, rej := acquire("example.com")
+	if rej != nil {
+		t.Fatalf("first request rejected: %+v", rej)
+	}
+	release()
+	if _, rej := acquire("example.com"); rej == nil || rej.limit != "per-host" {
+		t.Fatalf("expected per-host rejection, got %+v", rej)
+	}
+	// The rejected request must not have used up the client's last token or
+	// kept its concurrency slot.
+	if _, rej := acquire("other.example"); rej != nil {
+		t.Fatalf("per-ip limit charged for a rejected request: %+v", rej)
+	}
+}
+
+func TestRateLimitClient(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.SetRateLimit(config.RateLimit{Name: "per-ip", Key: config.LimitByIP, Rate: 0.001, Burst: 1})
+	rl := NewRateLimiter(cfg.GetRateLimits)
+	rl.Client = func(r *http.Request) string { return r.Header.Get("X-Forwarded-For") }
+	acquire := func(client string) *rejection {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		req.Header.Set("X-Forwarded-For", client)
+		_, rej := rl.acquire(req, nil)
+		return rej
+	}
+	if acquire("192.0.2.1") != nil || acquire("192.0.2.2") != nil {
+		t.Fatalf("clients behind the same proxy share a limit")
+	}
+	if rej := acquire("192.0.2.1"); rej == nil || rej.limit != "per-ip" {
+		t.Fatalf("expected per-ip rejection, got %+v", rej)
+	}
+}
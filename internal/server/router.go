@@ -4,26 +4,63 @@ import (
 	"encoding/base64"
 	"net/http"
 	"strings"
+
+	"github.com/pod32g/proxy/internal/accesslog"
+	"github.com/pod32g/proxy/internal/config"
+	"github.com/pod32g/proxy/internal/proxy"
 )
 
 // Router dispatches requests between the proxy handler and the UI handler.
+// When AuthRequired reports true every request must carry credentials
+// accepted by Authenticate, and the role of the user must allow the request:
+// any role may use the proxy, viewers may read the UI, API and metrics, and
+// only admins may change the configuration through them. Health serves the
+// /healthz and /readyz probes without authentication.
 type Router struct {
-	Proxy       http.Handler
-	UI          http.Handler
-	API         http.Handler
-	Metrics     http.Handler
-	AuthEnabled bool
-	Username    string
-	Password    string
+	Proxy   http.Handler
+	UI      http.Handler
+	API     http.Handler
+	Metrics http.Handler
+	Health  http.Handler
+	// AuthRequired and Authenticate are consulted on every request, so
+	// changes to the authentication settings and users apply at once.
+	// Authenticate checks the credentials of a user and returns its role,
+	// as config.Config.Authenticate does.
+	AuthRequired func() bool
+	Authenticate func(user, pass string) (string, bool)
 }
 
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if r.AuthEnabled && r.Username != "" {
-		if !authOK(r, req) {
-			w.Header().Set("WWW-Authenticate", "Basic realm=\"proxy\"")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+	// Requests for other hosts made through the forward proxy are proxied.
+	if r.Health != nil && req.Method != http.MethodConnect && req.URL.Host == "" &&
+		(req.URL.Path == "/healthz" || req.URL.Path == "/readyz") {
+		r.Health.ServeHTTP(w, req)
+		return
+	}
+	user, status := r.authorize(req)
+	switch status {
+	case http.StatusUnauthorized:
+		accesslog.SetErrorClass(req.Context(), accesslog.ErrorAuth)
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"proxy\"")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	case http.StatusForbidden:
+		accesslog.SetErrorClass(req.Context(), accesslog.ErrorForbidden)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if user != "" {
+		accesslog.SetUser(req.Context(), user)
+		req = req.WithContext(proxy.WithUser(req.Context(), user))
+	}
+	if req.Method == http.MethodConnect && r.AuthRequired != nil {
+		// Requests decrypted from an intercepted tunnel do not pass the
+		// router, so they are checked again with the tunnel credentials.
+		connect := req
+		req = req.WithContext(proxy.WithReauthorize(req.Context(), func() bool {
+			_, status := r.authorize(connect)
+			return status == http.StatusOK
+		}))
 	}
 	// CONNECT requests never have a path starting with '/'
 	if req.Method != http.MethodConnect {
@@ -55,10 +92,52 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func authOK(r *Router, req *http.Request) bool {
-	user, pass, ok := req.BasicAuth()
-	if ok && user == r.Username && pass == r.Password {
-		return true
+// authorize checks the credentials of req against the live authentication
+// settings and returns the authenticated user, empty when authentication is
+// disabled, and http.StatusOK, http.StatusUnauthorized or
+// http.StatusForbidden.
+func (r *Router) authorize(req *http.Request) (string, int) {
+	if r.AuthRequired == nil || r.Authenticate == nil || !r.AuthRequired() {
+		return "", http.StatusOK
+	}
+	if r.API != nil && strings.HasPrefix(req.URL.Path, "/api/") && bearerAuth(req) {
+		// API tokens are authenticated and scoped by the API handler.
+		return "", http.StatusOK
+	}
+	user, role, ok := authenticate(r, req)
+	if !ok {
+		return "", http.StatusUnauthorized
+	}
+	if !config.RoleAllows(role, r.requiredRole(req)) {
+		return user, http.StatusForbidden
+	}
+	return user, http.StatusOK
+}
+
+// requiredRole returns the least privileged role allowed to make req.
+func (r *Router) requiredRole(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return config.RoleProxyUser
+	}
+	admin := (r.API != nil && strings.HasPrefix(req.URL.Path, "/api/")) ||
+		(r.UI != nil && (req.URL.Path == "/ui" || strings.HasPrefix(req.URL.Path, "/ui/")))
+	switch {
+	case admin && req.Method != http.MethodGet && req.Method != http.MethodHead:
+		return config.RoleAdmin
+	case admin || (r.Metrics != nil && req.URL.Path == "/metrics"):
+		return config.RoleViewer
+	}
+	return config.RoleProxyUser
+}
+
+// authenticate checks the credentials of the Authorization or
+// Proxy-Authorization header and returns the user whose credentials were
+// accepted and its role.
+func authenticate(r *Router, req *http.Request) (string, string, bool) {
+	if user, pass, ok := req.BasicAuth(); ok {
+		if role, ok := r.Authenticate(user, pass); ok {
+			return user, role, true
+		}
 	}
 	if auth := req.Header.Get("Proxy-Authorization"); auth != "" {
 		if strings.HasPrefix(strings.ToLower(auth), "basic ") {
@@ -66,11 +145,19 @@ func authOK(r *Router, req *http.Request) bool {
 			data, err := base64.StdEncoding.DecodeString(b64)
 			if err == nil {
 				parts := strings.SplitN(string(data), ":", 2)
-				if len(parts) == 2 && parts[0] == r.Username && parts[1] == r.Password {
-					return true
+				if len(parts) == 2 {
+					if role, ok := r.Authenticate(parts[0], parts[1]); ok {
+						return parts[0], role, true
+					}
 				}
 			}
 		}
 	}
-	return false
+	return "", "", false
+}
+
+// bearerAuth reports whether req carries an "Authorization: Bearer" header.
+func bearerAuth(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	return len(auth) >= len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ")
 }
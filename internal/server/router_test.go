@@ -5,16 +5,26 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/pod32g/proxy/internal/config"
+	"github.com/pod32g/proxy/internal/proxy"
 )
 
+// testUsers accepts user "user" as a proxy user, "viewer" as a viewer and
+// "admin" as an admin, each with password "pass".
+func testUsers(user, pass string) (string, bool) {
+	roles := map[string]string{"user": config.RoleProxyUser, "viewer": config.RoleViewer, "admin": config.RoleAdmin}
+	role, ok := roles[user]
+	return role, ok && pass == "pass"
+}
+
 func TestRouterAuth(t *testing.T) {
 	r := &Router{
 		Proxy: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 		}),
-		AuthEnabled: true,
-		Username:    "user",
-		Password:    "pass",
+		AuthRequired: func() bool { return true },
+		Authenticate: testUsers,
 	}
 
 	req := httptest.NewRequest("GET", "/", nil)
@@ -47,9 +57,8 @@ func TestRouterAuthDisabled(t *testing.T) {
 		Proxy: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 		}),
-		AuthEnabled: false,
-		Username:    "user",
-		Password:    "pass",
+		AuthRequired: func() bool { return false },
+		Authenticate: testUsers,
 	}
 
 	req := httptest.NewRequest("GET", "/", nil)
@@ -59,3 +68,159 @@ func TestRouterAuthDisabled(t *testing.T) {
 		t.Fatalf("expected 200, got %d", rec.Result().StatusCode)
 	}
 }
+
+func TestRouterRoles(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	r := &Router{Proxy: ok, UI: ok, API: ok, Metrics: ok, AuthRequired: func() bool { return true }, Authenticate: testUsers}
+	cases := []struct {
+		user, method, path string
+		want               int
+	}{
+		{"user", "GET", "http://example.com/", http.StatusOK},
+		{"user", "GET", "/api/headers", http.StatusForbidden},
+		{"user", "GET", "/metrics", http.StatusForbidden},
+		{"viewer", "GET", "/api/headers", http.StatusOK},
+		{"viewer", "GET", "/ui/general", http.StatusOK},
+		{"viewer", "POST", "/api/headers", http.StatusForbidden},
+		{"viewer", "POST", "/ui/header", http.StatusForbidden},
+		{"admin", "POST", "/api/headers", http.StatusOK},
+		{"admin", "DELETE", "/api/users", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req.SetBasicAuth(c.user, "pass")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("%s %s %s: got %d, want %d", c.user, c.method, c.path, rec.Code, c.want)
+		}
+	}
+}
+
+func TestRouterLiveAuth(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.SetUser("admin", config.RoleAdmin, "pass")
+	r := &Router{
+		Proxy: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+		AuthRequired: cfg.AuthRequired,
+		Authenticate: cfg.Authenticate,
+	}
+	get := func() int {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:pass")))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	cfg.SetAuth(true, "", "")
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	cfg.SetUser("admin", config.RoleAdmin, "changed")
+	if code := get(); code != http.StatusUnauthorized {
+		t.Fatalf("password change not applied, got %d", code)
+	}
+	cfg.SetAuth(false, "", "")
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("disabling auth not applied, got %d", code)
+	}
+}
+
+func TestRouterWithoutAdminPlane(t *testing.T) {
+	var proxied []string
+	r := &Router{Proxy: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxied = append(proxied, req.URL.Path)
+	})}
+	for _, path := range []string{"/api/headers", "/ui/", "/metrics", "/healthz"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if len(proxied) != 4 || proxied[0] != "/api/headers" {
+		t.Fatalf("admin paths not proxied: %v", proxied)
+	}
+}
+
+func TestRouterBearerToAPI(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	r := &Router{Proxy: ok, API: ok, AuthRequired: func() bool { return true }, Authenticate: testUsers}
+	for path, want := range map[string]int{"/api/headers": http.StatusOK, "http://example.com/": http.StatusUnauthorized} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer pxt_token")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: got %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func TestRouterHealth(t *testing.T) {
+	health := &Health{}
+	r := &Router{
+		Proxy: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}),
+		Health:       health,
+		AuthRequired: func() bool { return true },
+		Authenticate: testUsers,
+	}
+	status := func(target string) int {
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetBasicAuth("user", "pass")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	get := func(target string) int {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec.Code
+	}
+
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("liveness probe returned %d without credentials", code)
+	}
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("readiness probe returned %d before draining", code)
+	}
+	health.Drain()
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("readiness probe returned %d while draining", code)
+	}
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("liveness probe returned %d while draining", code)
+	}
+	if code := status("http://example.com/readyz"); code != http.StatusTeapot {
+		t.Fatalf("forward proxy request answered by the probe: %d", code)
+	}
+}
+
+func TestRouterRequestUser(t *testing.T) {
+	var got string
+	required := true
+	r := &Router{
+		Proxy: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = proxy.RequestUser(r)
+		}),
+		AuthRequired: func() bool { return required },
+		Authenticate: testUsers,
+	}
+	// A wrong Authorization header does not name the user authenticated
+	// with Proxy-Authorization.
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.SetBasicAuth("admin", "x")
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "user" {
+		t.Fatalf("request attributed to %q, want user", got)
+	}
+
+	required = false
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.SetBasicAuth("admin", "pass")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "" {
+		t.Fatalf("request attributed to %q without authentication", got)
+	}
+}
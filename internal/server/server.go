@@ -1,58 +1,215 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/pod32g/proxy/internal/config"
+	"github.com/pod32g/proxy/internal/socks"
 	log "github.com/pod32g/simple-logger"
 )
 
-// Server contains configuration for running the proxy over HTTP and HTTPS.
+// Listener is a single address served by the proxy. HTTP listeners serve
+// Handler, over TLS when CertFile and KeyFile are set, and require client
+// certificates signed by a CA of ClientCAFile when it is set. Addr is a TCP
+// address or "unix:" followed by a socket path. When SOCKS is set the address
+// is served as a SOCKS5 listener instead. Admin listeners serve the admin
+// plane and their connections are not tracked as proxy clients. The timeouts
+// are those of http.Server, zero disabling them.
+type Listener struct {
+	Name         string
+	Addr         string
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	Admin        bool
+	Handler      http.Handler
+	SOCKS        *socks.Server
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+}
+
+// SetTimeouts sets the timeouts of the listener from t.
+func (l *Listener) SetTimeouts(t config.ServerTimeouts) {
+	l.ReadHeaderTimeout = t.ReadHeader.Std()
+	l.ReadTimeout = t.Read.Std()
+	l.WriteTimeout = t.Write.Std()
+	l.IdleTimeout = t.Idle.Std()
+}
+
+// Server runs the proxy listeners.
 type Server struct {
-	HTTPAddr  string
-	HTTPSAddr string
-	CertFile  string
-	KeyFile   string
-	Handler   http.Handler
+	Listeners []Listener
 	Logger    *log.Logger
 	Clients   *ClientTracker
+
+	mu      sync.Mutex
+	closing bool
+	servers []*http.Server
+	// active holds the HTTP connections in the middle of a request.
+	active map[net.Conn]struct{}
 }
 
-// Start launches the HTTP server and, if configured, an HTTPS server.
+// Start launches every listener and blocks until one of them fails, or until
+// all of them have stopped after Shutdown, returning nil.
 func (s *Server) Start() error {
-	if s.Handler == nil {
-		s.Handler = http.DefaultServeMux
-	}
-
-	if s.HTTPSAddr != "" && s.CertFile != "" && s.KeyFile != "" {
-		go func() {
-			httpsSrv := &http.Server{
-				Addr:         s.HTTPSAddr,
-				Handler:      s.Handler,
-				ReadTimeout:  5 * time.Second,
-				WriteTimeout: 10 * time.Second,
-				IdleTimeout:  30 * time.Second,
-			}
-			if s.Clients != nil {
-				httpsSrv.ConnState = s.Clients.ConnState
-			}
-			s.Logger.Info("Starting HTTPS proxy on", s.HTTPSAddr)
-			if err := httpsSrv.ListenAndServeTLS(s.CertFile, s.KeyFile); err != nil && err != http.ErrServerClosed {
-				s.Logger.Error("HTTPS server failed: %v", err)
-			}
-		}()
-	}
-
-	httpSrv := &http.Server{
-		Addr:         s.HTTPAddr,
-		Handler:      s.Handler,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  30 * time.Second,
-	}
-	if s.Clients != nil {
-		httpSrv.ConnState = s.Clients.ConnState
-	}
-	s.Logger.Info("Starting HTTP proxy on", s.HTTPAddr)
-	return httpSrv.ListenAndServe()
+	if len(s.Listeners) == 0 {
+		return errors.New("no listeners configured")
+	}
+	errc := make(chan error, len(s.Listeners))
+	for _, l := range s.Listeners {
+		go func(l Listener) {
+			errc <- s.serve(l)
+		}(l)
+	}
+	for range s.Listeners {
+		if err := <-errc; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown stops every listener from accepting connections, then waits for
+// the HTTP requests in flight and the SOCKS5 connections to finish until ctx
+// is done. Those left are closed and their numbers returned. Connections
+// hijacked by a handler, such as CONNECT tunnels, are not awaited.
+func (s *Server) Shutdown(ctx context.Context) (requests, socksConns int) {
+	s.mu.Lock()
+	s.closing = true
+	servers := s.servers
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, l := range s.Listeners {
+		if l.SOCKS == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(srv *socks.Server) {
+			defer wg.Done()
+			n := srv.Shutdown(ctx)
+			mu.Lock()
+			socksConns += n
+			mu.Unlock()
+		}(l.SOCKS)
+	}
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			srv.Shutdown(ctx)
+		}(srv)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	requests = len(s.active)
+	s.mu.Unlock()
+	for _, srv := range servers {
+		srv.Close()
+	}
+	return requests, socksConns
+}
+
+// connState records whether conn is in the middle of a request.
+func (s *Server) connState(conn net.Conn, state http.ConnState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state == http.StateActive {
+		if s.active == nil {
+			s.active = make(map[net.Conn]struct{})
+		}
+		s.active[conn] = struct{}{}
+	} else {
+		delete(s.active, conn)
+	}
+}
+
+func (s *Server) serve(l Listener) error {
+	if l.SOCKS != nil {
+		s.Logger.Info("Starting SOCKS5 listener", l.Name, "on", l.Addr)
+		return l.SOCKS.ListenAndServe(l.Addr)
+	}
+	handler := l.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	srv := &http.Server{
+		Addr:              l.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: l.ReadHeaderTimeout,
+		ReadTimeout:       l.ReadTimeout,
+		WriteTimeout:      l.WriteTimeout,
+		IdleTimeout:       l.IdleTimeout,
+	}
+	srv.ConnState = s.connState
+	if s.Clients != nil && !l.Admin {
+		srv.ConnState = func(conn net.Conn, state http.ConnState) {
+			s.connState(conn, state)
+			s.Clients.ConnState(conn, state)
+		}
+	}
+	if l.ClientCAFile != "" {
+		pem, err := os.ReadFile(l.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("listener %s: no certificates in %s", l.Name, l.ClientCAFile)
+		}
+		srv.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	}
+	if !s.track(srv) {
+		return http.ErrServerClosed
+	}
+	ln, err := listen(l.Addr)
+	if err != nil {
+		return err
+	}
+	if l.CertFile != "" && l.KeyFile != "" {
+		s.Logger.Info("Starting HTTPS listener", l.Name, "on", l.Addr)
+		return srv.ServeTLS(ln, l.CertFile, l.KeyFile)
+	}
+	s.Logger.Info("Starting HTTP listener", l.Name, "on", l.Addr)
+	return srv.Serve(ln)
+}
+
+// track registers srv for Shutdown, reporting false once the server is
+// shutting down.
+func (s *Server) track(srv *http.Server) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.servers = append(s.servers, srv)
+	return true
+}
+
+// listen opens a TCP address or, with a "unix:" prefix, a Unix socket,
+// replacing a socket left over by a previous run.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
 }
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/pod32g/simple-logger"
+)
+
+func TestServeUnixAdminListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	tracker := NewClientTracker()
+	s := &Server{
+		Logger:  log.NewLogger(os.Stdout, log.ERROR, &log.DefaultFormatter{}),
+		Clients: tracker,
+		Listeners: []Listener{{
+			Name:  "admin",
+			Addr:  "unix:" + path,
+			Admin: true,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "ok")
+			}),
+		}},
+	}
+	go s.Start()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get("http://admin/"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("request over unix socket failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if tracker.Count() != 0 {
+		t.Fatalf("admin connection tracked as a proxy client")
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	s := &Server{
+		Logger: log.NewLogger(os.Stdout, log.ERROR, &log.DefaultFormatter{}),
+		Listeners: []Listener{{
+			Name: "http",
+			Addr: addr,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				<-release
+				io.WriteString(w, "done")
+			}),
+		}},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Start() }()
+
+	get := func() (string, error) {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	// The request in flight finishes once shutdown has begun.
+	done := make(chan string, 1)
+	go func() {
+		for i := 0; i < 50; i++ {
+			if body, err := get(); err == nil {
+				done <- body
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		done <- ""
+	}()
+	<-started
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if requests, socks := s.Shutdown(ctx); requests != 0 || socks != 0 {
+		t.Fatalf("force-closed %d requests and %d SOCKS5 connections while draining", requests, socks)
+	}
+	if body := <-done; body != "done" {
+		t.Fatalf("request in flight not completed: %q", body)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Start returned %v after shutdown", err)
+	}
+	if _, err := get(); err == nil {
+		t.Fatalf("listener still accepting after shutdown")
+	}
+}
+
+func TestShutdownForceCloses(t *testing.T) {
+	started := make(chan struct{}, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	s := &Server{
+		Logger: log.NewLogger(os.Stdout, log.ERROR, &log.DefaultFormatter{}),
+		Listeners: []Listener{{
+			Name: "http",
+			Addr: addr,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				<-r.Context().Done()
+			}),
+		}},
+	}
+	go s.Start()
+
+	failed := make(chan error, 1)
+	go func() {
+		var err error
+		for i := 0; i < 50; i++ {
+			var resp *http.Response
+			if resp, err = http.Get("http://" + addr + "/"); err == nil {
+				resp.Body.Close()
+				failed <- nil
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		failed <- err
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if requests, _ := s.Shutdown(ctx); requests != 1 {
+		t.Fatalf("force-closed %d requests, want 1", requests)
+	}
+	if err := <-failed; err == nil {
+		t.Fatalf("request completed although it was force-closed")
+	}
+}
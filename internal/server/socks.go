@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/pod32g/proxy/internal/socks"
+	log "github.com/pod32g/simple-logger"
+)
+
+var socksCommands = map[byte]string{
+	socks.CmdConnect:      "CONNECT",
+	socks.CmdBind:         "BIND",
+	socks.CmdUDPAssociate: "UDP_ASSOCIATE",
+}
+
+// NewSOCKS returns a SOCKS5 server that shares authentication, client
+// tracking, domain statistics and metrics with the HTTP listeners. The
+// required and authenticate functions behave like config.Config.AuthRequired
+// and Authenticate; users of any role may connect. Metrics are labelled with
+// the listener name. Any of the collaborators may be nil.
+func NewSOCKS(logger *log.Logger, required func() bool, authenticate func(user, pass string) (string, bool), clients *ClientTracker, stats *DomainStats, statsEnabled func() bool, m *Metrics, listener string) *socks.Server {
+	srv := &socks.Server{AuthRequired: required, Logger: logger}
+	if authenticate != nil {
+		srv.Authenticate = func(user, pass string) bool {
+			_, ok := authenticate(user, pass)
+			return ok
+		}
+	}
+	if clients != nil {
+		srv.OnConnect = func(c net.Conn) { clients.ConnState(c, http.StateNew) }
+		srv.OnDisconnect = func(c net.Conn) { clients.ConnState(c, http.StateClosed) }
+	}
+	srv.OnRequest = func(cmd byte, addr string, reply byte) {
+		if logger != nil {
+			logger.Debug("SOCKS request", socksCommands[cmd], addr, reply)
+		}
+		if stats != nil && (statsEnabled == nil || statsEnabled()) {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				stats.Record(host)
+			}
+		}
+		if m != nil {
+			name, ok := socksCommands[cmd]
+			if !ok {
+				name = "UNKNOWN"
+			}
+			m.SOCKSRequests.WithLabelValues(listener, name, strconv.Itoa(int(reply))).Inc()
+		}
+	}
+	return srv
+}
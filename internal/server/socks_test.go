@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/pod32g/proxy/internal/socks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewSOCKSSharesStatsAndMetrics(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		if c, err := target.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	ds := NewDomainStats()
+	m := &Metrics{SOCKSRequests: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "socks_test"}, []string{"listener", "command", "reply"})}
+	srv := NewSOCKS(nil, nil, nil, NewClientTracker(), ds, nil, m, "socks")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go srv.Serve(ln)
+
+	conn, err := socks.Dial(context.Background(), ln.Addr().String(), "", "", target.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+
+	if top := ds.Top(1); len(top) != 1 || top[0].Host != "127.0.0.1" {
+		t.Fatalf("stats not recorded: %v", top)
+	}
+	if v := testutil.ToFloat64(m.SOCKSRequests.WithLabelValues("socks", "CONNECT", "0")); v != 1 {
+		t.Fatalf("socks metric %f", v)
+	}
+}
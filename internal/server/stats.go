@@ -4,18 +4,20 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
-// DomainStats tracks the number of requests per host.
+// DomainStats tracks the number of requests and the CONNECT tunnel traffic
+// per host.
 type DomainStats struct {
-	mu     sync.Mutex
-	counts map[string]int
-	subs   map[chan []Stat]struct{}
+	mu    sync.Mutex
+	hosts map[string]*Stat
+	subs  map[chan []Stat]struct{}
 }
 
 // NewDomainStats creates a new DomainStats instance.
 func NewDomainStats() *DomainStats {
-	return &DomainStats{counts: make(map[string]int), subs: make(map[chan []Stat]struct{})}
+	return &DomainStats{hosts: make(map[string]*Stat), subs: make(map[chan []Stat]struct{})}
 }
 
 // Subscribe returns a channel that receives the top stats when they change.
@@ -48,22 +50,53 @@ func (d *DomainStats) notify() {
 	}
 }
 
+// hostLocked returns the stats of host, creating them if needed.
+func (d *DomainStats) hostLocked(host string) *Stat {
+	host = strings.ToLower(host)
+	s, ok := d.hosts[host]
+	if !ok {
+		s = &Stat{Host: host}
+		d.hosts[host] = s
+	}
+	return s
+}
+
 // Record increments the counter for the given host.
 func (d *DomainStats) Record(host string) {
 	if host == "" {
 		return
 	}
-	host = strings.ToLower(host)
 	d.mu.Lock()
-	d.counts[host]++
+	d.hostLocked(host).Count++
+	d.notify()
+	d.mu.Unlock()
+}
+
+// RecordTunnel adds a closed CONNECT tunnel to host, which relayed up bytes
+// from the client and down bytes to it during d.
+func (d *DomainStats) RecordTunnel(host string, up, down int64, dur time.Duration) {
+	if host == "" {
+		return
+	}
+	d.mu.Lock()
+	s := d.hostLocked(host)
+	s.Tunnels++
+	s.BytesUp += up
+	s.BytesDown += down
+	s.TunnelSeconds += dur.Seconds()
 	d.notify()
 	d.mu.Unlock()
 }
 
-// Stat represents a host and count pair.
+// Stat holds the request count of a host and the traffic of the CONNECT
+// tunnels to it.
 type Stat struct {
-	Host  string
-	Count int
+	Host          string
+	Count         int
+	Tunnels       int
+	BytesUp       int64
+	BytesDown     int64
+	TunnelSeconds float64
 }
 
 // Top returns the top n hosts sorted by request count.
@@ -74,9 +107,9 @@ func (d *DomainStats) Top(n int) []Stat {
 }
 
 func (d *DomainStats) topLocked(n int) []Stat {
-	out := make([]Stat, 0, len(d.counts))
-	for h, c := range d.counts {
-		out = append(out, Stat{Host: h, Count: c})
+	out := make([]Stat, 0, len(d.hosts))
+	for _, s := range d.hosts {
+		out = append(out, *s)
 	}
 	sort.Slice(out, func(i, j int) bool { return out[i].Count > out[j].Count })
 	if n > 0 && len(out) > n {
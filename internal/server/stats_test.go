@@ -1,6 +1,9 @@
 package server
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestDomainStats(t *testing.T) {
 	ds := NewDomainStats()
@@ -15,3 +18,17 @@ func TestDomainStats(t *testing.T) {
 		t.Fatalf("unexpected top result: %+v", top[0])
 	}
 }
+
+func TestDomainStatsTunnels(t *testing.T) {
+	ds := NewDomainStats()
+	ds.Record("Example.com")
+	ds.RecordTunnel("example.com", 100, 2000, 3*time.Second)
+	ds.RecordTunnel("example.com", 10, 20, time.Second)
+	top := ds.Top(1)
+	if len(top) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(top))
+	}
+	if s := top[0]; s.Count != 1 || s.Tunnels != 2 || s.BytesUp != 110 || s.BytesDown != 2020 || s.TunnelSeconds != 4 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+}
@@ -14,14 +14,17 @@ type ClientTracker struct {
 	cnt   int
 	subs  map[chan int]struct{}
 	addrs map[string]int
-	gauge prometheus.Gauge
+	// labels describe connected clients, keyed by address.
+	labels map[string]string
+	gauge  prometheus.Gauge
 }
 
 // NewClientTracker creates a new ClientTracker.
 func NewClientTracker() *ClientTracker {
 	return &ClientTracker{
-		subs:  make(map[chan int]struct{}),
-		addrs: make(map[string]int),
+		subs:   make(map[chan int]struct{}),
+		addrs:  make(map[string]int),
+		labels: make(map[string]string),
 	}
 }
 
@@ -53,6 +56,28 @@ func (c *ClientTracker) Addrs() []string {
 	return out
 }
 
+// Label records a description of the connected client at addr, such as the
+// selector its requests matched. Labels of addresses without connections are
+// ignored and a label is dropped when the client's last connection closes.
+func (c *ClientTracker) Label(addr, label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.addrs[addr]; ok {
+		c.labels[addr] = label
+	}
+}
+
+// Labels returns the labels of connected clients keyed by address.
+func (c *ClientTracker) Labels() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]string, len(c.labels))
+	for a, l := range c.labels {
+		out[a] = l
+	}
+	return out
+}
+
 // Subscribe returns a channel that receives connection count updates.
 func (c *ClientTracker) Subscribe() chan int {
 	ch := make(chan int, 1)
@@ -114,6 +139,7 @@ func (c *ClientTracker) ConnState(conn net.Conn, state http.ConnState) {
 			if n, ok := c.addrs[addr]; ok {
 				if n <= 1 {
 					delete(c.addrs, addr)
+					delete(c.labels, addr)
 				} else {
 					c.addrs[addr] = n - 1
 				}
@@ -43,11 +43,19 @@ func TestClientTracker(t *testing.T) {
 	if len(addrs) != 1 || addrs[0] != "1.2.3.4" {
 		t.Fatalf("addrs wrong: %v", addrs)
 	}
+	ct.Label("1.2.3.4", "10.0.0.0/8")
+	ct.Label("5.6.7.8", "user:alice")
+	if l := ct.Labels(); len(l) != 1 || l["1.2.3.4"] != "10.0.0.0/8" {
+		t.Fatalf("labels wrong: %v", l)
+	}
 
 	ct.ConnState(c, http.StateClosed)
 	if ct.Count() != 0 {
 		t.Fatalf("count=0 expected")
 	}
+	if len(ct.Labels()) != 0 {
+		t.Fatalf("label not dropped")
+	}
 	ct.Unsubscribe(ch)
 	time.Sleep(10 * time.Millisecond) // allow async update
 }
@@ -0,0 +1,208 @@
+// Package socks implements the parts of the SOCKS5 protocol (RFC 1928) and
+// its username/password authentication (RFC 1929) used by the proxy.
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Protocol constants from RFC 1928 and RFC 1929.
+const (
+	Version5 = 0x05
+
+	MethodNoAuth       = 0x00
+	MethodUserPass     = 0x02
+	MethodNoAcceptable = 0xff
+
+	userPassVersion = 0x01
+
+	CmdConnect      = 0x01
+	CmdBind         = 0x02
+	CmdUDPAssociate = 0x03
+
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
+
+	ReplySucceeded           = 0x00
+	ReplyGeneralFailure      = 0x01
+	ReplyNotAllowed          = 0x02
+	ReplyNetworkUnreachable  = 0x03
+	ReplyHostUnreachable     = 0x04
+	ReplyConnectionRefused   = 0x05
+	ReplyTTLExpired          = 0x06
+	ReplyCommandNotSupported = 0x07
+	ReplyAddrNotSupported    = 0x08
+)
+
+var noDeadline time.Time
+
+var replyText = map[byte]string{
+	ReplyGeneralFailure:      "general SOCKS server failure",
+	ReplyNotAllowed:          "connection not allowed by ruleset",
+	ReplyNetworkUnreachable:  "network unreachable",
+	ReplyHostUnreachable:     "host unreachable",
+	ReplyConnectionRefused:   "connection refused",
+	ReplyTTLExpired:          "TTL expired",
+	ReplyCommandNotSupported: "command not supported",
+	ReplyAddrNotSupported:    "address type not supported",
+}
+
+// Dial connects to addr through the SOCKS5 server at proxyAddr. When user is
+// not empty username/password authentication is offered to the server.
+func Dial(ctx context.Context, proxyAddr, user, pass, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(noDeadline)
+	}
+	if err := handshake(conn, user, pass, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func handshake(conn net.Conn, user, pass, addr string) error {
+	methods := []byte{MethodNoAuth}
+	if user != "" {
+		methods = append(methods, MethodUserPass)
+	}
+	greeting := append([]byte{Version5, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != Version5 {
+		return fmt.Errorf("socks: unexpected protocol version %d", resp[0])
+	}
+	switch resp[1] {
+	case MethodNoAuth:
+	case MethodUserPass:
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("socks: credentials too long")
+		}
+		req := []byte{userPassVersion, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return errors.New("socks: authentication failed")
+		}
+	default:
+		return errors.New("socks: no acceptable authentication method")
+	}
+
+	req := []byte{Version5, CmdConnect, 0x00}
+	req, err := AppendAddr(req, addr)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var hdr [3]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[1] != ReplySucceeded {
+		if msg, ok := replyText[hdr[1]]; ok {
+			return errors.New("socks: " + msg)
+		}
+		return fmt.Errorf("socks: unknown reply %d", hdr[1])
+	}
+	_, err = ReadAddr(conn)
+	return err
+}
+
+// AppendAddr appends the SOCKS5 encoding of the host:port address to b.
+func AppendAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("socks: invalid port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, AtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, AtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks: host name too long")
+		}
+		b = append(b, AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// ReadAddr reads an address type byte followed by a SOCKS5 encoded address
+// and returns it in host:port form.
+func ReadAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case AtypIPv4:
+		var ip [net.IPv4len]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", err
+		}
+		host = net.IP(ip[:]).String()
+	case AtypIPv6:
+		var ip [net.IPv6len]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", err
+		}
+		host = net.IP(ip[:]).String()
+	case AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", ErrAddrType
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// ErrAddrType is returned for addresses with an unknown address type.
+var ErrAddrType = errors.New("socks: address type not supported")
@@ -0,0 +1,98 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeServer accepts one connection, expects username/password
+// authentication and a CONNECT request, and then echoes data.
+func fakeServer(t *testing.T, ln net.Listener, gotAddr chan<- string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	io.ReadFull(conn, buf)
+	methods := make([]byte, buf[1])
+	io.ReadFull(conn, methods)
+	if !bytes.Contains(methods, []byte{MethodUserPass}) {
+		conn.Write([]byte{Version5, MethodNoAcceptable})
+		return
+	}
+	conn.Write([]byte{Version5, MethodUserPass})
+	io.ReadFull(conn, buf[:2])
+	user := make([]byte, buf[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, buf[:1])
+	pass := make([]byte, buf[0])
+	io.ReadFull(conn, pass)
+	if string(user) != "u" || string(pass) != "p" {
+		conn.Write([]byte{userPassVersion, 0x01})
+		return
+	}
+	conn.Write([]byte{userPassVersion, 0x00})
+	hdr := make([]byte, 3)
+	io.ReadFull(conn, hdr)
+	addr, err := ReadAddr(conn)
+	if err != nil {
+		return
+	}
+	gotAddr <- addr
+	conn.Write([]byte{Version5, ReplySucceeded, 0x00, AtypIPv4, 0, 0, 0, 0, 0, 0})
+	io.Copy(conn, conn)
+}
+
+func TestDialUserPass(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	gotAddr := make(chan string, 1)
+	go fakeServer(t, ln, gotAddr)
+
+	conn, err := Dial(context.Background(), ln.Addr().String(), "u", "p", "example.com:443")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	if a := <-gotAddr; a != "example.com:443" {
+		t.Fatalf("unexpected target %q", a)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+}
+
+func TestDialAuthFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go fakeServer(t, ln, make(chan string, 1))
+
+	if _, err := Dial(context.Background(), ln.Addr().String(), "u", "wrong", "example.com:443"); err == nil {
+		t.Fatalf("expected authentication error")
+	}
+}
+
+func TestAddrRoundTrip(t *testing.T) {
+	for _, addr := range []string{"10.0.0.1:80", "[::1]:443", "example.com:8080"} {
+		b, err := AppendAddr(nil, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadAddr(bytes.NewReader(b))
+		if err != nil || got != addr {
+			t.Fatalf("round trip of %s gave %s: %v", addr, got, err)
+		}
+	}
+}
@@ -0,0 +1,559 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/pod32g/simple-logger"
+)
+
+// maxUDPPacket is the largest datagram relayed for UDP ASSOCIATE.
+const maxUDPPacket = 65535
+
+// maxUDPRoutes bounds the destinations whose verdict and resolved address a
+// UDP association remembers.
+const maxUDPRoutes = 256
+
+// Server is a SOCKS5 server supporting the CONNECT and UDP ASSOCIATE commands.
+type Server struct {
+	// AuthRequired reports whether clients must authenticate. It is
+	// consulted for every new connection so changes apply immediately. A nil
+	// function disables authentication.
+	AuthRequired func() bool
+	// Authenticate checks the username and password given by a client.
+	Authenticate func(user, pass string) bool
+	// Dial opens outbound TCP connections for CONNECT. It defaults to a
+	// net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Allow, when set, decides whether the client of conn, authenticated as
+	// user or empty without authentication, may reach addr with CONNECT or
+	// UDP ASSOCIATE. Denied commands get ReplyNotAllowed and denied
+	// datagrams are dropped.
+	Allow func(conn net.Conn, user, addr string) bool
+	// HandshakeTimeout, when set, returns how long clients have to
+	// negotiate and send their command, and replies have to be written;
+	// zero disables it.
+	HandshakeTimeout func() time.Duration
+	Logger           *log.Logger
+
+	// OnConnect and OnDisconnect are called when a client connection is
+	// accepted and closed.
+	OnConnect    func(net.Conn)
+	OnDisconnect func(net.Conn)
+	// OnRequest is called for every command with the destination address
+	// and the reply code sent to the client.
+	OnRequest func(cmd byte, addr string, reply byte)
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	// conns maps the open connections to their credentials, nil until
+	// negotiated and once closed by Reauthorize.
+	conns   map[net.Conn]*credentials
+	closing bool
+	// generation is bumped by Reauthorize so UDP associations drop the
+	// verdicts they remembered.
+	generation atomic.Uint64
+}
+
+// credentials are those a client negotiated. Authenticated is false for
+// clients accepted while authentication was not required.
+type credentials struct {
+	user, pass    string
+	authenticated bool
+}
+
+// ListenAndServe listens on the TCP address addr and serves SOCKS5 clients.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until it is closed or the server is shut
+// down.
+func (s *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+	if !s.trackListener(ln, true) {
+		return nil
+	}
+	defer s.trackListener(ln, false)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections and waits for the open ones to finish
+// until ctx is done, then closes those left and returns their number.
+func (s *Server) Shutdown(ctx context.Context) int {
+	s.mu.Lock()
+	s.closing = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for conn := range s.conns {
+				conn.Close()
+			}
+			return len(s.conns)
+		case <-ticker.C:
+		}
+	}
+}
+
+// trackListener adds or removes ln from the listeners closed by Shutdown,
+// reporting false once the server is shutting down.
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, ln)
+		return true
+	}
+	if s.closing {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes conn from the connections awaited by Shutdown,
+// reporting false once the server is shutting down.
+func (s *Server) trackConn(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.closing {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*credentials)
+	}
+	s.conns[conn] = nil
+	return true
+}
+
+// negotiated records the credentials conn negotiated.
+func (s *Server) negotiated(conn net.Conn, creds credentials) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[conn]; ok {
+		s.conns[conn] = &creds
+	}
+}
+
+// Reauthorize closes the connections whose credentials no longer
+// authenticate, or that negotiated none while authentication is now
+// required, and returns their number. UDP associations check their
+// destinations with Allow again. It is meant to be called when users, the
+// authentication settings or the access rules change.
+func (s *Server) Reauthorize() int {
+	s.generation.Add(1)
+	if s.AuthRequired == nil || !s.AuthRequired() {
+		return 0
+	}
+	s.mu.Lock()
+	conns := make(map[net.Conn]credentials, len(s.conns))
+	for conn, creds := range s.conns {
+		if creds != nil {
+			conns[conn] = *creds
+		}
+	}
+	s.mu.Unlock()
+	var revoked []net.Conn
+	for conn, creds := range conns {
+		if !creds.authenticated || s.Authenticate == nil || !s.Authenticate(creds.user, creds.pass) {
+			revoked = append(revoked, conn)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range revoked {
+		s.debug("Closing SOCKS connection with revoked credentials", conn.RemoteAddr())
+		if _, ok := s.conns[conn]; ok {
+			s.conns[conn] = nil
+		}
+		conn.Close()
+	}
+	return len(revoked)
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.trackConn(conn, false)
+	if s.OnConnect != nil {
+		s.OnConnect(conn)
+	}
+	defer func() {
+		conn.Close()
+		if s.OnDisconnect != nil {
+			s.OnDisconnect(conn)
+		}
+	}()
+	if d := s.handshakeTimeout(); d > 0 {
+		conn.SetDeadline(time.Now().Add(d))
+	}
+	creds, err := s.negotiate(conn)
+	if err != nil {
+		s.debug("SOCKS negotiation failed", err)
+		return
+	}
+	s.negotiated(conn, creds)
+	user := creds.user
+	var hdr [3]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return
+	}
+	if hdr[0] != Version5 {
+		return
+	}
+	addr, err := ReadAddr(conn)
+	if err != nil {
+		if errors.Is(err, ErrAddrType) {
+			s.reply(conn, ReplyAddrNotSupported, nil)
+		}
+		return
+	}
+	// Destinations are dialed with their own timeout and replies get a
+	// write deadline of their own.
+	conn.SetReadDeadline(time.Time{})
+	switch hdr[1] {
+	case CmdConnect:
+		if s.Allow != nil && !s.Allow(conn, user, addr) {
+			s.finish(conn, CmdConnect, addr, ReplyNotAllowed, nil)
+			return
+		}
+		s.handleConnect(conn, addr)
+	case CmdUDPAssociate:
+		s.handleUDPAssociate(conn, user, addr)
+	default:
+		s.finish(conn, hdr[1], addr, ReplyCommandNotSupported, nil)
+	}
+}
+
+// negotiate performs method selection and, if required, username/password
+// authentication. It returns the credentials of the client, which are empty
+// unless authentication is required.
+func (s *Server) negotiate(conn net.Conn) (credentials, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return credentials{}, err
+	}
+	if hdr[0] != Version5 {
+		return credentials{}, errors.New("unsupported SOCKS version")
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return credentials{}, err
+	}
+	required := s.AuthRequired != nil && s.AuthRequired()
+	method := byte(MethodNoAcceptable)
+	switch {
+	case required && bytes.IndexByte(methods, MethodUserPass) >= 0:
+		method = MethodUserPass
+	case !required && bytes.IndexByte(methods, MethodNoAuth) >= 0:
+		method = MethodNoAuth
+	case !required && bytes.IndexByte(methods, MethodUserPass) >= 0:
+		method = MethodUserPass
+	}
+	if _, err := conn.Write([]byte{Version5, method}); err != nil {
+		return credentials{}, err
+	}
+	switch method {
+	case MethodNoAcceptable:
+		return credentials{}, errors.New("no acceptable authentication method")
+	case MethodNoAuth:
+		return credentials{}, nil
+	}
+
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return credentials{}, err
+	}
+	if hdr[0] != userPassVersion {
+		return credentials{}, errors.New("unsupported authentication version")
+	}
+	gotUser := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, gotUser); err != nil {
+		return credentials{}, err
+	}
+	if _, err := io.ReadFull(conn, hdr[:1]); err != nil {
+		return credentials{}, err
+	}
+	gotPass := make([]byte, hdr[0])
+	if _, err := io.ReadFull(conn, gotPass); err != nil {
+		return credentials{}, err
+	}
+	ok := !required || (s.Authenticate != nil && s.Authenticate(string(gotUser), string(gotPass)))
+	status := byte(0x00)
+	if !ok {
+		status = 0x01
+	}
+	if _, err := conn.Write([]byte{userPassVersion, status}); err != nil {
+		return credentials{}, err
+	}
+	if !ok {
+		return credentials{}, errors.New("authentication failed")
+	}
+	if !required {
+		return credentials{}, nil
+	}
+	return credentials{user: string(gotUser), pass: string(gotPass), authenticated: true}, nil
+}
+
+func (s *Server) handleConnect(conn net.Conn, addr string) {
+	dial := s.Dial
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	dest, err := dial(context.Background(), "tcp", addr)
+	if err != nil {
+		s.debug("SOCKS dial error", addr, err)
+		s.finish(conn, CmdConnect, addr, dialReply(err), nil)
+		return
+	}
+	defer dest.Close()
+	if !s.finish(conn, CmdConnect, addr, ReplySucceeded, dest.LocalAddr()) {
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(dest, conn)
+		closeWrite(dest)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, dest)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		c.Close()
+	}
+}
+
+// handleUDPAssociate relays datagrams between the client and remote hosts
+// for as long as the control connection stays open.
+func (s *Server) handleUDPAssociate(conn net.Conn, user, addr string) {
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host)})
+	if err != nil {
+		s.finish(conn, CmdUDPAssociate, addr, ReplyGeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+	if !s.finish(conn, CmdUDPAssociate, addr, ReplySucceeded, relay.LocalAddr()) {
+		return
+	}
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	go s.relayUDP(relay, net.ParseIP(clientIP), func(dest string) bool {
+		return s.Allow == nil || s.Allow(conn, user, dest)
+	})
+	// The association ends when the control connection is closed.
+	io.Copy(io.Discard, conn)
+}
+
+// udpRoute is the verdict for a UDP destination and, when allowed, its
+// resolved address.
+type udpRoute struct {
+	addr *net.UDPAddr
+	ok   bool
+}
+
+// relayUDP relays the datagrams of a UDP association, dropping those to
+// destinations not allowed by allow.
+func (s *Server) relayUDP(relay *net.UDPConn, clientIP net.IP, allow func(dest string) bool) {
+	var client *net.UDPAddr
+	// routes remembers up to maxUDPRoutes destinations until Reauthorize is
+	// called.
+	routes := make(map[string]udpRoute)
+	generation := s.generation.Load()
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// The first datagram from the client's IP fixes the client port.
+		fromClient := from.IP.Equal(clientIP) && (client == nil || client.Port == from.Port)
+		if fromClient && client == nil {
+			client = from
+		}
+
+		if fromClient {
+			// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA; fragments are dropped.
+			if n < 4 || buf[2] != 0 {
+				continue
+			}
+			r := bytes.NewReader(buf[3:n])
+			dest, err := ReadAddr(r)
+			if err != nil {
+				continue
+			}
+			if g := s.generation.Load(); g != generation {
+				generation = g
+				clear(routes)
+			}
+			route, seen := routes[dest]
+			if !seen {
+				var keep bool
+				route, keep = s.udpRoute(dest, allow)
+				if keep {
+					if len(routes) >= maxUDPRoutes {
+						// Forget an arbitrary destination to make room.
+						for k := range routes {
+							delete(routes, k)
+							break
+						}
+					}
+					routes[dest] = route
+				}
+			}
+			if !route.ok {
+				continue
+			}
+			payload := buf[n-r.Len() : n]
+			relay.WriteToUDP(payload, route.addr)
+			continue
+		}
+		if client == nil {
+			continue
+		}
+		pkt, err := AppendAddr([]byte{0, 0, 0}, from.String())
+		if err != nil {
+			continue
+		}
+		pkt = append(pkt, buf[:n]...)
+		relay.WriteToUDP(pkt, client)
+	}
+}
+
+// udpRoute checks dest with allow and resolves it only when allowed. It
+// reports whether the route may be remembered, which it may not when the
+// resolution failed.
+func (s *Server) udpRoute(dest string, allow func(dest string) bool) (udpRoute, bool) {
+	var route udpRoute
+	rep := byte(ReplyNotAllowed)
+	if allow(dest) {
+		addr, err := net.ResolveUDPAddr("udp", dest)
+		if err != nil {
+			rep = dialReply(err)
+		} else {
+			route = udpRoute{addr: addr, ok: true}
+			rep = ReplySucceeded
+		}
+	}
+	if s.OnRequest != nil {
+		s.OnRequest(CmdUDPAssociate, dest, rep)
+	}
+	return route, rep == ReplySucceeded || rep == ReplyNotAllowed
+}
+
+// finish sends the reply for a command and reports it through OnRequest. It
+// returns whether the reply signalled success and was written. Successful UDP
+// associations are reported per destination by the relay instead.
+func (s *Server) finish(conn net.Conn, cmd byte, addr string, rep byte, bound net.Addr) bool {
+	if s.OnRequest != nil && (cmd != CmdUDPAssociate || rep != ReplySucceeded) {
+		s.OnRequest(cmd, addr, rep)
+	}
+	if err := s.reply(conn, rep, bound); err != nil {
+		return false
+	}
+	return rep == ReplySucceeded
+}
+
+func (s *Server) reply(conn net.Conn, rep byte, bound net.Addr) error {
+	if d := s.handshakeTimeout(); d > 0 {
+		conn.SetWriteDeadline(time.Now().Add(d))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	b := []byte{Version5, rep, 0x00}
+	addr := "0.0.0.0:0"
+	if bound != nil {
+		addr = bound.String()
+	}
+	b, err := AppendAddr(b, addr)
+	if err != nil {
+		b, _ = AppendAddr([]byte{Version5, rep, 0x00}, "0.0.0.0:0")
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+func dialReply(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return ReplyHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ReplyHostUnreachable
+	default:
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return ReplyTTLExpired
+		}
+		return ReplyGeneralFailure
+	}
+}
+
+func (s *Server) handshakeTimeout() time.Duration {
+	if s.HandshakeTimeout == nil {
+		return 0
+	}
+	return s.HandshakeTimeout()
+}
+
+func (s *Server) debug(args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Debug(args...)
+	}
+}
@@ -0,0 +1,325 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, srv *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.Serve(ln)
+	return ln.Addr().String()
+}
+
+func echoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestServerConnectWithAuth(t *testing.T) {
+	var got []string
+	srv := &Server{
+		AuthRequired: func() bool { return true },
+		Authenticate: func(user, pass string) bool { return user == "u" && pass == "p" },
+		OnRequest:    func(cmd byte, addr string, rep byte) { got = append(got, addr) },
+	}
+	proxyAddr := startServer(t, srv)
+	target := echoServer(t)
+
+	if _, err := Dial(context.Background(), proxyAddr, "", "", target); err == nil {
+		t.Fatalf("expected failure without credentials")
+	}
+	if _, err := Dial(context.Background(), proxyAddr, "u", "bad", target); err == nil {
+		t.Fatalf("expected failure with wrong password")
+	}
+	conn, err := Dial(context.Background(), proxyAddr, "u", "p", target)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+	if len(got) != 1 || got[0] != target {
+		t.Fatalf("request not reported: %v", got)
+	}
+}
+
+func TestServerAllow(t *testing.T) {
+	target := echoServer(t)
+	var gotUser, gotAddr string
+	srv := &Server{
+		AuthRequired: func() bool { return true },
+		Authenticate: func(user, pass string) bool { return pass == "p" },
+		Allow: func(conn net.Conn, user, addr string) bool {
+			gotUser, gotAddr = user, addr
+			return user == "alice"
+		},
+	}
+	proxyAddr := startServer(t, srv)
+	if _, err := Dial(context.Background(), proxyAddr, "bob", "p", target); err == nil {
+		t.Fatalf("denied CONNECT succeeded")
+	}
+	if gotUser != "bob" || gotAddr != target {
+		t.Fatalf("Allow called with %q %q", gotUser, gotAddr)
+	}
+	conn, err := Dial(context.Background(), proxyAddr, "alice", "p", target)
+	if err != nil {
+		t.Fatalf("allowed CONNECT failed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestServerReauthorize(t *testing.T) {
+	target := echoServer(t)
+	var required, revoked atomic.Bool
+	srv := &Server{
+		AuthRequired: required.Load,
+		Authenticate: func(user, pass string) bool { return user == "u" && !revoked.Load() },
+	}
+	proxyAddr := startServer(t, srv)
+	open := func(user string) net.Conn {
+		conn, err := Dial(context.Background(), proxyAddr, user, "p", target)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	closed := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+
+	// Connections accepted without authentication are closed once it is
+	// required.
+	anonymous := open("")
+	if n := srv.Reauthorize(); n != 0 {
+		t.Fatalf("closed %d connections while authentication is disabled", n)
+	}
+	required.Store(true)
+	authenticated := open("u")
+	if n := srv.Reauthorize(); n != 1 || !closed(anonymous) {
+		t.Fatalf("expected the unauthenticated connection to be closed, closed %d", n)
+	}
+
+	revoked.Store(true)
+	if n := srv.Reauthorize(); n != 1 || !closed(authenticated) {
+		t.Fatalf("expected the revoked connection to be closed, closed %d", n)
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	target := echoServer(t)
+	srv := &Server{HandshakeTimeout: func() time.Duration { return 100 * time.Millisecond }}
+	proxyAddr := startServer(t, srv)
+
+	// A client that never sends its greeting is disconnected.
+	idle, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle handshake not closed: %v", err)
+	}
+
+	// Established connections outlive the handshake timeout.
+	conn, err := Dial(context.Background(), proxyAddr, "", "", target)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+}
+
+func TestServerUDPAssociate(t *testing.T) {
+	echo := udpEchoServer(t)
+	client := udpAssociate(t, startServer(t, &Server{}))
+	pkt, _ := AppendAddr([]byte{0, 0, 0}, echo.LocalAddr().String())
+	client.Write(append(pkt, "ping"...))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[len(pkt):n]); got != "ping" {
+		t.Fatalf("unexpected datagram %q", got)
+	}
+}
+
+func TestServerUDPAllow(t *testing.T) {
+	echo := udpEchoServer(t)
+	var mu sync.Mutex
+	allowed := true
+	replies := make(map[string]byte)
+	srv := &Server{
+		Allow: func(conn net.Conn, user, addr string) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return allowed && !strings.HasSuffix(addr, ".invalid:53")
+		},
+		OnRequest: func(cmd byte, addr string, reply byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			replies[addr] = reply
+		},
+	}
+	client := udpAssociate(t, startServer(t, srv))
+	pkt, _ := AppendAddr([]byte{0, 0, 0}, echo.LocalAddr().String())
+	denied, _ := AppendAddr([]byte{0, 0, 0}, "denied.invalid:53")
+	client.Write(append(denied, "ping"...))
+	ping := func() bool {
+		client.Write(append(pkt, "ping"...))
+		client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, err := client.Read(make([]byte, 1024))
+		return err == nil
+	}
+	if !ping() {
+		t.Fatalf("allowed datagram not relayed")
+	}
+	mu.Lock()
+	// A denied destination is not resolved, which would fail for .invalid.
+	if rep := replies["denied.invalid:53"]; rep != ReplyNotAllowed {
+		t.Fatalf("denied destination reported %#x", rep)
+	}
+	allowed = false
+	mu.Unlock()
+	if !ping() {
+		t.Fatalf("verdict not remembered until Reauthorize")
+	}
+	srv.Reauthorize()
+	if ping() {
+		t.Fatalf("datagram relayed after the destination was denied")
+	}
+}
+
+// udpEchoServer returns a UDP socket echoing the datagrams it receives.
+func udpEchoServer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return echo
+}
+
+// udpAssociate sets up a UDP association with the server at proxyAddr and
+// returns a socket connected to its relay.
+func udpAssociate(t *testing.T, proxyAddr string) *net.UDPConn {
+	t.Helper()
+	ctrl, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ctrl.Close() })
+	ctrl.Write([]byte{Version5, 1, MethodNoAuth})
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, resp); err != nil || resp[1] != MethodNoAuth {
+		t.Fatalf("method selection failed: %v %v", resp, err)
+	}
+	req, _ := AppendAddr([]byte{Version5, CmdUDPAssociate, 0}, "0.0.0.0:0")
+	ctrl.Write(req)
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(ctrl, hdr); err != nil || hdr[1] != ReplySucceeded {
+		t.Fatalf("associate failed: %v %v", hdr, err)
+	}
+	relayAddr, err := ReadAddr(ctrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpRelay, _ := net.ResolveUDPAddr("udp", relayAddr)
+	client, err := net.DialUDP("udp", nil, udpRelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestServerShutdown(t *testing.T) {
+	srv := &Server{}
+	proxyAddr := startServer(t, srv)
+	target := echoServer(t)
+
+	conn, err := Dial(context.Background(), proxyAddr, "", "", target)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if n := srv.Shutdown(ctx); n != 0 {
+		t.Fatalf("%d connections force-closed while draining", n)
+	}
+	if _, err := net.DialTimeout("tcp", proxyAddr, time.Second); err == nil {
+		t.Fatalf("listener still accepting after shutdown")
+	}
+
+	busy := &Server{}
+	busyConn, err := Dial(context.Background(), startServer(t, busy), "", "", target)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer busyConn.Close()
+	short, cancelShort := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelShort()
+	if n := busy.Shutdown(short); n != 1 {
+		t.Fatalf("force-closed %d connections, want 1", n)
+	}
+	busyConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := busyConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection still open after shutdown: %v", err)
+	}
+}
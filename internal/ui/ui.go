@@ -4,16 +4,55 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/pod32g/proxy/internal/cache"
 	"github.com/pod32g/proxy/internal/config"
+	"github.com/pod32g/proxy/internal/proxy"
 	"github.com/pod32g/proxy/internal/server"
 	log "github.com/pod32g/simple-logger"
 )
 
+// Option configures optional features of the UI handler.
+type Option func(*handler)
+
+// WithCACert makes the PEM encoded TLS interception CA certificate available
+// for download from the UI.
+func WithCACert(pem []byte) Option {
+	return func(h *handler) { h.caCert = pem }
+}
+
+// WithBalancer shows the live state of the reverse proxy pool.
+func WithBalancer(b *proxy.Balancer) Option {
+	return func(h *handler) { h.balancer = b }
+}
+
+// WithCache shows the occupancy of the shared HTTP cache and allows purging it.
+func WithCache(c *cache.Store) Option {
+	return func(h *handler) { h.cache = c }
+}
+
+// WithACL shows how many requests each access control rule decided.
+func WithACL(a *proxy.ACL) Option {
+	return func(h *handler) { h.acl = a }
+}
+
+// WithTunnels lists the live CONNECT tunnels of the forward proxy and allows
+// terminating them.
+func WithTunnels(f *proxy.Forward) Option {
+	return func(h *handler) { h.forward = f }
+}
+
 // New returns a handler that exposes a simple configuration UI.
-func New(cfg *config.Config, store *config.Store, logger *log.Logger, clients *server.ClientTracker, stats *server.DomainStats) http.Handler {
+func New(cfg *config.Config, store *config.Store, logger *log.Logger, clients *server.ClientTracker, stats *server.DomainStats, opts ...Option) http.Handler {
 	h := &handler{cfg: cfg, store: store, logger: logger, clients: clients, stats: stats}
+	for _, opt := range opts {
+		opt(h)
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", h.index)
 	mux.HandleFunc("/general", h.general)
@@ -21,8 +60,39 @@ func New(cfg *config.Config, store *config.Store, logger *log.Logger, clients *s
 	mux.HandleFunc("/identity", h.identityPage)
 	mux.HandleFunc("/set-identity", h.setIdentity)
 	mux.HandleFunc("/auth", h.authPage)
+	mux.HandleFunc("/set-auth", h.setAuth)
+	mux.HandleFunc("/user", h.setUser)
+	mux.HandleFunc("/delete-user", h.deleteUser)
+	mux.HandleFunc("/tokens", h.tokensPage)
+	mux.HandleFunc("/token", h.createToken)
+	mux.HandleFunc("/revoke-token", h.revokeToken)
+	mux.HandleFunc("/tls", h.tlsPage)
+	mux.HandleFunc("/set-mitm", h.setMITM)
+	mux.HandleFunc("/ca.pem", h.caPEM)
+	mux.HandleFunc("/upstreams", h.upstreamsPage)
+	mux.HandleFunc("/upstream", h.setUpstream)
+	mux.HandleFunc("/delete-upstream", h.deleteUpstream)
+	mux.HandleFunc("/balancing", h.setBalancing)
+	mux.HandleFunc("/health", h.healthPage)
+	mux.HandleFunc("/health-check", h.setHealthCheck)
+	mux.HandleFunc("/acl", h.aclPage)
+	mux.HandleFunc("/acl-rule", h.setACLRule)
+	mux.HandleFunc("/delete-acl-rule", h.deleteACLRule)
+	mux.HandleFunc("/acl-policy", h.setACLPolicy)
+	mux.HandleFunc("/cache", h.cachePage)
+	mux.HandleFunc("/purge", h.purgeCache)
+	mux.HandleFunc("/tunnels", h.tunnelsPage)
+	mux.HandleFunc("/tunnel-timeouts", h.setTunnelTimeouts)
+	mux.HandleFunc("/close-tunnel", h.closeTunnel)
+	mux.HandleFunc("/history", h.historyPage)
+	mux.HandleFunc("/rollback", h.rollback)
+	mux.HandleFunc("/export", h.exportConfig)
+	mux.HandleFunc("/import", h.importConfig)
 	mux.HandleFunc("/header", h.addHeader)
 	mux.HandleFunc("/delete", h.deleteHeader)
+	mux.HandleFunc("/trusted-proxies", h.setTrustedProxies)
+	mux.HandleFunc("/forwarding", h.setForwarding)
+	mux.HandleFunc("/access-log", h.setAccessLog)
 	mux.HandleFunc("/loglevel", h.setLogLevel)
 	mux.HandleFunc("/stats", h.setStats)
 	mux.HandleFunc("/stats-events", h.statsEvents)
@@ -36,6 +106,12 @@ type handler struct {
 	logger  *log.Logger
 	clients *server.ClientTracker
 	stats   *server.DomainStats
+	caCert  []byte
+
+	balancer *proxy.Balancer
+	cache    *cache.Store
+	acl      *proxy.ACL
+	forward  *proxy.Forward
 }
 
 type pageData struct {
@@ -43,13 +119,47 @@ type pageData struct {
 	ClientHeaders map[string]map[string]string
 	LogLevel      string
 	AuthEnabled   bool
-	Username      string
+	Users         []config.User
 	ProxyName     string
 	ProxyID       string
 	ClientCount   int
 	ClientAddrs   []string
-	StatsEnabled  bool
-	Stats         []server.Stat
+	// ClientSelectors maps connected client addresses to the client
+	// selector their last request matched.
+	ClientSelectors map[string]string
+	TrustedProxies  string
+	Forwarding      config.Forwarding
+	AccessLog       config.AccessLog
+	StatsEnabled    bool
+	Stats           []server.Stat
+	MITMEnabled     bool
+	MITMBypass      string
+	CAAvailable     bool
+	Pool            config.UpstreamPool
+	Upstreams       []proxy.UpstreamStatus
+	HealthCheck     config.HealthCheck
+	CacheEnabled    bool
+	CacheUsage      cache.Usage
+	CachePercent    float64
+	Purged          string
+	TunnelsEnabled  bool
+	Tunnels         []proxy.Tunnel
+	TunnelTimeouts  config.TunnelTimeouts
+	ACL             config.AccessControl
+	ACLHits         map[string]uint64
+	History         []config.Revision
+	// Diff holds the changes between the DiffFrom and DiffTo revisions
+	// requested on the History page.
+	Diff     []config.Change
+	DiffFrom int
+	DiffTo   int
+	DiffErr  string
+	// Import is the outcome of the configuration import just submitted.
+	Import *config.ImportResult
+	Tokens []config.Token
+	Scopes []string
+	// NewToken is the secret of the API token just created, shown once.
+	NewToken string
 }
 
 var layout = template.Must(template.New("layout").Parse(`<!DOCTYPE html>
@@ -85,13 +195,21 @@ var layout = template.Must(template.New("layout").Parse(`<!DOCTYPE html>
         <li class="nav-item"><a href="/ui/analytics" class="nav-link">Analytics</a></li>
         <li class="nav-item"><a href="/ui/identity" class="nav-link">Identity</a></li>
         <li class="nav-item"><a href="/ui/auth" class="nav-link">Authentication</a></li>
+        <li class="nav-item"><a href="/ui/tokens" class="nav-link">API Tokens</a></li>
+        <li class="nav-item"><a href="/ui/tls" class="nav-link">TLS Interception</a></li>
+        <li class="nav-item"><a href="/ui/upstreams" class="nav-link">Upstreams</a></li>
+        <li class="nav-item"><a href="/ui/health" class="nav-link">Health</a></li>
+        <li class="nav-item"><a href="/ui/acl" class="nav-link">Access Control</a></li>
+        <li class="nav-item"><a href="/ui/cache" class="nav-link">Cache</a></li>
+        <li class="nav-item"><a href="/ui/tunnels" class="nav-link">Tunnels</a></li>
+        <li class="nav-item"><a href="/ui/history" class="nav-link">History</a></li>
     </ul>
 </div>
 <div class="content">
 <p>Connected clients: <span id="clients">{{.ClientCount}}</span></p>
 <ul>
 {{range .ClientAddrs}}
-<li>{{.}}</li>
+<li>{{.}}{{with index $.ClientSelectors .}} (matched {{.}}){{end}}</li>
 {{end}}
 </ul>
 {{template "content" .}}
@@ -127,9 +245,10 @@ var generalPage = template.Must(template.Must(layout.Clone()).Parse(`{{define "c
 <form method="POST" action="header">
 <label>Name: <input name="name"></label>
 <label>Value: <input name="value"></label>
-<label>Client: <input name="client" placeholder="(global)"></label>
+<label>Client: <input name="client" placeholder="(global)" title="IP, CIDR, user:NAME or header:Name=value"></label>
 <button type="submit">Save</button>
 </form>
+<p>Client selectors are an IP, a CIDR range, <code>user:NAME</code> or <code>header:Name=value</code>. When several match, user selectors win over header selectors, header over IP and IP over CIDR ranges, narrower ranges first.</p>
 <h2>Delete Header</h2>
 <form method="POST" action="delete">
 <label>Name: <input name="name"></label>
@@ -137,6 +256,34 @@ var generalPage = template.Must(template.Must(layout.Clone()).Parse(`{{define "c
 <button type="submit">Delete</button>
 </form>
 
+<h2>Trusted Proxies</h2>
+<p>Requests from these addresses or CIDR ranges are identified by their X-Forwarded-For header, and only they can match header selectors.</p>
+<form method="POST" action="trusted-proxies">
+<textarea name="proxies" rows="3" cols="40">{{.TrustedProxies}}</textarea>
+<button type="submit">Save</button>
+</form>
+
+<h2>Forwarding Headers</h2>
+<p>Headers added to requests forwarded in forward mode. Hop-by-hop headers such as Proxy-Authorization are always removed.</p>
+<form method="POST" action="forwarding">
+<label><input type="checkbox" name="via" {{if .Forwarding.Via}}checked{{end}}> Via</label>
+<label><input type="checkbox" name="x_forwarded_for" {{if .Forwarding.XForwardedFor}}checked{{end}}> X-Forwarded-For</label>
+<label><input type="checkbox" name="forwarded" {{if .Forwarding.Forwarded}}checked{{end}}> Forwarded</label>
+<label>Keep received headers from:
+<select name="trust">
+<option value="all" {{if or (eq .Forwarding.Trust "") (eq .Forwarding.Trust "all")}}selected{{end}}>all clients</option>
+<option value="trusted" {{if eq .Forwarding.Trust "trusted"}}selected{{end}}>trusted proxies</option>
+<option value="none" {{if eq .Forwarding.Trust "none"}}selected{{end}}>nobody</option>
+</select></label>
+<label>Client address:
+<select name="anonymize">
+<option value="" {{if eq .Forwarding.Anonymize ""}}selected{{end}}>full</option>
+<option value="truncate" {{if eq .Forwarding.Anonymize "truncate"}}selected{{end}}>truncated</option>
+<option value="hide" {{if eq .Forwarding.Anonymize "hide"}}selected{{end}}>hidden</option>
+</select></label>
+<button type="submit">Save</button>
+</form>
+
 <h2>Log Level</h2>
 Current: {{.LogLevel}}
 <form method="POST" action="loglevel">
@@ -149,16 +296,41 @@ Current: {{.LogLevel}}
 </select>
 <button type="submit">Set</button>
 </form>
+
+<h2>Access Log</h2>
+<form method="POST" action="access-log">
+<label><input type="checkbox" name="enabled" {{if .AccessLog.Enabled}}checked{{end}}> Enabled</label>
+<label>Format:
+<select name="format">
+<option value="common" {{if eq .AccessLog.Format "common"}}selected{{end}}>Common Log Format</option>
+<option value="combined" {{if or (eq .AccessLog.Format "") (eq .AccessLog.Format "combined")}}selected{{end}}>Combined Log Format</option>
+<option value="json" {{if eq .AccessLog.Format "json"}}selected{{end}}>JSON lines</option>
+<option value="template" {{if eq .AccessLog.Format "template"}}selected{{end}}>template</option>
+</select></label>
+<label>Template: <input name="template" size="60" value="{{.AccessLog.Template}}" placeholder="{client} {method} {url} {status} {duration_ms}"></label><br>
+<label>Sink:
+<select name="sink">
+<option value="stdout" {{if or (eq .AccessLog.Sink "") (eq .AccessLog.Sink "stdout")}}selected{{end}}>standard output</option>
+<option value="file" {{if eq .AccessLog.Sink "file"}}selected{{end}}>file</option>
+<option value="syslog" {{if eq .AccessLog.Sink "syslog"}}selected{{end}}>syslog</option>
+</select></label>
+<label>File: <input name="file" value="{{.AccessLog.File}}"></label>
+<label>Max size (MB): <input name="max_size" type="number" min="0" value="{{.AccessLog.MaxSize}}"></label>
+<label>Max age: <input name="max_age" value="{{.AccessLog.MaxAge.Std}}"></label>
+<label>Backups: <input name="max_backups" type="number" min="0" value="{{.AccessLog.MaxBackups}}"></label>
+<label>Syslog socket: <input name="syslog" value="{{.AccessLog.Syslog}}" placeholder="(system)"></label>
+<button type="submit">Save</button>
+</form>
 {{end}}`))
 
 var analyticsPage = template.Must(template.Must(layout.Clone()).Parse(`{{define "content"}}
 <h2>Top Websites</h2>
 {{if .StatsEnabled}}
 <table id="top">
-<thead><tr><th>Host</th><th>Count</th></tr></thead>
+<thead><tr><th>Host</th><th>Count</th><th>Tunnels</th><th>Bytes sent</th><th>Bytes received</th><th>Tunnel time (s)</th></tr></thead>
 <tbody>
 {{range .Stats}}
-<tr><td>{{.Host}}</td><td>{{.Count}}</td></tr>
+<tr><td>{{.Host}}</td><td>{{.Count}}</td><td>{{.Tunnels}}</td><td>{{.BytesUp}}</td><td>{{.BytesDown}}</td><td>{{printf "%.1f" .TunnelSeconds}}</td></tr>
 {{end}}
 </tbody>
 </table>
@@ -167,7 +339,7 @@ var statsSrc = new EventSource('stats-events');
 statsSrc.onmessage = function(e){
     var data = JSON.parse(e.data);
     var html = '';
-    data.forEach(function(s){ html += '<tr><td>'+s.Host+'</td><td>'+s.Count+'</td></tr>'; });
+    data.forEach(function(s){ html += '<tr><td>'+s.Host+'</td><td>'+s.Count+'</td><td>'+s.Tunnels+'</td><td>'+s.BytesUp+'</td><td>'+s.BytesDown+'</td><td>'+s.TunnelSeconds.toFixed(1)+'</td></tr>'; });
     document.querySelector('#top tbody').innerHTML = html;
 };
 </script>
@@ -188,33 +360,332 @@ var identityPage = template.Must(template.Must(layout.Clone()).Parse(`{{define "
 </form>
 {{end}}`))
 
+var tokensPage = template.Must(template.Must(layout.Clone()).Parse(`{{define "content"}}
+<h2>API Tokens</h2>
+{{with .NewToken}}
+<div class="alert alert-success">New token, shown only once: <code>{{.}}</code></div>
+{{end}}
+<table>
+<thead><tr><th>Name</th><th>Scopes</th><th>Created</th><th>Expires</th><th>Last used</th><th></th></tr></thead>
+{{range .Tokens}}
+<tr><td>{{.Name}}</td><td>{{range .Scopes}}<code>{{.}}</code> {{end}}</td>
+<td>{{.Created.Format "2006-01-02 15:04"}}</td>
+<td>{{if .Expires.IsZero}}never{{else}}{{.Expires.Format "2006-01-02 15:04"}}{{end}}</td>
+<td>{{if .LastUsed.IsZero}}never{{else}}{{.LastUsed.Format "2006-01-02 15:04"}}{{end}}</td>
+<td><form method="POST" action="revoke-token"><input type="hidden" name="name" value="{{.Name}}"><button type="submit">Revoke</button></form></td></tr>
+{{end}}
+</table>
+<h3>Create Token</h3>
+<form method="POST" action="token">
+<label>Name: <input name="name"></label><br>
+{{range .Scopes}}<label><input type="checkbox" name="scope" value="{{.}}"> {{.}}</label> {{end}}<br>
+<label>Expires in: <input name="expires_in" placeholder="720h (never if empty)"></label>
+<button type="submit">Create</button>
+</form>
+{{end}}`))
+
 var authPage = template.Must(template.Must(layout.Clone()).Parse(`{{define "content"}}
 <h2>Authentication</h2>
-<form method="POST" action="auth">
+<form method="POST" action="set-auth">
     <label><input type="checkbox" name="enabled" {{if .AuthEnabled}}checked{{end}}> Enable Auth</label><br>
-    <label>User: <input name="username" value="{{.Username}}"></label><br>
-    <label>Pass: <input type="password" name="password" placeholder="(unchanged)"></label><br>
     <button type="submit">Save</button>
 </form>
+<h3>Users</h3>
+<table>
+<thead><tr><th>Name</th><th>Role</th><th></th></tr></thead>
+{{range .Users}}
+<tr><td>{{.Name}}</td><td>{{.Role}}</td>
+<td><form method="POST" action="delete-user"><input type="hidden" name="name" value="{{.Name}}"><button type="submit">Delete</button></form></td></tr>
+{{end}}
+</table>
+<h3>Add/Update User</h3>
+<form method="POST" action="user">
+<label>Name: <input name="name"></label>
+<select name="role">
+<option value="proxy-user">Proxy user</option>
+<option value="viewer">Viewer</option>
+<option value="admin">Admin</option>
+</select>
+<label>Password: <input type="password" name="password" placeholder="(unchanged)"></label>
+<button type="submit">Save</button>
+</form>
+{{end}}`))
+
+var tlsPage = template.Must(template.Must(layout.Clone()).Parse(`{{define "content"}}
+<h2>TLS Interception</h2>
+{{if .CAAvailable}}
+<p><a href="ca.pem">Download CA certificate</a></p>
+{{else}}
+<p>No interception CA is configured. Start the proxy with <code>-mitm-ca-cert</code> and <code>-mitm-ca-key</code>.</p>
+{{end}}
+<form method="POST" action="set-mitm">
+    <label><input type="checkbox" name="enabled" {{if .MITMEnabled}}checked{{end}}> Enable Interception</label><br>
+    <label>Bypass hosts (one per line):<br><textarea name="bypass" rows="6" cols="40">{{.MITMBypass}}</textarea></label><br>
+    <button type="submit">Save</button>
+</form>
+{{end}}`))
+
+var upstreamsPage = template.Must(template.Must(layout.Clone()).Parse(`{{define "content"}}
+<h2>Upstreams</h2>
+<table>
+<thead><tr><th>URL</th><th>Weight</th><th>Active requests</th></tr></thead>
+{{range .Upstreams}}
+<tr><td>{{.URL}}</td><td>{{.Weight}}</td><td>{{.Active}}</td></tr>
+{{end}}
+</table>
+<h3>Add/Update Upstream</h3>
+<form method="POST" action="upstream">
+<label>URL: <input name="url" placeholder="http://10.0.0.1:9000"></label>
+<label>Weight: <input name="weight" type="number" min="1" value="1"></label>
+<button type="submit">Save</button>
+</form>
+<h3>Remove Upstream</h3>
+<form method="POST" action="delete-upstream">
+<label>URL: <input name="url"></label>
+<button type="submit">Remove</button>
+</form>
+<h3>Balancing</h3>
+<form method="POST" action="balancing">
+<select name="policy">
+<option value="round_robin" {{if or (eq .Pool.Policy "round_robin") (eq .Pool.Policy "")}}selected{{end}}>Round robin</option>
+<option value="weighted" {{if eq .Pool.Policy "weighted"}}selected{{end}}>Weighted</option>
+<option value="least_requests" {{if eq .Pool.Policy "least_requests"}}selected{{end}}>Least outstanding requests</option>
+<option value="hash" {{if eq .Pool.Policy "hash"}}selected{{end}}>Consistent hash</option>
+</select>
+<label>Hash key: <input name="hash_key" value="{{.Pool.HashKey}}" placeholder="ip or header:X-User"></label>
+<button type="submit">Set</button>
+</form>
+{{end}}`))
+
+var healthPage = template.Must(template.Must(layout.Clone()).Parse(`{{define "content"}}
+<h2>Upstream Health</h2>
+<table>
+<thead><tr><th>URL</th><th>State</th><th>Ejected until</th><th>Last check</th><th>Last error</th></tr></thead>
+{{range .Upstreams}}
+<tr>
+<td>{{.URL}}</td>
+<td>{{if .Available}}healthy{{else if .Healthy}}ejected{{else}}unhealthy{{end}}</td>
+<td>{{if not .EjectedUntil.IsZero}}{{.EjectedUntil.Format "15:04:05"}}{{end}}</td>
+<td>{{if not .LastCheck.IsZero}}{{.LastCheck.Format "15:04:05"}}{{end}}</td>
+<td>{{.LastError}}</td>
+</tr>
+{{end}}
+</table>
+<h3>Health Checks</h3>
+<form method="POST" action="health-check">
+<label><input type="checkbox" name="enabled" {{if .HealthCheck.Enabled}}checked{{end}}> Active checks</label><br>
+<label>Path: <input name="path" value="{{.HealthCheck.Path}}"></label>
+<label>Interval: <input name="interval" value="{{.HealthCheck.Interval.Std}}"></label>
+<label>Timeout: <input name="timeout" value="{{.HealthCheck.Timeout.Std}}"></label>
+<label>Expected status: <input name="expected_status" type="number" value="{{.HealthCheck.ExpectedStatus}}" placeholder="any 2xx/3xx"></label><br>
+<label>Healthy threshold: <input name="healthy_threshold" type="number" min="1" value="{{.HealthCheck.HealthyThreshold}}"></label>
+<label>Unhealthy threshold: <input name="unhealthy_threshold" type="number" min="1" value="{{.HealthCheck.UnhealthyThreshold}}"></label><br>
+<label>Eject after failures: <input name="max_failures" type="number" min="0" value="{{.HealthCheck.MaxFailures}}"></label>
+<label>Eject for: <input name="eject_duration" value="{{.HealthCheck.EjectDuration.Std}}"></label>
+<button type="submit">Save</button>
+</form>
+{{end}}`))
+
+var aclPage = template.Must(template.Must(layout.Clone()).Parse(`{{define "content"}}
+<h2>Access Control</h2>
+<p>Rules are evaluated in order and the first match decides.</p>
+<table>
+<thead><tr><th>Name</th><th>Action</th><th>Hosts</th><th>Host regex</th><th>Ports</th><th>Clients</th><th>Users</th><th>Methods</th><th>Hits</th><th></th></tr></thead>
+{{range .ACL.Rules}}
+<tr>
+<td>{{.Name}}</td><td>{{.Action}}</td>
+<td>{{range $i, $v := .Hosts}}{{if $i}}, {{end}}{{$v}}{{end}}</td>
+<td>{{.HostRegex}}</td>
+<td>{{range $i, $v := .Ports}}{{if $i}}, {{end}}{{$v}}{{end}}</td>
+<td>{{range $i, $v := .Clients}}{{if $i}}, {{end}}{{$v}}{{end}}</td>
+<td>{{range $i, $v := .Users}}{{if $i}}, {{end}}{{$v}}{{end}}</td>
+<td>{{range $i, $v := .Methods}}{{if $i}}, {{end}}{{$v}}{{end}}</td>
+<td>{{index $.ACLHits .Name}}</td>
+<td><form method="POST" action="delete-acl-rule"><input type="hidden" name="name" value="{{.Name}}"><button type="submit">Delete</button></form></td>
+</tr>
+{{end}}
+<tr><td>default</td><td>{{if .ACL.Default}}{{.ACL.Default}}{{else}}allow{{end}}</td><td colspan="6"></td><td>{{index .ACLHits "default"}}</td><td></td></tr>
+</table>
+<h3>Add or update rule</h3>
+<form method="POST" action="acl-rule">
+<label>Name: <input name="name"></label>
+<label>Action: <select name="action"><option value="deny">deny</option><option value="allow">allow</option></select></label><br>
+<label>Hosts: <input name="hosts" placeholder="ads.example.com, .tracker.net"></label>
+<label>Host regex: <input name="host_regex"></label>
+<label>Ports: <input name="ports" placeholder="80, 443"></label><br>
+<label>Clients: <input name="clients" placeholder="10.0.0.0/8"></label>
+<label>Users: <input name="users"></label>
+<label>Methods: <input name="methods" placeholder="GET, CONNECT"></label>
+<button type="submit">Save</button>
+</form>
+<h3>Policy</h3>
+<form method="POST" action="acl-policy">
+<label>Default action: <select name="default">
+<option value="allow" {{if ne .ACL.Default "deny"}}selected{{end}}>allow</option>
+<option value="deny" {{if eq .ACL.Default "deny"}}selected{{end}}>deny</option>
+</select></label><br>
+<label>Deny page (HTML, {host}, {rule} and {client} are replaced):<br>
+<textarea name="deny_page" rows="6" cols="60">{{.ACL.DenyPage}}</textarea></label><br>
+<button type="submit">Save</button>
+</form>
+{{end}}`))
+
+var cachePage = template.Must(template.Must(layout.Clone()).Parse(`{{define "content"}}
+<h2>Cache</h2>
+{{if .CacheEnabled}}
+<table>
+<tr><th>Entries</th><td>{{.CacheUsage.Entries}}</td></tr>
+<tr><th>Used</th><td>{{.CacheUsage.Size}} bytes</td></tr>
+<tr><th>Capacity</th><td>{{.CacheUsage.MaxSize}} bytes</td></tr>
+<tr><th>Occupancy</th><td>{{printf "%.1f" .CachePercent}}%</td></tr>
+</table>
+<div class="progress mb-3" style="max-width: 400px"><div class="progress-bar" style="width: {{printf "%.1f" .CachePercent}}%"></div></div>
+{{if .Purged}}<p>Purged {{.Purged}} entries.</p>{{end}}
+<h3>Purge</h3>
+<form method="POST" action="purge">
+<label>URL: <input name="url" placeholder="https://example.com/file.tar.gz"></label>
+<button type="submit">Purge URL</button>
+</form>
+<form method="POST" action="purge">
+<label>Host: <input name="host" placeholder="*.example.com"></label>
+<button type="submit">Purge host</button>
+</form>
+{{else}}
+<p>The cache is disabled. Start the proxy with <code>-cache-dir</code> to enable it.</p>
+{{end}}
+{{end}}`))
+
+var tunnelsPage = template.Must(template.Must(layout.Clone()).Parse(`{{define "content"}}
+<h2>Tunnels</h2>
+{{if .TunnelsEnabled}}
+<table>
+<thead><tr><th>ID</th><th>Client</th><th>User</th><th>Host</th><th>Upstream</th><th>Started</th><th>Bytes up</th><th>Bytes down</th><th></th></tr></thead>
+{{range .Tunnels}}
+<tr>
+<td>{{.ID}}</td><td>{{.Client}}</td><td>{{.User}}</td><td>{{.Host}}</td><td>{{if .Intercepted}}intercepted{{else}}{{.Upstream}}{{end}}</td>
+<td>{{.Started.Format "15:04:05"}}</td><td>{{.BytesUp}}</td><td>{{.BytesDown}}</td>
+<td><form method="POST" action="close-tunnel"><input type="hidden" name="id" value="{{.ID}}"><button type="submit">Terminate</button></form></td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No forward proxy listener is running.</p>
+{{end}}
+<h3>Timeouts</h3>
+<form method="POST" action="tunnel-timeouts">
+<label>Idle: <input name="idle" value="{{.TunnelTimeouts.Idle.Std}}"></label>
+<label>Maximum lifetime: <input name="max_lifetime" value="{{.TunnelTimeouts.MaxLifetime.Std}}"></label>
+<label>Dial: <input name="dial" value="{{.TunnelTimeouts.Dial.Std}}"></label>
+<button type="submit">Save</button>
+</form>
+<p>A timeout of 0s disables it. Changes apply to new tunnels.</p>
+{{end}}`))
+
+var historyPage = template.Must(template.Must(layout.Clone()).Parse(`{{define "content"}}
+<h2>Configuration History</h2>
+<h3>Export and Import</h3>
+<p><a href="export" class="btn btn-secondary">Export</a></p>
+<form method="POST" action="import" enctype="multipart/form-data">
+<label>Export file: <input type="file" name="file" accept="application/json"></label>
+<label><input type="checkbox" name="dry_run" checked> Dry run</label>
+<label><input type="checkbox" name="users"> Include users and authentication</label>
+<button type="submit">Import</button>
+</form>
+{{with .Import}}
+<h3>{{if .DryRun}}Import preview{{else}}Imported{{end}}</h3>
+{{range .Warnings}}<p>{{.}}</p>{{end}}
+<table>
+<thead><tr><th>Setting</th><th>Old</th><th>New</th></tr></thead>
+{{range .Changes}}
+<tr><td>{{.Path}}</td><td>{{.Old}}</td><td>{{.New}}</td></tr>
+{{else}}
+<tr><td colspan="3">No changes</td></tr>
+{{end}}
+</table>
+{{end}}
+<h3>Compare</h3>
+<form method="GET" action="history">
+<label>From: <input name="from" type="number" min="0" value="{{if .DiffTo}}{{.DiffFrom}}{{end}}"></label>
+<label>To: <input name="to" type="number" min="1" value="{{if .DiffTo}}{{.DiffTo}}{{end}}"></label>
+<button type="submit">Compare</button>
+</form>
+{{if .DiffErr}}<p>{{.DiffErr}}</p>{{end}}
+{{if .DiffTo}}
+<h3>Changes from version {{.DiffFrom}} to {{.DiffTo}}</h3>
+<table>
+<thead><tr><th>Setting</th><th>Old</th><th>New</th></tr></thead>
+{{range .Diff}}
+<tr><td>{{.Path}}</td><td>{{.Old}}</td><td>{{.New}}</td></tr>
+{{else}}
+<tr><td colspan="3">No changes</td></tr>
+{{end}}
+</table>
+{{end}}
+<table>
+<thead><tr><th>Version</th><th>Time</th><th>Actor</th><th>Changes</th><th></th></tr></thead>
+{{range .History}}
+<tr>
+<td>{{.Version}}</td>
+<td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.Actor}}</td>
+<td>{{with .Comment}}<em>{{.}}</em><br>{{end}}{{range .Changes}}<code>{{.Path}}</code>: {{.Old}} &rarr; {{.New}}<br>{{end}}</td>
+<td><form method="POST" action="rollback"><input type="hidden" name="version" value="{{.Version}}"><label><input type="checkbox" name="users"> Users</label> <button type="submit">Roll back</button></form></td>
+</tr>
+{{end}}
+</table>
 {{end}}`))
 
 func (h *handler) makeData() pageData {
-	enabled, user, _ := h.cfg.GetAuth()
 	data := pageData{
 		Headers:       h.cfg.GetHeaders(),
 		ClientHeaders: h.cfg.GetAllClientHeaders(),
 		LogLevel:      config.LevelString(h.cfg.GetLogLevel()),
-		AuthEnabled:   enabled,
-		Username:      user,
+		AuthEnabled:   h.cfg.AuthEnabledState(),
+		Users:         h.cfg.GetUsers(),
+		Tokens:        h.cfg.GetTokens(),
+		Scopes:        config.Scopes,
 		ProxyName:     h.cfg.ProxyName,
 		ProxyID:       h.cfg.ProxyID,
 		ClientCount:   0,
 		ClientAddrs:   nil,
 		StatsEnabled:  h.cfg.StatsEnabledState(),
+		CAAvailable:   len(h.caCert) > 0,
+	}
+	mitmEnabled, bypass := h.cfg.GetMITM()
+	data.MITMEnabled = mitmEnabled
+	data.MITMBypass = strings.Join(bypass, "\n")
+	data.Pool = h.cfg.GetPool()
+	data.HealthCheck = h.cfg.GetHealthCheck()
+	data.TrustedProxies = strings.Join(h.cfg.GetTrustedProxies(), "\n")
+	data.Forwarding = h.cfg.GetForwarding()
+	data.AccessLog = h.cfg.GetAccessLog()
+	data.TunnelTimeouts = h.cfg.GetTunnelTimeouts()
+	if h.forward != nil {
+		data.TunnelsEnabled = true
+		data.Tunnels = h.forward.Tunnels()
+	}
+	data.ACL = h.cfg.GetACL()
+	if h.acl != nil {
+		data.ACLHits = h.acl.Hits()
+	}
+	if h.cache != nil {
+		data.CacheEnabled = true
+		data.CacheUsage = h.cache.Usage()
+		if data.CacheUsage.MaxSize > 0 {
+			data.CachePercent = float64(data.CacheUsage.Size) * 100 / float64(data.CacheUsage.MaxSize)
+		}
+	}
+	if h.balancer != nil {
+		data.Upstreams = h.balancer.Status()
+	} else {
+		for _, t := range data.Pool.Targets {
+			data.Upstreams = append(data.Upstreams, proxy.UpstreamStatus{URL: t.URL, Weight: t.Weight})
+		}
 	}
 	if h.clients != nil {
 		data.ClientCount = h.clients.Count()
 		data.ClientAddrs = h.clients.Addrs()
+		data.ClientSelectors = h.clients.Labels()
 	}
 	if h.stats != nil && data.StatsEnabled {
 		data.Stats = h.stats.Top(10)
@@ -262,6 +733,325 @@ func (h *handler) authPage(w http.ResponseWriter, r *http.Request) {
 	authPage.Execute(w, h.makeData())
 }
 
+func (h *handler) tlsPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	tlsPage.Execute(w, h.makeData())
+}
+
+func (h *handler) upstreamsPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	upstreamsPage.Execute(w, h.makeData())
+}
+
+func (h *handler) healthPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	healthPage.Execute(w, h.makeData())
+}
+
+func (h *handler) aclPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	aclPage.Execute(w, h.makeData())
+}
+
+func (h *handler) setACLRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	rule := config.ACLRule{
+		Name:      r.FormValue("name"),
+		Action:    r.FormValue("action"),
+		Hosts:     splitFields(r.FormValue("hosts")),
+		HostRegex: r.FormValue("host_regex"),
+		Clients:   splitFields(r.FormValue("clients")),
+		Users:     splitFields(r.FormValue("users")),
+		Methods:   splitFields(strings.ToUpper(r.FormValue("methods"))),
+	}
+	for _, p := range splitFields(r.FormValue("ports")) {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			http.Error(w, "invalid port "+p, http.StatusBadRequest)
+			return
+		}
+		rule.Ports = append(rule.Ports, n)
+	}
+	if err := h.cfg.SetACLRule(rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.logger != nil {
+		h.logger.Info("Set ACL rule", rule.Name, rule.Action)
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	http.Redirect(w, r, "/ui/acl", http.StatusSeeOther)
+}
+
+func (h *handler) deleteACLRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if name := r.FormValue("name"); name != "" {
+		h.cfg.DeleteACLRule(name)
+		if h.logger != nil {
+			h.logger.Info("Deleted ACL rule", name)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+	}
+	http.Redirect(w, r, "/ui/acl", http.StatusSeeOther)
+}
+
+func (h *handler) setACLPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	def := r.FormValue("default")
+	if err := h.cfg.SetACLPolicy(def, r.FormValue("deny_page")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.logger != nil {
+		h.logger.Info("Set ACL policy", def)
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	http.Redirect(w, r, "/ui/acl", http.StatusSeeOther)
+}
+
+func (h *handler) historyPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	data := h.makeData()
+	var err error
+	if data.History, err = h.store.History(100); err != nil {
+		data.DiffErr = err.Error()
+	}
+	if to, err := strconv.Atoi(r.URL.Query().Get("to")); err == nil {
+		from, err := strconv.Atoi(r.URL.Query().Get("from"))
+		if err != nil {
+			from = to - 1
+		}
+		data.DiffFrom, data.DiffTo = from, to
+		var older, newer config.Snapshot
+		if newer, err = h.store.Snapshot(h.cfg, to); err == nil && from > 0 {
+			older, err = h.store.Snapshot(h.cfg, from)
+		}
+		if err != nil {
+			data.DiffErr, data.DiffTo = err.Error(), 0
+		} else {
+			data.Diff = config.Diff(older, newer)
+		}
+	}
+	historyPage.Execute(w, data)
+}
+
+func (h *handler) rollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	version, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return
+	}
+	if err := h.store.Rollback(h.cfg, version, actor(r), r.FormValue("users") != ""); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.logger != nil {
+		h.logger.SetLevel(h.cfg.GetLogLevel())
+		h.logger.Info("Rolled back configuration to version", version)
+	}
+	http.Redirect(w, r, "/ui/history", http.StatusSeeOther)
+}
+
+func (h *handler) exportConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	doc, err := h.cfg.Export()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"proxy-config.json\"")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(doc)
+}
+
+func (h *handler) importConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "missing export file", http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	doc, err := io.ReadAll(io.LimitReader(f, maxImportSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun := r.FormValue("dry_run") != ""
+	res, err := h.cfg.Import(doc, dryRun, r.FormValue("users") != "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !dryRun {
+		if h.logger != nil {
+			h.logger.SetLevel(h.cfg.GetLogLevel())
+			h.logger.Info("Imported configuration", len(res.Changes))
+		}
+		if h.store != nil {
+			h.store.SaveWithComment(h.cfg, actor(r), "import")
+		}
+	}
+	data := h.makeData()
+	data.History, _ = h.store.History(100)
+	data.Import = &res
+	historyPage.Execute(w, data)
+}
+
+// maxImportSize limits the size of imported configuration documents.
+const maxImportSize = 10 << 20
+
+// actor names who made a change in the configuration history: the
+// authenticated user, or "ui" for anonymous requests.
+func actor(r *http.Request) string {
+	if user := proxy.RequestUser(r); user != "" {
+		return user
+	}
+	return "ui"
+}
+
+// splitFields splits a comma or whitespace separated form value.
+func splitFields(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t' })
+}
+
+func (h *handler) cachePage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	data := h.makeData()
+	data.Purged = r.URL.Query().Get("purged")
+	cachePage.Execute(w, data)
+}
+
+func (h *handler) purgeCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || h.cache == nil {
+		http.NotFound(w, r)
+		return
+	}
+	n := 0
+	if u := r.FormValue("url"); u != "" {
+		n = h.cache.Purge(u)
+	} else if host := r.FormValue("host"); host != "" {
+		n = h.cache.PurgeHost(host)
+	}
+	if h.logger != nil {
+		h.logger.Info("Purged cache", n)
+	}
+	http.Redirect(w, r, "/ui/cache?purged="+strconv.Itoa(n), http.StatusSeeOther)
+}
+
+func (h *handler) tunnelsPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	tunnelsPage.Execute(w, h.makeData())
+}
+
+func (h *handler) setTunnelTimeouts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	var tt config.TunnelTimeouts
+	var err error
+	for name, d := range map[string]*config.Duration{
+		"idle":         &tt.Idle,
+		"max_lifetime": &tt.MaxLifetime,
+		"dial":         &tt.Dial,
+	} {
+		if v := r.FormValue(name); v != "" && err == nil {
+			var parsed time.Duration
+			parsed, err = time.ParseDuration(v)
+			*d = config.Duration(parsed)
+		}
+	}
+	if err == nil {
+		err = h.cfg.SetTunnelTimeouts(tt)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.logger != nil {
+		h.logger.Info("Updated tunnel timeouts", tt.Idle.Std(), tt.MaxLifetime.Std(), tt.Dial.Std())
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	http.Redirect(w, r, "/ui/tunnels", http.StatusSeeOther)
+}
+
+func (h *handler) closeTunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || h.forward == nil {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid tunnel id", http.StatusBadRequest)
+		return
+	}
+	if h.forward.CloseTunnel(id) && h.logger != nil {
+		h.logger.Info("Terminated tunnel", id)
+	}
+	http.Redirect(w, r, "/ui/tunnels", http.StatusSeeOther)
+}
+
+func (h *handler) caPEM(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || len(h.caCert) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"proxy-ca.pem\"")
+	w.Write(h.caCert)
+}
+
 func (h *handler) addHeader(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.NotFound(w, r)
@@ -270,6 +1060,14 @@ func (h *handler) addHeader(w http.ResponseWriter, r *http.Request) {
 	name := r.FormValue("name")
 	value := r.FormValue("value")
 	client := r.FormValue("client")
+	if client != "" {
+		sel, err := config.ParseSelector(client)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		client = sel.String()
+	}
 	if name != "" {
 		if client == "" {
 			h.cfg.SetHeader(name, value)
@@ -280,7 +1078,7 @@ func (h *handler) addHeader(w http.ResponseWriter, r *http.Request) {
 			h.logger.Info("Set header", name, value)
 		}
 		if h.store != nil {
-			h.store.Save(h.cfg)
+			h.store.SaveAs(h.cfg, actor(r))
 		}
 	}
 	http.Redirect(w, r, "/ui/general", http.StatusSeeOther)
@@ -303,12 +1101,97 @@ func (h *handler) deleteHeader(w http.ResponseWriter, r *http.Request) {
 			h.logger.Info("Deleted header", name)
 		}
 		if h.store != nil {
-			h.store.Save(h.cfg)
+			h.store.SaveAs(h.cfg, actor(r))
 		}
 	}
 	http.Redirect(w, r, "/ui/general", http.StatusSeeOther)
 }
 
+func (h *handler) setTrustedProxies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	proxies := splitFields(r.FormValue("proxies"))
+	if err := h.cfg.SetTrustedProxies(proxies); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.logger != nil {
+		h.logger.Info("Set trusted proxies", len(proxies))
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	http.Redirect(w, r, "/ui/general", http.StatusSeeOther)
+}
+
+func (h *handler) setForwarding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	f := config.Forwarding{
+		Via:           r.FormValue("via") != "",
+		XForwardedFor: r.FormValue("x_forwarded_for") != "",
+		Forwarded:     r.FormValue("forwarded") != "",
+		Trust:         r.FormValue("trust"),
+		Anonymize:     r.FormValue("anonymize"),
+	}
+	if err := h.cfg.SetForwarding(f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.logger != nil {
+		h.logger.Info("Updated forwarding headers", f.Via, f.XForwardedFor, f.Forwarded)
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	http.Redirect(w, r, "/ui/general", http.StatusSeeOther)
+}
+
+func (h *handler) setAccessLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	a := config.AccessLog{
+		Enabled:  r.FormValue("enabled") == "on",
+		Format:   r.FormValue("format"),
+		Template: r.FormValue("template"),
+		Sink:     r.FormValue("sink"),
+		File:     r.FormValue("file"),
+		Syslog:   r.FormValue("syslog"),
+	}
+	var err error
+	if v := r.FormValue("max_size"); v != "" {
+		a.MaxSize, err = strconv.ParseInt(v, 10, 64)
+	}
+	if v := r.FormValue("max_age"); v != "" && err == nil {
+		var parsed time.Duration
+		parsed, err = time.ParseDuration(v)
+		a.MaxAge = config.Duration(parsed)
+	}
+	if v := r.FormValue("max_backups"); v != "" && err == nil {
+		a.MaxBackups, err = strconv.Atoi(v)
+	}
+	if err == nil {
+		err = h.cfg.SetAccessLog(a)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.logger != nil {
+		h.logger.Info("Updated access log", a.Enabled, a.Format, a.Sink)
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	http.Redirect(w, r, "/ui/general", http.StatusSeeOther)
+}
+
 func (h *handler) setLogLevel(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.NotFound(w, r)
@@ -322,7 +1205,7 @@ func (h *handler) setLogLevel(w http.ResponseWriter, r *http.Request) {
 		h.logger.Info("Set log level", levelStr)
 	}
 	if h.store != nil {
-		h.store.Save(h.cfg)
+		h.store.SaveAs(h.cfg, actor(r))
 	}
 	http.Redirect(w, r, "/ui/general", http.StatusSeeOther)
 }
@@ -339,7 +1222,7 @@ func (h *handler) setIdentity(w http.ResponseWriter, r *http.Request) {
 		h.logger.Info("Updated identity", name, id)
 	}
 	if h.store != nil {
-		h.store.Save(h.cfg)
+		h.store.SaveAs(h.cfg, actor(r))
 	}
 	http.Redirect(w, r, "/ui/identity", http.StatusSeeOther)
 }
@@ -350,25 +1233,240 @@ func (h *handler) setAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	enabled := r.FormValue("enabled") == "on"
-	user := r.FormValue("username")
-	pass := r.FormValue("password")
-	_, curUser, curPass := h.cfg.GetAuth()
-	if user == "" {
-		user = curUser
+	if err := h.cfg.SetAuth(enabled, "", ""); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if pass == "" {
-		pass = curPass
+	if h.logger != nil {
+		h.logger.Info("Updated auth settings", "enabled=", enabled)
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	http.Redirect(w, r, "/ui/auth", http.StatusSeeOther)
+}
+
+func (h *handler) setUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	name := r.FormValue("name")
+	role := r.FormValue("role")
+	if err := h.cfg.SetUser(name, role, r.FormValue("password")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	h.cfg.SetAuth(enabled, user, pass)
 	if h.logger != nil {
-		h.logger.Info("Updated auth settings", "enabled=", enabled, "user=", user)
+		h.logger.Info("Set user", name, role)
 	}
 	if h.store != nil {
-		h.store.Save(h.cfg)
+		h.store.SaveAs(h.cfg, actor(r))
 	}
 	http.Redirect(w, r, "/ui/auth", http.StatusSeeOther)
 }
 
+func (h *handler) deleteUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if name := r.FormValue("name"); name != "" {
+		if err := h.cfg.DeleteUser(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.logger != nil {
+			h.logger.Info("Deleted user", name)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+	}
+	http.Redirect(w, r, "/ui/auth", http.StatusSeeOther)
+}
+
+func (h *handler) tokensPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	tokensPage.Execute(w, h.makeData())
+}
+
+func (h *handler) createToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	r.ParseForm()
+	name := r.FormValue("name")
+	var ttl time.Duration
+	if v := strings.TrimSpace(r.FormValue("expires_in")); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	secret, err := h.cfg.CreateToken(name, r.Form["scope"], ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.logger != nil {
+		h.logger.Info("Created API token", name, r.Form["scope"])
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	data := h.makeData()
+	data.NewToken = secret
+	tokensPage.Execute(w, data)
+}
+
+func (h *handler) revokeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if name := r.FormValue("name"); name != "" {
+		h.cfg.DeleteToken(name)
+		if h.logger != nil {
+			h.logger.Info("Revoked API token", name)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+	}
+	http.Redirect(w, r, "/ui/tokens", http.StatusSeeOther)
+}
+
+func (h *handler) setMITM(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	enabled := r.FormValue("enabled") == "on"
+	var bypass []string
+	for _, line := range strings.Split(r.FormValue("bypass"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			bypass = append(bypass, line)
+		}
+	}
+	h.cfg.SetMITM(enabled, bypass)
+	if h.logger != nil {
+		h.logger.Info("Updated TLS interception", "enabled=", enabled)
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	http.Redirect(w, r, "/ui/tls", http.StatusSeeOther)
+}
+
+func (h *handler) setUpstream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	u := config.Upstream{URL: r.FormValue("url")}
+	u.Weight, _ = strconv.Atoi(r.FormValue("weight"))
+	if err := h.cfg.SetUpstream(u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.logger != nil {
+		h.logger.Info("Set upstream", u.URL, u.Weight)
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	http.Redirect(w, r, "/ui/upstreams", http.StatusSeeOther)
+}
+
+func (h *handler) deleteUpstream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if u := r.FormValue("url"); u != "" {
+		h.cfg.DeleteUpstream(u)
+		if h.logger != nil {
+			h.logger.Info("Deleted upstream", u)
+		}
+		if h.store != nil {
+			h.store.SaveAs(h.cfg, actor(r))
+		}
+	}
+	http.Redirect(w, r, "/ui/upstreams", http.StatusSeeOther)
+}
+
+func (h *handler) setBalancing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	policy := r.FormValue("policy")
+	hashKey := r.FormValue("hash_key")
+	if err := (config.UpstreamPool{Policy: policy, HashKey: hashKey}).Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.cfg.SetBalancing(policy, hashKey)
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	http.Redirect(w, r, "/ui/upstreams", http.StatusSeeOther)
+}
+
+func (h *handler) setHealthCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	hc := config.HealthCheck{
+		Enabled: r.FormValue("enabled") == "on",
+		Path:    r.FormValue("path"),
+	}
+	var err error
+	for name, d := range map[string]*config.Duration{
+		"interval":       &hc.Interval,
+		"timeout":        &hc.Timeout,
+		"eject_duration": &hc.EjectDuration,
+	} {
+		if v := r.FormValue(name); v != "" && err == nil {
+			var parsed time.Duration
+			parsed, err = time.ParseDuration(v)
+			*d = config.Duration(parsed)
+		}
+	}
+	for name, n := range map[string]*int{
+		"expected_status":     &hc.ExpectedStatus,
+		"healthy_threshold":   &hc.HealthyThreshold,
+		"unhealthy_threshold": &hc.UnhealthyThreshold,
+		"max_failures":        &hc.MaxFailures,
+	} {
+		if v := r.FormValue(name); v != "" && err == nil {
+			*n, err = strconv.Atoi(v)
+		}
+	}
+	if err == nil {
+		err = hc.Validate()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.cfg.SetHealthCheck(hc)
+	if h.logger != nil {
+		h.logger.Info("Updated health checks", hc.Enabled)
+	}
+	if h.store != nil {
+		h.store.SaveAs(h.cfg, actor(r))
+	}
+	http.Redirect(w, r, "/ui/health", http.StatusSeeOther)
+}
+
 func (h *handler) setStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.NotFound(w, r)
@@ -377,7 +1475,7 @@ func (h *handler) setStats(w http.ResponseWriter, r *http.Request) {
 	enabled := r.FormValue("enabled") == "on"
 	h.cfg.SetStatsEnabled(enabled)
 	if h.store != nil {
-		h.store.Save(h.cfg)
+		h.store.SaveAs(h.cfg, actor(r))
 	}
 	http.Redirect(w, r, "/ui/analytics", http.StatusSeeOther)
 }
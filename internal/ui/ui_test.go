@@ -1,14 +1,18 @@
 package ui
 
 import (
+	"bytes"
 	"context"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/pod32g/proxy/internal/config"
+	"github.com/pod32g/proxy/internal/proxy"
 	"github.com/pod32g/proxy/internal/server"
 	log "github.com/pod32g/simple-logger"
 )
@@ -188,3 +192,215 @@ func TestStatsEventsStream(t *testing.T) {
 		t.Fatalf("stats not streamed: %q", w.buf.String())
 	}
 }
+
+func TestCACertDownload(t *testing.T) {
+	cfg := &config.Config{}
+	rec := httptest.NewRecorder()
+	New(cfg, nil, nil, nil, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/ca.pem", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without CA, got %d", rec.Code)
+	}
+
+	h := New(cfg, nil, nil, nil, nil, WithCACert([]byte("PEM")))
+	rec2 := httptest.NewRecorder()
+	h.ServeHTTP(rec2, httptest.NewRequest("GET", "/ca.pem", nil))
+	if rec2.Code != http.StatusOK || rec2.Body.String() != "PEM" {
+		t.Fatalf("unexpected CA download: %d %q", rec2.Code, rec2.Body.String())
+	}
+}
+
+func TestUpstreamForms(t *testing.T) {
+	cfg := &config.Config{}
+	h := New(cfg, nil, nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/upstream", strings.NewReader("url=http%3A%2F%2F10.0.0.1%3A9000&weight=3"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect, got %d", rec.Code)
+	}
+	if p := cfg.GetPool(); len(p.Targets) != 1 || p.Targets[0].Weight != 3 {
+		t.Fatalf("upstream not added: %+v", p)
+	}
+
+	rec2 := httptest.NewRecorder()
+	h.ServeHTTP(rec2, httptest.NewRequest("GET", "/upstreams", nil))
+	if !strings.Contains(rec2.Body.String(), "http://10.0.0.1:9000") {
+		t.Fatalf("upstream not listed")
+	}
+}
+
+func TestTunnelForms(t *testing.T) {
+	cfg := &config.Config{}
+	h := New(cfg, nil, nil, nil, nil, WithTunnels(proxy.NewForward(nil, nil)))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/tunnel-timeouts", strings.NewReader("idle=90s&max_lifetime=1h&dial=0s"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect, got %d", rec.Code)
+	}
+	if tt := cfg.GetTunnelTimeouts(); tt.Idle.Std() != 90*time.Second || tt.MaxLifetime.Std() != time.Hour || tt.Dial != 0 {
+		t.Fatalf("tunnel timeouts not set: %+v", tt)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/close-tunnel", strings.NewReader("id=x"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid id, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/tunnels", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "1m30s") || strings.Contains(body, "No forward proxy") {
+		t.Fatalf("unexpected tunnels page")
+	}
+}
+
+func TestUserForms(t *testing.T) {
+	cfg := &config.Config{}
+	h := New(cfg, nil, nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/user", strings.NewReader("name=root&role=admin&password=s3cret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/set-auth", strings.NewReader("enabled=on"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(rec, req)
+	if !cfg.AuthRequired() {
+		t.Fatalf("auth not enabled")
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/auth", nil))
+	if !strings.Contains(rec.Body.String(), "root") || strings.Contains(rec.Body.String(), "$2") {
+		t.Fatalf("user not listed or hash shown")
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/delete-user", strings.NewReader("name=root"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest || len(cfg.GetUsers()) != 1 {
+		t.Fatalf("last admin deleted: %d", rec.Code)
+	}
+}
+
+func TestTokenForms(t *testing.T) {
+	cfg := &config.Config{}
+	h := New(cfg, nil, nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader("name=ci&scope=read&scope=write%3Aheaders&expires_in=24h"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "pxt_") {
+		t.Fatalf("new token not shown: %d", rec.Code)
+	}
+	if tokens := cfg.GetTokens(); len(tokens) != 1 || len(tokens[0].Scopes) != 2 || tokens[0].Expires.IsZero() {
+		t.Fatalf("token not created: %+v", tokens)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/tokens", nil))
+	if !strings.Contains(rec.Body.String(), "ci") || strings.Contains(rec.Body.String(), "pxt_") {
+		t.Fatalf("token not listed or secret shown again")
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/revoke-token", strings.NewReader("name=ci"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther || len(cfg.GetTokens()) != 0 {
+		t.Fatalf("token not revoked")
+	}
+}
+
+func TestACLForms(t *testing.T) {
+	cfg := &config.Config{}
+	h := New(cfg, nil, nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/acl-rule", strings.NewReader("name=ads&action=deny&hosts=.ads.example%2C+tracker.example&ports=80%2C443&methods=get"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect, got %d: %s", rec.Code, rec.Body.String())
+	}
+	a := cfg.GetACL()
+	if len(a.Rules) != 1 || len(a.Rules[0].Hosts) != 2 || len(a.Rules[0].Ports) != 2 || a.Rules[0].Methods[0] != "GET" {
+		t.Fatalf("rule not added: %+v", a)
+	}
+
+	rec2 := httptest.NewRecorder()
+	h.ServeHTTP(rec2, httptest.NewRequest("GET", "/acl", nil))
+	if !strings.Contains(rec2.Body.String(), "tracker.example") {
+		t.Fatalf("rule not listed")
+	}
+}
+
+func TestHistoryPage(t *testing.T) {
+	store, err := config.NewStore(filepath.Join(t.TempDir(), "config.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	cfg := &config.Config{}
+	h := New(cfg, store, nil, nil, nil)
+	for _, v := range []string{"one", "two"} {
+		req := httptest.NewRequest(http.MethodPost, "/header", strings.NewReader("name=X-Env&value="+v))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/history?from=1&to=2", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, "Changes from version 1 to 2") || !strings.Contains(body, "headers.X-Env") || !strings.Contains(body, ">ui<") {
+		t.Fatalf("history not shown: %s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/rollback", strings.NewReader("version=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther || cfg.GetHeaders()["X-Env"] != "one" {
+		t.Fatalf("rollback failed: %d %v", rec.Code, cfg.GetHeaders())
+	}
+}
+
+func TestExportImportForms(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.SetHeader("X-Env", "staging")
+	h := New(cfg, nil, nil, nil, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/export", nil))
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), "attachment") || !strings.Contains(rec.Body.String(), "staging") {
+		t.Fatalf("unexpected export: %v %s", rec.Header(), rec.Body)
+	}
+	doc := rec.Body.String()
+
+	other := &config.Config{}
+	h2 := New(other, nil, nil, nil, nil)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "proxy-config.json")
+	fw.Write([]byte(doc))
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/import", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	h2.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Imported") || other.GetHeaders()["X-Env"] != "staging" {
+		t.Fatalf("import failed: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
-import "testing"
+import (
+    "testing"
+    "time"
+
+    "github.com/pod32g/proxy/internal/config"
+)
 
 func TestGetenv(t *testing.T) {
     key := "TEST_ENV_VAR"
@@ -25,3 +30,40 @@ func TestHeaderFlags(t *testing.T) {
         t.Fatalf("expected error for bad format")
     }
 }
+
+func TestParseParentRules(t *testing.T) {
+    rules, err := parseParentRules([]string{"*.corp=direct", ".example.com=socks5"})
+    if err != nil || len(rules) != 2 || rules[1].Via != "socks5" {
+        t.Fatalf("unexpected rules: %v %v", rules, err)
+    }
+    if _, err := parseParentRules([]string{"nope"}); err == nil {
+        t.Fatalf("expected error for bad format")
+    }
+}
+
+func TestParseListeners(t *testing.T) {
+    ls, err := parseListeners([]string{
+        "name=edge,addr=:8080,mode=reverse,targets=http://a:1|http://b:2,routes=billing",
+        "addr=:3128,mode=forward,auth=false,write_timeout=5m,response_header_timeout=30s",
+        "addr=:3129,write_timeout=0",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(ls) != 3 || ls[0].Name != "edge" || len(ls[0].Targets) != 2 || ls[0].Routes[0] != "billing" {
+        t.Fatalf("unexpected listeners: %+v", ls)
+    }
+    if ls[1].Name != ":3128" || !ls[1].NoAuth || ls[1].Timeouts.Write.Std() != 5*time.Minute || ls[1].Timeouts.ResponseHeader.Std() != 30*time.Second {
+        t.Fatalf("unexpected listener: %+v", ls[1])
+    }
+    def := config.ServerTimeouts{Write: config.Duration(time.Minute), Idle: config.Duration(time.Minute)}
+    if tt := ls[2].Timeouts.Or(def); tt.Write != 0 || tt.Idle.Std() != time.Minute {
+        t.Fatalf("write_timeout=0 does not disable the server-wide timeout: %+v", tt)
+    }
+    if _, err := parseListeners([]string{"name=x,port=1"}); err == nil {
+        t.Fatalf("expected error for unknown key")
+    }
+    if _, err := parseListeners([]string{"addr=:1,idle_timeout=soon"}); err == nil {
+        t.Fatalf("expected error for an invalid timeout")
+    }
+}